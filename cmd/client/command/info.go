@@ -0,0 +1,42 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/joobisb/vitadb/internal/resp"
+	"github.com/spf13/cobra"
+)
+
+var infoCmd = &cobra.Command{
+	Use:   "info [section]",
+	Short: "Show information and statistics about the server",
+	Long: `Show information and statistics about the server, one field per line. The
+sections are server, clients, memory, persistence, lsm and keyspace; all of
+them are shown when no section is given.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := connect()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		reply, err := c.request(append([]string{"INFO"}, args...)...)
+		if err != nil {
+			return err
+		}
+		switch r := reply.(type) {
+		case resp.BulkString:
+			fmt.Print(strings.ReplaceAll(string(r), "\r\n", "\n"))
+			return nil
+		case resp.Error:
+			return fmt.Errorf("%s", r)
+		}
+		return fmt.Errorf("unexpected response: %v", reply)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(infoCmd)
+}
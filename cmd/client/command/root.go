@@ -2,11 +2,15 @@ package command
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strings"
 
+	"github.com/joobisb/vitadb/internal/resp"
+	"github.com/joobisb/vitadb/internal/tlsconfig"
 	"github.com/spf13/cobra"
 )
 
@@ -18,6 +22,14 @@ const (
 var (
 	host string
 	port string
+
+	useTLS bool
+	caCert string
+	cert   string
+	key    string
+
+	user     string
+	password string
 )
 
 var rootCmd = &cobra.Command{
@@ -25,22 +37,14 @@ var rootCmd = &cobra.Command{
 	Short: "VitaDB CLI - A command-line interface for VitaDB",
 	Long:  `VitaDB CLI is a command-line interface for interacting with the VitaDB server.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if host == "" {
-			host = DefaultHost
-		}
-		if port == "" {
-			port = DefaultPort
-		}
-
-		serverAddress := net.JoinHostPort(host, port)
-		conn, err := net.Dial("tcp", serverAddress)
+		c, err := connect()
 		if err != nil {
-			fmt.Printf("Error connecting to VitaDB server at %s: %v\n", serverAddress, err)
+			fmt.Println(err)
 			return
 		}
-		defer conn.Close()
+		defer c.Close()
 
-		fmt.Printf("Connected to VitaDB server at %s\n", serverAddress)
+		fmt.Printf("Connected to VitaDB server at %s\n", address())
 		scanner := bufio.NewScanner(os.Stdin)
 		for {
 			fmt.Print("> ")
@@ -51,20 +55,105 @@ var rootCmd = &cobra.Command{
 			if command == "exit" {
 				break
 			}
-			fmt.Fprintf(conn, "%s\n", command)
-			response, err := bufio.NewReader(conn).ReadString('\n')
+			args := strings.Fields(command)
+			if len(args) == 0 {
+				continue
+			}
+			// Replies are printed as the server's plain-text protocol would
+			// have written them
+			reply, err := c.request(args...)
 			if err != nil {
 				fmt.Println("Error reading response:", err)
-				continue
+				return
 			}
-			fmt.Print(strings.TrimSpace(response), "\n")
+			resp.Write(os.Stdout, reply, resp.ProtocolText)
 		}
 	},
 }
 
+// client is a connection to the server speaking RESP. A single reader is kept
+// for the whole connection, so bytes it buffered past one reply are not lost
+// for the next.
+type client struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// connect connects to the server and authenticates with --user and --pass.
+func connect() (*client, error) {
+	if user != "" && password == "" {
+		return nil, errors.New("--user requires --pass")
+	}
+	serverAddress := address()
+	conn, err := dial(serverAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to VitaDB server at %s: %v", serverAddress, err)
+	}
+	c := &client{Conn: conn, reader: bufio.NewReader(conn)}
+	if password != "" {
+		args := []string{"AUTH", password}
+		if user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		reply, err := c.request(args...)
+		if err == nil {
+			if e, ok := reply.(resp.Error); ok {
+				err = fmt.Errorf("authentication failed: %s", e)
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// request sends a command and reads its reply.
+func (c *client) request(args ...string) (resp.Reply, error) {
+	if err := resp.WriteCommand(c, args...); err != nil {
+		return nil, fmt.Errorf("error sending command: %v", err)
+	}
+	reply, err := resp.ReadReply(c.reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	return reply, nil
+}
+
+// address returns the address of the server from --host and --port.
+func address() string {
+	if host == "" {
+		host = DefaultHost
+	}
+	if port == "" {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// dial connects to the server, over TLS when --tls or any of the certificate
+// flags is set.
+func dial(address string) (net.Conn, error) {
+	if !useTLS && caCert == "" && cert == "" && key == "" {
+		return net.Dial("tcp", address)
+	}
+	config, err := tlsconfig.ClientConfig(host, caCert, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", address, config)
+}
+
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&host, "host", "H", "", "VitaDB server host")
 	rootCmd.PersistentFlags().StringVarP(&port, "port", "p", "", "VitaDB server port")
+	rootCmd.PersistentFlags().BoolVar(&useTLS, "tls", false, "Connect using TLS")
+	rootCmd.PersistentFlags().StringVar(&caCert, "cacert", "", "CA certificate to verify the server with (default: system roots)")
+	rootCmd.PersistentFlags().StringVar(&cert, "cert", "", "Client certificate for servers that require one")
+	rootCmd.PersistentFlags().StringVar(&key, "key", "", "Private key of the client certificate")
+	rootCmd.PersistentFlags().StringVar(&user, "user", "", "User to authenticate as (default: the default user)")
+	rootCmd.PersistentFlags().StringVarP(&password, "pass", "a", os.Getenv("VITADB_PASSWORD"), "Password to authenticate with (default: $VITADB_PASSWORD)")
 	rootCmd.Flags().SortFlags = false
 }
 
@@ -1,10 +1,12 @@
 package main
 
 import (
-	"log"
+	"log/slog"
+	"os"
 
 	"github.com/joobisb/vitadb/internal/cli"
 	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/logging"
 	"github.com/joobisb/vitadb/internal/store"
 )
 
@@ -12,25 +14,37 @@ func main() {
 
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		fatal("Failed to load configuration", err)
 	}
+	logger, err := logging.New(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		fatal("Failed to set up logging", err)
+	}
+	slog.SetDefault(logger)
 
 	kvStore, err := store.NewKVStore(cfg)
 	if err != nil {
-		log.Fatalf("Failed to create KVStore: %v", err)
+		fatal("Failed to create KVStore", err)
 	}
 	defer func() {
 		err := kvStore.Close()
 		if err != nil {
-			log.Printf("error closing store %v", err)
+			slog.Error("Failed to close store", "err", err)
 			return
 		}
 	}()
 
+	// Running on a partially recovered store would lose the rest of the WAL
 	if err := kvStore.RecoverFromWAL(); err != nil {
-		log.Printf("Failed to recover from WAL: %v", err)
+		fatal("Failed to recover from WAL", err)
 	}
 
 	cli := cli.NewCLI(kvStore)
 	cli.Run()
 }
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
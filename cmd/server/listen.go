@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/joobisb/vitadb/internal/config"
+)
+
+// listen opens the TCP listeners in cfg.ListenAddrs, wrapped with tlsConfig
+// when it is set, and the Unix socket in cfg.UnixSocket. Unix sockets never
+// use TLS; access to them is controlled by their file permissions.
+func listen(cfg *config.Config, tlsConfig *tls.Config) ([]net.Listener, error) {
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	// Go uses a negative KeepAlive to disable keepalive probes and 0 for its
+	// default interval
+	lc := net.ListenConfig{KeepAlive: cfg.TCPKeepAlive}
+	if cfg.TCPKeepAlive <= 0 {
+		lc.KeepAlive = -1
+	}
+	for _, addr := range cfg.ListenAddrs {
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+		}
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if cfg.UnixSocket != "" {
+		l, err := listenUnix(cfg.UnixSocket, cfg.UnixSocketPerm)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listen_addrs or unix_socket configured")
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix socket at path with the given octal
+// permissions. A socket left behind by a previous run is removed first. The
+// socket file is removed again when the listener is closed.
+//
+// The socket is bound in a private directory next to path and only moved to
+// path once its permissions are set, so that nobody can connect to it in the
+// meantime. Changing the umask instead would affect files created by other
+// goroutines.
+func listenUnix(path, perm string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(perm, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unix_socket_perm %q: %v", perm, err)
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("unix socket %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale unix socket: %v", err)
+		}
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".vitadb-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create unix socket directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "sock")
+
+	l, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	ul := l.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, os.FileMode(mode)); err != nil {
+		ul.Close()
+		return nil, fmt.Errorf("failed to set unix socket permissions: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		ul.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	return &unixListener{UnixListener: ul, path: path}, nil
+}
+
+// unixListener is a Unix socket listener that was bound at another path and
+// moved to path.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// Close closes the listener and removes the socket file.
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if err == nil {
+		os.Remove(l.path)
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "vitadb.sock")
+	// A socket left behind by a crashed server is replaced
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err, "Failed to create stale socket")
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	cfg := &config.Config{
+		ListenAddrs:    []string{"127.0.0.1:0", "127.0.0.1:0"},
+		UnixSocket:     socket,
+		UnixSocketPerm: "0700",
+		TCPKeepAlive:   0,
+	}
+	listeners, err := listen(cfg, nil)
+	require.NoError(t, err, "Failed to listen")
+	require.Len(t, listeners, 3, "Expected two TCP listeners and a Unix socket")
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err, "Expected the socket file to exist")
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), "Unexpected socket permissions")
+	entries, err := os.ReadDir(filepath.Dir(socket))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "Expected the directory the socket was bound in to be removed")
+	assert.Equal(t, socket, listeners[2].Addr().String(), "Expected the socket path as address")
+
+	srv := serveTestStore(t, &config.Config{}, listeners[0])
+	for _, listener := range listeners[1:] {
+		go srv.Serve(listener)
+	}
+	for _, listener := range listeners {
+		conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+		require.NoError(t, err, "Failed to connect to %s", listener.Addr())
+		_, err = conn.Write([]byte("PING\n"))
+		require.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err, "Failed to read reply from %s", listener.Addr())
+		assert.Equal(t, "PONG\n", line, "Unexpected reply from %s", listener.Addr())
+		conn.Close()
+	}
+
+	srv.Shutdown(0)
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err), "Expected the socket file to be removed on shutdown")
+
+	require.NoError(t, os.WriteFile(socket, nil, 0600))
+	_, err = listen(&config.Config{UnixSocket: socket, UnixSocketPerm: "0700"}, nil)
+	assert.Error(t, err, "Regular files must not be replaced by the socket")
+	_, err = listen(&config.Config{}, nil)
+	assert.Error(t, err, "Expected an error without any address")
+}
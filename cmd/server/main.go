@@ -1,93 +1,127 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
-	"log"
+	"crypto/tls"
+	"log/slog"
 	"net"
-	"strings"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/joobisb/vitadb/internal/acl"
 	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/logging"
+	"github.com/joobisb/vitadb/internal/metrics"
 	"github.com/joobisb/vitadb/internal/store"
+	"github.com/joobisb/vitadb/internal/tlsconfig"
 )
 
 func main() {
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		fatal("Failed to load configuration", err)
 	}
+	logger, err := logging.New(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		fatal("Failed to set up logging", err)
+	}
+	slog.SetDefault(logger)
 
 	kvStore, err := store.NewKVStore(cfg)
 	if err != nil {
-		log.Fatalf("Failed to create KVStore: %v", err)
+		fatal("Failed to create KVStore", err)
+	}
+	if kvStore.CleanStart() {
+		slog.Info("Previous shutdown was clean")
+	} else {
+		slog.Warn("No clean shutdown recorded, the previous run may have crashed")
 	}
 
+	// Running on a partially recovered store would lose the rest of the WAL
 	if err := kvStore.RecoverFromWAL(); err != nil {
-		log.Printf("Failed to recover from WAL: %v", err)
+		fatal("Failed to recover from WAL", err)
 	}
 
-	listener, err := net.Listen("tcp", ":6370")
-	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	var users *acl.Users
+	if len(cfg.Users) > 0 {
+		if users, err = acl.NewUsers(cfg.Users); err != nil {
+			fatal("Failed to load users", err)
+		}
+		slog.Info("Authentication enabled", "users", len(cfg.Users))
 	}
-	defer listener.Close()
-
-	fmt.Println("VitaDB server listening on :6370")
 
-	for {
-		conn, err := listener.Accept()
+	var certs *tlsconfig.Reloader
+	var tlsConfig *tls.Config
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		certs, err = tlsconfig.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile)
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
-			continue
+			fatal("Failed to set up TLS", err)
 		}
-		go handleConnection(conn, kvStore)
+		tlsConfig = certs.ServerConfig()
 	}
-}
 
-func handleConnection(conn net.Conn, kvStore *store.KVStore) {
-	defer conn.Close()
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		cmd := strings.Fields(scanner.Text())
-		if len(cmd) == 0 {
-			continue
-		}
-		switch strings.ToUpper(cmd[0]) {
-		case "SET":
-			if len(cmd) != 3 {
-				fmt.Fprintf(conn, "Usage: set <key> <value>\n")
-				continue
-			}
-			err := kvStore.Set(cmd[1], cmd[2])
-			if err != nil {
-				fmt.Fprintf(conn, "ERR %v\n", err)
-			} else {
-				fmt.Fprintf(conn, "OK\n")
-			}
-		case "GET":
-			if len(cmd) != 2 {
-				fmt.Fprintf(conn, "Usage: get <key>")
-				continue
-			}
-			value, ok := kvStore.Get(cmd[1])
-			if !ok {
-				fmt.Fprintf(conn, "(nil)\n")
-			} else {
-				fmt.Fprintf(conn, "%s\n", value)
+	listeners, err := listen(cfg, tlsConfig)
+	if err != nil {
+		fatal("Failed to start server", err)
+	}
+
+	srv := newServer(cfg, kvStore, users)
+	for _, listener := range listeners {
+		_, unix := listener.(*net.UnixListener)
+		slog.Info("VitaDB server listening", "addr", listener.Addr().String(), "tls", !unix && tlsConfig != nil)
+		go srv.Serve(listener)
+	}
+
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Default.Handler())
+		metricsServer = &http.Server{Addr: cfg.MetricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("Metrics server failed", "err", err)
 			}
-		case "DEL":
-			if len(cmd) != 2 {
-				fmt.Fprintf(conn, "ERR wrong number of arguments for 'del' command\n")
+		}()
+		slog.Info("Serving metrics", "url", "http://"+cfg.MetricsAddr+"/metrics")
+	}
+
+	// SIGHUP reloads the TLS certificates
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if certs == nil {
 				continue
 			}
-			err := kvStore.Delete(cmd[1])
-			if err != nil {
-				fmt.Fprintf(conn, "ERR %v\n", err)
+			if err := certs.Reload(); err != nil {
+				slog.Error("Failed to reload TLS certificates", "err", err)
 			} else {
-				fmt.Fprintf(conn, "OK\n")
+				slog.Info("Reloaded TLS certificates")
 			}
-		default:
-			fmt.Fprintf(conn, "ERR unknown command '%s'\n", cmd[0])
 		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	// A second signal kills the process right away
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+
+	slog.Info("Shutting down", "signal", sig.String())
+	srv.Shutdown(cfg.ShutdownTimeout)
+	if metricsServer != nil {
+		metricsServer.Close()
 	}
+	if err := kvStore.Close(); err != nil {
+		fatal("Failed to close KVStore", err)
+	}
+	slog.Info("Shutdown complete")
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/metrics"
+	"github.com/joobisb/vitadb/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestServer serves a fresh store on a random local port.
+func startTestServer(tb testing.TB) string {
+	addr, _ := startShutdownTestServer(tb)
+	return addr
+}
+
+// startShutdownTestServer is like startTestServer but also returns the server
+// so that tests can shut it down.
+func startShutdownTestServer(tb testing.TB) (string, *server) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err, "Failed to listen")
+	return listener.Addr().String(), serveTestStore(tb, &config.Config{}, listener)
+}
+
+// serveTestStore serves a fresh store on listener with the connection limits
+// of cfg.
+func serveTestStore(tb testing.TB, cfg *config.Config, listener net.Listener) *server {
+	kvStore, err := store.NewKVStore(&config.Config{WALDir: tb.TempDir(), SSTDir: tb.TempDir(), UseSegmentedLogs: true, SegmentSize: 100000})
+	require.NoError(tb, err, "Failed to create KVStore")
+
+	srv := newServer(cfg, kvStore, nil)
+	tb.Cleanup(func() {
+		srv.Shutdown(time.Second)
+		kvStore.Close()
+	})
+	go srv.Serve(listener)
+	return srv
+}
+
+func TestPipelinedCommands(t *testing.T) {
+	conn, err := net.Dial("tcp", startTestServer(t))
+	require.NoError(t, err, "Failed to connect")
+	defer conn.Close()
+
+	// Send every command before reading any reply
+	const n = 100
+	var request []byte
+	for i := 0; i < n; i++ {
+		request = append(request, fmt.Sprintf("*3\r\n$3\r\nSET\r\n$5\r\nkey%02d\r\n$1\r\n%d\r\n", i, i%10)...)
+		request = append(request, fmt.Sprintf("*2\r\n$3\r\nGET\r\n$5\r\nkey%02d\r\n", i)...)
+	}
+	_, err = conn.Write(request)
+	require.NoError(t, err, "Failed to write pipelined commands")
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err, "Failed to read SET reply")
+		assert.Equal(t, "+OK\r\n", line, "Unexpected SET reply %d", i)
+
+		header, err := reader.ReadString('\n')
+		require.NoError(t, err, "Failed to read GET reply")
+		value, err := reader.ReadString('\n')
+		require.NoError(t, err, "Failed to read GET reply")
+		assert.Equal(t, fmt.Sprintf("$1\r\n%d\r\n", i%10), header+value, "Replies should arrive in order")
+	}
+}
+
+// BenchmarkRequests compares waiting for every reply with pipelining batches
+// of commands over the same connection. Run it with
+//
+//	go test ./cmd/server -bench Requests -benchtime 20000x
+//
+// Each iteration is one GET; pipelining amortizes the round trip and the
+// write system call over the whole batch.
+func BenchmarkRequests(b *testing.B) {
+	for _, depth := range []int{1, 16, 128} {
+		b.Run(fmt.Sprintf("pipeline=%d", depth), func(b *testing.B) {
+			conn, err := net.Dial("tcp", startTestServer(b))
+			require.NoError(b, err, "Failed to connect")
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			command := []byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n")
+			batch := make([]byte, 0, depth*len(command))
+			for i := 0; i < depth; i++ {
+				batch = append(batch, command...)
+			}
+
+			b.ResetTimer()
+			for sent := 0; sent < b.N; sent += depth {
+				count := depth
+				if b.N-sent < depth {
+					count = b.N - sent
+				}
+				if _, err := conn.Write(batch[:count*len(command)]); err != nil {
+					b.Fatalf("Failed to write: %v", err)
+				}
+				for i := 0; i < count; i++ {
+					if _, err := reader.ReadString('\n'); err != nil {
+						b.Fatalf("Failed to read: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// failingListener fails every Accept until it is closed.
+type failingListener struct {
+	net.Listener
+	accepts int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts++
+	if l.accepts > 4 {
+		return nil, net.ErrClosed
+	}
+	return nil, errors.New("too many open files")
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	defer listener.Close()
+	srv := newServer(&config.Config{}, nil, nil)
+
+	failing := &failingListener{Listener: listener}
+	start := time.Now()
+	srv.Serve(failing)
+	assert.Equal(t, 5, failing.accepts, "Expected Serve to return once the listener is closed")
+	assert.GreaterOrEqual(t, time.Since(start), 75*time.Millisecond, "Expected failed accepts to back off 5, 10, 20 and 40ms")
+}
+
+func TestShutdown(t *testing.T) {
+	addr, srv := startShutdownTestServer(t)
+
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err, "Failed to connect")
+	defer idle.Close()
+
+	// Commands that were sent before the shutdown still get their replies
+	busy, err := net.Dial("tcp", addr)
+	require.NoError(t, err, "Failed to connect")
+	defer busy.Close()
+	_, err = busy.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	require.NoError(t, err, "Failed to write commands")
+	reader := bufio.NewReader(busy)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err, "Failed to read SET reply")
+	assert.Equal(t, "+OK\r\n", line, "Unexpected SET reply")
+
+	start := time.Now()
+	srv.Shutdown(10 * time.Second)
+	assert.Less(t, time.Since(start), 5*time.Second, "Idle connections should not delay the shutdown")
+
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err, "Failed to read remaining replies")
+	assert.Equal(t, "$1\r\n1\r\n", string(rest), "Expected the pipelined GET to be answered before the connection closed")
+
+	_, err = bufio.NewReader(idle).ReadByte()
+	assert.Equal(t, io.EOF, err, "Idle connections should be closed")
+
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	assert.Error(t, err, "New connections should be refused after shutdown")
+}
+
+func TestMaxClients(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	serveTestStore(t, &config.Config{MaxClients: 1}, listener)
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "Failed to connect")
+	defer first.Close()
+	reader := bufio.NewReader(first)
+	_, err = first.Write([]byte("PING\n"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err, "Expected the first client to be served")
+	assert.Equal(t, "PONG\n", line, "Unexpected reply")
+
+	second, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "Failed to connect")
+	defer second.Close()
+	reply, err := io.ReadAll(second)
+	require.NoError(t, err, "Failed to read rejection")
+	assert.Equal(t, "-ERR max number of clients reached\r\n", string(reply), "Expected an error reply before the connection is closed")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	serveTestStore(t, &config.Config{IdleTimeout: 100 * time.Millisecond}, listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "Failed to connect")
+	defer conn.Close()
+	_, err = conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	require.NoError(t, err)
+
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err, "Failed to read replies")
+	assert.Equal(t, "+PONG\r\n-ERR idle for more than 100ms, closing connection\r\n", string(reply), "Expected idle connections to be closed with an error")
+}
+
+func TestMaxRequestSize(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	serveTestStore(t, &config.Config{MaxRequestSize: 16}, listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "Failed to connect")
+	defer conn.Close()
+	_, err = conn.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\na\r\n$100\r\n"))
+	require.NoError(t, err)
+
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err, "Failed to read reply")
+	assert.Equal(t, "-ERR request exceeds max_request_size of 16 bytes\r\n", string(reply), "Expected too large requests to be rejected with an error")
+}
+
+// metricValue returns the value of a sample of the default registry, such as
+// `vitadb_commands_total{command="get"}`, or 0 when it has not been written.
+func metricValue(t *testing.T, sample string) float64 {
+	var buf bytes.Buffer
+	metrics.Default.Write(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, sample+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			require.NoError(t, err, "Invalid value in %q", line)
+			return v
+		}
+	}
+	return 0
+}
+
+func TestCommandMetrics(t *testing.T) {
+	whoami := metricValue(t, `vitadb_commands_total{command="whoami"}`)
+	whoamiLatency := metricValue(t, `vitadb_command_duration_seconds_count{command="whoami"}`)
+	unknown := metricValue(t, `vitadb_commands_total{command="unknown"}`)
+	clients := metricValue(t, "vitadb_connected_clients")
+
+	conn, err := net.Dial("tcp", startTestServer(t))
+	require.NoError(t, err, "Failed to connect")
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("WHOAMI\nNOPE\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		_, err := reader.ReadString('\n')
+		require.NoError(t, err, "Failed to read reply")
+	}
+
+	assert.Equal(t, whoami+1, metricValue(t, `vitadb_commands_total{command="whoami"}`), "Expected the command to be counted")
+	assert.Equal(t, whoamiLatency+1, metricValue(t, `vitadb_command_duration_seconds_count{command="whoami"}`), "Expected the command latency to be observed")
+	assert.Equal(t, unknown+1, metricValue(t, `vitadb_commands_total{command="unknown"}`), "Expected unknown commands to share a label")
+	assert.Equal(t, clients+1, metricValue(t, "vitadb_connected_clients"), "Expected the connection to be counted")
+}
+
+func TestInfoClients(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	serveTestStore(t, &config.Config{MaxClients: 5}, listener)
+
+	other, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "Failed to connect")
+	defer other.Close()
+	_, err = other.Write([]byte("PING\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(other).ReadString('\n')
+	require.NoError(t, err, "Failed to read reply")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "Failed to connect")
+	defer conn.Close()
+	_, err = conn.Write([]byte("*2\r\n$4\r\nINFO\r\n$7\r\nclients\r\n"))
+	require.NoError(t, err)
+
+	expected := "# Clients\r\nconnected_clients:2\r\nmaxclients:5\r\n"
+	reply := make([]byte, len(fmt.Sprintf("$%d\r\n%s\r\n", len(expected), expected)))
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err, "Failed to read reply")
+	assert.Equal(t, fmt.Sprintf("$%d\r\n%s\r\n", len(expected), expected), string(reply), "Unexpected INFO reply")
+}
+
+func TestSlowLog(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	srv := serveTestStore(t, &config.Config{SlowLogMaxLen: 10}, listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "Failed to connect")
+	defer conn.Close()
+	_, err = conn.Write([]byte("SET a 1\nSLOWLOG LEN\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		_, err := reader.ReadString('\n')
+		require.NoError(t, err, "Failed to read reply")
+	}
+
+	entries := srv.slowLog.Entries(-1)
+	require.Len(t, entries, 2, "Expected every command to be recorded with a threshold of 0")
+	assert.Equal(t, []string{"SET", "a", "1"}, entries[1].Args)
+	assert.Equal(t, conn.LocalAddr().String(), entries[1].Client, "Expected the address of the client")
+}
+
+func TestPubSub(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	serveTestStore(t, &config.Config{IdleTimeout: 50 * time.Millisecond, PubSubOutputBufferLimit: 100}, listener)
+	addr := listener.Addr().String()
+
+	subscriber, err := net.Dial("tcp", addr)
+	require.NoError(t, err, "Failed to connect")
+	defer subscriber.Close()
+	subscriberReader := bufio.NewReader(subscriber)
+
+	readLine := func(reader *bufio.Reader) string {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err, "Failed to read reply")
+		return strings.TrimSpace(line)
+	}
+	request := func(conn net.Conn, reader *bufio.Reader, line string) string {
+		_, err := conn.Write([]byte(line + "\n"))
+		require.NoError(t, err)
+		return readLine(reader)
+	}
+
+	assert.Equal(t, "1) subscribe 2) news 3) (integer) 1", request(subscriber, subscriberReader, "SUBSCRIBE news"))
+	// Subscribed connections wait for messages longer than idle_timeout
+	time.Sleep(100 * time.Millisecond)
+	publisher, err := net.Dial("tcp", addr)
+	require.NoError(t, err, "Failed to connect")
+	defer publisher.Close()
+	publisherReader := bufio.NewReader(publisher)
+	assert.Equal(t, "(integer) 1", request(publisher, publisherReader, "PUBLISH news hello"))
+	assert.Equal(t, "1) message 2) news 3) hello", readLine(subscriberReader), "Expected the message to be pushed")
+
+	assert.Equal(t, "(integer) 1", request(publisher, publisherReader, "PUBLISH news "+strings.Repeat("x", 200)))
+	_, err = subscriberReader.ReadString('\n')
+	assert.Error(t, err, "Expected a subscriber over its output buffer limit to be disconnected")
+}
+
+func TestPubSubWhileBlocked(t *testing.T) {
+	addr := startTestServer(t)
+	subscriber, err := net.Dial("tcp", addr)
+	require.NoError(t, err, "Failed to connect")
+	defer subscriber.Close()
+	_, err = subscriber.Write([]byte("*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n" +
+		"*2\r\n$9\r\nSUBSCRIBE\r\n$4\r\nnews\r\n" +
+		"*4\r\n$7\r\nCHANGES\r\n$1\r\n0\r\n$5\r\nBLOCK\r\n$1\r\n0\r\n"))
+	require.NoError(t, err)
+
+	publisher, err := net.Dial("tcp", addr)
+	require.NoError(t, err, "Failed to connect")
+	defer publisher.Close()
+	message := ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n"
+	var received []byte
+	assert.Eventually(t, func() bool {
+		publisher.Write([]byte("PUBLISH news hi\n"))
+		subscriber.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		buf := make([]byte, 4096)
+		n, _ := subscriber.Read(buf)
+		received = append(received, buf[:n]...)
+		return bytes.Contains(received, []byte(message))
+	}, 2*time.Second, 10*time.Millisecond, "Expected messages to be pushed while CHANGES BLOCK waits")
+}
+
+func TestKeyspaceEvents(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	serveTestStore(t, &config.Config{KeyspaceEvents: true}, listener)
+
+	subscriber, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "Failed to connect")
+	defer subscriber.Close()
+	_, err = subscriber.Write([]byte("PSUBSCRIBE __keyspace__:user:*\n"))
+	require.NoError(t, err)
+	subscriberReader := bufio.NewReader(subscriber)
+	reply, err := subscriberReader.ReadString('\n')
+	require.NoError(t, err, "Failed to read reply")
+	assert.Equal(t, "1) psubscribe 2) __keyspace__:user:* 3) (integer) 1\n", reply)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "Failed to connect")
+	defer conn.Close()
+	_, err = conn.Write([]byte("SET order:1 a\nSET user:1 a\nDEL user:1\n"))
+	require.NoError(t, err)
+
+	for _, event := range []string{"set", "del"} {
+		message, err := subscriberReader.ReadString('\n')
+		require.NoError(t, err, "Failed to read message")
+		assert.Equal(t, "1) pmessage 2) __keyspace__:user:* 3) __keyspace__:user:1 4) "+event+"\n", message)
+	}
+}
+
+func TestShutdownWakesBlockedChanges(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	srv := serveTestStore(t, &config.Config{}, listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "Failed to connect")
+	defer conn.Close()
+	_, err = conn.Write([]byte("CHANGES 0 BLOCK 0\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	srv.Shutdown(5 * time.Second)
+	assert.Less(t, time.Since(start), time.Second, "Shutdown should not wait for blocked commands")
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err, "Failed to read reply")
+	assert.Equal(t, "1) (integer) 0 2) (empty array)\n", reply, "Blocked commands should get their reply")
+}
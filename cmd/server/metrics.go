@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/command"
+	"github.com/joobisb/vitadb/internal/metrics"
+)
+
+var (
+	commandsMetric        = metrics.NewCounterVec("vitadb_commands_total", "Commands executed, by command.", "command")
+	commandDurationMetric = metrics.NewHistogramVec("vitadb_command_duration_seconds", "Time taken to execute a command, by command.", "command", metrics.DurationBuckets)
+	connectedClients      = metrics.NewGauge("vitadb_connected_clients", "Client connections being served.")
+	rejectedConnections   = metrics.NewCounterVec("vitadb_rejected_connections_total", "Connections closed right after they were accepted, by reason.", "reason")
+)
+
+// observeCommand records a command that was executed since start. Unknown
+// commands share a label so that clients cannot create arbitrary series.
+func observeCommand(args []string, start time.Time) {
+	name := "unknown"
+	if len(args) > 0 {
+		if c, ok := command.Lookup(args[0]); ok {
+			name = strings.ToLower(c.Name)
+		}
+	}
+	commandsMetric.With(name).Inc()
+	commandDurationMetric.With(name).ObserveDuration(start)
+}
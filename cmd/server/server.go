@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/acl"
+	"github.com/joobisb/vitadb/internal/command"
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/pubsub"
+	"github.com/joobisb/vitadb/internal/resp"
+	"github.com/joobisb/vitadb/internal/store"
+)
+
+var errMaxClients = errors.New("max number of clients reached")
+
+// Failed accepts are retried after minAcceptDelay, doubling up to
+// maxAcceptDelay while they keep failing
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// server accepts client connections and keeps track of them so that it can
+// shut down without cutting off commands that are being executed.
+type server struct {
+	store *store.KVStore
+
+	// users is nil when authentication is disabled
+	users *acl.Users
+
+	// info is shared by the sessions, for INFO and SLOWLOG
+	info    *command.ServerInfo
+	slowLog *command.SlowLog
+
+	// pubsub routes the messages of PUBLISH to subscribed connections, which
+	// are closed when more than pubsubLimit bytes of messages are waiting
+	pubsub      *pubsub.Broker
+	pubsubLimit int
+
+	// keyspaceEvents publishes the changes of the store, nil unless
+	// keyspace_events is enabled
+	keyspaceEvents *store.Subscription
+
+	// ctx is cancelled by Shutdown to wake up blocked commands
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Connection limits, see config.Config
+	maxClients     int
+	idleTimeout    time.Duration
+	maxRequestSize int
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+	shutdown  bool
+}
+
+func newServer(cfg *config.Config, kvStore *store.KVStore, users *acl.Users) *server {
+	srv := &server{
+		store:          kvStore,
+		users:          users,
+		maxClients:     cfg.MaxClients,
+		idleTimeout:    cfg.IdleTimeout,
+		maxRequestSize: cfg.MaxRequestSize,
+		conns:          make(map[net.Conn]struct{}),
+		slowLog:        command.NewSlowLog(cfg.SlowLogThreshold, cfg.SlowLogMaxLen),
+		pubsub:         pubsub.NewBroker(),
+		pubsubLimit:    cfg.PubSubOutputBufferLimit,
+	}
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	srv.info = &command.ServerInfo{
+		ConfigFile:       cfg.ConfigFile,
+		MaxClients:       cfg.MaxClients,
+		ConnectedClients: srv.connectedClients,
+		SlowLog:          srv.slowLog,
+	}
+	if cfg.KeyspaceEvents {
+		// Publishing never blocks, so it can run while the store is locked
+		// and no event is lost between the store and the subscribers
+		srv.keyspaceEvents = kvStore.SubscribeFunc("", func(e store.Event) {
+			srv.pubsub.Publish(command.KeyspaceChannelPrefix+e.Key, string(e.Type))
+		})
+	}
+	return srv
+}
+
+// connectedClients returns the number of open connections.
+func (srv *server) connectedClients() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.conns)
+}
+
+// Serve accepts connections on listener until Shutdown is called. It can be
+// called for several listeners.
+func (srv *server) Serve(listener net.Listener) {
+	srv.mu.Lock()
+	if srv.shutdown {
+		srv.mu.Unlock()
+		listener.Close()
+		return
+	}
+	srv.listeners = append(srv.listeners, listener)
+	srv.mu.Unlock()
+
+	// Accept fails when the process runs out of file descriptors, for
+	// example. Back off like net/http does instead of spinning.
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if srv.isShuttingDown() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			slog.Error("Failed to accept connection", "addr", listener.Addr().String(), "err", err, "retry_in", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if err := srv.track(conn); err != nil {
+			if err == errMaxClients {
+				rejectedConnections.With("max_clients").Inc()
+			}
+			go reject(conn, err)
+			continue
+		}
+		go func() {
+			defer srv.untrack(conn)
+			srv.handleConnection(conn)
+		}()
+	}
+}
+
+// reject replies to a connection that cannot be served with an error before
+// closing it.
+func reject(conn net.Conn, reason error) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn, "-ERR "+reason.Error()+"\r\n")
+}
+
+// Shutdown stops accepting connections and waits up to timeout for commands
+// that are being executed to finish. Commands blocked waiting for data, such
+// as CHANGES BLOCK, return right away. Idle connections are closed right away;
+// connections that are still busy when the timeout expires are closed
+// forcibly. The store is not closed.
+func (srv *server) Shutdown(timeout time.Duration) {
+	if srv.keyspaceEvents != nil {
+		defer srv.keyspaceEvents.Close()
+	}
+	srv.cancel()
+	srv.mu.Lock()
+	srv.shutdown = true
+	for _, listener := range srv.listeners {
+		listener.Close()
+	}
+	// Wake up connections blocked on a read. Commands that were already
+	// read still run and get their reply.
+	for conn := range srv.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	srv.mu.Lock()
+	slog.Warn("Shutdown timeout expired, closing connections", "connections", len(srv.conns))
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+	<-done
+}
+
+func (srv *server) isShuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.shutdown
+}
+
+// track registers conn, unless the server is shutting down or has too many
+// clients.
+func (srv *server) track(conn net.Conn) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdown {
+		return errors.New("server is shutting down")
+	}
+	if srv.maxClients > 0 && len(srv.conns) >= srv.maxClients {
+		return errMaxClients
+	}
+	srv.conns[conn] = struct{}{}
+	srv.wg.Add(1)
+	connectedClients.Inc()
+	return nil
+}
+
+// setReadDeadline makes the next read of conn fail once it has waited for
+// timeout, or never when timeout is 0. It leaves the deadline alone once the
+// server is shutting down, as Shutdown already set it.
+func (srv *server) setReadDeadline(conn net.Conn, timeout time.Duration) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.shutdown {
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		conn.SetReadDeadline(deadline)
+	}
+}
+
+func (srv *server) untrack(conn net.Conn) {
+	srv.mu.Lock()
+	delete(srv.conns, conn)
+	srv.mu.Unlock()
+	connectedClients.Dec()
+	srv.wg.Done()
+}
+
+// sessionCommands change the subscriptions or the session state messages are
+// written with, and run under writeMu: SUBSCRIBE then confirms a channel before
+// any message of the channel is written, and HELLO and AUTH never change the
+// protocol or user while a message is being written.
+var sessionCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"HELLO":        true,
+	"AUTH":         true,
+}
+
+// handleConnection serves a client. Clients that start with a RESP array
+// ('*') speak RESP2, or RESP3 after HELLO 3; anyone else gets the plain-text
+// protocol, which replies with a single line per command.
+//
+// Clients may pipeline commands: replies are buffered while more commands are
+// already waiting in the read buffer, and flushed together once it is empty.
+//
+// Once the client subscribes, messages are written by a second goroutine.
+// writeMu keeps them from being interleaved with replies. It is only held
+// while commands run for sessionCommands, so that messages keep flowing while
+// a command such as CHANGES BLOCK waits. Subscribed connections are never
+// closed for being idle.
+func (srv *server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	reader := resp.NewReader(conn)
+	reader.SetMaxRequestSize(srv.maxRequestSize)
+	writer := bufio.NewWriter(conn)
+	var writeMu sync.Mutex
+	defer func() {
+		writeMu.Lock()
+		writer.Flush()
+		writeMu.Unlock()
+	}()
+	if srv.idleTimeout > 0 {
+		srv.setReadDeadline(conn, srv.idleTimeout)
+	}
+	first, err := reader.Peek()
+	if err != nil {
+		return
+	}
+	proto := resp.ProtocolText
+	if first == '*' {
+		proto = resp.Protocol2
+	}
+	s := command.NewSession(srv.store, proto)
+	s.Users = srv.users
+	s.Server = srv.info
+	s.PubSub = srv.pubsub
+	s.Context = srv.ctx
+	s.Subscriber = srv.pubsub.NewSubscriber(srv.pubsubLimit, func() {
+		// Closing the connection also unblocks a write to a client that
+		// stopped reading. Closing a TLS connection writes to it, so it is
+		// done in the background to never block the publisher.
+		slog.Warn("Closing subscriber over its output buffer limit", "client", conn.RemoteAddr().String(), "limit", srv.pubsubLimit)
+		rejectedConnections.With("pubsub_output_buffer_limit").Inc()
+		go conn.Close()
+	})
+	defer s.Close()
+	delivering := false
+
+	// stop ends the delivery of messages, which runs from the first
+	// subscription until the connection is closed
+	stop := make(chan struct{})
+	var delivery sync.WaitGroup
+	defer func() {
+		close(stop)
+		delivery.Wait()
+		s.Subscriber.Close()
+	}()
+
+	for {
+		if srv.idleTimeout > 0 && reader.Buffered() == 0 {
+			timeout := srv.idleTimeout
+			if s.Subscriber.Count() > 0 {
+				timeout = 0
+			}
+			srv.setReadDeadline(conn, timeout)
+		}
+		cmd, err := reader.ReadCommand()
+		if err != nil {
+			switch {
+			case errors.Is(err, resp.ErrRequestTooLarge):
+				resp.Write(writer, resp.Errorf("ERR request exceeds max_request_size of %d bytes", srv.maxRequestSize), s.Proto)
+			case errors.Is(err, resp.ErrProtocol):
+				resp.Write(writer, resp.Errorf("ERR %v", err), s.Proto)
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				if !srv.isShuttingDown() {
+					resp.Write(writer, resp.Errorf("ERR idle for more than %v, closing connection", srv.idleTimeout), s.Proto)
+				}
+			case err != io.EOF && !errors.Is(err, net.ErrClosed):
+				slog.Warn("Failed to read from client", "client", conn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+		locked := len(cmd) > 0 && sessionCommands[strings.ToUpper(cmd[0])]
+		if locked {
+			writeMu.Lock()
+		}
+		start := time.Now()
+		reply := s.Execute(cmd)
+		observeCommand(cmd, start)
+		srv.slowLog.Record(cmd, conn.RemoteAddr().String(), start)
+		if !locked {
+			writeMu.Lock()
+		}
+		err = resp.Write(writer, reply, s.Proto)
+		if err == nil && reader.Buffered() == 0 {
+			err = writer.Flush()
+		}
+		writeMu.Unlock()
+		if err != nil {
+			return
+		}
+
+		if !delivering && s.Subscriber.Count() > 0 {
+			delivering = true
+			delivery.Add(1)
+			go func() {
+				defer delivery.Done()
+				srv.deliverMessages(conn, s, writer, &writeMu, stop)
+			}()
+		}
+	}
+}
+
+// deliverMessages writes the messages queued for the subscriber of s until
+// stop is closed or the subscriber is dropped.
+func (srv *server) deliverMessages(conn net.Conn, s *command.Session, writer *bufio.Writer, writeMu *sync.Mutex, stop <-chan struct{}) {
+	for {
+		select {
+		case <-s.Subscriber.Notify():
+		case <-stop:
+			return
+		}
+
+		messages, err := s.Subscriber.Messages()
+		if err != nil {
+			return
+		}
+		writeMu.Lock()
+		for _, m := range messages {
+			if !s.CanReceive(m) {
+				continue
+			}
+			if err = resp.Write(writer, command.MessageReply(m), s.Proto); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+		writeMu.Unlock()
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
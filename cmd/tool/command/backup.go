@@ -0,0 +1,120 @@
+package command
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/joobisb/vitadb/internal/resp"
+	"github.com/joobisb/vitadb/internal/tlsconfig"
+	"github.com/spf13/cobra"
+)
+
+var (
+	backupHost string
+	backupPort string
+
+	backupTLS    bool
+	backupCACert string
+	backupCert   string
+	backupKey    string
+
+	backupUser     string
+	backupPassword string
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup <dir>",
+	Short: "Take a base backup of a running VitaDB server",
+	Long: `Take a base backup of a running VitaDB server. The backup is written by the
+server below its backup_dir, so <dir> is a path on the server host, relative
+to backup_dir unless it is absolute. Combined with the archived WAL
+(wal_archive_dir) it can be restored to any later offset or timestamp.
+
+The connection and authentication flags are the same as vitadb-cli's. BACKUP
+is an admin command, so --user must name a user allowed to run it.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if backupUser != "" && backupPassword == "" {
+			return errors.New("--user requires --pass")
+		}
+		dir := args[0]
+		serverAddress := net.JoinHostPort(backupHost, backupPort)
+		conn, err := dialBackup(serverAddress)
+		if err != nil {
+			return fmt.Errorf("error connecting to VitaDB server at %s: %v", serverAddress, err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		if backupPassword != "" {
+			args := []string{"AUTH", backupPassword}
+			if backupUser != "" {
+				args = []string{"AUTH", backupUser, backupPassword}
+			}
+			reply, err := request(conn, reader, args...)
+			if err != nil {
+				return err
+			}
+			if e, ok := reply.(resp.Error); ok {
+				return fmt.Errorf("authentication failed: %s", e)
+			}
+		}
+
+		reply, err := request(conn, reader, "BACKUP", dir)
+		if err != nil {
+			return err
+		}
+		if e, ok := reply.(resp.Error); ok {
+			return fmt.Errorf("backup failed: %s", e)
+		}
+		status, ok := reply.(resp.SimpleString)
+		if !ok || !strings.HasPrefix(string(status), "OK") {
+			return fmt.Errorf("backup failed: unexpected reply %v", reply)
+		}
+		fmt.Printf("Backup written to %s (%s)\n", dir, strings.TrimSpace(strings.TrimPrefix(string(status), "OK")))
+		return nil
+	},
+}
+
+// request sends a command and reads its reply.
+func request(conn net.Conn, reader *bufio.Reader, args ...string) (resp.Reply, error) {
+	if err := resp.WriteCommand(conn, args...); err != nil {
+		return nil, fmt.Errorf("error sending command: %v", err)
+	}
+	reply, err := resp.ReadReply(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	return reply, nil
+}
+
+// dialBackup connects to the server, over TLS when --tls or any of the
+// certificate flags is set.
+func dialBackup(address string) (net.Conn, error) {
+	if !backupTLS && backupCACert == "" && backupCert == "" && backupKey == "" {
+		return net.Dial("tcp", address)
+	}
+	config, err := tlsconfig.ClientConfig(backupHost, backupCACert, backupCert, backupKey)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", address, config)
+}
+
+func init() {
+	backupCmd.Flags().StringVarP(&backupHost, "host", "H", "localhost", "VitaDB server host")
+	backupCmd.Flags().StringVarP(&backupPort, "port", "p", "6370", "VitaDB server port")
+	backupCmd.Flags().BoolVar(&backupTLS, "tls", false, "Connect using TLS")
+	backupCmd.Flags().StringVar(&backupCACert, "cacert", "", "CA certificate to verify the server with (default: system roots)")
+	backupCmd.Flags().StringVar(&backupCert, "cert", "", "Client certificate for servers that require one")
+	backupCmd.Flags().StringVar(&backupKey, "key", "", "Private key of the client certificate")
+	backupCmd.Flags().StringVar(&backupUser, "user", "", "User to authenticate as (default: the default user)")
+	backupCmd.Flags().StringVarP(&backupPassword, "pass", "a", os.Getenv("VITADB_PASSWORD"), "Password to authenticate with (default: $VITADB_PASSWORD)")
+	backupCmd.Flags().SortFlags = false
+	rootCmd.AddCommand(backupCmd)
+}
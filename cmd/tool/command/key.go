@@ -0,0 +1,101 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/encryption"
+	"github.com/joobisb/vitadb/internal/lsm"
+	"github.com/joobisb/vitadb/internal/store"
+	"github.com/joobisb/vitadb/internal/wal"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rotateNewKeyFile string
+	rotateBackupDirs []string
+)
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage the encryption master key",
+}
+
+var keyRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Rewrap the data keys of all files with a new master key",
+	Long: `Rewrap the data keys of the WAL segments, SSTables, archived segments and the
+base backups in --backup-dir with the master key in --new-key-file. Only file
+headers are rewritten, in place and through a journal that is replayed when the
+file is next opened, so data is never lost if the command is interrupted. Files
+already using the new key are skipped: run the command again to finish an
+interrupted rotation.
+
+Run this command while the server is stopped, with encryption_key_file still
+set to the current key, then set encryption_key_file to the new key. If the
+server has to be started before a rotation completed, set
+previous_encryption_key_file to the old key so every file can still be read.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %v", err)
+		}
+		if cfg.EncryptionKeyFile == "" {
+			return errors.New("encryption is not enabled, set encryption_key_file to the current key")
+		}
+		newKey, err := encryption.LoadMasterKey(rotateNewKeyFile)
+		if err != nil {
+			return err
+		}
+		// Files rotated by an interrupted run must be readable as well
+		cfg.PreviousEncryptionKeyFile = rotateNewKeyFile
+		readKey, err := encryption.LoadMasterKeys(cfg.EncryptionKeyFile, cfg.PreviousEncryptionKeyFile)
+		if err != nil {
+			return err
+		}
+
+		w, err := wal.NewWAL(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to open WAL: %v", err)
+		}
+		defer w.Close()
+		if err := w.RotateMasterKey(newKey); err != nil {
+			return fmt.Errorf("failed to rotate WAL master key: %v", err)
+		}
+
+		l, err := lsm.NewLSM(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to open SSTables: %v", err)
+		}
+		if err := l.RotateMasterKey(newKey); err != nil {
+			return fmt.Errorf("failed to rotate SST master key: %v", err)
+		}
+
+		// Archived segments are rewrapped with the WAL, base backups live
+		// outside of the configured directories
+		backups := 0
+		for _, dir := range rotateBackupDirs {
+			rewrapped, err := store.RewrapBackup(dir, readKey, newKey)
+			if err != nil {
+				return fmt.Errorf("failed to rewrap backup in %s: %v", dir, err)
+			}
+			if rewrapped {
+				backups++
+			}
+		}
+
+		fmt.Printf("Rotated the master key to %s (%d backups rewrapped)\n", newKey.ID(), backups)
+		fmt.Println("Set encryption_key_file to the new key before starting the server")
+		return nil
+	},
+}
+
+func init() {
+	keyRotateCmd.Flags().StringVar(&rotateNewKeyFile, "new-key-file", "", "path to the new 32 byte master key")
+	keyRotateCmd.Flags().StringSliceVar(&rotateBackupDirs, "backup-dir", nil, "base backup directory to rewrap as well, may be repeated")
+	keyRotateCmd.MarkFlagRequired("new-key-file")
+	keyCmd.AddCommand(keyRotateCmd)
+	rootCmd.AddCommand(keyCmd)
+}
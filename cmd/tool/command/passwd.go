@@ -0,0 +1,40 @@
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/joobisb/vitadb/internal/acl"
+	"github.com/spf13/cobra"
+)
+
+var hashPasswordCmd = &cobra.Command{
+	Use:   "hash-password",
+	Short: "Hash a password for the password_hash of a user",
+	Long: `Read a password from the first line of stdin and print its hash, for the
+password_hash of a user in the configuration or a '#' rule of ACL SETUSER.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read password: %v", err)
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return fmt.Errorf("empty password")
+		}
+
+		hash, err := acl.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(hashPasswordCmd)
+}
@@ -0,0 +1,86 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/store"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreBackupDir  string
+	restoreArchiveDir string
+	restoreWALDir     string
+	restoreToOffset   int64
+	restoreToTime     string
+	restoreOutputDir  string
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a base backup up to a WAL offset or timestamp",
+	Long: `Restore a base backup and replay the archived WAL up to and including
+--to-offset, or up to the last entry written at or before --to-time. Without a
+target every available entry is replayed. The result is written as a new WAL
+to --output; point wal_dir at it to start a server from the restored state.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %v", err)
+		}
+
+		opts := store.RestoreOptions{
+			BackupDir:    restoreBackupDir,
+			ArchiveDir:   restoreArchiveDir,
+			WALDir:       restoreWALDir,
+			TargetOffset: restoreToOffset,
+			OutputDir:    restoreOutputDir,
+		}
+		if opts.ArchiveDir == "" {
+			opts.ArchiveDir = cfg.WALArchiveDir
+		}
+		if opts.ArchiveDir == "" && opts.WALDir == "" {
+			return errors.New("either --archive or wal_archive_dir is required")
+		}
+		if restoreToTime != "" {
+			if opts.TargetOffset >= 0 {
+				return errors.New("--to-offset and --to-time are mutually exclusive")
+			}
+			if opts.TargetTime, err = time.Parse(time.RFC3339Nano, restoreToTime); err != nil {
+				return fmt.Errorf("invalid --to-time: %v", err)
+			}
+		}
+
+		result, err := store.Restore(cfg, opts)
+		if err != nil {
+			return err
+		}
+
+		target := "the end of the WAL"
+		if result.LastOffset >= 0 {
+			target = fmt.Sprintf("offset %d", result.LastOffset)
+			if !result.LastTime.IsZero() {
+				target += fmt.Sprintf(" written at %s", result.LastTime.Format(time.RFC3339Nano))
+			}
+		}
+		fmt.Printf("Restored %d keys as of %s to %s\n", result.Keys, target, opts.OutputDir)
+		return nil
+	},
+}
+
+func init() {
+	restoreCmd.Flags().StringVar(&restoreBackupDir, "backup", "", "directory of the base backup")
+	restoreCmd.Flags().StringVar(&restoreArchiveDir, "archive", "", "WAL archive directory (defaults to wal_archive_dir)")
+	restoreCmd.Flags().StringVar(&restoreWALDir, "wal", "", "live WAL directory, for entries that were not archived yet")
+	restoreCmd.Flags().Int64Var(&restoreToOffset, "to-offset", -1, "last WAL offset to replay")
+	restoreCmd.Flags().StringVar(&restoreToTime, "to-time", "", "replay entries written up to this RFC 3339 timestamp")
+	restoreCmd.Flags().StringVar(&restoreOutputDir, "output", "", "directory the restored WAL is written to")
+	restoreCmd.MarkFlagRequired("backup")
+	restoreCmd.MarkFlagRequired("output")
+	restoreCmd.Flags().SortFlags = false
+	rootCmd.AddCommand(restoreCmd)
+}
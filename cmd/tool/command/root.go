@@ -0,0 +1,18 @@
+package command
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "vitadb-tool",
+	Short: "VitaDB tool - administrative commands for VitaDB",
+	Long:  `VitaDB tool runs administrative tasks such as backups and point-in-time recovery.`,
+	// Errors are printed by main
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+func Execute() error {
+	return rootCmd.Execute()
+}
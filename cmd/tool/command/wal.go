@@ -0,0 +1,60 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/wal"
+	"github.com/spf13/cobra"
+)
+
+var migrateTo string
+
+var walCmd = &cobra.Command{
+	Use:   "wal",
+	Short: "Manage the write-ahead log",
+}
+
+var walMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Convert the WAL between the single-file and segmented layouts",
+	Long: `Convert the WAL in wal_dir to the layout selected by use_segmented_logs, or by
+--to. Records found in both layouts are merged. The server migrates on startup
+as well; run this command while the server is stopped.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %v", err)
+		}
+		switch migrateTo {
+		case "":
+		case "segmented":
+			cfg.UseSegmentedLogs = true
+		case "single":
+			cfg.UseSegmentedLogs = false
+		default:
+			return fmt.Errorf("invalid --to %q, expected segmented or single", migrateTo)
+		}
+
+		result, err := wal.Migrate(cfg)
+		if err != nil {
+			return err
+		}
+		if !result.Migrated {
+			fmt.Printf("WAL in %s already uses the %s layout\n", cfg.WALDir, result.To)
+			return nil
+		}
+		fmt.Printf("Migrated %d records in %s from the %s to the %s layout\n", result.Entries, cfg.WALDir, result.From, result.To)
+		if migrateTo != "" {
+			fmt.Printf("Set use_segmented_logs: %v before starting the server\n", cfg.UseSegmentedLogs)
+		}
+		return nil
+	},
+}
+
+func init() {
+	walMigrateCmd.Flags().StringVar(&migrateTo, "to", "", "target layout, segmented or single (defaults to use_segmented_logs)")
+	walCmd.AddCommand(walMigrateCmd)
+	rootCmd.AddCommand(walCmd)
+}
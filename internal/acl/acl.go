@@ -0,0 +1,319 @@
+// Package acl holds the users of the server and what each of them may do.
+//
+// Users are described by rules, as in Redis ACLs:
+//
+//	on, off            enable or disable the user
+//	>password          add a password
+//	<password          remove a password
+//	#hash              add a password by its hash, see HashPassword
+//	nopass             allow any password
+//	resetpass          remove all passwords and nopass
+//	+@category         allow the commands of a category: read, write, admin,
+//	                   pubsub or all
+//	-@category         disallow the commands of a category
+//	allcommands        same as +@all
+//	nocommands         same as -@all
+//	~pattern           allow keys matching a glob pattern, such as tenant-a:*
+//	allkeys            same as ~*
+//	resetkeys          disallow all keys
+//	reset              disable the user and remove passwords, commands and keys
+//
+// Commands in no category, such as PING or MULTI, can be run by every
+// authenticated user.
+package acl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/glob"
+)
+
+// Categories are the command categories rules can refer to, in the order
+// they are listed.
+var Categories = []string{"read", "write", "admin", "pubsub"}
+
+// User is a user of the server. Its rules can be changed while sessions are
+// authenticated as it, and apply to their next command.
+type User struct {
+	Name string
+
+	mu         sync.RWMutex
+	enabled    bool
+	nopass     bool
+	passwords  []string // hashes
+	categories map[string]bool
+	keys       []string
+}
+
+func newUser(name string) *User {
+	return &User{Name: name, categories: make(map[string]bool)}
+}
+
+// CheckPassword reports whether the user is enabled and password is one of
+// its passwords.
+func (u *User) CheckPassword(password string) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	for _, hash := range u.passwords {
+		if checkPassword(hash, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanRun reports whether the user may run a command in the given categories.
+// A command in several categories needs all of them.
+func (u *User) CanRun(categories []string) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, category := range categories {
+		if !u.categories[category] {
+			return false
+		}
+	}
+	return true
+}
+
+// CanAccess reports whether key matches one of the user's key patterns.
+func (u *User) CanAccess(key string) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, pattern := range u.keys {
+		if glob.Match(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules describes the user as a list of rules, as shown by ACL LIST.
+func (u *User) Rules() []string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	rules := []string{"off"}
+	if u.enabled {
+		rules[0] = "on"
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, hash := range u.passwords {
+		rules = append(rules, "#"+hash)
+	}
+	for _, pattern := range u.keys {
+		rules = append(rules, "~"+pattern)
+	}
+
+	all := true
+	var allowed []string
+	for _, category := range Categories {
+		if u.categories[category] {
+			allowed = append(allowed, "+@"+category)
+		} else {
+			all = false
+		}
+	}
+	switch {
+	case all:
+		rules = append(rules, "+@all")
+	case len(allowed) == 0:
+		rules = append(rules, "-@all")
+	default:
+		rules = append(rules, allowed...)
+	}
+	return rules
+}
+
+// SetRules applies rules in order. Either all of them are applied, or none
+// when one is invalid.
+func (u *User) SetRules(rules []string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	next := &User{
+		enabled:    u.enabled,
+		nopass:     u.nopass,
+		passwords:  append([]string(nil), u.passwords...),
+		categories: make(map[string]bool),
+		keys:       append([]string(nil), u.keys...),
+	}
+	for category, ok := range u.categories {
+		next.categories[category] = ok
+	}
+	for _, rule := range rules {
+		if err := next.apply(rule); err != nil {
+			return err
+		}
+	}
+
+	u.enabled, u.nopass, u.passwords = next.enabled, next.nopass, next.passwords
+	u.categories, u.keys = next.categories, next.keys
+	return nil
+}
+
+// apply applies a single rule to a user that is not shared yet.
+func (u *User) apply(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case lower == "allcommands":
+		return u.apply("+@all")
+	case lower == "nocommands":
+		return u.apply("-@all")
+	case lower == "allkeys":
+		u.keys = []string{"*"}
+	case lower == "resetkeys":
+		u.keys = nil
+	case lower == "reset":
+		u.enabled, u.nopass, u.passwords, u.keys = false, false, nil, nil
+		u.categories = make(map[string]bool)
+	case strings.HasPrefix(rule, ">"):
+		hash, err := HashPassword(rule[1:])
+		if err != nil {
+			return err
+		}
+		u.nopass = false
+		u.passwords = append(u.passwords, hash)
+	case strings.HasPrefix(rule, "<"):
+		passwords := u.passwords[:0]
+		for _, hash := range u.passwords {
+			if !checkPassword(hash, rule[1:]) {
+				passwords = append(passwords, hash)
+			}
+		}
+		u.passwords = passwords
+	case strings.HasPrefix(rule, "#"):
+		if _, _, _, err := parseHash(rule[1:]); err != nil {
+			return err
+		}
+		u.nopass = false
+		u.passwords = append(u.passwords, rule[1:])
+	case strings.HasPrefix(rule, "~"):
+		u.keys = append(u.keys, rule[1:])
+	case strings.HasPrefix(lower, "+@"), strings.HasPrefix(lower, "-@"):
+		allow := lower[0] == '+'
+		category := lower[2:]
+		if category == "all" {
+			for _, c := range Categories {
+				u.categories[c] = allow
+			}
+			return nil
+		}
+		for _, c := range Categories {
+			if c == category {
+				u.categories[c] = allow
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown command category '%s'", category)
+	default:
+		return fmt.Errorf("syntax error in ACL rule '%s'", rule)
+	}
+	return nil
+}
+
+// Users is the set of users of the server.
+type Users struct {
+	mu    sync.RWMutex
+	users map[string]*User
+}
+
+// NewUsers creates the users of the configuration. Configured users are
+// enabled unless their rules say otherwise.
+func NewUsers(users []config.UserConfig) (*Users, error) {
+	us := &Users{users: make(map[string]*User)}
+	for _, cfg := range users {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("user without a name")
+		}
+		if _, ok := us.users[cfg.Name]; ok {
+			return nil, fmt.Errorf("user %s is defined twice", cfg.Name)
+		}
+
+		rules := []string{"on"}
+		if cfg.PasswordHash != "" {
+			rules = append(rules, "#"+cfg.PasswordHash)
+		}
+		rules = append(rules, strings.Fields(cfg.Rules)...)
+		user := newUser(cfg.Name)
+		if err := user.SetRules(rules); err != nil {
+			return nil, fmt.Errorf("invalid rules for user %s: %v", cfg.Name, err)
+		}
+		us.users[cfg.Name] = user
+	}
+	return us, nil
+}
+
+// Get returns the user called name.
+func (us *Users) Get(name string) (*User, bool) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	user, ok := us.users[name]
+	return user, ok
+}
+
+// Authenticate returns the user called name if password is one of its
+// passwords.
+func (us *Users) Authenticate(name, password string) (*User, bool) {
+	user, ok := us.Get(name)
+	if !ok || !user.CheckPassword(password) {
+		return nil, false
+	}
+	return user, true
+}
+
+// SetUser applies rules to the user called name, creating it when it does
+// not exist. New users start disabled, without passwords, commands or keys.
+func (us *Users) SetUser(name string, rules []string) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	user, ok := us.users[name]
+	if !ok {
+		user = newUser(name)
+	}
+	if err := user.SetRules(rules); err != nil {
+		return err
+	}
+	us.users[name] = user
+	return nil
+}
+
+// List describes every user, ordered by name, as "user <name> <rules>".
+func (us *Users) List() []string {
+	us.mu.RLock()
+	users := make([]*User, 0, len(us.users))
+	for _, user := range us.users {
+		users = append(users, user)
+	}
+	us.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	lines := make([]string, len(users))
+	for i, user := range users {
+		lines[i] = "user " + user.Name + " " + strings.Join(user.Rules(), " ")
+	}
+	return lines
+}
@@ -0,0 +1,74 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUsers(t *testing.T) {
+	hash, err := HashPassword("alice-secret")
+	require.NoError(t, err)
+
+	users, err := NewUsers([]config.UserConfig{
+		{Name: "alice", PasswordHash: hash, Rules: "+@read +@write ~tenant-a:*"},
+		{Name: "disabled", Rules: "off nopass +@all allkeys"},
+	})
+	require.NoError(t, err, "Failed to create users")
+
+	alice, ok := users.Authenticate("alice", "alice-secret")
+	require.True(t, ok, "Expected alice to authenticate")
+	_, ok = users.Authenticate("alice", "wrong")
+	assert.False(t, ok, "Expected a wrong password to fail")
+	_, ok = users.Authenticate("bob", "alice-secret")
+	assert.False(t, ok, "Expected an unknown user to fail")
+	_, ok = users.Authenticate("disabled", "")
+	assert.False(t, ok, "Expected a disabled user to fail")
+
+	assert.True(t, alice.CanRun([]string{"read"}), "Expected alice to read")
+	assert.True(t, alice.CanRun(nil), "Commands without categories should always be allowed")
+	assert.False(t, alice.CanRun([]string{"admin"}), "Expected alice not to run admin commands")
+	assert.True(t, alice.CanAccess("tenant-a:users"), "Expected alice to access her tenant")
+	assert.False(t, alice.CanAccess("tenant-b:users"), "Expected alice not to access other tenants")
+
+	_, err = NewUsers([]config.UserConfig{{Name: "x", Rules: "+@nope"}})
+	assert.Error(t, err, "Expected unknown categories to be rejected")
+	_, err = NewUsers([]config.UserConfig{{Name: "x", PasswordHash: "plaintext"}})
+	assert.Error(t, err, "Expected malformed hashes to be rejected")
+	_, err = NewUsers([]config.UserConfig{{Name: "x"}, {Name: "x"}})
+	assert.Error(t, err, "Expected duplicate users to be rejected")
+}
+
+func TestSetUser(t *testing.T) {
+	users, err := NewUsers(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, users.SetUser("bob", []string{"+@read"}), "Failed to create user")
+	bob, ok := users.Get("bob")
+	require.True(t, ok, "Expected bob to exist")
+	assert.Equal(t, []string{"off", "+@read"}, bob.Rules(), "New users should be disabled")
+
+	require.NoError(t, users.SetUser("bob", []string{"on", ">pw", "~app:*", "+@all", "-@admin"}))
+	_, ok = users.Authenticate("bob", "pw")
+	assert.True(t, ok, "Expected bob to authenticate")
+	assert.False(t, bob.CanRun([]string{"admin"}), "Expected -@admin to apply after +@all")
+	assert.True(t, bob.CanRun([]string{"write"}), "Expected bob to write")
+
+	// Invalid rules leave the user unchanged
+	assert.Error(t, users.SetUser("bob", []string{"resetkeys", "bogus"}), "Expected an invalid rule to fail")
+	assert.True(t, bob.CanAccess("app:1"), "A failed SETUSER must not apply any rule")
+
+	require.NoError(t, users.SetUser("bob", []string{"<pw"}))
+	_, ok = users.Authenticate("bob", "pw")
+	assert.False(t, ok, "Expected the removed password to fail")
+
+	lines := users.List()
+	require.Len(t, lines, 1)
+	assert.Equal(t, "user bob on ~app:* +@read +@write +@pubsub", lines[0], "Unexpected ACL LIST line")
+
+	require.NoError(t, users.SetUser("bob", []string{"reset"}))
+	assert.True(t, strings.HasPrefix(users.List()[0], "user bob off -@all"), "Unexpected rules after reset: %s", users.List()[0])
+}
@@ -0,0 +1,87 @@
+package acl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Password hashes are PBKDF2-HMAC-SHA256 with a random salt, encoded as
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>" with unpadded base64 salt and
+// hash.
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 100000
+	saltSize       = 16
+	hashSize       = sha256.Size
+)
+
+// HashPassword returns a salted hash of password, for the password_hash of a
+// user in the configuration or a '#' rule of ACL SETUSER.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+	return encodeHash(hashIterations, salt, pbkdf2([]byte(password), salt, hashIterations)), nil
+}
+
+func encodeHash(iterations int, salt, hash []byte) string {
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, iterations, enc.EncodeToString(salt), enc.EncodeToString(hash))
+}
+
+// parseHash splits an encoded hash into its parts.
+func parseHash(encoded string) (iterations int, salt, hash []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return 0, nil, nil, fmt.Errorf("invalid password hash, expected %s$<iterations>$<salt>$<hash>", hashScheme)
+	}
+	iterations, err = strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid password hash iterations %q", parts[1])
+	}
+	enc := base64.RawStdEncoding
+	if salt, err = enc.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid password hash salt: %v", err)
+	}
+	if hash, err = enc.DecodeString(parts[3]); err != nil || len(hash) != hashSize {
+		return 0, nil, nil, fmt.Errorf("invalid password hash")
+	}
+	return iterations, salt, hash, nil
+}
+
+// checkPassword reports whether password matches the encoded hash.
+func checkPassword(encoded, password string) bool {
+	iterations, salt, hash, err := parseHash(encoded)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, pbkdf2([]byte(password), salt, iterations)) == 1
+}
+
+// pbkdf2 derives a single SHA-256 sized key as described in RFC 8018.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,31 @@
+package acl
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	require.NoError(t, err, "Failed to hash password")
+	assert.True(t, checkPassword(hash, "secret"), "Expected the password to match its hash")
+	assert.False(t, checkPassword(hash, "Secret"), "Expected a different password not to match")
+	assert.NotContains(t, hash, "secret", "The password must not be stored")
+
+	other, err := HashPassword("secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, other, "Hashes should be salted")
+
+	assert.False(t, checkPassword("nope", "secret"), "Malformed hashes should never match")
+	_, _, _, err = parseHash("pbkdf2-sha256$0$AAAA$AAAA")
+	assert.Error(t, err, "Expected invalid iterations to be rejected")
+}
+
+func TestPBKDF2(t *testing.T) {
+	// Test vector from RFC 7914, section 11
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1)
+	assert.Equal(t, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc", hex.EncodeToString(key), "Unexpected derived key")
+}
@@ -3,10 +3,12 @@ package cli
 import (
 	"bufio"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
 
+	"github.com/joobisb/vitadb/internal/command"
+	"github.com/joobisb/vitadb/internal/resp"
 	"github.com/joobisb/vitadb/internal/store"
 )
 
@@ -18,7 +20,12 @@ func NewCLI(store *store.KVStore) *CLI {
 	return &CLI{store: store}
 }
 
+// Run reads commands from stdin and runs them through the same command
+// registry as the server, printing replies in the plain-text format.
 func (c *CLI) Run() {
+	session := command.NewSession(c.store, resp.ProtocolText)
+	defer session.Close()
+
 	scanner := bufio.NewScanner(os.Stdin)
 	for {
 		fmt.Print("> ")
@@ -26,49 +33,16 @@ func (c *CLI) Run() {
 			break
 		}
 
-		input := scanner.Text()
-		parts := strings.Fields(input)
+		parts := strings.Fields(scanner.Text())
 		if len(parts) == 0 {
 			continue
 		}
-
-		switch parts[0] {
-		case "set":
-			if len(parts) != 3 {
-				fmt.Println("Usage: set <key> <value>")
-				continue
-			}
-			err := c.store.Set(parts[1], parts[2])
-			if err != nil {
-				log.Printf("error setting key %v", err)
-				continue
-			}
-			fmt.Println("OK")
-		case "get":
-			if len(parts) != 2 {
-				fmt.Println("Usage: get <key>")
-				continue
-			}
-			value, ok := c.store.Get(parts[1])
-			if !ok {
-				fmt.Println("Key not found")
-			} else {
-				fmt.Println(value)
-			}
-		case "del":
-			if len(parts) != 2 {
-				fmt.Println("Usage: delete <key>")
-				continue
-			}
-			if err := c.store.Delete(parts[1]); err != nil {
-				fmt.Printf("Error: %v\n", err)
-			} else {
-				fmt.Println("OK")
-			}
-		case "exit":
+		if parts[0] == "exit" {
 			return
-		default:
-			fmt.Println("Unknown command. Available commands: set, get, exit")
+		}
+
+		if err := resp.Write(os.Stdout, session.Execute(parts), resp.ProtocolText); err != nil {
+			slog.Error("Failed to write reply", "err", err)
 		}
 	}
 }
@@ -0,0 +1,138 @@
+package command
+
+import (
+	"strings"
+
+	"github.com/joobisb/vitadb/internal/resp"
+)
+
+func init() {
+	register(
+		&Command{Name: "AUTH", Arity: -2, Usage: "[username] password", Summary: "Authenticate the connection", Handler: auth},
+		&Command{Name: "WHOAMI", Arity: 1, Summary: "Show the user of the connection", Handler: whoami},
+		&Command{Name: "ACL", Arity: -2, Flags: FlagAdmin, Usage: "LIST|WHOAMI|SETUSER username [rule ...]",
+			Summary: "List or change the users and their permissions", Handler: aclCommand},
+	)
+}
+
+// defaultUser is the user AUTH with a single argument authenticates as, and
+// the user of sessions when authentication is disabled.
+const defaultUser = "default"
+
+// categories returns the ACL categories of the flags.
+func (f Flags) categories() []string {
+	var categories []string
+	if f&FlagReadonly != 0 {
+		categories = append(categories, "read")
+	}
+	if f&FlagWrite != 0 {
+		categories = append(categories, "write")
+	}
+	if f&FlagAdmin != 0 {
+		categories = append(categories, "admin")
+	}
+	if f&FlagPubSub != 0 {
+		categories = append(categories, "pubsub")
+	}
+	return categories
+}
+
+// keys returns the key arguments of a command.
+func (c *Command) keys(args []string) []string {
+	if c.FirstKey == 0 {
+		return nil
+	}
+	last := c.LastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []string
+	for i := c.FirstKey; i <= last && i < len(args); i += c.Step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// checkAccess returns an error reply when the user of the session may not run
+// args. c is nil for unknown commands.
+func (s *Session) checkAccess(c *Command, args []string) resp.Reply {
+	if s.user == nil {
+		if c != nil && (c.Name == "AUTH" || c.Name == "PING") {
+			return nil
+		}
+		return resp.Error("NOAUTH Authentication required.")
+	}
+	if c == nil {
+		return nil
+	}
+	if !s.user.CanRun(c.Flags.categories()) {
+		return resp.Errorf("NOPERM User %s has no permissions to run the '%s' command", s.user.Name, strings.ToLower(c.Name))
+	}
+	for _, key := range c.keys(args) {
+		if !s.user.CanAccess(key) {
+			return resp.Error("NOPERM No permissions to access a key")
+		}
+	}
+	return nil
+}
+
+// auth authenticates the session: AUTH [username] password.
+func auth(s *Session, args []string) resp.Reply {
+	if s.Users == nil {
+		return resp.Error("ERR AUTH called without any users configured")
+	}
+	name, password := defaultUser, args[1]
+	switch len(args) {
+	case 2:
+	case 3:
+		name, password = args[1], args[2]
+	default:
+		return resp.ErrWrongArgs(args[0])
+	}
+
+	user, ok := s.Users.Authenticate(name, password)
+	if !ok {
+		return resp.Error("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	s.user = user
+	return resp.OK
+}
+
+func whoami(s *Session, args []string) resp.Reply {
+	if s.user == nil {
+		return resp.BulkString(defaultUser)
+	}
+	return resp.BulkString(s.user.Name)
+}
+
+func aclCommand(s *Session, args []string) resp.Reply {
+	subcommand := strings.ToUpper(args[1])
+	if subcommand == "WHOAMI" {
+		return whoami(s, args[1:])
+	}
+	if s.Users == nil {
+		return resp.Error("ERR ACL is disabled, no users are configured")
+	}
+
+	switch subcommand {
+	case "LIST":
+		if len(args) != 2 {
+			return resp.ErrWrongArgs("acl|list")
+		}
+		lines := resp.Array{}
+		for _, line := range s.Users.List() {
+			lines = append(lines, resp.BulkString(line))
+		}
+		return lines
+	case "SETUSER":
+		if len(args) < 3 {
+			return resp.ErrWrongArgs("acl|setuser")
+		}
+		if err := s.Users.SetUser(args[2], args[3:]); err != nil {
+			return resp.Errorf("ERR Error in ACL SETUSER modifier: %v", err)
+		}
+		return resp.OK
+	default:
+		return resp.Errorf("ERR unknown subcommand '%s'", args[1])
+	}
+}
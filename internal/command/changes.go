@@ -0,0 +1,187 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/resp"
+	"github.com/joobisb/vitadb/internal/wal"
+)
+
+// defaultChangesCount is the number of WAL entries CHANGES returns at most
+// without COUNT, and maxChangesCount caps COUNT so a single reply stays small.
+const (
+	defaultChangesCount = 100
+	maxChangesCount     = 10000
+)
+
+func init() {
+	register(
+		&Command{Name: "CHANGES", Arity: -2, Flags: FlagReadonly, Usage: "offset [BLOCK ms] [COUNT n]",
+			Summary: "Read the changes logged from a WAL offset on, optionally waiting for new ones", Handler: changes},
+		&Command{Name: "CONSUMER", Arity: -2, Flags: FlagAdmin, Usage: "LIST|SET name offset|DEL name",
+			Summary: "List, register or remove the change consumers whose WAL segments are retained", Handler: consumer},
+	)
+}
+
+// changes reads up to COUNT WAL entries from offset on, at most
+// maxChangesCount. It replies with the offset to pass to the next call and the
+// changes read, each as [offset, op, key, value, version]. The operations of a
+// write batch share its offset and are always returned together. With BLOCK,
+// it waits up to ms milliseconds, or forever for 0, until there is a change to
+// return.
+func changes(s *Session, args []string) resp.Reply {
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return resp.Error("ERR offset is not an integer or out of range")
+	}
+	count := defaultChangesCount
+	var block time.Duration
+	blocking := false
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return resp.Error("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "BLOCK":
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || ms < 0 {
+				return resp.Error("ERR timeout is not an integer or out of range")
+			}
+			block, blocking = time.Duration(ms)*time.Millisecond, true
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return resp.Error("ERR count should be greater than 0")
+			}
+			count = min(n, maxChangesCount)
+		default:
+			return resp.Error("ERR syntax error")
+		}
+	}
+
+	reader, err := s.Store.Changes(offset)
+	if err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+
+	items := resp.Array{}
+	for read := 0; read < count; {
+		entry, offset, err := reader.Next()
+		if err == io.EOF {
+			if read > 0 || !blocking {
+				break
+			}
+			if err := s.waitForChange(reader, block); err != nil {
+				if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+					break
+				}
+				return resp.Errorf("ERR %v", err)
+			}
+			continue
+		}
+		// Changes read so far are returned, the next call fails at offset
+		if err != nil && read > 0 {
+			break
+		}
+		if err != nil {
+			return resp.Errorf("ERR %v", err)
+		}
+		read++
+		items = append(items, s.changeItems(offset, entry)...)
+	}
+	return resp.Array{resp.Integer(reader.Offset()), items}
+}
+
+// waitForChange waits up to timeout, or forever when it is 0, for the entry
+// reader points at to be written.
+func (s *Session) waitForChange(reader *wal.Reader, timeout time.Duration) error {
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return reader.Wait(ctx)
+}
+
+// changeItems formats the operations of a WAL entry for CHANGES, leaving out
+// the keys the user of the session cannot access.
+func (s *Session) changeItems(offset int64, entry wal.LogEntry) resp.Array {
+	ops := entry.Batch
+	if entry.Operation != wal.OperationBatch {
+		ops = []wal.LogEntry{entry}
+	}
+	var items resp.Array
+	for _, op := range ops {
+		if s.Users != nil && !s.user.CanAccess(op.Key) {
+			continue
+		}
+		var value resp.Reply = resp.BulkString(op.Value)
+		if op.Operation == wal.OperationDel {
+			value = resp.Null{}
+		}
+		items = append(items, resp.Array{
+			resp.Integer(offset),
+			resp.BulkString(op.Operation),
+			resp.BulkString(op.Key),
+			value,
+			resp.Integer(entry.Version),
+		})
+	}
+	return items
+}
+
+// consumer manages the change consumers. CONSUMER SET registers a consumer at
+// an offset, acknowledging the changes before it, so the WAL is retained from
+// there. It is an admin command since retained segments are not compacted.
+func consumer(s *Session, args []string) resp.Reply {
+	switch strings.ToUpper(args[1]) {
+	case "LIST":
+		if len(args) != 2 {
+			return resp.ErrWrongArgs("consumer|list")
+		}
+		consumers := s.Store.Consumers()
+		names := make([]string, 0, len(consumers))
+		for name := range consumers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		replies := make(resp.Array, len(names))
+		for i, name := range names {
+			replies[i] = resp.Array{resp.BulkString(name), resp.Integer(consumers[name])}
+		}
+		return replies
+	case "SET":
+		if len(args) != 4 {
+			return resp.ErrWrongArgs("consumer|set")
+		}
+		offset, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return resp.Error("ERR offset is not an integer or out of range")
+		}
+		if err := s.Store.SetConsumerOffset(args[2], offset); err != nil {
+			return resp.Errorf("ERR %v", err)
+		}
+		return resp.OK
+	case "DEL":
+		if len(args) != 3 {
+			return resp.ErrWrongArgs("consumer|del")
+		}
+		removed, err := s.Store.RemoveConsumer(args[2])
+		if err != nil {
+			return resp.Errorf("ERR %v", err)
+		}
+		return resp.Bool(removed)
+	default:
+		return resp.Errorf("ERR unknown subcommand '%s'", args[1])
+	}
+}
@@ -0,0 +1,207 @@
+package command
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/joobisb/vitadb/internal/acl"
+	"github.com/joobisb/vitadb/internal/pubsub"
+	"github.com/joobisb/vitadb/internal/resp"
+	"github.com/joobisb/vitadb/internal/store"
+)
+
+// Flags describe what a command does, for introspection and access control.
+type Flags uint
+
+const (
+	// FlagWrite commands modify the store
+	FlagWrite Flags = 1 << iota
+	// FlagReadonly commands only read the store
+	FlagReadonly
+	// FlagAdmin commands manage the server rather than the data
+	FlagAdmin
+	// FlagPubSub commands publish or subscribe to messages
+	FlagPubSub
+)
+
+// Names returns the flags as reported by COMMAND.
+func (f Flags) Names() []string {
+	var names []string
+	if f&FlagWrite != 0 {
+		names = append(names, "write")
+	}
+	if f&FlagReadonly != 0 {
+		names = append(names, "readonly")
+	}
+	if f&FlagAdmin != 0 {
+		names = append(names, "admin")
+	}
+	if f&FlagPubSub != 0 {
+		names = append(names, "pubsub")
+	}
+	return names
+}
+
+// Handler runs a command. args holds the command name followed by its
+// arguments, and has already been checked against the command arity.
+type Handler func(s *Session, args []string) resp.Reply
+
+// Command describes a command of the registry.
+type Command struct {
+	Name string
+
+	// Arity is the number of arguments including the command name, or its
+	// negated minimum for commands with a variable number of arguments, as in
+	// Redis
+	Arity int
+	Flags Flags
+
+	// FirstKey, LastKey and Step locate the key arguments, as reported by
+	// COMMAND. LastKey is -1 when keys run to the last argument, all three are
+	// 0 for commands without keys.
+	FirstKey int
+	LastKey  int
+	Step     int
+
+	Usage   string // arguments, shown by HELP
+	Summary string
+	Handler Handler
+}
+
+func (c *Command) checkArity(args []string) bool {
+	if c.Arity < 0 {
+		return len(args) >= -c.Arity
+	}
+	return len(args) == c.Arity
+}
+
+// Help returns the usage line of the command.
+func (c *Command) Help() string {
+	usage := c.Name
+	if c.Usage != "" {
+		usage += " " + c.Usage
+	}
+	return usage + " - " + c.Summary
+}
+
+var registry = make(map[string]*Command)
+
+// register adds commands to the registry. Names are case insensitive.
+func register(commands ...*Command) {
+	for _, c := range commands {
+		registry[c.Name] = c
+	}
+}
+
+// Lookup returns the command called name.
+func Lookup(name string) (*Command, bool) {
+	c, ok := registry[strings.ToUpper(name)]
+	return c, ok
+}
+
+// Commands returns every registered command ordered by name.
+func Commands() []*Command {
+	commands := make([]*Command, 0, len(registry))
+	for _, c := range registry {
+		commands = append(commands, c)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+	return commands
+}
+
+// Session is the state of a client, a server connection or the embedded
+// CLI, across commands.
+type Session struct {
+	Store *store.KVStore
+
+	// Proto is the protocol replies must be written with, changed by HELLO
+	Proto resp.Protocol
+
+	// Users authenticate with AUTH. Sessions without users run every command,
+	// as the default user.
+	Users *acl.Users
+	user  *acl.User
+
+	// Server describes the server of network sessions, for INFO. It is nil
+	// for the embedded CLI.
+	Server *ServerInfo
+
+	// PubSub routes PUBLISH and Subscriber holds the subscriptions of the
+	// connection. Both are nil for the embedded CLI.
+	PubSub     *pubsub.Broker
+	Subscriber *pubsub.Subscriber
+
+	// Context is cancelled when the server shuts down, to wake up commands
+	// waiting for data such as CHANGES BLOCK. It is nil for the embedded CLI.
+	Context context.Context
+
+	// batch is set between BATCH and END, while write commands are queued
+	batch *store.WriteBatch
+	tx    txnState
+}
+
+func NewSession(kvStore *store.KVStore, proto resp.Protocol) *Session {
+	return &Session{Store: kvStore, Proto: proto}
+}
+
+// Close discards any pending transaction.
+func (s *Session) Close() {
+	s.tx.reset()
+}
+
+// Execute runs a command and returns its reply.
+func (s *Session) Execute(args []string) resp.Reply {
+	if len(args) == 0 {
+		return resp.Error("ERR empty command")
+	}
+	c, ok := Lookup(args[0])
+	if s.Users != nil {
+		if reply := s.checkAccess(c, args); reply != nil {
+			if s.tx.multi {
+				s.tx.aborted = true
+			}
+			return reply
+		}
+	}
+
+	if s.subscribed() && !subscribedCommands[strings.ToUpper(args[0])] {
+		return resp.Errorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context", strings.ToLower(args[0]))
+	}
+	if s.batch != nil {
+		return s.queueBatchCommand(args)
+	}
+	if s.tx.multi {
+		return s.tx.queue(args)
+	}
+	if !ok {
+		return resp.Errorf("ERR unknown command '%s'", args[0])
+	}
+	if !c.checkArity(args) {
+		return resp.ErrWrongArgs(c.Name)
+	}
+	return c.Handler(s, args)
+}
+
+func okReply(err error) resp.Reply {
+	if err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	return resp.OK
+}
+
+func boolReply(ok bool, err error) resp.Reply {
+	if err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	return resp.Bool(ok)
+}
+
+func valueReply(value string, ok bool) resp.Reply {
+	if !ok {
+		return resp.Null{}
+	}
+	return resp.BulkString(value)
+}
@@ -0,0 +1,405 @@
+package command
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/acl"
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/pubsub"
+	"github.com/joobisb/vitadb/internal/resp"
+	"github.com/joobisb/vitadb/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSession(t *testing.T) *Session {
+	kvStore, err := store.NewKVStore(&config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir(), UseSegmentedLogs: true})
+	require.NoError(t, err, "Failed to create KVStore")
+	t.Cleanup(func() { kvStore.Close() })
+
+	s := NewSession(kvStore, resp.Protocol2)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// run executes a command given as a single line.
+func run(s *Session, line string) resp.Reply {
+	return s.Execute(strings.Fields(line))
+}
+
+func TestRegistry(t *testing.T) {
+	for _, c := range Commands() {
+		assert.Equal(t, strings.ToUpper(c.Name), c.Name, "Command names should be upper case")
+		assert.NotNil(t, c.Handler, "%s has no handler", c.Name)
+		assert.NotEmpty(t, c.Summary, "%s has no summary", c.Name)
+		assert.NotZero(t, c.Arity, "%s has no arity", c.Name)
+		assert.False(t, c.Flags&FlagWrite != 0 && c.Flags&FlagReadonly != 0, "%s cannot be both write and readonly", c.Name)
+	}
+
+	c, ok := Lookup("get")
+	require.True(t, ok, "Lookup should be case insensitive")
+	assert.Equal(t, "GET", c.Name, "Unexpected command")
+}
+
+func TestExecute(t *testing.T) {
+	s := newTestSession(t)
+
+	assert.Equal(t, resp.OK, run(s, "set a 1"), "Commands should be case insensitive")
+	assert.Equal(t, resp.BulkString("1"), run(s, "GET a"), "Unexpected GET reply")
+	assert.Equal(t, resp.Null{}, run(s, "GET missing"), "Missing keys should reply nil")
+	assert.Equal(t, resp.ErrWrongArgs("get"), run(s, "GET"), "Arity should be checked")
+	assert.Equal(t, resp.ErrWrongArgs("mset"), run(s, "MSET a 1 b"), "MSET needs key value pairs")
+	assert.Equal(t, resp.Error("ERR unknown command 'NOPE'"), run(s, "NOPE"), "Unknown commands should fail")
+	assert.Equal(t, resp.Null{}, run(s, "SET a 2 NX"), "SET NX should not overwrite")
+	assert.Equal(t, resp.Integer(1), run(s, "CAS a 1 2"), "CAS should succeed on the expected value")
+}
+
+func TestTransactionCommands(t *testing.T) {
+	s := newTestSession(t)
+	other := NewSession(s.Store, resp.Protocol2)
+
+	assert.Equal(t, resp.OK, run(s, "WATCH a"), "WATCH failed")
+	assert.Equal(t, resp.OK, run(s, "MULTI"), "MULTI failed")
+	assert.Equal(t, resp.SimpleString("QUEUED"), run(s, "SET a 1"), "SET should be queued")
+	assert.Equal(t, resp.SimpleString("QUEUED"), run(s, "GET a"), "GET should be queued")
+	assert.Equal(t, resp.Array{resp.OK, resp.BulkString("1")}, run(s, "EXEC"), "Unexpected EXEC reply")
+
+	run(s, "WATCH a")
+	run(s, "MULTI")
+	run(s, "SET a 2")
+	run(other, "SET a changed")
+	assert.Equal(t, resp.Null{}, run(s, "EXEC"), "EXEC should fail when a watched key changed")
+
+	// Writes before a key is watched do not make EXEC fail
+	run(s, "WATCH a")
+	run(other, "SET b changed")
+	run(s, "WATCH b")
+	run(s, "MULTI")
+	run(s, "SET b 3")
+	assert.Equal(t, resp.Array{resp.OK}, run(s, "EXEC"), "Keys should be checked from when they were watched")
+
+	// Queued reads only read
+	run(s, "MULTI")
+	run(s, "GET a")
+	run(s, "SET b 4")
+	run(other, "SET a again")
+	assert.Equal(t, resp.Array{resp.BulkString("again"), resp.OK}, run(s, "EXEC"), "GETs queued by MULTI should not conflict")
+
+	run(s, "MULTI")
+	assert.Equal(t, resp.Error("ERR 'MSET' is not allowed inside MULTI"), run(s, "MSET a 1"), "Unsupported commands should be rejected")
+	assert.Equal(t, resp.Error("EXECABORT Transaction discarded because of previous errors"), run(s, "EXEC"), "EXEC should abort after an error")
+	assert.Equal(t, resp.Error("ERR EXEC without MULTI"), run(s, "EXEC"), "EXEC outside MULTI should fail")
+}
+
+func TestBatchCommands(t *testing.T) {
+	s := newTestSession(t)
+
+	assert.Equal(t, resp.OK, run(s, "BATCH"), "BATCH failed")
+	assert.Equal(t, resp.SimpleString("QUEUED"), run(s, "SET a 1"), "SET should be queued")
+	assert.Equal(t, resp.SimpleString("QUEUED"), run(s, "MERGE a 2"), "MERGE should be queued")
+	assert.Equal(t, resp.Error("ERR 'GET' is not allowed inside BATCH"), run(s, "GET a"), "Reads are not allowed in a batch")
+	assert.Equal(t, resp.Integer(2), run(s, "END"), "END should report the number of operations")
+	assert.Equal(t, resp.BulkString("12"), run(s, "GET a"), "Unexpected value after batch")
+}
+
+func TestIntrospection(t *testing.T) {
+	s := newTestSession(t)
+
+	assert.Equal(t, resp.Integer(len(Commands())), run(s, "COMMAND COUNT"), "Unexpected command count")
+	assert.Equal(t, resp.Array{
+		resp.Array{resp.BulkString("mset"), resp.Integer(-3), resp.Array{resp.SimpleString("write")}, resp.Integer(1), resp.Integer(-1), resp.Integer(2)},
+		resp.Null{},
+	}, run(s, "COMMAND INFO mset nope"), "Unexpected COMMAND INFO reply")
+
+	all, ok := run(s, "COMMAND").(resp.Array)
+	require.True(t, ok, "COMMAND should reply with an array")
+	assert.Len(t, all, len(Commands()), "COMMAND should describe every command")
+
+	assert.Equal(t, resp.BulkString("GET key - Get the value of a key"), run(s, "HELP get"), "Unexpected HELP reply")
+	lines, ok := run(s, "HELP").(resp.Array)
+	require.True(t, ok, "HELP should reply with an array")
+	assert.Len(t, lines, len(Commands()), "HELP should list every command")
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newTestSession(t)
+	assert.Equal(t, resp.BulkString("default"), run(s, "WHOAMI"), "Sessions without users run as the default user")
+	assert.Equal(t, resp.OK, run(s, "SET tenant-b:x 1"), "Sessions without users run every command")
+
+	users, err := acl.NewUsers([]config.UserConfig{
+		{Name: "admin", Rules: "nopass +@all allkeys"},
+		{Name: "alice", Rules: ">alice-pw +@read +@write ~tenant-a:*"},
+	})
+	require.NoError(t, err, "Failed to create users")
+	s = NewSession(s.Store, resp.Protocol2)
+	s.Users = users
+
+	noauth := resp.Error("NOAUTH Authentication required.")
+	assert.Equal(t, noauth, run(s, "GET tenant-a:x"), "Unauthenticated sessions should not read")
+	assert.Equal(t, noauth, run(s, "WHOAMI"), "Unauthenticated sessions should only run AUTH and PING")
+	assert.Equal(t, noauth, run(s, "NOPE"), "Unknown commands should not reveal anything either")
+	assert.Equal(t, resp.SimpleString("PONG"), run(s, "PING"), "PING should not need authentication")
+	assert.Equal(t, resp.Error("WRONGPASS invalid username-password pair or user is disabled."), run(s, "AUTH alice wrong"), "Expected a wrong password to fail")
+
+	assert.Equal(t, resp.OK, run(s, "AUTH alice alice-pw"), "Expected alice to authenticate")
+	assert.Equal(t, resp.BulkString("alice"), run(s, "WHOAMI"), "Unexpected user")
+	assert.Equal(t, resp.OK, run(s, "SET tenant-a:x 1"), "Expected alice to write her keys")
+	assert.Equal(t, resp.Error("NOPERM No permissions to access a key"), run(s, "GET tenant-b:x"), "Expected other keys to be denied")
+	assert.Equal(t, resp.Error("NOPERM No permissions to access a key"), run(s, "MSET tenant-a:y 1 tenant-b:y 2"), "Every key of a command should be checked")
+	assert.Equal(t, resp.Error("NOPERM User alice has no permissions to run the 'backup' command"), run(s, "BACKUP /tmp/nope"), "Expected admin commands to be denied")
+	assert.Equal(t, resp.Error("NOPERM User alice has no permissions to run the 'acl' command"), run(s, "ACL LIST"), "Expected ACL to be denied")
+
+	// Denied commands inside MULTI abort the transaction
+	assert.Equal(t, resp.OK, run(s, "MULTI"))
+	assert.Equal(t, resp.SimpleString("QUEUED"), run(s, "SET tenant-a:z 1"))
+	assert.Equal(t, resp.Error("NOPERM No permissions to access a key"), run(s, "SET tenant-b:z 1"))
+	assert.Equal(t, resp.Error("EXECABORT Transaction discarded because of previous errors"), run(s, "EXEC"))
+
+	admin := NewSession(s.Store, resp.Protocol2)
+	admin.Users = users
+	assert.Equal(t, resp.OK, run(admin, "AUTH admin anything"), "Expected nopass users to authenticate")
+	assert.Equal(t, resp.OK, run(admin, "ACL SETUSER alice -@write"), "Failed to change alice")
+	assert.Equal(t, resp.Error("NOPERM User alice has no permissions to run the 'set' command"), run(s, "SET tenant-a:x 2"), "ACL changes should apply to authenticated sessions")
+	assert.Equal(t, resp.BulkString("1"), run(s, "GET tenant-a:x"), "Expected alice to still read")
+
+	list, ok := run(admin, "ACL LIST").(resp.Array)
+	require.True(t, ok, "ACL LIST should reply with an array")
+	require.Len(t, list, 2)
+	assert.Equal(t, resp.BulkString("user admin on nopass ~* +@all"), list[0], "Unexpected ACL LIST line")
+	assert.Contains(t, string(list[1].(resp.BulkString)), "~tenant-a:* +@read", "Unexpected ACL LIST line")
+	assert.NotContains(t, string(list[1].(resp.BulkString)), "alice-pw", "Passwords must only be listed as hashes")
+	assert.Equal(t, resp.BulkString("admin"), run(admin, "ACL WHOAMI"), "Unexpected user")
+	assert.Equal(t, resp.Error("ERR Error in ACL SETUSER modifier: syntax error in ACL rule 'bogus'"), run(admin, "ACL SETUSER alice bogus"), "Expected invalid rules to fail")
+}
+
+func TestBackup(t *testing.T) {
+	assert.Equal(t, resp.Error("ERR BACKUP is disabled, set backup_dir to enable it"), run(newTestSession(t), "BACKUP /tmp/nope"), "Expected BACKUP to be disabled without backup_dir")
+
+	root := t.TempDir()
+	kvStore, err := store.NewKVStore(&config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir(), UseSegmentedLogs: true, BackupDir: root})
+	require.NoError(t, err, "Failed to create KVStore")
+	defer kvStore.Close()
+	s := NewSession(kvStore, resp.Protocol2)
+	defer s.Close()
+
+	require.Equal(t, resp.OK, run(s, "SET a 1"))
+	assert.Equal(t, resp.SimpleString("OK wal_offset=1 keys=1"), run(s, "BACKUP base"), "Expected relative paths to be taken from backup_dir")
+	assert.FileExists(t, filepath.Join(root, "base", "backup.json"))
+	assert.Equal(t, resp.SimpleString("OK wal_offset=1 keys=1"), run(s, "BACKUP "+filepath.Join(root, "nightly", "..", "abs")), "Expected absolute paths below backup_dir to be allowed")
+	assert.FileExists(t, filepath.Join(root, "abs", "backup.json"))
+
+	for _, dir := range []string{"..", "../escape", "base/../../escape", "/tmp/escape", filepath.Dir(root)} {
+		reply, ok := run(s, "BACKUP "+dir).(resp.Error)
+		require.True(t, ok, "Expected BACKUP %s to fail", dir)
+		assert.Contains(t, string(reply), "outside of backup_dir", "Unexpected error for %s", dir)
+	}
+	assert.NoDirExists(t, filepath.Join(filepath.Dir(root), "escape"), "Nothing must be written outside of backup_dir")
+}
+
+func TestInfo(t *testing.T) {
+	s := newTestSession(t)
+	require.Equal(t, resp.OK, run(s, "SET a 1"))
+
+	all, ok := run(s, "INFO").(resp.BulkString)
+	require.True(t, ok, "Expected a bulk string, got %v", all)
+	for _, section := range []string{"# Server", "# Clients", "# Memory", "# Persistence", "# LSM", "# Keyspace"} {
+		assert.Contains(t, string(all), section+"\r\n", "Missing section %s", section)
+	}
+	assert.Contains(t, string(all), "vitadb_version:"+Version+"\r\n")
+
+	keyspace := run(s, "INFO keyspace")
+	assert.Equal(t, resp.BulkString("# Keyspace\r\nkeys:1\r\n"), keyspace, "Expected only the keyspace section")
+	assert.Equal(t, resp.BulkString(""), run(s, "INFO nope"), "Unknown sections should be empty")
+
+	s.Server = &ServerInfo{ConfigFile: "/etc/vitadb/config.yaml", MaxClients: 10, ConnectedClients: func() int { return 3 }}
+	assert.Equal(t, resp.BulkString("# Clients\r\nconnected_clients:3\r\nmaxclients:10\r\n"), run(s, "INFO CLIENTS"))
+	assert.Contains(t, string(run(s, "INFO server").(resp.BulkString)), "config_file:/etc/vitadb/config.yaml\r\n")
+}
+
+func TestSlowLog(t *testing.T) {
+	s := newTestSession(t)
+	assert.Equal(t, resp.Error("ERR SLOWLOG is only available on the server"), run(s, "SLOWLOG LEN"))
+
+	log := NewSlowLog(time.Millisecond, 2)
+	s.Server = &ServerInfo{SlowLog: log}
+	start := time.Now().Add(-5 * time.Millisecond)
+	log.Record([]string{"GET", "fast"}, "10.0.0.1:1000", time.Now())
+	log.Record([]string{"SET", "a", strings.Repeat("x", 200)}, "10.0.0.1:1000", start)
+	log.Record([]string{"AUTH", "alice", "secret"}, "10.0.0.2:2000", start)
+	log.Record(append([]string{"MSET"}, make([]string, 40)...), "10.0.0.3:3000", start)
+	assert.Equal(t, resp.Integer(2), run(s, "SLOWLOG LEN"), "Expected fast commands to be skipped and the oldest entry dropped")
+
+	entries := log.Entries(-1)
+	require.Len(t, entries, 2)
+	assert.Equal(t, uint64(2), entries[0].ID, "Expected the newest entry first")
+	assert.Len(t, entries[0].Args, 32, "Expected the arguments to be truncated")
+	assert.Equal(t, "... (10 more arguments)", entries[0].Args[31])
+	assert.Equal(t, []string{"AUTH", "(redacted)", "(redacted)"}, entries[1].Args, "Passwords must not be logged")
+	assert.Equal(t, "10.0.0.2:2000", entries[1].Client)
+	assert.GreaterOrEqual(t, entries[1].Duration, 5*time.Millisecond)
+
+	reply, ok := run(s, "SLOWLOG GET 1").(resp.Array)
+	require.True(t, ok, "Expected an array")
+	require.Len(t, reply, 1)
+	assert.Equal(t, resp.Integer(2), reply[0].(resp.Array)[0], "Unexpected entry id")
+	assert.Equal(t, resp.BulkString("10.0.0.3:3000"), reply[0].(resp.Array)[4], "Unexpected client address")
+
+	assert.Equal(t, resp.OK, run(s, "SLOWLOG RESET"))
+	assert.Equal(t, resp.Integer(0), run(s, "SLOWLOG LEN"))
+	log.Record([]string{"SET", "a", strings.Repeat("x", 200)}, "10.0.0.1:1000", start)
+	assert.Equal(t, "x... (72 more bytes)", log.Entries(1)[0].Args[2][127:], "Expected long arguments to be truncated")
+	assert.Equal(t, uint64(3), log.Entries(1)[0].ID, "Ids should keep increasing after a reset")
+}
+
+func TestPubSub(t *testing.T) {
+	s := newTestSession(t)
+	assert.Equal(t, resp.Error("ERR SUBSCRIBE is only available on the server"), run(s, "SUBSCRIBE news"))
+
+	broker := pubsub.NewBroker()
+	s.PubSub = broker
+	s.Subscriber = broker.NewSubscriber(0, nil)
+	assert.Equal(t, resp.Replies{
+		resp.Push{resp.BulkString("subscribe"), resp.BulkString("news"), resp.Integer(1)},
+		resp.Push{resp.BulkString("subscribe"), resp.BulkString("sports"), resp.Integer(2)},
+	}, run(s, "SUBSCRIBE news sports"))
+	assert.Equal(t, resp.Replies{
+		resp.Push{resp.BulkString("psubscribe"), resp.BulkString("n*"), resp.Integer(3)},
+	}, run(s, "PSUBSCRIBE n*"))
+
+	assert.Equal(t, resp.Error("ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context"), run(s, "GET a"))
+	assert.Equal(t, resp.Array{resp.BulkString("pong"), resp.BulkString("")}, run(s, "PING"), "Expected PING to reply like a message")
+
+	publisher := newTestSession(t)
+	publisher.PubSub = broker
+	assert.Equal(t, resp.Integer(2), run(publisher, "PUBLISH news hi"), "Expected the channel and pattern subscriptions to receive it")
+	assert.Equal(t, resp.Error("ERR channels starting with __keyspace__: are reserved for keyspace events"),
+		run(publisher, "PUBLISH __keyspace__:a set"), "Clients should not be able to forge keyspace events")
+	messages, err := s.Subscriber.Messages()
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	replies := []resp.Reply{MessageReply(messages[0]), MessageReply(messages[1])}
+	assert.Contains(t, replies, resp.Push{resp.BulkString("message"), resp.BulkString("news"), resp.BulkString("hi")})
+	assert.Contains(t, replies, resp.Push{resp.BulkString("pmessage"), resp.BulkString("n*"), resp.BulkString("news"), resp.BulkString("hi")})
+
+	unsubscribed, ok := run(s, "UNSUBSCRIBE").(resp.Replies)
+	require.True(t, ok, "Expected a reply per channel")
+	assert.Len(t, unsubscribed, 2)
+	assert.Equal(t, resp.Replies{
+		resp.Push{resp.BulkString("punsubscribe"), resp.BulkString("n*"), resp.Integer(0)},
+	}, run(s, "PUNSUBSCRIBE"))
+	assert.Equal(t, resp.Push{resp.BulkString("unsubscribe"), resp.Null{}, resp.Integer(0)}, run(s, "UNSUBSCRIBE"), "Expected a nil channel without subscriptions")
+	assert.Equal(t, resp.SimpleString("PONG"), run(s, "PING"), "Expected to leave subscribed mode")
+
+	s.Proto = resp.Protocol3
+	run(s, "SUBSCRIBE news")
+	assert.Equal(t, resp.Null{}, run(s, "GET a"), "RESP3 connections can run any command while subscribed")
+}
+
+func TestKeyspaceMessagesACL(t *testing.T) {
+	s := newTestSession(t)
+	event := pubsub.Message{Channel: KeyspaceChannelPrefix + "tenant-b:x", Payload: "set"}
+	assert.True(t, s.CanReceive(event), "Sessions without users receive every event")
+
+	users, err := acl.NewUsers([]config.UserConfig{{Name: "alice", Rules: ">pw +@read ~tenant-a:*"}})
+	require.NoError(t, err, "Failed to create users")
+	s.Users = users
+	assert.False(t, s.CanReceive(event), "Unauthenticated sessions should not receive events")
+
+	require.Equal(t, resp.OK, run(s, "AUTH alice pw"))
+	assert.False(t, s.CanReceive(event), "Expected events of other keys to be filtered")
+	assert.True(t, s.CanReceive(pubsub.Message{Channel: KeyspaceChannelPrefix + "tenant-a:x", Payload: "set"}))
+	assert.True(t, s.CanReceive(pubsub.Message{Channel: "news", Payload: "tenant-b:x"}), "Other channels should not be filtered")
+
+	s.PubSub = pubsub.NewBroker()
+	assert.Equal(t, resp.Error("NOPERM User alice has no permissions to run the 'publish' command"), run(s, "PUBLISH news hi"), "PUBLISH should need +@pubsub")
+	require.NoError(t, users.SetUser("alice", []string{"+@pubsub"}))
+	assert.Equal(t, resp.Integer(0), run(s, "PUBLISH news hi"))
+}
+
+func TestChanges(t *testing.T) {
+	s := newTestSession(t)
+	run(s, "SET a 1")
+	run(s, "DEL a")
+	run(s, "MSET b 2 c 3")
+
+	assert.Equal(t, resp.Array{resp.Integer(2), resp.Array{
+		resp.Array{resp.Integer(0), resp.BulkString("SET"), resp.BulkString("a"), resp.BulkString("1"), resp.Integer(1)},
+		resp.Array{resp.Integer(1), resp.BulkString("DEL"), resp.BulkString("a"), resp.Null{}, resp.Integer(2)},
+	}}, run(s, "CHANGES 0 COUNT 2"), "Unexpected changes")
+	assert.Equal(t, resp.Array{resp.Integer(3), resp.Array{
+		resp.Array{resp.Integer(2), resp.BulkString("SET"), resp.BulkString("b"), resp.BulkString("2"), resp.Integer(3)},
+		resp.Array{resp.Integer(2), resp.BulkString("SET"), resp.BulkString("c"), resp.BulkString("3"), resp.Integer(3)},
+	}}, run(s, "CHANGES 2 COUNT 1"), "Batch operations should be returned together")
+	assert.Equal(t, resp.Array{resp.Integer(3), resp.Array{}}, run(s, "CHANGES 3"), "Expected no changes once caught up")
+
+	start := time.Now()
+	assert.Equal(t, resp.Array{resp.Integer(3), resp.Array{}}, run(s, "CHANGES 3 BLOCK 20"), "Expected no changes after the timeout")
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond, "Expected CHANGES to block")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Store.Set("d", "4")
+	}()
+	reply, ok := run(s, "CHANGES 3 BLOCK 0").(resp.Array)
+	require.True(t, ok, "CHANGES should reply with an array")
+	assert.Equal(t, resp.Integer(4), reply[0], "Expected CHANGES to return the new change")
+
+	assert.Equal(t, resp.Error("ERR syntax error"), run(s, "CHANGES 0 COUNT"), "Options need a value")
+	assert.Equal(t, resp.Error("ERR count should be greater than 0"), run(s, "CHANGES 0 COUNT 0"))
+	assert.Equal(t, resp.Integer(4), run(s, "CHANGES 0 COUNT 1000000").(resp.Array)[0], "Expected large counts to be capped")
+	assert.Equal(t, resp.Error("ERR offset 9 is beyond the end of the log"), run(s, "CHANGES 9"))
+
+	// Consumers are registered at the offset they ask for
+	assert.Equal(t, resp.OK, run(s, "CONSUMER SET indexer 3"), "Failed to register the consumer")
+	assert.Equal(t, resp.Error("ERR syntax error"), run(s, "CHANGES 3 CONSUMER indexer"), "Consumers are registered with CONSUMER SET")
+	assert.Equal(t, resp.Array{resp.Array{resp.BulkString("indexer"), resp.Integer(3)}}, run(s, "CONSUMER LIST"), "Unexpected consumers")
+	assert.Equal(t, resp.Integer(1), run(s, "CONSUMER DEL indexer"), "Expected the consumer to be removed")
+	assert.Equal(t, resp.Integer(0), run(s, "CONSUMER DEL indexer"), "Expected unknown consumers not to be removed")
+
+	// Users only get the changes of keys they can access
+	users, err := acl.NewUsers([]config.UserConfig{{Name: "alice", Rules: ">pw +@read ~b"}})
+	require.NoError(t, err, "Failed to create users")
+	s.Users = users
+	run(s, "AUTH alice pw")
+	assert.Equal(t, resp.Array{resp.Integer(4), resp.Array{
+		resp.Array{resp.Integer(2), resp.BulkString("SET"), resp.BulkString("b"), resp.BulkString("2"), resp.Integer(3)},
+	}}, run(s, "CHANGES 0"), "Expected changes of other keys to be left out")
+	assert.Equal(t, resp.Error("NOPERM User alice has no permissions to run the 'consumer' command"), run(s, "CONSUMER LIST"))
+	assert.Equal(t, resp.Error("NOPERM User alice has no permissions to run the 'consumer' command"), run(s, "CONSUMER SET alice 0"), "Read-only users must not register consumers")
+}
+
+func TestScan(t *testing.T) {
+	s := newTestSession(t)
+	assert.Equal(t, resp.Integer(0), run(s, "DBSIZE"), "Expected an empty store")
+	assert.Equal(t, resp.Array{resp.BulkString("0"), resp.Array{}}, run(s, "SCAN 0"), "Expected no keys")
+	run(s, "MSET user:1 a user:2 b order:1 c user:3 d")
+	assert.Equal(t, resp.Integer(4), run(s, "DBSIZE"), "Unexpected number of keys")
+
+	var found resp.Array
+	cursor, calls := "0", 0
+	for {
+		reply, ok := run(s, "SCAN "+cursor+" MATCH user:* COUNT 1").(resp.Array)
+		require.True(t, ok, "SCAN should reply with an array")
+		found = append(found, reply[1].(resp.Array)...)
+		cursor, calls = string(reply[0].(resp.BulkString)), calls+1
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, resp.Array{resp.BulkString("user:1"), resp.BulkString("user:2"), resp.BulkString("user:3")}, found, "Unexpected keys")
+	assert.Equal(t, 4, calls, "Expected COUNT keys to be looked at per call")
+
+	assert.Equal(t, resp.Array{resp.BulkString("order:1"), resp.BulkString("user:1")}, run(s, "KEYS *:1"), "Unexpected KEYS reply")
+	assert.Equal(t, resp.Error("ERR invalid cursor"), run(s, "SCAN !"), "Expected malformed cursors to be rejected")
+	assert.Equal(t, resp.Error("ERR syntax error"), run(s, "SCAN 0 MATCH"), "Options need a value")
+	assert.Equal(t, resp.Error("ERR count should be greater than 0"), run(s, "SCAN 0 COUNT 0"))
+
+	// Users only see the keys they can access
+	users, err := acl.NewUsers([]config.UserConfig{{Name: "alice", Rules: ">pw +@read ~user:*"}})
+	require.NoError(t, err, "Failed to create users")
+	s.Users = users
+	run(s, "AUTH alice pw")
+	assert.Equal(t, resp.Array{resp.BulkString("user:1")}, run(s, "KEYS *:1"), "Expected other keys to be left out")
+}
@@ -0,0 +1,150 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/resp"
+	"github.com/joobisb/vitadb/internal/store"
+)
+
+func init() {
+	register(
+		&Command{Name: "INFO", Arity: -1, Flags: FlagAdmin, Usage: "[section]", Summary: "Show information and statistics about the server", Handler: info},
+	)
+}
+
+// Version is the server version reported by HELLO and INFO.
+const Version = "0.1.0"
+
+// ServerInfo describes the server a session is connected to.
+type ServerInfo struct {
+	// ConfigFile is the path of the configuration file, empty when the
+	// server runs with defaults and environment variables only
+	ConfigFile string
+
+	MaxClients int
+	// ConnectedClients returns the number of open connections
+	ConnectedClients func() int
+
+	SlowLog *SlowLog
+}
+
+// infoSections are the sections of INFO, in the order they are written.
+var infoSections = []struct {
+	name  string
+	write func(s *Session, stats store.Stats, b *strings.Builder)
+}{
+	{"server", writeServerInfo},
+	{"clients", writeClientsInfo},
+	{"memory", writeMemoryInfo},
+	{"persistence", writePersistenceInfo},
+	{"lsm", writeLSMInfo},
+	{"keyspace", writeKeyspaceInfo},
+}
+
+// info describes the server in "field:value" lines grouped in sections, like
+// Redis does: INFO [section]. Without a section, or with "all", every section
+// is written. Unknown sections are empty.
+func info(s *Session, args []string) resp.Reply {
+	if len(args) > 2 {
+		return resp.Error("ERR syntax error, only INFO [section] is supported")
+	}
+	section := "all"
+	if len(args) == 2 {
+		section = strings.ToLower(args[1])
+	}
+	if section == "default" || section == "everything" {
+		section = "all"
+	}
+
+	stats, err := s.Store.Stats()
+	if err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	var b strings.Builder
+	for _, sec := range infoSections {
+		if section != "all" && section != sec.name {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		sec.write(s, stats, &b)
+	}
+	return resp.BulkString(b.String())
+}
+
+func writeSection(b *strings.Builder, title string, fields ...string) {
+	b.WriteString("# " + title + "\r\n")
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.WriteString(fields[i] + ":" + fields[i+1] + "\r\n")
+	}
+}
+
+// unixTime formats t in seconds since the epoch, 0 for the zero time.
+func unixTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+func writeServerInfo(s *Session, stats store.Stats, b *strings.Builder) {
+	configFile := ""
+	if s.Server != nil {
+		configFile = s.Server.ConfigFile
+	}
+	uptime := time.Since(stats.Started)
+	writeSection(b, "Server",
+		"vitadb_version", Version,
+		"uptime_in_seconds", strconv.FormatInt(int64(uptime.Seconds()), 10),
+		"uptime_in_days", strconv.FormatInt(int64(uptime.Hours()/24), 10),
+		"config_file", configFile,
+	)
+}
+
+func writeClientsInfo(s *Session, stats store.Stats, b *strings.Builder) {
+	// The embedded CLI is the only client of its store
+	clients, maxClients := 1, 0
+	if s.Server != nil {
+		clients, maxClients = s.Server.ConnectedClients(), s.Server.MaxClients
+	}
+	writeSection(b, "Clients",
+		"connected_clients", strconv.Itoa(clients),
+		"maxclients", strconv.Itoa(maxClients),
+	)
+}
+
+func writeMemoryInfo(s *Session, stats store.Stats, b *strings.Builder) {
+	writeSection(b, "Memory",
+		"memtable_bytes", strconv.Itoa(stats.MemtableBytes),
+		"data_map_keys", strconv.Itoa(stats.Keys),
+	)
+}
+
+func writePersistenceInfo(s *Session, stats store.Stats, b *strings.Builder) {
+	writeSection(b, "Persistence",
+		"wal_segments", strconv.Itoa(stats.WALSegments),
+		"wal_bytes", strconv.FormatInt(stats.WALBytes, 10),
+		"wal_last_fsync_time", unixTime(stats.LastWALSync),
+		"memtable_last_flush_time", unixTime(stats.LastFlush),
+	)
+}
+
+func writeLSMInfo(s *Session, stats store.Stats, b *strings.Builder) {
+	var fields []string
+	for level, tables := range stats.SSTablesPerLevel {
+		fields = append(fields, "level"+strconv.Itoa(level)+"_tables", strconv.Itoa(tables))
+	}
+	fields = append(fields,
+		"sstable_bytes", strconv.FormatInt(stats.SSTableBytes, 10),
+		"pending_compaction_bytes", strconv.FormatInt(stats.PendingCompactionBytes, 10),
+	)
+	writeSection(b, "LSM", fields...)
+}
+
+func writeKeyspaceInfo(s *Session, stats store.Stats, b *strings.Builder) {
+	writeSection(b, "Keyspace", "keys", strconv.Itoa(stats.Keys))
+}
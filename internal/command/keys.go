@@ -0,0 +1,115 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/joobisb/vitadb/internal/resp"
+	"github.com/joobisb/vitadb/internal/store"
+)
+
+func init() {
+	register(
+		&Command{Name: "GET", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1,
+			Usage: "key", Summary: "Get the value of a key", Handler: get},
+		&Command{Name: "SET", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1,
+			Usage: "key value [NX|XX|VERSION version]", Summary: "Set the value of a key, optionally only if it does not exist, exists, or is still at a version", Handler: set},
+		&Command{Name: "DEL", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1,
+			Usage: "key", Summary: "Delete a key", Handler: del},
+		&Command{Name: "SETNX", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1,
+			Usage: "key value", Summary: "Set the value of a key if it does not exist", Handler: setnx},
+		&Command{Name: "CAS", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1,
+			Usage: "key expected value", Summary: "Set the value of a key if it currently is expected", Handler: cas},
+		&Command{Name: "GETSET", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1,
+			Usage: "key value", Summary: "Set the value of a key and return its previous value", Handler: getset},
+		&Command{Name: "GETVER", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1,
+			Usage: "key", Summary: "Get the version and value of a key", Handler: getver},
+		&Command{Name: "MSET", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 2,
+			Usage: "key value [key value ...]", Summary: "Set several keys atomically", Handler: mset},
+		&Command{Name: "MERGE", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1,
+			Usage: "key value", Summary: "Append to the value of a key", Handler: merge},
+	)
+}
+
+func get(s *Session, args []string) resp.Reply {
+	return valueReply(s.Store.Get(args[1]))
+}
+
+// set runs SET with its optional condition: NX only sets missing keys, XX
+// only existing ones, and VERSION only keys still at the version returned by
+// GETVER. A write skipped because of its condition replies nil.
+func set(s *Session, args []string) resp.Reply {
+	key, value, opts := args[1], args[2], args[3:]
+
+	var ok bool
+	var err error
+	switch {
+	case len(opts) == 0:
+		ok, err = true, s.Store.Set(key, value)
+	case len(opts) == 1 && strings.ToUpper(opts[0]) == "NX":
+		ok, err = s.Store.SetIfAbsent(key, value)
+	case len(opts) == 1 && strings.ToUpper(opts[0]) == "XX":
+		ok, err = s.Store.SetIfPresent(key, value)
+	case len(opts) == 2 && strings.ToUpper(opts[0]) == "VERSION":
+		version, parseErr := strconv.ParseUint(opts[1], 10, 64)
+		if parseErr != nil {
+			return resp.Error("ERR version is not an integer or out of range")
+		}
+		ok, err = s.Store.SetIfVersion(key, value, version)
+	default:
+		return resp.Error("ERR syntax error")
+	}
+
+	if err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	if !ok {
+		return resp.Null{}
+	}
+	return resp.OK
+}
+
+func del(s *Session, args []string) resp.Reply {
+	return okReply(s.Store.Delete(args[1]))
+}
+
+func setnx(s *Session, args []string) resp.Reply {
+	return boolReply(s.Store.SetIfAbsent(args[1], args[2]))
+}
+
+func cas(s *Session, args []string) resp.Reply {
+	return boolReply(s.Store.CompareAndSet(args[1], args[2], args[3]))
+}
+
+func getset(s *Session, args []string) resp.Reply {
+	old, ok, err := s.Store.GetSet(args[1], args[2])
+	if err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	return valueReply(old, ok)
+}
+
+func getver(s *Session, args []string) resp.Reply {
+	value, version, ok := s.Store.GetVersioned(args[1])
+	if !ok {
+		return resp.Null{}
+	}
+	return resp.Array{resp.Integer(version), resp.BulkString(value)}
+}
+
+func mset(s *Session, args []string) resp.Reply {
+	if len(args)%2 != 1 {
+		return resp.ErrWrongArgs(args[0])
+	}
+	var b store.WriteBatch
+	for i := 1; i < len(args); i += 2 {
+		b.Put(args[i], args[i+1])
+	}
+	return okReply(s.Store.Write(&b))
+}
+
+func merge(s *Session, args []string) resp.Reply {
+	var b store.WriteBatch
+	b.Merge(args[1], args[2])
+	return okReply(s.Store.Write(&b))
+}
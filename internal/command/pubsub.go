@@ -0,0 +1,123 @@
+package command
+
+import (
+	"strings"
+
+	"github.com/joobisb/vitadb/internal/pubsub"
+	"github.com/joobisb/vitadb/internal/resp"
+)
+
+func init() {
+	register(
+		&Command{Name: "SUBSCRIBE", Arity: -2, Flags: FlagPubSub, Usage: "channel [channel ...]", Summary: "Receive the messages published on channels", Handler: subscribe},
+		&Command{Name: "UNSUBSCRIBE", Arity: -1, Flags: FlagPubSub, Usage: "[channel ...]", Summary: "Stop receiving messages from channels, all of them by default", Handler: unsubscribe},
+		&Command{Name: "PSUBSCRIBE", Arity: -2, Flags: FlagPubSub, Usage: "pattern [pattern ...]", Summary: "Receive the messages published on channels matching glob patterns", Handler: psubscribe},
+		&Command{Name: "PUNSUBSCRIBE", Arity: -1, Flags: FlagPubSub, Usage: "[pattern ...]", Summary: "Stop receiving messages from patterns, all of them by default", Handler: punsubscribe},
+		&Command{Name: "PUBLISH", Arity: 3, Flags: FlagPubSub, Usage: "channel message", Summary: "Post a message to a channel", Handler: publish},
+	)
+}
+
+// subscribedCommands are the commands a RESP2 or plain-text connection can
+// run while it has subscriptions, since any reply could be mistaken for a
+// message. RESP3 connections tell messages apart and can run anything.
+var subscribedCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+}
+
+// KeyspaceChannelPrefix prefixes the channels keyspace events are published
+// on, followed by the key. The message is the event type, such as "set".
+const KeyspaceChannelPrefix = "__keyspace__:"
+
+// CanReceive reports whether the user of the session may receive m. Keyspace
+// events are only delivered for keys the user can access.
+func (s *Session) CanReceive(m pubsub.Message) bool {
+	key, ok := strings.CutPrefix(m.Channel, KeyspaceChannelPrefix)
+	if !ok || s.Users == nil {
+		return true
+	}
+	return s.user != nil && s.user.CanAccess(key)
+}
+
+// subscribed reports whether the session is in subscribed mode.
+func (s *Session) subscribed() bool {
+	return s.Subscriber != nil && s.Subscriber.Count() > 0 && s.Proto != resp.Protocol3
+}
+
+// MessageReply formats a message for a subscriber, like Redis does.
+func MessageReply(m pubsub.Message) resp.Reply {
+	if m.Pattern != "" {
+		return resp.Push{resp.BulkString("pmessage"), resp.BulkString(m.Pattern), resp.BulkString(m.Channel), resp.BulkString(m.Payload)}
+	}
+	return resp.Push{resp.BulkString("message"), resp.BulkString(m.Channel), resp.BulkString(m.Payload)}
+}
+
+func subscriptionReply(kind string, name resp.Reply, count int) resp.Reply {
+	return resp.Push{resp.BulkString(kind), name, resp.Integer(count)}
+}
+
+// changeSubscriptions applies change to each name and confirms each of them
+// with a kind message. Without names, change is applied to every name in all,
+// and confirmed with a nil name when there are none.
+func changeSubscriptions(s *Session, kind string, names []string, all func() []string, change func(string) int) resp.Reply {
+	if names == nil && all != nil {
+		names = all()
+		if len(names) == 0 {
+			return subscriptionReply(kind, resp.Null{}, s.Subscriber.Count())
+		}
+	}
+	replies := make(resp.Replies, 0, len(names))
+	for _, name := range names {
+		replies = append(replies, subscriptionReply(kind, resp.BulkString(name), change(name)))
+	}
+	return replies
+}
+
+func subscribe(s *Session, args []string) resp.Reply {
+	if s.Subscriber == nil {
+		return resp.Error("ERR SUBSCRIBE is only available on the server")
+	}
+	return changeSubscriptions(s, "subscribe", args[1:], nil, s.Subscriber.Subscribe)
+}
+
+func unsubscribe(s *Session, args []string) resp.Reply {
+	if s.Subscriber == nil {
+		return resp.Error("ERR UNSUBSCRIBE is only available on the server")
+	}
+	var channels []string
+	if len(args) > 1 {
+		channels = args[1:]
+	}
+	return changeSubscriptions(s, "unsubscribe", channels, s.Subscriber.Channels, s.Subscriber.Unsubscribe)
+}
+
+func psubscribe(s *Session, args []string) resp.Reply {
+	if s.Subscriber == nil {
+		return resp.Error("ERR PSUBSCRIBE is only available on the server")
+	}
+	return changeSubscriptions(s, "psubscribe", args[1:], nil, s.Subscriber.PSubscribe)
+}
+
+func punsubscribe(s *Session, args []string) resp.Reply {
+	if s.Subscriber == nil {
+		return resp.Error("ERR PUNSUBSCRIBE is only available on the server")
+	}
+	var patterns []string
+	if len(args) > 1 {
+		patterns = args[1:]
+	}
+	return changeSubscriptions(s, "punsubscribe", patterns, s.Subscriber.Patterns, s.Subscriber.PUnsubscribe)
+}
+
+func publish(s *Session, args []string) resp.Reply {
+	if s.PubSub == nil {
+		return resp.Error("ERR PUBLISH is only available on the server")
+	}
+	if strings.HasPrefix(args[1], KeyspaceChannelPrefix) {
+		return resp.Errorf("ERR channels starting with %s are reserved for keyspace events", KeyspaceChannelPrefix)
+	}
+	return resp.Integer(s.PubSub.Publish(args[1], args[2]))
+}
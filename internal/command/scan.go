@@ -0,0 +1,111 @@
+package command
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/joobisb/vitadb/internal/glob"
+	"github.com/joobisb/vitadb/internal/resp"
+)
+
+// defaultScanCount is the number of keys SCAN looks at without COUNT, and
+// keysScanCount the number KEYS looks at with each lock of the store.
+const (
+	defaultScanCount = 10
+	keysScanCount    = 1000
+)
+
+func init() {
+	register(
+		&Command{Name: "SCAN", Arity: -2, Flags: FlagReadonly, Usage: "cursor [MATCH pattern] [COUNT n]",
+			Summary: "Iterate over the keys, starting with cursor 0", Handler: scan},
+		&Command{Name: "KEYS", Arity: 2, Flags: FlagReadonly, Usage: "pattern",
+			Summary: "List the keys matching a glob pattern, for small datasets", Handler: keys},
+		&Command{Name: "DBSIZE", Arity: 1, Flags: FlagReadonly,
+			Summary: "Return the number of keys", Handler: dbsize},
+	)
+}
+
+// scan looks at COUNT keys from cursor on, and replies with the next cursor
+// and the keys matching the MATCH pattern, like Redis. The cursor is 0 to
+// start and once every key has been returned. Otherwise it encodes the key to
+// continue from, so it stays valid across flushes and restarts.
+func scan(s *Session, args []string) resp.Reply {
+	start, ok := parseScanCursor(args[1])
+	if !ok {
+		return resp.Error("ERR invalid cursor")
+	}
+	pattern, count := "", defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return resp.Error("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return resp.Error("ERR count should be greater than 0")
+			}
+			count = n
+		default:
+			return resp.Error("ERR syntax error")
+		}
+	}
+
+	keys, next := s.Store.Scan(start, count)
+	return resp.Array{resp.BulkString(formatScanCursor(next)), s.matchingKeys(keys, pattern)}
+}
+
+func parseScanCursor(cursor string) (string, bool) {
+	if cursor == "0" {
+		return "", true
+	}
+	start, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(start), err == nil
+}
+
+func formatScanCursor(start string) string {
+	if start == "" {
+		return "0"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(start))
+}
+
+// matchingKeys returns the keys matching pattern, or all of them when it is
+// empty, that the user of the session can access.
+func (s *Session) matchingKeys(keys []string, pattern string) resp.Array {
+	matching := resp.Array{}
+	for _, key := range keys {
+		if pattern != "" && !glob.Match(pattern, key) {
+			continue
+		}
+		if s.Users != nil && !s.user.CanAccess(key) {
+			continue
+		}
+		matching = append(matching, resp.BulkString(key))
+	}
+	return matching
+}
+
+// keys replies with every key matching pattern. It scans the store like SCAN
+// does rather than locking it for the whole command, so keys written while it
+// runs may or may not be listed.
+func keys(s *Session, args []string) resp.Reply {
+	matching := resp.Array{}
+	start := ""
+	for {
+		var keys []string
+		keys, start = s.Store.Scan(start, keysScanCount)
+		matching = append(matching, s.matchingKeys(keys, args[1])...)
+		if start == "" {
+			return matching
+		}
+	}
+}
+
+func dbsize(s *Session, args []string) resp.Reply {
+	return resp.Integer(s.Store.Len())
+}
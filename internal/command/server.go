@@ -0,0 +1,181 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/joobisb/vitadb/internal/resp"
+)
+
+func init() {
+	register(
+		&Command{Name: "PING", Arity: -1, Usage: "[message]", Summary: "Check that the server is alive", Handler: ping},
+		&Command{Name: "HELLO", Arity: -1, Usage: "[protover]", Summary: "Switch to RESP2 or RESP3 and describe the server", Handler: hello},
+		&Command{Name: "COMMAND", Arity: -1, Usage: "[COUNT|INFO name ...]", Summary: "Describe the available commands", Handler: commandInfo},
+		&Command{Name: "HELP", Arity: -1, Usage: "[command]", Summary: "Show the usage of the available commands", Handler: help},
+		&Command{Name: "REPAIR", Arity: 2, Flags: FlagAdmin, Usage: "STATUS", Summary: "Show the async repair scrubber status", Handler: repair},
+		&Command{Name: "BACKUP", Arity: 2, Flags: FlagAdmin, Usage: "dir", Summary: "Write a base backup to a directory below backup_dir on the server", Handler: backup},
+	)
+}
+
+func ping(s *Session, args []string) resp.Reply {
+	if len(args) > 2 {
+		return resp.ErrWrongArgs(args[0])
+	}
+	// Subscribed connections get a reply that looks like a message
+	if s.subscribed() {
+		message := ""
+		if len(args) == 2 {
+			message = args[1]
+		}
+		return resp.Array{resp.BulkString("pong"), resp.BulkString(message)}
+	}
+	if len(args) == 2 {
+		return resp.BulkString(args[1])
+	}
+	return resp.SimpleString("PONG")
+}
+
+// hello switches the protocol version: HELLO [2|3]. It replies with a map
+// describing the server, like Redis does.
+func hello(s *Session, args []string) resp.Reply {
+	if len(args) > 2 {
+		return resp.Error("ERR syntax error, only HELLO [protover] is supported")
+	}
+	proto := s.Proto
+	if len(args) == 2 {
+		switch args[1] {
+		case "2":
+			proto = resp.Protocol2
+		case "3":
+			proto = resp.Protocol3
+		default:
+			return resp.Error("NOPROTO unsupported protocol version")
+		}
+	}
+	// Plain-text clients stay in plain-text mode when they ask for RESP2
+	if s.Proto != resp.ProtocolText || proto == resp.Protocol3 {
+		s.Proto = proto
+	}
+
+	version := 2
+	if s.Proto == resp.Protocol3 {
+		version = 3
+	}
+	return resp.Map{
+		{Key: "server", Value: resp.BulkString("vitadb")},
+		{Key: "version", Value: resp.BulkString(Version)},
+		{Key: "proto", Value: resp.Integer(version)},
+		{Key: "mode", Value: resp.BulkString("standalone")},
+		{Key: "role", Value: resp.BulkString("master")},
+		{Key: "modules", Value: resp.Array{}},
+	}
+}
+
+// commandInfo describes commands the way Redis COMMAND does: name, arity,
+// flags and the positions of the first key, the last key and the step
+// between keys.
+func commandInfo(s *Session, args []string) resp.Reply {
+	if len(args) == 1 {
+		var replies resp.Array
+		for _, c := range Commands() {
+			replies = append(replies, describe(c))
+		}
+		return replies
+	}
+
+	switch strings.ToUpper(args[1]) {
+	case "COUNT":
+		if len(args) != 2 {
+			return resp.Error("ERR syntax error")
+		}
+		return resp.Integer(len(registry))
+	case "INFO":
+		var replies resp.Array
+		for _, name := range args[2:] {
+			if c, ok := Lookup(name); ok {
+				replies = append(replies, describe(c))
+			} else {
+				replies = append(replies, resp.Null{})
+			}
+		}
+		return replies
+	default:
+		return resp.Errorf("ERR unknown subcommand '%s'", args[1])
+	}
+}
+
+func describe(c *Command) resp.Reply {
+	flags := resp.Array{}
+	for _, flag := range c.Flags.Names() {
+		flags = append(flags, resp.SimpleString(flag))
+	}
+	return resp.Array{
+		resp.BulkString(strings.ToLower(c.Name)),
+		resp.Integer(c.Arity),
+		flags,
+		resp.Integer(c.FirstKey),
+		resp.Integer(c.LastKey),
+		resp.Integer(c.Step),
+	}
+}
+
+func help(s *Session, args []string) resp.Reply {
+	if len(args) > 2 {
+		return resp.ErrWrongArgs(args[0])
+	}
+	if len(args) == 2 {
+		c, ok := Lookup(args[1])
+		if !ok {
+			return resp.Errorf("ERR unknown command '%s'", args[1])
+		}
+		return resp.BulkString(c.Help())
+	}
+
+	lines := resp.Array{}
+	for _, c := range Commands() {
+		lines = append(lines, resp.BulkString(c.Help()))
+	}
+	return lines
+}
+
+func repair(s *Session, args []string) resp.Reply {
+	if strings.ToUpper(args[1]) != "STATUS" {
+		return resp.Error("ERR syntax error, expected REPAIR STATUS")
+	}
+	return resp.BulkString(s.Store.RepairStatus().String())
+}
+
+func backup(s *Session, args []string) resp.Reply {
+	dir, err := backupPath(s.Store.BackupDir(), args[1])
+	if err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	info, err := s.Store.Backup(dir)
+	if err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	return resp.SimpleString("OK wal_offset=" + strconv.FormatInt(info.WALOffset, 10) + " keys=" + strconv.Itoa(info.Keys))
+}
+
+// backupPath resolves the directory of a BACKUP below root. Relative paths
+// are taken from root, and paths that leave it are rejected, so clients
+// cannot have the server write anywhere else.
+func backupPath(root, dir string) (string, error) {
+	if root == "" {
+		return "", errors.New("BACKUP is disabled, set backup_dir to enable it")
+	}
+	root = filepath.Clean(root)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	dir = filepath.Clean(dir)
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("backup directory %s is outside of backup_dir", dir)
+	}
+	return dir, nil
+}
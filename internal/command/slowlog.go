@@ -0,0 +1,191 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/resp"
+)
+
+func init() {
+	register(
+		&Command{Name: "SLOWLOG", Arity: -2, Flags: FlagAdmin, Usage: "GET [count]|LEN|RESET",
+			Summary: "Show or clear the commands that exceeded slowlog_threshold", Handler: slowlog},
+	)
+}
+
+// Arguments of slow log entries are truncated like Redis does, so that large
+// values do not pin memory.
+const (
+	slowLogMaxArgs   = 32
+	slowLogMaxArgLen = 128
+)
+
+// SlowLogEntry is a command that took longer than the slow log threshold.
+type SlowLogEntry struct {
+	ID       uint64
+	Time     time.Time
+	Duration time.Duration
+	Args     []string // truncated, with passwords redacted
+	Client   string   // remote address of the connection
+}
+
+// SlowLog is a ring buffer of the latest slow commands.
+type SlowLog struct {
+	threshold time.Duration
+
+	// entries[next] is overwritten by the next entry once len entries were
+	// recorded
+	mu      sync.Mutex
+	entries []SlowLogEntry
+	next    int
+	len     int
+	nextID  uint64
+}
+
+// NewSlowLog returns a slow log recording commands that take longer than
+// threshold, keeping the last maxLen of them. It records nothing when maxLen
+// is 0.
+func NewSlowLog(threshold time.Duration, maxLen int) *SlowLog {
+	if maxLen < 0 {
+		maxLen = 0
+	}
+	return &SlowLog{threshold: threshold, entries: make([]SlowLogEntry, maxLen)}
+}
+
+// Record adds a command that was started at start by client, if it took
+// longer than the threshold.
+func (l *SlowLog) Record(args []string, client string, start time.Time) {
+	duration := time.Since(start)
+	if len(l.entries) == 0 || duration < l.threshold || len(args) == 0 {
+		return
+	}
+	entry := SlowLogEntry{Time: start, Duration: duration, Args: slowLogArgs(args), Client: client}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.ID = l.nextID
+	l.nextID++
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.len < len(l.entries) {
+		l.len++
+	}
+}
+
+// Entries returns up to count entries, newest first. A negative count returns
+// every entry.
+func (l *SlowLog) Entries(count int) []SlowLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if count < 0 || count > l.len {
+		count = l.len
+	}
+	entries := make([]SlowLogEntry, count)
+	for i := range entries {
+		entries[i] = l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+	}
+	return entries
+}
+
+// Len returns the number of entries.
+func (l *SlowLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.len
+}
+
+// Reset removes every entry.
+func (l *SlowLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	clear(l.entries)
+	l.next, l.len = 0, 0
+}
+
+// slowLogArgs copies args for the slow log: passwords are redacted, long
+// arguments truncated and arguments past slowLogMaxArgs summarized.
+func slowLogArgs(args []string) []string {
+	n := len(args)
+	if n > slowLogMaxArgs {
+		n = slowLogMaxArgs - 1
+	}
+	out := make([]string, 0, n+1)
+	redactFrom := len(args)
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		redactFrom = 1
+	case "ACL":
+		// ACL SETUSER rules can set passwords
+		redactFrom = 2
+	}
+	for i, arg := range args[:n] {
+		switch {
+		case i >= redactFrom:
+			arg = "(redacted)"
+		case len(arg) > slowLogMaxArgLen:
+			arg = arg[:slowLogMaxArgLen] + "... (" + strconv.Itoa(len(arg)-slowLogMaxArgLen) + " more bytes)"
+		}
+		out = append(out, arg)
+	}
+	if n < len(args) {
+		out = append(out, "... ("+strconv.Itoa(len(args)-n)+" more arguments)")
+	}
+	return out
+}
+
+// slowlog replies like Redis SLOWLOG: GET returns the newest entries as
+// arrays of id, unix time, duration in microseconds, arguments and client
+// address, 10 by default.
+func slowlog(s *Session, args []string) resp.Reply {
+	if s.Server == nil || s.Server.SlowLog == nil {
+		return resp.Error("ERR SLOWLOG is only available on the server")
+	}
+	log := s.Server.SlowLog
+
+	switch strings.ToUpper(args[1]) {
+	case "GET":
+		count := 10
+		switch len(args) {
+		case 2:
+		case 3:
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < -1 {
+				return resp.Error("ERR count should be greater than or equal to -1")
+			}
+			count = n
+		default:
+			return resp.ErrWrongArgs("slowlog|get")
+		}
+		replies := resp.Array{}
+		for _, entry := range log.Entries(count) {
+			entryArgs := make(resp.Array, len(entry.Args))
+			for i, arg := range entry.Args {
+				entryArgs[i] = resp.BulkString(arg)
+			}
+			replies = append(replies, resp.Array{
+				resp.Integer(entry.ID),
+				resp.Integer(entry.Time.Unix()),
+				resp.Integer(entry.Duration.Microseconds()),
+				entryArgs,
+				resp.BulkString(entry.Client),
+			})
+		}
+		return replies
+	case "LEN":
+		if len(args) != 2 {
+			return resp.ErrWrongArgs("slowlog|len")
+		}
+		return resp.Integer(log.Len())
+	case "RESET":
+		if len(args) != 2 {
+			return resp.ErrWrongArgs("slowlog|reset")
+		}
+		log.Reset()
+		return resp.OK
+	default:
+		return resp.Errorf("ERR unknown subcommand '%s'", args[1])
+	}
+}
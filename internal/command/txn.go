@@ -0,0 +1,169 @@
+package command
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/joobisb/vitadb/internal/resp"
+	"github.com/joobisb/vitadb/internal/store"
+)
+
+func init() {
+	register(
+		&Command{Name: "WATCH", Arity: -2, FirstKey: 1, LastKey: -1, Step: 1,
+			Usage: "key [key ...]", Summary: "Make the next EXEC fail if the keys change", Handler: watch},
+		&Command{Name: "UNWATCH", Arity: 1, Summary: "Forget the watched keys", Handler: unwatch},
+		&Command{Name: "MULTI", Arity: 1, Summary: "Start queueing commands of a transaction", Handler: multi},
+		&Command{Name: "EXEC", Arity: 1, Summary: "Run the queued commands of a transaction", Handler: notInMulti},
+		&Command{Name: "DISCARD", Arity: 1, Summary: "Discard the queued commands of a transaction", Handler: notInMulti},
+		&Command{Name: "BATCH", Arity: 1, Flags: FlagWrite,
+			Summary: "Start queueing SET, DEL and MERGE commands applied atomically by END", Handler: batch},
+		&Command{Name: "END", Arity: 1, Flags: FlagWrite, Summary: "Apply the commands queued since BATCH", Handler: endWithoutBatch},
+	)
+}
+
+// txnState tracks the MULTI/EXEC transaction of a session. txn is started by
+// the first WATCH or by MULTI. Each watched key is checked for changes since it
+// was watched, while GETs queued by MULTI only read.
+type txnState struct {
+	txn    *store.Txn
+	multi  bool
+	queued [][]string
+
+	// aborted is set when a command could not be queued, EXEC then fails
+	aborted bool
+}
+
+func (tx *txnState) reset() {
+	if tx.txn != nil {
+		tx.txn.Rollback()
+	}
+	*tx = txnState{}
+}
+
+func watch(s *Session, args []string) resp.Reply {
+	if s.tx.txn == nil {
+		s.tx.txn = s.Store.BeginTxn()
+	}
+	s.tx.txn.Watch(args[1:]...)
+	return resp.OK
+}
+
+func unwatch(s *Session, args []string) resp.Reply {
+	s.tx.reset()
+	return resp.OK
+}
+
+func multi(s *Session, args []string) resp.Reply {
+	if s.tx.txn == nil {
+		s.tx.txn = s.Store.BeginTxn()
+	}
+	s.tx.multi = true
+	return resp.OK
+}
+
+func notInMulti(s *Session, args []string) resp.Reply {
+	return resp.Errorf("ERR %s without MULTI", strings.ToUpper(args[0]))
+}
+
+// queue handles a command sent after MULTI. SET, GET and DEL are queued and
+// run by EXEC inside the transaction.
+func (tx *txnState) queue(args []string) resp.Reply {
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "EXEC":
+		return tx.exec()
+	case "DISCARD":
+		tx.reset()
+		return resp.OK
+	case "MULTI":
+		return resp.Error("ERR MULTI calls can not be nested")
+	case "WATCH":
+		return resp.Error("ERR WATCH inside MULTI is not allowed")
+	}
+
+	// Only the plain forms of SET, GET and DEL can run inside a transaction
+	arity := map[string]int{"SET": 3, "GET": 2, "DEL": 2}
+	want, ok := arity[name]
+	if !ok {
+		tx.aborted = true
+		return resp.Errorf("ERR '%s' is not allowed inside MULTI", args[0])
+	}
+	if len(args) != want {
+		tx.aborted = true
+		return resp.ErrWrongArgs(name)
+	}
+	tx.queued = append(tx.queued, args)
+	return resp.SimpleString("QUEUED")
+}
+
+// exec runs the queued commands and commits. It replies with the replies of
+// the queued commands, or nil on a conflict.
+func (tx *txnState) exec() resp.Reply {
+	defer tx.reset()
+	if tx.aborted {
+		return resp.Error("EXECABORT Transaction discarded because of previous errors")
+	}
+
+	replies := make(resp.Array, 0, len(tx.queued))
+	for _, args := range tx.queued {
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			tx.txn.Set(args[1], args[2])
+			replies = append(replies, resp.OK)
+		case "GET":
+			value, ok, _ := tx.txn.Peek(args[1])
+			replies = append(replies, valueReply(value, ok))
+		case "DEL":
+			tx.txn.Delete(args[1])
+			replies = append(replies, resp.OK)
+		}
+	}
+
+	if err := tx.txn.Commit(); errors.Is(err, store.ErrConflict) {
+		return resp.Null{}
+	} else if err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	return replies
+}
+
+func batch(s *Session, args []string) resp.Reply {
+	s.batch = &store.WriteBatch{}
+	return resp.OK
+}
+
+func endWithoutBatch(s *Session, args []string) resp.Reply {
+	return resp.Error("ERR END without BATCH")
+}
+
+// queueBatchCommand handles a command sent between BATCH and END. Write
+// commands are queued; END writes the batch atomically.
+func (s *Session) queueBatchCommand(args []string) resp.Reply {
+	switch name := strings.ToUpper(args[0]); name {
+	case "SET", "MERGE":
+		if len(args) != 3 {
+			return resp.ErrWrongArgs(name)
+		}
+		if name == "SET" {
+			s.batch.Put(args[1], args[2])
+		} else {
+			s.batch.Merge(args[1], args[2])
+		}
+	case "DEL":
+		if len(args) != 2 {
+			return resp.ErrWrongArgs(name)
+		}
+		s.batch.Delete(args[1])
+	case "END":
+		b := s.batch
+		s.batch = nil
+		if err := s.Store.Write(b); err != nil {
+			return resp.Errorf("ERR %v", err)
+		}
+		return resp.Integer(b.Len())
+	default:
+		return resp.Errorf("ERR '%s' is not allowed inside BATCH", args[0])
+	}
+	return resp.SimpleString("QUEUED")
+}
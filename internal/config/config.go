@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -12,6 +14,99 @@ type Config struct {
 	SegmentSize      int    `mapstructure:"segment_size"`
 	SSTDir           string `mapstructure:"sst_dir"`
 	MemtableSize     int    `mapstructure:"memtable_size"`
+
+	// WAL compaction keeps only the newest record per key in closed segments
+	WALCompaction         bool          `mapstructure:"wal_compaction"`
+	WALCompactionInterval time.Duration `mapstructure:"wal_compaction_interval"`
+	WALDeleteRetention    time.Duration `mapstructure:"wal_delete_retention"`
+
+	// Closed WAL segments left without records by compaction are removed once
+	// they were last written longer ago than this. They are kept when 0.
+	WALSegmentRetention time.Duration `mapstructure:"wal_segment_retention"`
+
+	// Closed WAL segments are copied here for point-in-time recovery. Archiving
+	// is disabled when empty.
+	WALArchiveDir string `mapstructure:"wal_archive_dir"`
+
+	// BACKUP only writes base backups below this directory. It is disabled
+	// when empty.
+	BackupDir string `mapstructure:"backup_dir"`
+
+	// How often the async repair scrubber verifies WAL segments and SSTables
+	RepairInterval time.Duration `mapstructure:"repair_interval"`
+
+	// Path to the master key used to encrypt WAL segments and SSTables at rest.
+	// Encryption is disabled when empty.
+	EncryptionKeyFile string `mapstructure:"encryption_key_file"`
+
+	// Path to the master key being rotated out, still accepted for reading
+	// files until every file is rewrapped with the key in EncryptionKeyFile
+	PreviousEncryptionKeyFile string `mapstructure:"previous_encryption_key_file"`
+
+	// TCP addresses the server listens on, and an optional Unix socket with
+	// its permissions, in octal
+	ListenAddrs    []string `mapstructure:"listen_addrs"`
+	UnixSocket     string   `mapstructure:"unix_socket"`
+	UnixSocketPerm string   `mapstructure:"unix_socket_perm"`
+
+	// Connection limits. MaxClients and IdleTimeout are disabled when 0,
+	// TCPKeepAlive disables keepalive probes when 0. MaxRequestSize is the
+	// largest total size in bytes of the arguments of a command.
+	MaxClients     int           `mapstructure:"max_clients"`
+	IdleTimeout    time.Duration `mapstructure:"idle_timeout"`
+	MaxRequestSize int           `mapstructure:"max_request_size"`
+	TCPKeepAlive   time.Duration `mapstructure:"tcp_keepalive"`
+
+	// TCP listeners accept TLS connections only when a certificate and key
+	// are set. Clients must present a certificate signed by a CA in
+	// TLSClientCAFile when it is set (mutual TLS). The files are reloaded on
+	// SIGHUP.
+	TLSCertFile     string `mapstructure:"tls_cert_file"`
+	TLSKeyFile      string `mapstructure:"tls_key_file"`
+	TLSClientCAFile string `mapstructure:"tls_client_ca_file"`
+
+	// Users that can authenticate with AUTH. Authentication is disabled when
+	// no users are configured.
+	Users []UserConfig `mapstructure:"users"`
+
+	// Address of the HTTP server exposing Prometheus metrics on /metrics, such
+	// as ":9121". Metrics are not served when empty.
+	MetricsAddr string `mapstructure:"metrics_addr"`
+
+	// How long the server waits for in-flight commands on SIGINT/SIGTERM
+	// before closing the remaining connections
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+
+	// LogLevel is debug, info, warn or error and LogFormat text or json
+	LogLevel  string `mapstructure:"log_level"`
+	LogFormat string `mapstructure:"log_format"`
+
+	// Commands taking longer than SlowLogThreshold are recorded in the slow
+	// log, which keeps the last SlowLogMaxLen of them. The slow log is
+	// disabled when SlowLogMaxLen is 0.
+	SlowLogThreshold time.Duration `mapstructure:"slowlog_threshold"`
+	SlowLogMaxLen    int           `mapstructure:"slowlog_max_len"`
+
+	// Subscribers are disconnected when more than PubSubOutputBufferLimit
+	// bytes of messages are waiting to be sent to them, no limit when 0
+	PubSubOutputBufferLimit int `mapstructure:"pubsub_output_buffer_limit"`
+
+	// KeyspaceEvents publishes every change to a key on the pub/sub channel
+	// __keyspace__:<key>
+	KeyspaceEvents bool `mapstructure:"keyspace_events"`
+
+	// ConfigFile is the path of the configuration file that was loaded, empty
+	// when none was found
+	ConfigFile string `mapstructure:"-"`
+}
+
+// UserConfig describes a user. PasswordHash is created with
+// "vitadb-tool hash-password", Rules are ACL rules separated by spaces, such
+// as "+@read ~tenant-a:*".
+type UserConfig struct {
+	Name         string `mapstructure:"name"`
+	PasswordHash string `mapstructure:"password_hash"`
+	Rules        string `mapstructure:"rules"`
 }
 
 func Load() (*Config, error) {
@@ -29,6 +124,33 @@ func Load() (*Config, error) {
 	viper.SetDefault("segment_size", 1000)
 	viper.SetDefault("sst_dir", "/tmp/vitadb/sstables")
 	viper.SetDefault("memtable_size", 4*1024*1024) //4MB
+	viper.SetDefault("wal_compaction", false)
+	viper.SetDefault("wal_compaction_interval", "10m")
+	viper.SetDefault("wal_delete_retention", "24h")
+	viper.SetDefault("wal_segment_retention", "0s")
+	viper.SetDefault("wal_archive_dir", "")
+	viper.SetDefault("backup_dir", "")
+	viper.SetDefault("repair_interval", "1h")
+	viper.SetDefault("encryption_key_file", "")
+	viper.SetDefault("previous_encryption_key_file", "")
+	viper.SetDefault("listen_addrs", []string{":6370"})
+	viper.SetDefault("unix_socket", "")
+	viper.SetDefault("unix_socket_perm", "0770")
+	viper.SetDefault("max_clients", 10000)
+	viper.SetDefault("idle_timeout", "0s")
+	viper.SetDefault("max_request_size", 512*1024*1024) //512MB
+	viper.SetDefault("tcp_keepalive", "5m")
+	viper.SetDefault("tls_cert_file", "")
+	viper.SetDefault("tls_key_file", "")
+	viper.SetDefault("tls_client_ca_file", "")
+	viper.SetDefault("metrics_addr", "")
+	viper.SetDefault("shutdown_timeout", "10s")
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("log_format", "text")
+	viper.SetDefault("slowlog_threshold", "10ms")
+	viper.SetDefault("slowlog_max_len", 128)
+	viper.SetDefault("pubsub_output_buffer_limit", 32*1024*1024) //32MB
+	viper.SetDefault("keyspace_events", false)
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
@@ -43,5 +165,6 @@ func Load() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.ConfigFile = viper.ConfigFileUsed()
 	return &c, nil
 }
@@ -0,0 +1,440 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Encrypted files start with a fixed size header line:
+// "VENC" + base64([version (1 byte)][flags (1 byte)][master key id (8 bytes)][wrapped data key]) + "\n"
+// The data key is wrapped by the master key, so rotating the master key only
+// rewrites the header in place and never the data that follows it.
+const (
+	headerMagic   = "VENC"
+	headerVersion = 1
+
+	// FlagEncrypted marks a file whose records are encrypted with the data key in its header
+	FlagEncrypted byte = 1 << 0
+
+	keySize        = 32 // AES-256
+	keyIDSize      = 8
+	wrappedKeySize = 12 + keySize + 16 // nonce + data key + GCM tag
+	rawHeaderSize  = 2 + keyIDSize + wrappedKeySize
+
+	// HeaderSize is the size in bytes of the header line, including the trailing newline
+	HeaderSize = len(headerMagic) + (rawHeaderSize+2)/3*4 + 1
+)
+
+var (
+	ErrKeyMismatch = errors.New("file was encrypted with a different master key")
+	ErrNoMasterKey = errors.New("file is encrypted but no master key is configured")
+)
+
+// rewrapJournalExt is appended to the path of a file for the journal holding
+// its new header while RewrapFile rewrites it.
+const rewrapJournalExt = ".rewrap"
+
+// MasterKey wraps and unwraps the per-file data keys.
+type MasterKey struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+
+	// previous is the key being rotated out. Files whose data key it wraps can
+	// still be read, new files always use this key.
+	previous *MasterKey
+}
+
+// NewMasterKey returns a MasterKey for a 32 byte AES-256 key.
+func NewMasterKey(key []byte) (*MasterKey, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", keySize, len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	mk := &MasterKey{aead: aead}
+	sum := sha256.Sum256(key)
+	copy(mk.id[:], sum[:keyIDSize])
+	return mk, nil
+}
+
+// LoadMasterKey reads a master key from path. The file holds either the 32 raw
+// key bytes or their hex encoding.
+func LoadMasterKey(path string) (*MasterKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key file: %v", err)
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == hex.EncodedLen(keySize) {
+		key := make([]byte, keySize)
+		if _, err := hex.Decode(key, trimmed); err == nil {
+			return NewMasterKey(key)
+		}
+	}
+	return NewMasterKey(data)
+}
+
+// LoadMasterKeys reads the master key from path like LoadMasterKey. If
+// previousPath is set, the key it holds is accepted for reading files that were
+// not rotated to the new key yet.
+func LoadMasterKeys(path, previousPath string) (*MasterKey, error) {
+	mk, err := LoadMasterKey(path)
+	if err != nil || previousPath == "" {
+		return mk, err
+	}
+	previous, err := LoadMasterKey(previousPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load previous master key: %v", err)
+	}
+	return mk.WithPrevious(previous), nil
+}
+
+// WithPrevious returns a copy of mk that also reads files whose data key is
+// wrapped by previous, or by the keys previous accepts itself.
+func (mk *MasterKey) WithPrevious(previous *MasterKey) *MasterKey {
+	withPrevious := *mk
+	if previous != nil && previous.id == mk.id {
+		previous = previous.previous
+	}
+	withPrevious.previous = previous
+	return &withPrevious
+}
+
+// ID returns the hex encoded identifier stored in the headers of files
+// encrypted with this key.
+func (mk *MasterKey) ID() string {
+	return hex.EncodeToString(mk.id[:])
+}
+
+// DataKey encrypts the records of a single file.
+type DataKey struct {
+	aead cipher.AEAD
+}
+
+// Seal encrypts plaintext and returns nonce || ciphertext.
+func (dk *DataKey) Seal(plaintext []byte) []byte {
+	return seal(dk.aead, plaintext)
+}
+
+// Open decrypts data produced by Seal.
+func (dk *DataKey) Open(data []byte) ([]byte, error) {
+	return open(dk.aead, data)
+}
+
+// SealLine encrypts a record and encodes it so that it never contains a newline,
+// for use in line oriented files such as WAL segments.
+func (dk *DataKey) SealLine(plaintext []byte) []byte {
+	sealed := dk.Seal(plaintext)
+	line := make([]byte, base64.RawStdEncoding.EncodedLen(len(sealed)))
+	base64.RawStdEncoding.Encode(line, sealed)
+	return line
+}
+
+// OpenLine decrypts a record produced by SealLine.
+func (dk *DataKey) OpenLine(line []byte) ([]byte, error) {
+	sealed := make([]byte, base64.RawStdEncoding.DecodedLen(len(line)))
+	n, err := base64.RawStdEncoding.Decode(sealed, line)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode encrypted record: %w", err)
+	}
+	return dk.Open(sealed[:n])
+}
+
+// NewHeader generates a fresh data key and returns it together with the file
+// header that stores it wrapped by mk.
+func NewHeader(mk *MasterKey) ([]byte, *DataKey, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeHeader(FlagEncrypted, mk, key), &DataKey{aead: aead}, nil
+}
+
+// IsHeader reports whether data starts with an encryption header.
+func IsHeader(data []byte) bool {
+	return len(data) >= HeaderSize && bytes.HasPrefix(data, []byte(headerMagic)) && data[HeaderSize-1] == '\n'
+}
+
+// ReadHeader returns the header at the start of r, or nil if r does not start
+// with one.
+func ReadHeader(r io.ReaderAt) ([]byte, error) {
+	header := make([]byte, HeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+	if !IsHeader(header[:n]) {
+		return nil, nil
+	}
+	return header, nil
+}
+
+// OpenHeader unwraps the data key stored in header. It returns nil for a
+// header without FlagEncrypted.
+func OpenHeader(header []byte, mk *MasterKey) (*DataKey, error) {
+	flags, key, err := decodeHeader(header, mk)
+	if err != nil {
+		return nil, err
+	}
+	if flags&FlagEncrypted == 0 {
+		return nil, nil
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{aead: aead}, nil
+}
+
+// RewrapHeader returns a header holding the same data key as header, wrapped
+// by newKey instead of oldKey. A header already wrapped by newKey is returned
+// unchanged, so an interrupted rotation can be run again.
+func RewrapHeader(header []byte, oldKey, newKey *MasterKey) ([]byte, error) {
+	flags, key, err := decodeHeader(header, newKey.WithPrevious(oldKey))
+	if err != nil {
+		return nil, err
+	}
+	if id, _ := headerKeyID(header); id == newKey.id {
+		return header, nil
+	}
+	return encodeHeader(flags, newKey, key), nil
+}
+
+// RewrapFile rewrites the header of the file at path in place so that its data
+// key is wrapped by newKey; the data that follows is never rewritten. The new
+// header is first written to a journal next to the file, which RecoverRewrap
+// replays if the rewrite is interrupted. It reports false for files without a
+// header or already wrapped by newKey.
+func RewrapFile(path string, oldKey, newKey *MasterKey) (bool, error) {
+	if err := RecoverRewrap(path); err != nil {
+		return false, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	header, err := ReadHeader(file)
+	if err != nil || header == nil {
+		return false, err
+	}
+	rewrapped, err := RewrapHeader(header, oldKey, newKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to rewrap %s: %w", path, err)
+	}
+	if bytes.Equal(rewrapped, header) {
+		return false, nil
+	}
+
+	journalPath := path + rewrapJournalExt
+	if err := writeJournal(journalPath, rewrapped); err != nil {
+		os.Remove(journalPath)
+		return false, err
+	}
+	// From here on the journal is left in place on failure, to be replayed
+	if err := writeHeader(file, rewrapped); err != nil {
+		return false, err
+	}
+	if err := removeJournal(journalPath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RecoverRewrap completes a header rewrite of the file at path that was
+// interrupted, using the journal written by RewrapFile. A journal that was not
+// completely written is discarded, as the header was not touched yet then.
+func RecoverRewrap(path string) error {
+	journalPath := path + rewrapJournalExt
+	header, err := os.ReadFile(journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %w", journalPath, err)
+	}
+
+	if len(header) == HeaderSize && IsHeader(header) {
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		err = writeHeader(file, header)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return removeJournal(journalPath)
+}
+
+// writeJournal writes the new header of a file to path and makes it durable.
+func writeJournal(path string, header []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(header); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	return SyncDir(filepath.Dir(path))
+}
+
+// writeHeader overwrites the header at the start of file and syncs it. The
+// modification time is kept, as retention windows are based on it.
+func writeHeader(file *os.File, header []byte) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", file.Name(), err)
+	}
+	if _, err := file.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("failed to write header of %s: %w", file.Name(), err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", file.Name(), err)
+	}
+	if err := os.Chtimes(file.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("failed to preserve modification time of %s: %w", file.Name(), err)
+	}
+	return nil
+}
+
+func removeJournal(path string) error {
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return SyncDir(filepath.Dir(path))
+}
+
+// SyncDir makes the creation, rename or removal of a file in dir durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", dir, err)
+	}
+	return nil
+}
+
+func encodeHeader(flags byte, mk *MasterKey, key []byte) []byte {
+	raw := make([]byte, 0, rawHeaderSize)
+	raw = append(raw, headerVersion, flags)
+	raw = append(raw, mk.id[:]...)
+	raw = append(raw, seal(mk.aead, key)...)
+
+	header := make([]byte, HeaderSize)
+	copy(header, headerMagic)
+	base64.StdEncoding.Encode(header[len(headerMagic):], raw)
+	header[HeaderSize-1] = '\n'
+	return header
+}
+
+func decodeHeader(header []byte, mk *MasterKey) (byte, []byte, error) {
+	raw, err := rawHeader(header)
+	if err != nil {
+		return 0, nil, err
+	}
+	if mk == nil {
+		return 0, nil, ErrNoMasterKey
+	}
+	var id [keyIDSize]byte
+	copy(id[:], raw[2:2+keyIDSize])
+	wrapping := mk
+	for wrapping != nil && wrapping.id != id {
+		wrapping = wrapping.previous
+	}
+	if wrapping == nil {
+		return 0, nil, fmt.Errorf("%w: expected key %s, got %x", ErrKeyMismatch, mk.ID(), id)
+	}
+
+	key, err := open(wrapping.aead, raw[2+keyIDSize:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return raw[1], key, nil
+}
+
+// headerKeyID returns the id of the master key that wraps the data key in
+// header.
+func headerKeyID(header []byte) ([keyIDSize]byte, error) {
+	var id [keyIDSize]byte
+	raw, err := rawHeader(header)
+	if err != nil {
+		return id, err
+	}
+	copy(id[:], raw[2:2+keyIDSize])
+	return id, nil
+}
+
+// rawHeader decodes header into
+// [version (1 byte)][flags (1 byte)][master key id (8 bytes)][wrapped data key].
+func rawHeader(header []byte) ([]byte, error) {
+	if !IsHeader(header) {
+		return nil, errors.New("invalid encryption header")
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(header[len(headerMagic) : HeaderSize-1]))
+	if err != nil || len(raw) != rawHeaderSize {
+		return nil, errors.New("invalid encryption header")
+	}
+	if raw[0] != headerVersion {
+		return nil, fmt.Errorf("unsupported encryption header version %d", raw[0])
+	}
+	return raw, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return aead, nil
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		// crypto/rand only fails if the operating system's entropy source is broken
+		panic(fmt.Sprintf("failed to generate nonce: %v", err))
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil)
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
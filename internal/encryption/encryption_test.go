@@ -0,0 +1,133 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMasterKey(t *testing.T) *MasterKey {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err, "Failed to generate key")
+	mk, err := NewMasterKey(key)
+	require.NoError(t, err, "Failed to create master key")
+	return mk
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{0x42}, keySize)
+
+	rawPath := filepath.Join(dir, "raw.key")
+	require.NoError(t, os.WriteFile(rawPath, key, 0600))
+	hexPath := filepath.Join(dir, "hex.key")
+	require.NoError(t, os.WriteFile(hexPath, []byte(hex.EncodeToString(key)+"\n"), 0600))
+
+	raw, err := LoadMasterKey(rawPath)
+	require.NoError(t, err, "Failed to load raw key")
+	fromHex, err := LoadMasterKey(hexPath)
+	require.NoError(t, err, "Failed to load hex key")
+	assert.Equal(t, raw.ID(), fromHex.ID(), "Raw and hex encoded keys should be identical")
+
+	shortPath := filepath.Join(dir, "short.key")
+	require.NoError(t, os.WriteFile(shortPath, []byte("too short"), 0600))
+	_, err = LoadMasterKey(shortPath)
+	assert.Error(t, err, "Expected error for a key of the wrong size")
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	mk := newTestMasterKey(t)
+
+	header, dk, err := NewHeader(mk)
+	require.NoError(t, err, "Failed to create header")
+	assert.Len(t, header, HeaderSize, "Unexpected header size")
+	assert.True(t, IsHeader(header), "Header should be recognised")
+	assert.Equal(t, -1, bytes.IndexByte(header[:HeaderSize-1], '\n'), "Header must be a single line")
+
+	line := dk.SealLine([]byte(`{"op":"SET","key":"k","value":"v"}`))
+	assert.Equal(t, -1, bytes.IndexByte(line, '\n'), "Sealed line must not contain a newline")
+
+	opened, err := OpenHeader(header, mk)
+	require.NoError(t, err, "Failed to open header")
+	plaintext, err := opened.OpenLine(line)
+	require.NoError(t, err, "Failed to open line")
+	assert.Equal(t, `{"op":"SET","key":"k","value":"v"}`, string(plaintext))
+
+	_, err = OpenHeader(header, newTestMasterKey(t))
+	assert.True(t, errors.Is(err, ErrKeyMismatch), "Expected ErrKeyMismatch, got %v", err)
+	_, err = OpenHeader(header, nil)
+	assert.True(t, errors.Is(err, ErrNoMasterKey), "Expected ErrNoMasterKey, got %v", err)
+}
+
+func TestRewrapFile(t *testing.T) {
+	oldKey := newTestMasterKey(t)
+	newKey := newTestMasterKey(t)
+
+	header, dk, err := NewHeader(oldKey)
+	require.NoError(t, err, "Failed to create header")
+	record := dk.SealLine([]byte("secret"))
+
+	path := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.WriteFile(path, append(append(header, record...), '\n'), 0644))
+
+	rewrapped, err := RewrapFile(path, oldKey, newKey)
+	require.NoError(t, err, "Failed to rewrap file")
+	assert.True(t, rewrapped, "Expected file to be rewrapped")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, record, data[HeaderSize:len(data)-1], "Data must not be rewritten")
+
+	opened, err := OpenHeader(data[:HeaderSize], newKey)
+	require.NoError(t, err, "Failed to open rewrapped header with the new key")
+	plaintext, err := opened.OpenLine(record)
+	require.NoError(t, err, "Failed to decrypt with the rewrapped data key")
+	assert.Equal(t, "secret", string(plaintext))
+
+	rewrapped, err = RewrapFile(path, oldKey, newKey)
+	require.NoError(t, err, "Rewrapping a rotated file again should succeed")
+	assert.False(t, rewrapped, "Files already wrapped by the new key are skipped")
+	assert.NoFileExists(t, path+rewrapJournalExt, "Expected no leftover journal")
+
+	_, err = OpenHeader(header, newKey)
+	assert.ErrorIs(t, err, ErrKeyMismatch, "The new key alone cannot read files not rotated yet")
+	_, err = OpenHeader(header, newKey.WithPrevious(oldKey))
+	assert.NoError(t, err, "Expected the previous key to be accepted for reading")
+
+	// A crash after the journal was written is completed when the file is
+	// next opened
+	header, _, err = NewHeader(oldKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, append(append(header, record...), '\n'), 0644))
+	journal, err := RewrapHeader(header, oldKey, newKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path+rewrapJournalExt, journal, 0600))
+	require.NoError(t, RecoverRewrap(path), "Failed to replay journal")
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, journal, data[:HeaderSize], "Expected the journaled header to be written")
+	assert.Equal(t, record, data[HeaderSize:len(data)-1], "Data must not be rewritten")
+	assert.NoFileExists(t, path+rewrapJournalExt, "Expected the journal to be removed")
+
+	// A journal that was not completely written is discarded
+	require.NoError(t, os.WriteFile(path+rewrapJournalExt, journal[:10], 0600))
+	require.NoError(t, RecoverRewrap(path))
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, journal, data[:HeaderSize], "Expected a torn journal to leave the header alone")
+	assert.NoFileExists(t, path+rewrapJournalExt)
+
+	plainPath := filepath.Join(t.TempDir(), "plain")
+	require.NoError(t, os.WriteFile(plainPath, []byte("plaintext\n"), 0644))
+	rewrapped, err = RewrapFile(plainPath, oldKey, newKey)
+	require.NoError(t, err)
+	assert.False(t, rewrapped, "Plaintext files have no header to rewrap")
+}
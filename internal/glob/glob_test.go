@@ -0,0 +1,39 @@
+package glob
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "anything/at:all", true},
+		{"tenant-a:*", "tenant-a:users/1", true},
+		{"tenant-a:*", "tenant-b:users", false},
+		{"tenant-a:*", "tenant-a", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello world", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*:*:end", "a:b:c:end", true},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, Match(test.pattern, test.s), "Match(%q, %q)", test.pattern, test.s)
+	}
+}
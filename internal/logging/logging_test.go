@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "warn", "json")
+	require.NoError(t, err, "Failed to create logger")
+
+	logger.Info("ignored")
+	logger.Warn("slow disk", "path", "/tmp/wal")
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record), "Expected a single JSON record, got %s", buf.String())
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "slow disk", record["msg"])
+	assert.Equal(t, "/tmp/wal", record["path"])
+
+	buf.Reset()
+	logger, err = New(&buf, "DEBUG", "text")
+	require.NoError(t, err, "Levels should be case insensitive")
+	logger.Debug("hello", "n", 1)
+	assert.Contains(t, buf.String(), "level=DEBUG msg=hello n=1")
+
+	_, err = New(&buf, "loud", "text")
+	assert.Error(t, err, "Expected an unknown level to be rejected")
+	_, err = New(&buf, "info", "xml")
+	assert.Error(t, err, "Expected an unknown format to be rejected")
+}
@@ -2,32 +2,117 @@ package lsm
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/encryption"
 )
 
 type LSM struct {
 	memtable *Memtable
 	config   *config.Config
 
-	// keep track of SSTables
+	// masterKey is set when SSTables must be encrypted at rest
+	masterKey *encryption.MasterKey
+
+	// keep track of SSTables, mu guards sstables, sstCounter and masterKey
+	// against the background scrubber, and the memtable swap against Stats.
+	// sstCounter is only changed by flushes, which may read it unlocked.
+	mu         sync.RWMutex
 	sstables   []*SSTable
 	sstCounter int
+	lastFlush  time.Time
+}
+
+// Stats describes the memtable and the SSTables on disk.
+type Stats struct {
+	MemtableBytes int
+
+	// TablesPerLevel holds the number of SSTables on each level and
+	// TableBytes their total size
+	TablesPerLevel []int
+	TableBytes     int64
+
+	// PendingCompactionBytes is the size of the tables waiting to be merged
+	// into a lower level. SSTables are not compacted yet, so it is always 0.
+	PendingCompactionBytes int64
+
+	// LastFlush is when the memtable was last written to an SSTable, zero if
+	// it has not been flushed since the LSM was opened
+	LastFlush time.Time
 }
 
 func NewLSM(cfg *config.Config) (*LSM, error) {
+	var masterKey *encryption.MasterKey
+	if cfg.EncryptionKeyFile != "" {
+		var err error
+		if masterKey, err = encryption.LoadMasterKeys(cfg.EncryptionKeyFile, cfg.PreviousEncryptionKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Continue numbering after tables flushed by a previous run so they are
+	// not overwritten
+	tables, err := tableFiles(cfg.SSTDir)
+	if err != nil {
+		return nil, err
+	}
+	sstCounter := 0
+	sstables := make([]*SSTable, 0, len(tables))
+	for _, table := range tables {
+		sstCounter = table.id + 1
+		// Tables that cannot be opened are left to the scrubber
+		if sst, err := OpenSSTable(table.path, masterKey); err == nil {
+			sstables = append(sstables, sst)
+		}
+	}
+	// SSTables are not compacted yet, so every table is on level 0
+	sstablesMetric.With("0").Set(float64(len(tables)))
+	memtableBytesMetric.Set(0)
+
 	return &LSM{
 		memtable:   NewMemtable(),
 		config:     cfg,
-		sstables:   make([]*SSTable, 0),
-		sstCounter: 0,
+		masterKey:  masterKey,
+		sstables:   sstables,
+		sstCounter: sstCounter,
 	}, nil
 }
 
+// tableFile is an SSTable found in the SST directory.
+type tableFile struct {
+	path string
+	id   int
+}
+
+// tableFiles lists the SSTables in dir ordered by id.
+func tableFiles(dir string) ([]tableFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "sst_*.db"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list SST files: %v", err)
+	}
+	tables := make([]tableFile, 0, len(paths))
+	for _, path := range paths {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(path), "sst_%d.db", &id); err == nil {
+			tables = append(tables, tableFile{path: path, id: id})
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].id < tables[j].id
+	})
+	return tables, nil
+}
+
 func (l *LSM) Set(key, value string) error {
 
 	// insert into Memtable
 	l.memtable.Set(key, value)
+	memtableBytesMetric.Set(float64(l.memtable.Size()))
 
 	// Check if Memtable needs to be flushed (we'll implement this later)
 	//TODO implement the concept of 2 active memtables
@@ -41,8 +126,27 @@ func (l *LSM) Set(key, value string) error {
 	return nil
 }
 
+// Flush writes the memtable to a new SSTable unless it is empty.
+func (l *LSM) Flush() error {
+	if l.memtable.Size() == 0 {
+		return nil
+	}
+	return l.flushMemtable()
+}
+
 func (l *LSM) flushMemtable() error {
-	ssTable, err := NewSSTable(l.config, l.sstCounter)
+	start := time.Now()
+	l.mu.RLock()
+	masterKey := l.masterKey
+	l.mu.RUnlock()
+
+	var ssTable *SSTable
+	var err error
+	if masterKey != nil {
+		ssTable, err = NewEncryptedSSTable(l.config, l.sstCounter, masterKey)
+	} else {
+		ssTable, err = NewSSTable(l.config, l.sstCounter)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create new SSTable: %v", err)
 	}
@@ -57,14 +161,68 @@ func (l *LSM) flushMemtable() error {
 	if err != nil {
 		return err
 	}
+	if err := ssTable.finish(); err != nil {
+		return fmt.Errorf("failed to write entry to SST: %v", err)
+	}
 
-	// Add the new SST to the list of SSTables
+	// Add the new SST to the list of SSTables and create a new memtable. The
+	// scrubber skips tables numbered from sstCounter, which are being written.
+	l.mu.Lock()
 	l.sstables = append(l.sstables, ssTable)
+	l.memtable = NewMemtable()
+	l.lastFlush = time.Now()
 	l.sstCounter++
+	l.mu.Unlock()
 
-	// Create a new memtable
-	l.memtable = NewMemtable()
+	memtableBytesMetric.Set(0)
+	flushesMetric.Inc()
+	flushDurationMetric.ObserveDuration(start)
+	sstablesMetric.With("0").Inc()
+	return nil
+}
+
+// Stats returns the current memtable size and the SSTables on disk, including
+// tables flushed by previous runs.
+func (l *LSM) Stats() (Stats, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	paths, err := filepath.Glob(filepath.Join(l.config.SSTDir, "sst_*.db"))
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to list SST files: %v", err)
+	}
+	stats := Stats{
+		MemtableBytes: l.memtable.Size(),
+		// SSTables are not compacted yet, so every table is on level 0
+		TablesPerLevel: []int{len(paths)},
+		LastFlush:      l.lastFlush,
+	}
+	for _, path := range paths {
+		// Tables can be removed by a concurrent restore, skip them
+		if info, err := os.Stat(path); err == nil {
+			stats.TableBytes += info.Size()
+		}
+	}
+	return stats, nil
+}
+
+// RotateMasterKey re-wraps the data key of every encrypted SSTable in the SST
+// directory with newKey. Only table headers are rewritten, in place.
+func (l *LSM) RotateMasterKey(newKey *encryption.MasterKey) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(l.config.SSTDir, "sst_*.db"))
+	if err != nil {
+		return fmt.Errorf("failed to list SST files: %v", err)
+	}
+	for _, path := range paths {
+		if _, err := encryption.RewrapFile(path, l.masterKey, newKey); err != nil {
+			return err
+		}
+	}
 
+	l.masterKey = newKey
 	return nil
 }
 
@@ -53,3 +53,43 @@ func TestLSMIterate(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 2, count)
 }
+
+func TestLSMFlush(t *testing.T) {
+	cfg := &config.Config{MemtableSize: 1024, SSTDir: t.TempDir()}
+	lsm, err := NewLSM(cfg)
+	assert.NoError(t, err)
+
+	assert.NoError(t, lsm.Flush(), "Flushing an empty memtable should be a no-op")
+	assert.Empty(t, lsm.sstables, "An empty memtable should not be written")
+
+	assert.NoError(t, lsm.Set("key1", "value1"))
+	assert.NoError(t, lsm.Flush())
+	assert.Equal(t, 1, len(lsm.sstables))
+	assert.Equal(t, 0, lsm.memtable.Size(), "Expected a fresh memtable after flushing")
+
+	// A new LSM must not overwrite tables flushed by the previous one
+	lsm, err = NewLSM(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, lsm.sstCounter, "Expected numbering to continue after existing tables")
+}
+
+func TestLSMStats(t *testing.T) {
+	cfg := &config.Config{MemtableSize: 1024, SSTDir: t.TempDir()}
+	lsm, err := NewLSM(cfg)
+	assert.NoError(t, err)
+
+	assert.NoError(t, lsm.Set("key1", "value1"))
+	stats, err := lsm.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.MemtableBytes, "Expected the size of the key and value")
+	assert.Equal(t, []int{0}, stats.TablesPerLevel)
+	assert.True(t, stats.LastFlush.IsZero(), "Expected no flush yet")
+
+	assert.NoError(t, lsm.Flush())
+	stats, err = lsm.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.MemtableBytes)
+	assert.Equal(t, []int{1}, stats.TablesPerLevel)
+	assert.Positive(t, stats.TableBytes)
+	assert.False(t, stats.LastFlush.IsZero(), "Expected the flush to be recorded")
+}
@@ -0,0 +1,10 @@
+package lsm
+
+import "github.com/joobisb/vitadb/internal/metrics"
+
+var (
+	memtableBytesMetric = metrics.NewGauge("vitadb_memtable_bytes", "Size of the keys and values in the memtable.")
+	flushesMetric       = metrics.NewCounter("vitadb_memtable_flushes_total", "Memtables flushed to SSTables.")
+	flushDurationMetric = metrics.NewHistogram("vitadb_memtable_flush_duration_seconds", "Time taken to flush a memtable to an SSTable.", metrics.DurationBuckets)
+	sstablesMetric      = metrics.NewGaugeVec("vitadb_sstables", "SSTables on disk per level.", "level")
+)
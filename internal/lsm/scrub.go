@@ -0,0 +1,103 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SSTScrubResult describes an SSTable that could not be read completely.
+type SSTScrubResult struct {
+	Path    string
+	Problem string
+
+	// Salvaged is the number of entries read before the corruption, which are
+	// written to a rebuilt table at the original path
+	Salvaged int
+
+	// LostPath is where the damaged table was moved
+	LostPath string
+}
+
+// Scrub reads every SSTable in the SST directory in full, including tables
+// flushed by previous runs. Tables that fail to read are moved to lostDir and
+// rebuilt from the entries that could still be read.
+func (l *LSM) Scrub(lostDir string) ([]SSTScrubResult, error) {
+	l.mu.RLock()
+	files, err := tableFiles(l.config.SSTDir)
+	sstCounter := l.sstCounter
+	masterKey := l.masterKey
+	l.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SSTScrubResult
+	for _, file := range files {
+		// Tables from sstCounter on are still being flushed
+		if file.id >= sstCounter {
+			continue
+		}
+		type entry struct{ key, value string }
+		var entries []entry
+
+		opened, err := OpenSSTable(file.path, masterKey)
+		if err == nil {
+			err = opened.Iterate(func(key, value string) error {
+				entries = append(entries, entry{key, value})
+				return nil
+			})
+		}
+		if err == nil {
+			continue
+		}
+
+		result := SSTScrubResult{Path: file.path, Problem: err.Error(), Salvaged: len(entries)}
+
+		tmpPath := file.path + ".rebuilt"
+		rebuilt, err := createSSTable(tmpPath, masterKey)
+		if err != nil {
+			return results, err
+		}
+		for _, e := range entries {
+			if err := rebuilt.writeEntry(e.key, e.value); err != nil {
+				return results, err
+			}
+		}
+		if err := rebuilt.finish(); err != nil {
+			return results, err
+		}
+
+		if err := os.MkdirAll(lostDir, 0755); err != nil {
+			return results, fmt.Errorf("failed to create lost directory: %v", err)
+		}
+		result.LostPath = filepath.Join(lostDir, fmt.Sprintf("%s.%s", filepath.Base(file.path), time.Now().UTC().Format("20060102T150405.000000000")))
+		if err := os.Rename(file.path, result.LostPath); err != nil {
+			return results, fmt.Errorf("failed to move %s to lost directory: %v", file.path, err)
+		}
+		if err := os.Rename(tmpPath, file.path); err != nil {
+			return results, fmt.Errorf("failed to replace %s: %v", file.path, err)
+		}
+		if opened, err := OpenSSTable(file.path, masterKey); err == nil {
+			l.replaceTable(opened)
+		}
+
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// replaceTable makes sst the table kept for its path, which has a new data key
+// once it was rebuilt.
+func (l *LSM) replaceTable(sst *SSTable) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, table := range l.sstables {
+		if table.path == sst.path {
+			l.sstables[i] = sst
+			return
+		}
+	}
+	l.sstables = append(l.sstables, sst)
+}
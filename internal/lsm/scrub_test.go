@@ -0,0 +1,44 @@
+package lsm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrubTablesFromPreviousRun(t *testing.T) {
+	cfg := &config.Config{MemtableSize: 1024, SSTDir: t.TempDir()}
+	l, err := NewLSM(cfg)
+	require.NoError(t, err)
+	require.NoError(t, l.Set("key1", "value1"))
+	require.NoError(t, l.Set("key2", "value2"))
+	require.NoError(t, l.Flush())
+
+	// Truncate the table before the next run opens it
+	path := filepath.Join(cfg.SSTDir, "sst_0.db")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, content[:len(content)-3], 0644))
+
+	l, err = NewLSM(cfg)
+	require.NoError(t, err)
+	lostDir := filepath.Join(cfg.SSTDir, "lost")
+	results, err := l.Scrub(lostDir)
+	require.NoError(t, err, "Scrub failed")
+	require.Len(t, results, 1, "Expected the table flushed by the previous run to be scrubbed")
+	assert.Equal(t, path, results[0].Path)
+	assert.FileExists(t, results[0].LostPath, "Expected the damaged table in the lost directory")
+
+	// The rebuilt table replaces the damaged one in memory and reads cleanly
+	require.Len(t, l.sstables, 1, "Expected one table entry per path")
+	assert.Equal(t, path, l.sstables[0].path)
+	assert.NoError(t, l.sstables[0].Iterate(func(key, value string) error { return nil }))
+
+	results, err = l.Scrub(lostDir)
+	require.NoError(t, err, "Scrub failed")
+	assert.Empty(t, results, "Expected the rebuilt table to be intact")
+}
@@ -1,16 +1,29 @@
 package lsm
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
 	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/encryption"
 )
 
+// Entries of encrypted SSTables are buffered until a block reaches this size
+// and each block is encrypted as a whole.
+const sstBlockSize = 4096
+
 type SSTable struct {
 	path string
+
+	// key and block are only set for encrypted tables
+	key   *encryption.DataKey
+	block []byte
 }
 
 func NewSSTable(cfg *config.Config, id int) (*SSTable, error) {
@@ -19,19 +32,85 @@ func NewSSTable(cfg *config.Config, id int) (*SSTable, error) {
 		return nil, fmt.Errorf("failed to create WAL directory: %v", err)
 	}
 
-	path := filepath.Join(cfg.SSTDir, fmt.Sprintf("sst_%d.db", id))
+	return createSSTable(filepath.Join(cfg.SSTDir, fmt.Sprintf("sst_%d.db", id)), nil)
+}
+
+// NewEncryptedSSTable creates an SSTable whose blocks are encrypted with a new
+// data key wrapped by mk.
+//
+// Encrypted SST file format:
+// [encryption header][block_size (4 bytes)][encrypted block]...
+// where every decrypted block holds entries in the plaintext SST format.
+func NewEncryptedSSTable(cfg *config.Config, id int, mk *encryption.MasterKey) (*SSTable, error) {
+	// Ensure the SST directory exists
+	if err := os.MkdirAll(cfg.SSTDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create SST directory: %v", err)
+	}
+
+	return createSSTable(filepath.Join(cfg.SSTDir, fmt.Sprintf("sst_%d.db", id)), mk)
+}
+
+// createSSTable creates an empty SSTable at path, encrypted when mk is set.
+func createSSTable(path string, mk *encryption.MasterKey) (*SSTable, error) {
 	file, err := os.Create(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SST file: %v", err)
 	}
 	defer file.Close()
 
-	return &SSTable{path: path}, nil
+	sst := &SSTable{path: path}
+	if mk == nil {
+		return sst, nil
+	}
+
+	header, key, err := encryption.NewHeader(mk)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write SST header: %v", err)
+	}
+	sst.key = key
+	return sst, nil
+}
+
+// OpenSSTable opens an existing SSTable for reading. mk may be nil when the
+// table is not encrypted.
+func OpenSSTable(path string, mk *encryption.MasterKey) (*SSTable, error) {
+	if err := encryption.RecoverRewrap(path); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SST file: %v", err)
+	}
+	defer file.Close()
+
+	header, err := encryption.ReadHeader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	sst := &SSTable{path: path}
+	if header != nil {
+		if sst.key, err = encryption.OpenHeader(header, mk); err != nil {
+			return nil, fmt.Errorf("failed to open encrypted SST file %s: %w", path, err)
+		}
+	}
+	return sst, nil
 }
 
 // SST file format:
 // [key_size (4 bytes)][key][value_size (4 bytes)][value]...
 func (sst *SSTable) writeEntry(key, value string) error {
+	if sst.key != nil {
+		sst.block = appendEntry(sst.block, key, value)
+		if len(sst.block) >= sstBlockSize {
+			return sst.flushBlock()
+		}
+		return nil
+	}
+
 	file, err := os.OpenFile(sst.path, os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open SST file: %v", err)
@@ -61,3 +140,113 @@ func (sst *SSTable) writeEntry(key, value string) error {
 
 	return nil
 }
+
+// finish writes any entries still buffered in the current block.
+func (sst *SSTable) finish() error {
+	if len(sst.block) == 0 {
+		return nil
+	}
+	return sst.flushBlock()
+}
+
+func (sst *SSTable) flushBlock() error {
+	file, err := os.OpenFile(sst.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open SST file: %v", err)
+	}
+	defer file.Close()
+
+	sealed := sst.key.Seal(sst.block)
+	if err := binary.Write(file, binary.LittleEndian, uint32(len(sealed))); err != nil {
+		return fmt.Errorf("failed to write block size: %v", err)
+	}
+	if _, err := file.Write(sealed); err != nil {
+		return fmt.Errorf("failed to write block: %v", err)
+	}
+
+	sst.block = sst.block[:0]
+	return nil
+}
+
+// Iterate calls fn for every entry of the SSTable in the order they were written.
+func (sst *SSTable) Iterate(fn func(key, value string) error) error {
+	file, err := os.Open(sst.path)
+	if err != nil {
+		return fmt.Errorf("failed to open SST file: %v", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if sst.key == nil {
+		return iterateEntries(reader, fn)
+	}
+
+	if _, err := reader.Discard(encryption.HeaderSize); err != nil {
+		return fmt.Errorf("failed to skip SST header: %v", err)
+	}
+	for {
+		var size uint32
+		if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read block size: %v", err)
+		}
+
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(reader, sealed); err != nil {
+			return fmt.Errorf("failed to read block: %v", err)
+		}
+		block, err := sst.key.Open(sealed)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt block: %w", err)
+		}
+		if err := iterateEntries(bufio.NewReader(bytes.NewReader(block)), fn); err != nil {
+			return err
+		}
+	}
+}
+
+func iterateEntries(r *bufio.Reader, fn func(key, value string) error) error {
+	for {
+		key, err := readField(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read key: %v", err)
+		}
+		value, err := readField(r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("failed to read value: %v", err)
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+}
+
+func readField(r io.Reader) (string, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return "", err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(data), nil
+}
+
+func appendEntry(buf []byte, key, value string) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+	buf = append(buf, key...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
@@ -1,11 +1,14 @@
 package lsm
 
 import (
+	"crypto/rand"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/encryption"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -52,3 +55,63 @@ func TestSSTableWriteEntry(t *testing.T) {
 
 	assert.Equal(t, expected, data)
 }
+
+func TestEncryptedSSTable(t *testing.T) {
+	tempDir := t.TempDir()
+	cfg := &config.Config{SSTDir: tempDir}
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+	mk, err := encryption.NewMasterKey(key)
+	assert.NoError(t, err)
+
+	sst, err := NewEncryptedSSTable(cfg, 1, mk)
+	assert.NoError(t, err)
+
+	// Enough entries to span several blocks
+	for i := 0; i < 500; i++ {
+		assert.NoError(t, sst.writeEntry(fmt.Sprintf("key%03d", i), "secret_value"))
+	}
+	assert.NoError(t, sst.finish())
+
+	data, err := os.ReadFile(sst.path)
+	assert.NoError(t, err)
+	assert.True(t, encryption.IsHeader(data))
+	assert.NotContains(t, string(data), "secret_value")
+
+	_, err = OpenSSTable(sst.path, nil)
+	assert.ErrorIs(t, err, encryption.ErrNoMasterKey)
+
+	opened, err := OpenSSTable(sst.path, mk)
+	assert.NoError(t, err)
+
+	count := 0
+	err = opened.Iterate(func(key, value string) error {
+		assert.Equal(t, fmt.Sprintf("key%03d", count), key)
+		assert.Equal(t, "secret_value", value)
+		count++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 500, count)
+}
+
+func TestSSTableIterate(t *testing.T) {
+	cfg := &config.Config{SSTDir: t.TempDir()}
+
+	sst, _ := NewSSTable(cfg, 1)
+	assert.NoError(t, sst.writeEntry("key1", "value1"))
+	assert.NoError(t, sst.writeEntry("key2", "value2"))
+
+	opened, err := OpenSSTable(sst.path, nil)
+	assert.NoError(t, err)
+
+	var keys []string
+	err = opened.Iterate(func(key, value string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key1", "key2"}, keys)
+}
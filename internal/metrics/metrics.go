@@ -0,0 +1,327 @@
+// Package metrics implements the counters, gauges and histograms exported on
+// the /metrics endpoint, in the Prometheus text exposition format.
+//
+// Metrics are package level variables of the packages they measure, created
+// with the New functions, which register them in Default.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DurationBuckets are the histogram buckets, in seconds, used for latencies.
+var DurationBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a family of samples sharing a name.
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds the metrics written by its handler.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Default is the registry metrics created by the New functions are added to.
+var Default = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.metrics {
+		if existing.name() == m.name() {
+			panic("metrics: duplicate metric " + m.name())
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes every metric, ordered by name.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name() < metrics[j].name()
+	})
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// desc holds the name, help and label name of a metric family.
+type desc struct {
+	metricName string
+	help       string
+	typ        string
+	label      string // empty for metrics without labels
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metricName, strings.ReplaceAll(d.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metricName, d.typ)
+}
+
+// labels formats the label set of a sample, with extra appended to the label
+// of the family.
+func (d *desc) labels(value string, extra ...string) string {
+	var pairs []string
+	if d.label != "" {
+		pairs = append(pairs, d.label+`="`+escape(value)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// atomicFloat is a float64 that can be updated concurrently.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) Add(delta float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add adds delta, which must not be negative.
+func (c *Counter) Add(delta float64) {
+	c.value.Add(delta)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	value atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.value.Set(v)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.value.Add(delta)
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	upperBounds []float64
+	buckets     []atomic.Uint64 // not cumulative, the last one is +Inf
+	count       atomic.Uint64
+	sum         atomicFloat
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{upperBounds: buckets, buckets: make([]atomic.Uint64, len(buckets)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	h.buckets[i].Add(1)
+	h.sum.Add(v)
+	h.count.Add(1)
+}
+
+// ObserveDuration observes the time elapsed since start, in seconds.
+func (h *Histogram) ObserveDuration(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// vec holds the children of a metric family by label value.
+type vec[T any] struct {
+	desc
+	mu       sync.Mutex
+	children map[string]*T
+	newChild func() *T
+}
+
+func (v *vec[T]) With(value string) *T {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	child, ok := v.children[value]
+	if !ok {
+		child = v.newChild()
+		v.children[value] = child
+	}
+	return child
+}
+
+// each calls fn for every child, ordered by label value.
+func (v *vec[T]) each(fn func(value string, child *T)) {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.children))
+	for value := range v.children {
+		values = append(values, value)
+	}
+	children := make(map[string]*T, len(v.children))
+	for value, child := range v.children {
+		children[value] = child
+	}
+	v.mu.Unlock()
+
+	sort.Strings(values)
+	for _, value := range values {
+		fn(value, children[value])
+	}
+}
+
+func newVec[T any](name, help, typ, label string, newChild func() *T) *vec[T] {
+	return &vec[T]{
+		desc:     desc{metricName: name, help: help, typ: typ, label: label},
+		children: make(map[string]*T),
+		newChild: newChild,
+	}
+}
+
+// CounterVec is a family of counters distinguished by one label.
+type CounterVec struct {
+	*vec[Counter]
+}
+
+func (v CounterVec) write(w io.Writer) {
+	v.writeHeader(w)
+	v.each(func(value string, c *Counter) {
+		fmt.Fprintf(w, "%s%s %s\n", v.metricName, v.labels(value), formatFloat(c.value.Load()))
+	})
+}
+
+// GaugeVec is a family of gauges distinguished by one label.
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+func (v GaugeVec) write(w io.Writer) {
+	v.writeHeader(w)
+	v.each(func(value string, g *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", v.metricName, v.labels(value), formatFloat(g.value.Load()))
+	})
+}
+
+// HistogramVec is a family of histograms distinguished by one label.
+type HistogramVec struct {
+	*vec[Histogram]
+}
+
+func (v HistogramVec) write(w io.Writer) {
+	v.writeHeader(w)
+	v.each(func(value string, h *Histogram) {
+		var cumulative uint64
+		for i := range h.buckets {
+			cumulative += h.buckets[i].Load()
+			le := math.Inf(1)
+			if i < len(h.upperBounds) {
+				le = h.upperBounds[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.metricName, v.labels(value, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.metricName, v.labels(value), formatFloat(h.sum.Load()))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.metricName, v.labels(value), h.count.Load())
+	})
+}
+
+// NewCounter registers a counter without labels.
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help, "").With("")
+}
+
+// NewCounterVec registers a family of counters with a label.
+func NewCounterVec(name, help, label string) CounterVec {
+	v := CounterVec{newVec(name, help, "counter", label, func() *Counter { return &Counter{} })}
+	Default.register(v)
+	return v
+}
+
+// NewGauge registers a gauge without labels.
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help, "").With("")
+}
+
+// NewGaugeVec registers a family of gauges with a label.
+func NewGaugeVec(name, help, label string) GaugeVec {
+	v := GaugeVec{newVec(name, help, "gauge", label, func() *Gauge { return &Gauge{} })}
+	Default.register(v)
+	return v
+}
+
+// NewHistogram registers a histogram without labels. buckets are the sorted
+// upper bounds of the buckets.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, "", buckets).With("")
+}
+
+// NewHistogramVec registers a family of histograms with a label.
+func NewHistogramVec(name, help, label string, buckets []float64) HistogramVec {
+	v := HistogramVec{newVec(name, help, "histogram", label, func() *Histogram { return newHistogram(buckets) })}
+	Default.register(v)
+	return v
+}
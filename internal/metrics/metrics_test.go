@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// output returns the lines Default writes for the metric called name.
+func output(name string) string {
+	var buf bytes.Buffer
+	Default.Write(&buf)
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, name) || strings.HasPrefix(line, "# HELP "+name+" ") || strings.HasPrefix(line, "# TYPE "+name+" ") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A test counter")
+	c.Inc()
+	c.Add(2.5)
+	assert.Equal(t, "# HELP test_counter_total A test counter\n# TYPE test_counter_total counter\ntest_counter_total 3.5", output("test_counter_total"))
+
+	v := NewCounterVec("test_labeled_total", "A labeled counter", "command")
+	v.With("set").Inc()
+	v.With(`we"ird`).Add(2)
+	assert.Equal(t, "# HELP test_labeled_total A labeled counter\n# TYPE test_labeled_total counter\n"+
+		"test_labeled_total{command=\"set\"} 1\ntest_labeled_total{command=\"we\\\"ird\"} 2", output("test_labeled_total"),
+		"Children should be sorted and label values escaped")
+
+	assert.Panics(t, func() { NewCounter("test_counter_total", "again") }, "Duplicate names should be rejected")
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_gauge", "A test gauge")
+	g.Set(10)
+	g.Inc()
+	g.Dec()
+	g.Add(-4)
+	assert.Equal(t, "# HELP test_gauge A test gauge\n# TYPE test_gauge gauge\ntest_gauge 6", output("test_gauge"))
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "A test histogram", "command", []float64{0.1, 1})
+	h.With("get").Observe(0.05)
+	h.With("get").Observe(0.1)
+	h.With("get").Observe(5)
+	assert.Equal(t, `# HELP test_duration_seconds A test histogram
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{command="get",le="0.1"} 2
+test_duration_seconds_bucket{command="get",le="1"} 2
+test_duration_seconds_bucket{command="get",le="+Inf"} 3
+test_duration_seconds_sum{command="get"} 5.15
+test_duration_seconds_count{command="get"} 3`, output("test_duration_seconds"), "Buckets should be cumulative")
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_handler_total", "Served by the handler").Inc()
+
+	server := httptest.NewServer(Default.Handler())
+	defer server.Close()
+	res, err := server.Client().Get(server.URL + "/metrics")
+	require.NoError(t, err, "Failed to get metrics")
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", res.Header.Get("Content-Type"), "Unexpected content type")
+	assert.Contains(t, string(body), "\ntest_handler_total 1\n", "Expected the counter to be served")
+}
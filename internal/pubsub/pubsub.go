@@ -0,0 +1,249 @@
+// Package pubsub routes messages published on channels to the subscribers of
+// the channel and of the glob patterns matching it.
+//
+// Publishing never blocks: messages are queued on each subscriber and
+// delivered by its connection. A subscriber whose queue grows past its output
+// buffer limit is dropped, so a slow client cannot hold up publishers or make
+// the server run out of memory.
+package pubsub
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/joobisb/vitadb/internal/glob"
+)
+
+// ErrOutputBufferLimit is returned by Subscriber.Messages once messages were
+// dropped because the subscriber did not keep up.
+var ErrOutputBufferLimit = errors.New("pubsub: subscriber exceeded its output buffer limit")
+
+// Message is a message delivered to a subscriber. Pattern is the pattern the
+// subscriber matched the channel with, empty for channel subscriptions.
+type Message struct {
+	Pattern string
+	Channel string
+	Payload string
+}
+
+func (m Message) size() int {
+	return len(m.Pattern) + len(m.Channel) + len(m.Payload)
+}
+
+// Broker holds the subscriptions of every subscriber.
+type Broker struct {
+	mu       sync.RWMutex
+	channels map[string]map[*Subscriber]struct{}
+	patterns map[string]map[*Subscriber]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		channels: make(map[string]map[*Subscriber]struct{}),
+		patterns: make(map[string]map[*Subscriber]struct{}),
+	}
+}
+
+// Publish queues payload for the subscribers of channel and returns how many
+// subscriptions received it. A subscriber matching the channel with several
+// subscriptions gets a message for each, like in Redis.
+func (b *Broker) Publish(channel, payload string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	n := 0
+	for sub := range b.channels[channel] {
+		sub.push(Message{Channel: channel, Payload: payload})
+		n++
+	}
+	for pattern, subs := range b.patterns {
+		if !glob.Match(pattern, channel) {
+			continue
+		}
+		for sub := range subs {
+			sub.push(Message{Pattern: pattern, Channel: channel, Payload: payload})
+			n++
+		}
+	}
+	return n
+}
+
+func (b *Broker) add(subscriptions map[string]map[*Subscriber]struct{}, name string, sub *Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs, ok := subscriptions[name]
+	if !ok {
+		subs = make(map[*Subscriber]struct{})
+		subscriptions[name] = subs
+	}
+	subs[sub] = struct{}{}
+}
+
+func (b *Broker) remove(subscriptions map[string]map[*Subscriber]struct{}, name string, sub *Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(subscriptions[name], sub)
+	if len(subscriptions[name]) == 0 {
+		delete(subscriptions, name)
+	}
+}
+
+// Subscriber is the subscriptions and the queue of pending messages of a
+// client. Subscriptions are changed by the client's connection only; messages
+// are queued by any publisher.
+type Subscriber struct {
+	broker   *Broker
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// limit is the largest size in bytes of the queued messages, no limit
+	// when 0, and dropped is called once when it is exceeded
+	limit   int
+	dropped func()
+
+	// notify has a value when queue is not empty or the limit was exceeded
+	mu         sync.Mutex
+	queue      []Message
+	queued     int
+	overflowed bool
+	closed     bool
+	notify     chan struct{}
+}
+
+// NewSubscriber returns a subscriber without subscriptions whose queue holds
+// at most limit bytes of messages. dropped, if not nil, is called by the
+// publisher that exceeds the limit, and should disconnect the client; it
+// must not block.
+func (b *Broker) NewSubscriber(limit int, dropped func()) *Subscriber {
+	return &Subscriber{
+		broker:   b,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		limit:    limit,
+		dropped:  dropped,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Subscribe subscribes to channel and returns the number of subscriptions of
+// the subscriber.
+func (s *Subscriber) Subscribe(channel string) int {
+	if _, ok := s.channels[channel]; !ok {
+		s.channels[channel] = struct{}{}
+		s.broker.add(s.broker.channels, channel, s)
+	}
+	return s.Count()
+}
+
+// Unsubscribe unsubscribes from channel and returns the number of
+// subscriptions left.
+func (s *Subscriber) Unsubscribe(channel string) int {
+	if _, ok := s.channels[channel]; ok {
+		delete(s.channels, channel)
+		s.broker.remove(s.broker.channels, channel, s)
+	}
+	return s.Count()
+}
+
+// PSubscribe subscribes to the channels matching the glob pattern and returns
+// the number of subscriptions of the subscriber.
+func (s *Subscriber) PSubscribe(pattern string) int {
+	if _, ok := s.patterns[pattern]; !ok {
+		s.patterns[pattern] = struct{}{}
+		s.broker.add(s.broker.patterns, pattern, s)
+	}
+	return s.Count()
+}
+
+// PUnsubscribe removes a pattern subscription and returns the number of
+// subscriptions left.
+func (s *Subscriber) PUnsubscribe(pattern string) int {
+	if _, ok := s.patterns[pattern]; ok {
+		delete(s.patterns, pattern)
+		s.broker.remove(s.broker.patterns, pattern, s)
+	}
+	return s.Count()
+}
+
+// Channels returns the channels the subscriber is subscribed to.
+func (s *Subscriber) Channels() []string {
+	return setKeys(s.channels)
+}
+
+// Patterns returns the patterns the subscriber is subscribed to.
+func (s *Subscriber) Patterns() []string {
+	return setKeys(s.patterns)
+}
+
+// Count returns the number of channel and pattern subscriptions.
+func (s *Subscriber) Count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// Notify returns a channel that receives a value when messages are queued or
+// the output buffer limit is exceeded.
+func (s *Subscriber) Notify() <-chan struct{} {
+	return s.notify
+}
+
+// Messages removes and returns the queued messages, or ErrOutputBufferLimit
+// if messages were dropped.
+func (s *Subscriber) Messages() ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.overflowed {
+		return nil, ErrOutputBufferLimit
+	}
+	messages := s.queue
+	s.queue = nil
+	s.queued = 0
+	return messages, nil
+}
+
+// Close removes every subscription and stops queueing messages.
+func (s *Subscriber) Close() {
+	for channel := range s.channels {
+		s.Unsubscribe(channel)
+	}
+	for pattern := range s.patterns {
+		s.PUnsubscribe(pattern)
+	}
+	s.mu.Lock()
+	s.closed = true
+	s.queue = nil
+	s.mu.Unlock()
+}
+
+func (s *Subscriber) push(m Message) {
+	s.mu.Lock()
+	if s.closed || s.overflowed {
+		s.mu.Unlock()
+		return
+	}
+	overflowed := s.limit > 0 && s.queued+m.size() > s.limit
+	if overflowed {
+		// The client is dropped rather than skipping messages silently
+		s.overflowed = true
+		s.queue = nil
+	} else {
+		s.queue = append(s.queue, m)
+		s.queued += m.size()
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	s.mu.Unlock()
+
+	if overflowed && s.dropped != nil {
+		s.dropped()
+	}
+}
+
+func setKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	return keys
+}
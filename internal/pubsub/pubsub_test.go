@@ -0,0 +1,73 @@
+package pubsub
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	b := NewBroker()
+	news := b.NewSubscriber(0, nil)
+	assert.Equal(t, 1, news.Subscribe("news"))
+	assert.Equal(t, 1, news.Subscribe("news"), "Subscribing twice should not add a subscription")
+	all := b.NewSubscriber(0, nil)
+	assert.Equal(t, 1, all.PSubscribe("n*"))
+	assert.Equal(t, 2, all.Subscribe("news"))
+
+	assert.Equal(t, 3, b.Publish("news", "hello"), "Expected one message per matching subscription")
+	assert.Equal(t, 1, b.Publish("nope", "x"))
+	assert.Equal(t, 0, b.Publish("other", "x"))
+
+	select {
+	case <-news.Notify():
+	default:
+		t.Fatal("Expected the subscriber to be notified")
+	}
+	messages, err := news.Messages()
+	require.NoError(t, err)
+	assert.Equal(t, []Message{{Channel: "news", Payload: "hello"}}, messages)
+
+	messages, err = all.Messages()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []Message{
+		{Channel: "news", Payload: "hello"},
+		{Pattern: "n*", Channel: "news", Payload: "hello"},
+		{Pattern: "n*", Channel: "nope", Payload: "x"},
+	}, messages)
+
+	channels := all.Channels()
+	sort.Strings(channels)
+	assert.Equal(t, []string{"news"}, channels)
+	assert.Equal(t, []string{"n*"}, all.Patterns())
+
+	assert.Equal(t, 1, all.Unsubscribe("news"))
+	assert.Equal(t, 0, all.PUnsubscribe("n*"))
+	news.Close()
+	assert.Equal(t, 0, b.Publish("news", "bye"), "Expected no subscribers left")
+	assert.Empty(t, b.channels, "Expected empty channels to be removed")
+	assert.Empty(t, b.patterns, "Expected empty patterns to be removed")
+}
+
+func TestOutputBufferLimit(t *testing.T) {
+	b := NewBroker()
+	dropped := 0
+	sub := b.NewSubscriber(10, func() { dropped++ })
+	sub.Subscribe("c")
+
+	b.Publish("c", "12345678")
+	messages, err := sub.Messages()
+	require.NoError(t, err)
+	assert.Len(t, messages, 1, "Expected a message within the limit")
+
+	b.Publish("c", "1234")
+	b.Publish("c", "12345")
+	_, err = sub.Messages()
+	assert.ErrorIs(t, err, ErrOutputBufferLimit, "Expected the subscriber to be dropped past its limit")
+	b.Publish("c", "1")
+	_, err = sub.Messages()
+	assert.ErrorIs(t, err, ErrOutputBufferLimit, "Dropped subscribers should stay dropped")
+	assert.Equal(t, 1, dropped, "Expected the dropped callback to run once")
+}
@@ -0,0 +1,232 @@
+package repair
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/lsm"
+	"github.com/joobisb/vitadb/internal/seglog"
+	"github.com/joobisb/vitadb/internal/wal"
+)
+
+const (
+	defaultInterval = time.Hour
+	lostDirName     = "lost"
+
+	// maxFindings bounds the number of findings kept for the status command
+	maxFindings = 100
+)
+
+// Finding is a problem found by the scrubber and the action taken to fix it.
+type Finding struct {
+	Time    time.Time
+	Path    string
+	Problem string
+	Action  string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s (%s)", f.Path, f.Problem, f.Action)
+}
+
+// Status summarizes the scrubber activity.
+type Status struct {
+	Enabled      bool
+	Runs         int
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    string
+	Findings     []Finding // oldest first
+}
+
+// String formats the status on a single line, as returned by the status command.
+func (s Status) String() string {
+	if !s.Enabled {
+		return "enabled=false"
+	}
+
+	parts := []string{"enabled=true", fmt.Sprintf("runs=%d", s.Runs)}
+	if !s.LastRun.IsZero() {
+		parts = append(parts,
+			"last_run="+s.LastRun.UTC().Format(time.RFC3339),
+			"last_duration="+s.LastDuration.String())
+	}
+	if s.LastError != "" {
+		parts = append(parts, fmt.Sprintf("last_error=%q", s.LastError))
+	}
+	parts = append(parts, fmt.Sprintf("findings=%d", len(s.Findings)))
+	if len(s.Findings) > 0 {
+		parts = append(parts, fmt.Sprintf("last_finding=%q", s.Findings[len(s.Findings)-1].String()))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Scrubber periodically verifies WAL segments and SSTables in the background,
+// moves corrupted files to a lost/ directory and rebuilds what it can.
+type Scrubber struct {
+	wal        *wal.WAL
+	lsm        *lsm.LSM
+	walLostDir string
+	sstLostDir string
+	interval   time.Duration
+
+	// runMu serializes scrub runs, mu guards status
+	runMu  sync.Mutex
+	mu     sync.Mutex
+	status Status
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewScrubber(cfg *config.Config, w *wal.WAL, l *lsm.LSM) *Scrubber {
+	interval := cfg.RepairInterval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	return &Scrubber{
+		wal:        w,
+		lsm:        l,
+		walLostDir: filepath.Join(cfg.WALDir, lostDirName),
+		sstLostDir: filepath.Join(cfg.SSTDir, lostDirName),
+		interval:   interval,
+		status:     Status{Enabled: true},
+	}
+}
+
+// Start runs the scrubber in a background goroutine, once right away and then
+// every interval, until Stop is called. It does nothing if the scrubber is
+// already running.
+func (s *Scrubber) Start() {
+	s.start(true)
+}
+
+// StartDeferred is like Start but waits a full interval before the first run.
+// It is used after a clean shutdown, when the files are known to be intact.
+func (s *Scrubber) StartDeferred() {
+	s.start(false)
+}
+
+func (s *Scrubber) start(runNow bool) {
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			if runNow {
+				if err := s.RunOnce(); err != nil {
+					slog.Error("Scrubber run failed", "err", err)
+				}
+			}
+			runNow = true
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background goroutine and waits for a running scrub to finish.
+func (s *Scrubber) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+// RunOnce scrubs all WAL segments and SSTables and records the findings.
+func (s *Scrubber) RunOnce() error {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	start := time.Now()
+	var findings []Finding
+
+	walResults, err := s.wal.Scrub(s.walLostDir)
+	for _, r := range walResults {
+		findings = append(findings, walFinding(start, r))
+	}
+	if err == nil {
+		var sstResults []lsm.SSTScrubResult
+		sstResults, err = s.lsm.Scrub(s.sstLostDir)
+		for _, r := range sstResults {
+			findings = append(findings, Finding{
+				Time:    start,
+				Path:    r.Path,
+				Problem: r.Problem,
+				Action:  fmt.Sprintf("moved to %s, rebuilt with %d salvaged entries", r.LostPath, r.Salvaged),
+			})
+		}
+	}
+
+	for _, f := range findings {
+		slog.Warn("Scrubber found a problem", "path", f.Path, "problem", f.Problem, "action", f.Action)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Runs++
+	s.status.LastRun = start
+	s.status.LastDuration = time.Since(start)
+	s.status.LastError = ""
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+	s.status.Findings = append(s.status.Findings, findings...)
+	if len(s.status.Findings) > maxFindings {
+		s.status.Findings = s.status.Findings[len(s.status.Findings)-maxFindings:]
+	}
+	return err
+}
+
+// Status returns a snapshot of the scrubber activity.
+func (s *Scrubber) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.status
+	status.Findings = append([]Finding(nil), s.status.Findings...)
+	return status
+}
+
+func walFinding(t time.Time, r seglog.ScrubResult) Finding {
+	f := Finding{Time: t, Path: r.Path}
+	if r.CorruptEntries > 0 {
+		f.Problem = fmt.Sprintf("%d corrupt records", r.CorruptEntries)
+	} else {
+		f.Problem = "index does not match segment"
+	}
+
+	var actions []string
+	if r.IndexRebuilt {
+		actions = append(actions, "rebuilt index")
+	}
+	if r.LostPath != "" {
+		actions = append(actions, "copied to "+r.LostPath)
+	}
+	if r.CorruptEntries > 0 {
+		if r.Repaired {
+			actions = append(actions, "dropped corrupt records")
+		} else {
+			actions = append(actions, "records in the active segment left in place")
+		}
+	}
+	f.Action = strings.Join(actions, ", ")
+	return f
+}
@@ -0,0 +1,86 @@
+package repair
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/lsm"
+	"github.com/joobisb/vitadb/internal/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrubber(t *testing.T) {
+	cfg := &config.Config{
+		WALDir:           t.TempDir(),
+		SSTDir:           t.TempDir(),
+		UseSegmentedLogs: true,
+		SegmentSize:      2,
+		MemtableSize:     20,
+	}
+
+	w, err := wal.NewWAL(cfg)
+	require.NoError(t, err, "Failed to create WAL")
+	defer w.Close()
+	l, err := lsm.NewLSM(cfg)
+	require.NoError(t, err, "Failed to create LSM")
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		require.NoError(t, w.AppendSet(key, "value"))
+		require.NoError(t, l.Set(key, "a_value_long_enough_to_flush"))
+	}
+
+	scrubber := NewScrubber(cfg, w, l)
+	require.NoError(t, scrubber.RunOnce(), "Scrub of healthy files failed")
+	status := scrubber.Status()
+	assert.True(t, status.Enabled)
+	assert.Equal(t, 1, status.Runs)
+	assert.Empty(t, status.Findings, "Expected no findings for healthy files")
+
+	// Corrupt a closed WAL segment and truncate an SSTable
+	segment := filepath.Join(cfg.WALDir, "log-0.seg")
+	content, err := os.ReadFile(segment)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(segment, []byte(strings.Replace(string(content), `"op":"SET"`, `"op":"???"`, 1)), 0644))
+
+	sst := filepath.Join(cfg.SSTDir, "sst_0.db")
+	content, err = os.ReadFile(sst)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(sst, content[:len(content)-3], 0644))
+
+	require.NoError(t, scrubber.RunOnce(), "Scrub of corrupt files failed")
+	status = scrubber.Status()
+	assert.Equal(t, 2, status.Runs)
+	require.Len(t, status.Findings, 2, "Expected one finding per corrupt file")
+	assert.Equal(t, segment, status.Findings[0].Path)
+	assert.Equal(t, sst, status.Findings[1].Path)
+
+	lost, err := filepath.Glob(filepath.Join(cfg.WALDir, "lost", "log-0.seg.*"))
+	require.NoError(t, err)
+	assert.Len(t, lost, 1, "Expected the damaged segment in the WAL lost directory")
+	lost, err = filepath.Glob(filepath.Join(cfg.SSTDir, "lost", "sst_0.db.*"))
+	require.NoError(t, err)
+	assert.Len(t, lost, 1, "Expected the damaged SSTable in the SST lost directory")
+
+	// Repaired files pass the next run
+	require.NoError(t, scrubber.RunOnce())
+	assert.Len(t, scrubber.Status().Findings, 2, "Expected no new findings after repair")
+}
+
+func TestScrubberStartDeferred(t *testing.T) {
+	cfg := &config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir(), UseSegmentedLogs: true, RepairInterval: time.Hour}
+	w, err := wal.NewWAL(cfg)
+	require.NoError(t, err, "Failed to create WAL")
+	defer w.Close()
+	l, err := lsm.NewLSM(cfg)
+	require.NoError(t, err, "Failed to create LSM")
+
+	scrubber := NewScrubber(cfg, w, l)
+	scrubber.StartDeferred()
+	scrubber.Stop()
+	assert.Equal(t, 0, scrubber.Status().Runs, "A deferred scrubber should wait for the interval before the first run")
+}
@@ -0,0 +1,102 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// WriteCommand sends a command as a RESP array of bulk strings, the way
+// clients do.
+func WriteCommand(w io.Writer, args ...string) error {
+	buf := appendLength(nil, '*', len(args))
+	for _, arg := range args {
+		buf = appendRESP(buf, BulkString(arg), Protocol2)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadReply reads a RESP2 or RESP3 reply written by the server. Error replies
+// are returned as Error values; the error is for failed reads and malformed
+// replies, after which the connection cannot be used.
+func ReadReply(r *bufio.Reader) (Reply, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == "" {
+		return nil, fmt.Errorf("%w: empty reply line", ErrProtocol)
+	}
+
+	switch prefix, rest := line[0], line[1:]; prefix {
+	case '+':
+		return SimpleString(rest), nil
+	case '-':
+		return Error(rest), nil
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid integer %q", ErrProtocol, line)
+		}
+		return Integer(n), nil
+	case '_':
+		return Null{}, nil
+	case '$':
+		n, err := replyLength(line, maxBulkLength)
+		if err != nil || n < 0 {
+			return Null{}, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return BulkString(data[:n]), nil
+	case '*', '>':
+		n, err := replyLength(line, maxArrayLength)
+		if err != nil || n < 0 {
+			return Null{}, err
+		}
+		elements := make([]Reply, n)
+		for i := range elements {
+			if elements[i], err = ReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+		if prefix == '>' {
+			return Push(elements), nil
+		}
+		return Array(elements), nil
+	case '%':
+		n, err := replyLength(line, maxArrayLength)
+		if err != nil || n < 0 {
+			return Null{}, err
+		}
+		entries := make(Map, n)
+		for i := range entries {
+			key, err := ReadReply(r)
+			if err != nil {
+				return nil, err
+			}
+			if entries[i].Value, err = ReadReply(r); err != nil {
+				return nil, err
+			}
+			entries[i].Key = string(appendText(nil, key))
+		}
+		return entries, nil
+	}
+	return nil, fmt.Errorf("%w: unexpected reply %q", ErrProtocol, line)
+}
+
+// replyLength parses the length of a header line such as "$5", -1 for the
+// RESP2 null bulk string and array.
+func replyLength(line string, max int) (int, error) {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < -1 || n > max {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, line)
+	}
+	return n, nil
+}
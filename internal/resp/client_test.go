@@ -0,0 +1,64 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCommand(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteCommand(&buf, "SET", "a b", ""))
+	assert.Equal(t, "*3\r\n$3\r\nSET\r\n$3\r\na b\r\n$0\r\n\r\n", buf.String())
+
+	args, err := NewReader(&buf).ReadCommand()
+	require.NoError(t, err, "Failed to read command")
+	assert.Equal(t, []string{"SET", "a b", ""}, args, "Expected the server to read the same arguments")
+}
+
+func TestReadReply(t *testing.T) {
+	replies := []Reply{
+		OK,
+		ErrWrongArgs("GET"),
+		Integer(-42),
+		BulkString("a b\r\n"),
+		Null{},
+		Array{},
+		Array{BulkString("a"), Integer(1), Null{}},
+		Map{{Key: "proto", Value: Integer(3)}},
+		Push{BulkString("message"), BulkString("news")},
+	}
+	for _, proto := range []Protocol{Protocol2, Protocol3} {
+		var buf bytes.Buffer
+		for _, reply := range replies {
+			require.NoError(t, Write(&buf, reply, proto))
+		}
+		reader := bufio.NewReader(&buf)
+		for _, want := range replies {
+			got, err := ReadReply(reader)
+			require.NoError(t, err, "Failed to read reply")
+			if proto == Protocol2 {
+				// RESP2 has no maps or pushes, the client gets their arrays
+				switch r := want.(type) {
+				case Map:
+					want = Array{BulkString("proto"), Integer(3)}
+				case Push:
+					want = Array(r)
+				}
+			}
+			assert.Equal(t, want, got, "Unexpected reply for protocol %d", proto)
+		}
+	}
+
+	_, err := ReadReply(bufio.NewReader(strings.NewReader("*-1\r\n")))
+	assert.NoError(t, err, "Expected the RESP2 null array to be read")
+	_, err = ReadReply(bufio.NewReader(strings.NewReader("$5\r\nab")))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "Expected truncated replies to fail")
+	_, err = ReadReply(bufio.NewReader(strings.NewReader("?\r\n")))
+	assert.ErrorIs(t, err, ErrProtocol, "Expected unknown replies to fail")
+}
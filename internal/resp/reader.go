@@ -0,0 +1,155 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBulkLength  = 512 * 1024 * 1024
+	maxArrayLength = 1024 * 1024
+	maxInlineSize  = 64 * 1024
+)
+
+// ErrProtocol is returned for malformed requests. The connection cannot be
+// used afterwards because the position of the next request is unknown.
+var ErrProtocol = errors.New("protocol error")
+
+// ErrRequestTooLarge is returned for requests larger than the maximum request
+// size. It wraps ErrProtocol, as the rest of the request is not read.
+var ErrRequestTooLarge = fmt.Errorf("%w: request too large", ErrProtocol)
+
+// Reader reads commands sent as RESP arrays of bulk strings, or as inline
+// commands: a line of space separated arguments, as typed in telnet.
+type Reader struct {
+	r *bufio.Reader
+
+	// maxRequestSize limits the total size of the arguments of a command,
+	// 0 means no limit besides the per-argument ones
+	maxRequestSize int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// SetMaxRequestSize limits the total size in bytes of the arguments of a
+// command. Larger requests fail with ErrRequestTooLarge before their
+// arguments are read.
+func (r *Reader) SetMaxRequestSize(n int) {
+	r.maxRequestSize = n
+}
+
+// Peek returns the first byte of the next request without consuming it.
+func (r *Reader) Peek() (byte, error) {
+	b, err := r.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Buffered returns the number of bytes already read from the connection but
+// not consumed yet. Servers flush replies once it drops to zero, so that the
+// replies to pipelined commands are written together.
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// ReadCommand returns the arguments of the next command. Empty inline lines
+// are skipped.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		first, err := r.Peek()
+		if err != nil {
+			return nil, err
+		}
+		if first == '*' {
+			return r.readArray()
+		}
+
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if args := strings.Fields(line); len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+func (r *Reader) readArray() ([]string, error) {
+	n, err := r.readLength('*', maxArrayLength)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, n)
+	total := 0
+	for i := 0; i < n; i++ {
+		size, err := r.readLength('$', maxBulkLength)
+		if err != nil {
+			return nil, err
+		}
+		if total += size; r.maxRequestSize > 0 && total > r.maxRequestSize {
+			return nil, ErrRequestTooLarge
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r.r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+// readLength reads a header line such as "*3" or "$5".
+func (r *Reader) readLength(prefix byte, max int) (int, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if len(line) == 0 || line[0] != prefix {
+		return 0, fmt.Errorf("%w: expected '%c', got %q", ErrProtocol, prefix, line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > max {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, line)
+	}
+	return n, nil
+}
+
+// readLine reads a line terminated by LF or CRLF.
+func (r *Reader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxInlineSize {
+			return "", fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		if r.maxRequestSize > 0 && len(line) > r.maxRequestSize {
+			return "", ErrRequestTooLarge
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
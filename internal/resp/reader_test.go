@@ -0,0 +1,73 @@
+package resp
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCommand(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$9\r\nmy key\r\nx\r\n$0\r\n\r\n" + // binary safe bulk strings
+		"GET  key\r\n" + // inline command
+		"\n" + // empty lines are skipped
+		"PING\n"
+	r := NewReader(strings.NewReader(input))
+
+	cmd, err := r.ReadCommand()
+	require.NoError(t, err, "Failed to read RESP command")
+	assert.Equal(t, []string{"SET", "my key\r\nx", ""}, cmd, "Unexpected RESP command")
+
+	cmd, err = r.ReadCommand()
+	require.NoError(t, err, "Failed to read inline command")
+	assert.Equal(t, []string{"GET", "key"}, cmd, "Unexpected inline command")
+
+	cmd, err = r.ReadCommand()
+	require.NoError(t, err, "Failed to read inline command")
+	assert.Equal(t, []string{"PING"}, cmd, "Unexpected inline command")
+
+	_, err = r.ReadCommand()
+	assert.Equal(t, io.EOF, err, "Expected EOF after the last command")
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	tests := map[string]string{
+		"bad array length":   "*x\r\n",
+		"negative length":    "*-1\r\n",
+		"missing bulk":       "*1\r\n:1\r\n",
+		"bulk without CRLF":  "*1\r\n$3\r\nGETX\r\n",
+		"bulk too long":      "*1\r\n$999999999999\r\n",
+		"array too long":     "*99999999\r\n",
+		"inline line length": strings.Repeat("a", maxInlineSize+1) + "\r\n",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewReader(strings.NewReader(input)).ReadCommand()
+			assert.True(t, errors.Is(err, ErrProtocol), "Expected a protocol error, got %v", err)
+		})
+	}
+
+	_, err := NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n")).ReadCommand()
+	assert.Equal(t, io.ErrUnexpectedEOF, err, "Truncated commands should fail with ErrUnexpectedEOF")
+}
+
+func TestMaxRequestSize(t *testing.T) {
+	r := NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$1\r\na\r\n$4\r\n1234\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$5\r\n12345\r\n"))
+	r.SetMaxRequestSize(8)
+
+	cmd, err := r.ReadCommand()
+	require.NoError(t, err, "Requests within the limit should be read")
+	assert.Equal(t, []string{"SET", "a", "1234"}, cmd, "Unexpected command")
+
+	_, err = r.ReadCommand()
+	assert.Equal(t, ErrRequestTooLarge, err, "Expected the request to be rejected")
+	assert.True(t, errors.Is(err, ErrProtocol), "Too large requests are protocol errors")
+
+	r = NewReader(strings.NewReader("SET a 123456789\r\n"))
+	r.SetMaxRequestSize(8)
+	_, err = r.ReadCommand()
+	assert.Equal(t, ErrRequestTooLarge, err, "Expected the inline request to be rejected")
+}
@@ -0,0 +1,209 @@
+package resp
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Protocol selects how replies are encoded.
+type Protocol int
+
+const (
+	// ProtocolText is the plain-text protocol for telnet users: every reply is
+	// a single line
+	ProtocolText Protocol = iota
+	Protocol2
+	Protocol3
+)
+
+// Reply is a typed reply. Use the types below; their encoding depends on the
+// Protocol of the connection.
+type Reply interface {
+	reply()
+}
+
+type (
+	SimpleString string
+	Error        string
+	Integer      int64
+	BulkString   string
+	Null         struct{}
+	Array        []Reply
+
+	// Map is encoded as a RESP3 map, or as a flat array of keys and values in
+	// RESP2. Pairs keep their order.
+	Map []MapEntry
+
+	// Push is an out-of-band message, such as a pub/sub message. It is
+	// encoded as a RESP3 push, or as an array in RESP2.
+	Push []Reply
+
+	// Replies are several top-level replies to a single command, written one
+	// after another, as SUBSCRIBE does for each of its channels. They cannot
+	// be nested in other replies.
+	Replies []Reply
+)
+
+type MapEntry struct {
+	Key   string
+	Value Reply
+}
+
+func (SimpleString) reply() {}
+func (Error) reply()        {}
+func (Integer) reply()      {}
+func (BulkString) reply()   {}
+func (Null) reply()         {}
+func (Array) reply()        {}
+func (Map) reply()          {}
+func (Push) reply()         {}
+func (Replies) reply()      {}
+
+// OK is the usual reply of successful writes.
+const OK = SimpleString("OK")
+
+// Errorf builds an error reply. Error replies start with an upper case error
+// code, ERR unless the message brings its own.
+func Errorf(format string, args ...interface{}) Error {
+	return Error(fmt.Sprintf(format, args...))
+}
+
+// ErrWrongArgs is the error reply for a command called with the wrong number
+// of arguments.
+func ErrWrongArgs(command string) Error {
+	return Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))
+}
+
+// Bool replies 1 or 0.
+func Bool(b bool) Integer {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Write encodes reply for proto and writes it to w in a single call.
+func Write(w io.Writer, reply Reply, proto Protocol) error {
+	replies, ok := reply.(Replies)
+	if !ok {
+		replies = Replies{reply}
+	}
+	var buf []byte
+	for _, reply := range replies {
+		if proto == ProtocolText {
+			buf = append(appendText(buf, reply), '\n')
+		} else {
+			buf = appendRESP(buf, reply, proto)
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendRESP(buf []byte, reply Reply, proto Protocol) []byte {
+	switch r := reply.(type) {
+	case SimpleString:
+		buf = append(buf, '+')
+		buf = append(buf, sanitizeLine(string(r))...)
+		return append(buf, "\r\n"...)
+	case Error:
+		buf = append(buf, '-')
+		buf = append(buf, sanitizeLine(string(r))...)
+		return append(buf, "\r\n"...)
+	case Integer:
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, int64(r), 10)
+		return append(buf, "\r\n"...)
+	case BulkString:
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(r)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, r...)
+		return append(buf, "\r\n"...)
+	case Null:
+		if proto == Protocol3 {
+			return append(buf, "_\r\n"...)
+		}
+		return append(buf, "$-1\r\n"...)
+	case Array:
+		buf = appendLength(buf, '*', len(r))
+		for _, element := range r {
+			buf = appendRESP(buf, element, proto)
+		}
+		return buf
+	case Push:
+		if proto != Protocol3 {
+			return appendRESP(buf, Array(r), proto)
+		}
+		buf = appendLength(buf, '>', len(r))
+		for _, element := range r {
+			buf = appendRESP(buf, element, proto)
+		}
+		return buf
+	case Map:
+		if proto == Protocol3 {
+			buf = appendLength(buf, '%', len(r))
+		} else {
+			buf = appendLength(buf, '*', 2*len(r))
+		}
+		for _, entry := range r {
+			buf = appendRESP(buf, BulkString(entry.Key), proto)
+			buf = appendRESP(buf, entry.Value, proto)
+		}
+		return buf
+	}
+	panic(fmt.Sprintf("resp: unknown reply type %T", reply))
+}
+
+func appendLength(buf []byte, prefix byte, n int) []byte {
+	buf = append(buf, prefix)
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	return append(buf, "\r\n"...)
+}
+
+// appendText formats reply on a single line, the way the plain-text protocol
+// always has: nested replies are numbered like redis-cli does.
+func appendText(buf []byte, reply Reply) []byte {
+	switch r := reply.(type) {
+	case SimpleString:
+		return append(buf, sanitizeLine(string(r))...)
+	case Error:
+		return append(buf, sanitizeLine(string(r))...)
+	case Integer:
+		buf = append(buf, "(integer) "...)
+		return strconv.AppendInt(buf, int64(r), 10)
+	case BulkString:
+		return append(buf, sanitizeLine(string(r))...)
+	case Null:
+		return append(buf, "(nil)"...)
+	case Array:
+		if len(r) == 0 {
+			return append(buf, "(empty array)"...)
+		}
+		for i, element := range r {
+			if i > 0 {
+				buf = append(buf, ' ')
+			}
+			buf = strconv.AppendInt(buf, int64(i+1), 10)
+			buf = append(buf, ") "...)
+			buf = appendText(buf, element)
+		}
+		return buf
+	case Push:
+		return appendText(buf, Array(r))
+	case Map:
+		flat := make(Array, 0, 2*len(r))
+		for _, entry := range r {
+			flat = append(flat, BulkString(entry.Key), entry.Value)
+		}
+		return appendText(buf, flat)
+	}
+	panic(fmt.Sprintf("resp: unknown reply type %T", reply))
+}
+
+// sanitizeLine keeps simple strings, errors and plain-text replies on one line.
+func sanitizeLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
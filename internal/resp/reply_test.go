@@ -0,0 +1,43 @@
+package resp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encode(t *testing.T, reply Reply, proto Protocol) string {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, reply, proto), "Failed to write reply")
+	return buf.String()
+}
+
+func TestWriteRESP(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply Reply
+		resp2 string
+		resp3 string
+		plain string
+	}{
+		{"simple string", OK, "+OK\r\n", "+OK\r\n", "OK\n"},
+		{"error", ErrWrongArgs("GET"), "-ERR wrong number of arguments for 'get' command\r\n", "-ERR wrong number of arguments for 'get' command\r\n", "ERR wrong number of arguments for 'get' command\n"},
+		{"integer", Integer(-42), ":-42\r\n", ":-42\r\n", "(integer) -42\n"},
+		{"bulk string", BulkString("a b\r\n"), "$5\r\na b\r\n\r\n", "$5\r\na b\r\n\r\n", "a b  \n"},
+		{"null", Null{}, "$-1\r\n", "_\r\n", "(nil)\n"},
+		{"empty array", Array{}, "*0\r\n", "*0\r\n", "(empty array)\n"},
+		{"array", Array{BulkString("a"), Integer(1), Null{}}, "*3\r\n$1\r\na\r\n:1\r\n$-1\r\n", "*3\r\n$1\r\na\r\n:1\r\n_\r\n", "1) a 2) (integer) 1 3) (nil)\n"},
+		{"map", Map{{Key: "proto", Value: Integer(3)}}, "*2\r\n$5\r\nproto\r\n:3\r\n", "%1\r\n$5\r\nproto\r\n:3\r\n", "1) proto 2) (integer) 3\n"},
+		{"push", Push{BulkString("message"), BulkString("news")}, "*2\r\n$7\r\nmessage\r\n$4\r\nnews\r\n", ">2\r\n$7\r\nmessage\r\n$4\r\nnews\r\n", "1) message 2) news\n"},
+		{"replies", Replies{OK, Integer(1)}, "+OK\r\n:1\r\n", "+OK\r\n:1\r\n", "OK\n(integer) 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.resp2, encode(t, tt.reply, Protocol2), "Unexpected RESP2 encoding")
+			assert.Equal(t, tt.resp3, encode(t, tt.reply, Protocol3), "Unexpected RESP3 encoding")
+			assert.Equal(t, tt.plain, encode(t, tt.reply, ProtocolText), "Unexpected plain-text encoding")
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package seglog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/encryption"
+)
+
+// archiveRetryInterval is how long the archiver waits before copying again
+// after a failure.
+const archiveRetryInterval = 10 * time.Second
+
+// WithArchiveDir copies every segment to dir once it is closed. Segments are
+// never removed by retention or rewritten by compaction before they have been
+// archived, so the archive always holds the complete history of the log.
+func WithArchiveDir(dir string) Option {
+	return func(sl *SegmentedLog) {
+		sl.archiveDir = dir
+	}
+}
+
+// Archive copies every closed segment that is not in the archive directory
+// yet, oldest first. It runs in the background whenever a segment is closed;
+// call it to wait for the archive to catch up. It is a no-op when archiving is
+// disabled.
+func (sl *SegmentedLog) Archive() error {
+	if sl.archiveDir == "" {
+		return nil
+	}
+
+	// Closed segments are only modified with compactMu held, so they can be
+	// copied without blocking appends
+	sl.compactMu.Lock()
+	defer sl.compactMu.Unlock()
+
+	sl.mu.RLock()
+	if sl.closed {
+		sl.mu.RUnlock()
+		return ErrClosed
+	}
+	closed := make([]*LogSegment, len(sl.segments)-1)
+	copy(closed, sl.segments[:len(sl.segments)-1])
+	sl.mu.RUnlock()
+
+	for _, segment := range closed {
+		if segment.archived {
+			continue
+		}
+		if err := sl.archiveSegment(segment); err != nil {
+			archiveFailuresMetric.Inc()
+			return err
+		}
+		segment.archived = true
+	}
+	return nil
+}
+
+// archiveSegment copies segment to the archive directory unless a complete
+// copy is already there. sl.compactMu must be held.
+func (sl *SegmentedLog) archiveSegment(segment *LogSegment) error {
+	archivePath := filepath.Join(sl.archiveDir, filepath.Base(segment.file.Name()))
+	complete, err := isArchived(segment.file.Name(), archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to check archived segment: %w", err)
+	}
+	if complete {
+		return nil
+	}
+
+	if err := os.MkdirAll(sl.archiveDir, 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	if err := copyFile(segment.file.Name(), archivePath+".tmp"); err != nil {
+		return fmt.Errorf("failed to archive segment: %w", err)
+	}
+	if err := os.Rename(archivePath+".tmp", archivePath); err != nil {
+		return fmt.Errorf("failed to archive segment: %w", err)
+	}
+	if err := encryption.SyncDir(sl.archiveDir); err != nil {
+		return fmt.Errorf("failed to archive segment: %w", err)
+	}
+	segmentsArchivedMetric.Inc()
+	return nil
+}
+
+// isArchived reports whether archivePath holds a complete copy of the segment
+// at path. Compaction and scrubbing only blank entries after the copy was
+// made, so a larger copy is complete. A copy of the same size must have the
+// same entries; only the header differs once both were rewrapped with a new
+// master key. Smaller or different copies are replaced.
+func isArchived(path, archivePath string) (bool, error) {
+	archiveInfo, err := os.Stat(archivePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if archiveInfo.Size() != info.Size() {
+		if archiveInfo.Size() < info.Size() {
+			slog.Warn("Replacing incomplete archived segment", "path", archivePath, "size", archiveInfo.Size(), "expected", info.Size())
+		}
+		return archiveInfo.Size() > info.Size(), nil
+	}
+
+	sum, err := entriesChecksum(path)
+	if err != nil {
+		return false, err
+	}
+	archiveSum, err := entriesChecksum(archivePath)
+	if err != nil {
+		return false, err
+	}
+	if sum != archiveSum {
+		slog.Warn("Replacing damaged archived segment", "path", archivePath)
+		return false, nil
+	}
+	return true, nil
+}
+
+// entriesChecksum returns the checksum of a segment file without its
+// encryption header.
+func entriesChecksum(path string) (uint32, error) {
+	if err := encryption.RecoverRewrap(path); err != nil {
+		return 0, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	header, err := encryption.ReadHeader(file)
+	if err != nil {
+		return 0, err
+	}
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, int64(len(header)), 1<<62)); err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+// startArchiver archives the segments closed before the log was opened, then
+// every segment once it is closed, until stopArchiver is called. Failed copies
+// are retried after archiveRetryInterval.
+func (sl *SegmentedLog) startArchiver() {
+	sl.archiveWake = make(chan struct{}, 1)
+	sl.archiveStop = make(chan struct{})
+	sl.archiveDone = make(chan struct{})
+
+	go func() {
+		defer close(sl.archiveDone)
+		for {
+			var retry <-chan time.Time
+			if err := sl.Archive(); err != nil {
+				slog.Error("Failed to archive WAL segment", "dir", sl.archiveDir, "err", err)
+				retry = time.After(archiveRetryInterval)
+			}
+			select {
+			case <-sl.archiveWake:
+			case <-retry:
+			case <-sl.archiveStop:
+				return
+			}
+		}
+	}()
+}
+
+// wakeArchiver tells the archiver that a segment was closed without waiting
+// for it.
+func (sl *SegmentedLog) wakeArchiver() {
+	if sl.archiveWake == nil {
+		return
+	}
+	select {
+	case sl.archiveWake <- struct{}{}:
+	default:
+	}
+}
+
+// stopArchiver stops the archiver and waits for a running copy to finish.
+func (sl *SegmentedLog) stopArchiver() {
+	if sl.archiveStop == nil {
+		return
+	}
+	close(sl.archiveStop)
+	<-sl.archiveDone
+	sl.archiveStop = nil
+}
+
+// ReadSegmentFile calls fn for every entry of the segment file at path without
+// opening it as part of a log, so it can be used on archived segments. mk may
+// be nil for plaintext segments. Entries removed by compaction are skipped.
+func ReadSegmentFile(path string, mk *encryption.MasterKey, fn func(offset int64, entry []byte) error) error {
+	baseOffset, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), logFilePrefix), logFileExt), 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse base offset from filename: %v", err)
+	}
+
+	if err := encryption.RecoverRewrap(path); err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open segment file: %w", err)
+	}
+	defer file.Close()
+
+	header, err := encryption.ReadHeader(file)
+	if err != nil {
+		return err
+	}
+	var key *encryption.DataKey
+	if header != nil {
+		if key, err = encryption.OpenHeader(header, mk); err != nil {
+			return fmt.Errorf("failed to open encrypted segment %s: %w", path, err)
+		}
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, int64(len(header)), 1<<62))
+	for offset := baseOffset; ; offset++ {
+		line, readErr := reader.ReadBytes('\n')
+		if line = bytes.TrimSuffix(line, []byte("\n")); len(line) > 0 {
+			entry := line
+			if key != nil {
+				if entry, err = key.OpenLine(line); err != nil {
+					return fmt.Errorf("failed to decrypt entry at offset %d: %w", offset, err)
+				}
+			}
+			if err := fn(offset, entry); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read segment file: %w", readErr)
+		}
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
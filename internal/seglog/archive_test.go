@@ -0,0 +1,158 @@
+package seglog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTestSegmentFile(t *testing.T, path string) map[int64]string {
+	entries := make(map[int64]string)
+	err := ReadSegmentFile(path, nil, func(offset int64, entry []byte) error {
+		entries[offset] = string(entry)
+		return nil
+	})
+	require.NoError(t, err, "Failed to read segment file %s", path)
+	return entries
+}
+
+func TestArchiveClosedSegments(t *testing.T) {
+	dir := t.TempDir()
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	sl, err := NewSegmentedLog(dir, 2, WithArchiveDir(archiveDir))
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("k%d=%d", i, i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	// Segments are copied in the background
+	var files []SegmentFile
+	require.Eventually(t, func() bool {
+		files, err = SegmentFiles(archiveDir)
+		return err == nil && len(files) == 2
+	}, time.Second, 5*time.Millisecond, "Only closed segments should be archived")
+	assert.Equal(t, int64(0), files[0].BaseOffset, "Unexpected base offset of first archived segment")
+	assert.Equal(t, int64(2), files[1].BaseOffset, "Unexpected base offset of second archived segment")
+
+	assert.Equal(t, map[int64]string{2: "k2=2", 3: "k3=3"}, readTestSegmentFile(t, files[1].Path), "Unexpected archived entries")
+}
+
+func TestArchiveKeepsHistoryOfCompactedSegments(t *testing.T) {
+	dir := t.TempDir()
+	archiveDir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 3)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+
+	for _, entry := range []string{"a=1", "a=2", "a=3", "b=1"} {
+		_, err := sl.Append([]byte(entry))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	// Segments closed before archiving was enabled are archived before they
+	// are compacted
+	sl, err = NewSegmentedLog(dir, 3, WithArchiveDir(archiveDir))
+	require.NoError(t, err, "Failed to reopen SegmentedLog")
+	defer sl.Close()
+	require.NoError(t, sl.Archive(), "Failed to archive segments")
+
+	stats, err := sl.Compact(CompactionPolicy{Key: testKey, DeleteRetention: time.Hour})
+	require.NoError(t, err, "Compaction failed")
+	assert.Equal(t, 2, stats.EntriesRemoved, "Unexpected number of removed entries")
+
+	archived := readTestSegmentFile(t, filepath.Join(archiveDir, "log-0.seg"))
+	assert.Equal(t, map[int64]string{0: "a=1", 1: "a=2", 2: "a=3"}, archived, "Archive should keep compacted entries")
+	assert.Equal(t, map[int64]string{2: "a=3"}, readTestSegmentFile(t, filepath.Join(dir, "log-0.seg")), "Unexpected entries after compaction")
+
+	// The larger archived copy is kept when the log is opened again
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+	sl, err = NewSegmentedLog(dir, 3, WithArchiveDir(archiveDir))
+	require.NoError(t, err, "Failed to reopen SegmentedLog")
+	defer sl.Close()
+	require.NoError(t, sl.Archive(), "Failed to archive segments")
+	assert.Equal(t, archived, readTestSegmentFile(t, filepath.Join(archiveDir, "log-0.seg")), "Archive should not be replaced by the compacted segment")
+}
+
+func TestArchiveReplacesIncompleteCopies(t *testing.T) {
+	dir := t.TempDir()
+	archiveDir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 2)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	for i := 0; i < 5; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("k%d=%d", i, i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	// A truncated copy and a copy of the same size with different entries
+	require.NoError(t, os.WriteFile(filepath.Join(archiveDir, "log-0.seg"), []byte("k0=0\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(archiveDir, "log-2.seg"), []byte("k2=2\nk3=X\n"), 0644))
+
+	sl, err = NewSegmentedLog(dir, 2, WithArchiveDir(archiveDir))
+	require.NoError(t, err, "Failed to reopen SegmentedLog")
+	defer sl.Close()
+	require.NoError(t, sl.Archive(), "Failed to archive segments")
+	assert.Equal(t, map[int64]string{0: "k0=0", 1: "k1=1"}, readTestSegmentFile(t, filepath.Join(archiveDir, "log-0.seg")), "Expected the truncated copy to be replaced")
+	assert.Equal(t, map[int64]string{2: "k2=2", 3: "k3=3"}, readTestSegmentFile(t, filepath.Join(archiveDir, "log-2.seg")), "Expected the damaged copy to be replaced")
+	assert.NoFileExists(t, filepath.Join(archiveDir, "log-0.seg.tmp"))
+}
+
+func TestArchiveBeforeRemovingSegments(t *testing.T) {
+	dir := t.TempDir()
+	// The archive directory cannot be created while a file is in the way
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	require.NoError(t, os.WriteFile(archiveDir, nil, 0644))
+	sl, err := NewSegmentedLog(dir, 2, WithArchiveDir(archiveDir))
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("k%d=%d", i, i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	assert.Error(t, sl.Archive(), "Expected the copy to fail")
+	require.NoError(t, sl.RemoveSegmentsBefore(4), "Failed to remove segments")
+	assert.FileExists(t, filepath.Join(dir, "log-0.seg"), "Segments must not be removed before they are archived")
+	stats, err := sl.Compact(CompactionPolicy{Key: testKey})
+	require.NoError(t, err, "Compaction failed")
+	assert.Zero(t, stats.SegmentsRewritten, "Segments must not be compacted before they are archived")
+
+	require.NoError(t, os.Remove(archiveDir))
+	require.NoError(t, sl.Archive(), "Failed to archive segments")
+	require.NoError(t, sl.RemoveSegmentsBefore(4), "Failed to remove segments")
+	assert.NoFileExists(t, filepath.Join(dir, "log-0.seg"), "Segment should have been removed")
+	assert.Equal(t, map[int64]string{0: "k0=0", 1: "k1=1"}, readTestSegmentFile(t, filepath.Join(archiveDir, "log-0.seg")), "Removed segment should be archived")
+}
+
+func TestReadEncryptedSegmentFile(t *testing.T) {
+	dir := t.TempDir()
+	mk := newTestMasterKey(t)
+	sl, err := NewSegmentedLog(dir, 10, WithEncryption(mk))
+	require.NoError(t, err, "Failed to create SegmentedLog")
+
+	for _, entry := range []string{"a=1", "b=1"} {
+		_, err := sl.Append([]byte(entry))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	entries := make(map[int64]string)
+	err = ReadSegmentFile(filepath.Join(dir, "log-0.seg"), mk, func(offset int64, entry []byte) error {
+		entries[offset] = string(entry)
+		return nil
+	})
+	require.NoError(t, err, "Failed to read encrypted segment file")
+	assert.Equal(t, map[int64]string{0: "a=1", 1: "b=1"}, entries, "Unexpected decrypted entries")
+
+	err = ReadSegmentFile(filepath.Join(dir, "log-0.seg"), nil, func(int64, []byte) error { return nil })
+	assert.Error(t, err, "Reading an encrypted segment without a key should fail")
+}
@@ -0,0 +1,308 @@
+package seglog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const cleanedFileExt = ".cleaned"
+
+// KeyFunc extracts the compaction key of an entry and reports whether the
+// entry is a delete marker for that key.
+type KeyFunc func(entry []byte) (key string, tombstone bool, err error)
+
+// CompactionPolicy configures how Compact rewrites closed segments.
+type CompactionPolicy struct {
+	Key KeyFunc
+
+	// DeleteRetention is how long delete markers are kept after their segment
+	// was last written, so that slow consumers still get to see them.
+	DeleteRetention time.Duration
+
+	// UnkeyedKeys, if set, returns the keys written by an entry that Key
+	// failed on, such as the keys of a batch. Those entries are always kept,
+	// so a delete marker written after one of them is kept too, even once it
+	// expired: dropping it would bring the key back on replay.
+	UnkeyedKeys func(entry []byte) []string
+}
+
+// CompactionStats describes the outcome of a compaction run.
+type CompactionStats struct {
+	SegmentsRewritten int
+	EntriesRemoved    int
+}
+
+// Compact rewrites closed segments so that only the newest entry per key is
+// kept, along with delete markers still inside the retention window. Removed
+// entries are left as empty lines, so offsets of the remaining entries never
+// change and existing readers keep their positions. The active segment is
+// neither rewritten nor used to decide which entries are the newest, and
+// segments retained by RetainFrom are not rewritten either.
+func (sl *SegmentedLog) Compact(policy CompactionPolicy) (CompactionStats, error) {
+	var stats CompactionStats
+	if policy.Key == nil {
+		return stats, errors.New("compaction policy requires a key function")
+	}
+
+	sl.compactMu.Lock()
+	defer sl.compactMu.Unlock()
+
+	// Closed segments are only modified by compaction and retention, both of
+	// which are excluded by compactMu, so they can be read without holding sl.mu
+	sl.mu.RLock()
+	if sl.closed {
+		sl.mu.RUnlock()
+		return stats, ErrClosed
+	}
+	closed := make([]*LogSegment, len(sl.segments)-1)
+	copy(closed, sl.segments[:len(sl.segments)-1])
+	sl.mu.RUnlock()
+
+	// unkeyed holds the offset of the first kept entry without a single key
+	// that writes each key
+	latest := make(map[string]int64)
+	unkeyed := make(map[string]int64)
+	for _, segment := range closed {
+		err := segment.scan(func(offset int64, entry []byte) error {
+			key, _, err := policy.Key(entry)
+			if err == nil {
+				latest[key] = offset
+				return nil
+			}
+			if policy.UnkeyedKeys != nil {
+				for _, key := range policy.UnkeyedKeys(entry) {
+					if _, ok := unkeyed[key]; !ok {
+						unkeyed[key] = offset
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	for _, segment := range closed {
+		// Readers can be retained while compaction runs, so this is checked
+		// again before the compacted segment is swapped in
+		if sl.retained(segment) {
+			break
+		}
+		// Keep the full history of a segment in the archive before dropping
+		// entries. Segments not archived yet are compacted by a later run.
+		if sl.archiveDir != "" && !segment.archived {
+			break
+		}
+		removed, err := sl.compactSegment(segment, policy, latest, unkeyed)
+		if errors.Is(err, errRetained) {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		if removed > 0 {
+			stats.SegmentsRewritten++
+			stats.EntriesRemoved += removed
+		}
+	}
+
+	return stats, nil
+}
+
+// errRetained is returned by compactSegment when RetainFrom was called for an
+// offset of the segment while it was being compacted.
+var errRetained = errors.New("segment is retained")
+
+// retained reports whether segment holds entries from the offset passed to
+// RetainFrom on.
+func (sl *SegmentedLog) retained(segment *LogSegment) bool {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return segment.nextOffset > sl.retainFrom
+}
+
+// scan calls fn for every entry of the segment that has not been compacted.
+func (s *LogSegment) scan(fn func(offset int64, entry []byte) error) error {
+	for offset := s.baseOffset; offset < s.nextOffset; offset++ {
+		entry, err := s.read(offset - s.baseOffset)
+		if errors.Is(err, ErrCompacted) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(offset, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sl *SegmentedLog) compactSegment(segment *LogSegment, policy CompactionPolicy, latest, unkeyed map[string]int64) (int, error) {
+	info, err := segment.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat segment file: %w", err)
+	}
+	tombstonesExpired := time.Since(info.ModTime()) > policy.DeleteRetention
+
+	// Entries that cannot be parsed by the key function are always kept
+	removed := 0
+	keep := make(map[int64]bool)
+	err = segment.scan(func(offset int64, entry []byte) error {
+		key, tombstone, err := policy.Key(entry)
+		first, overwrites := unkeyed[key]
+		dropTombstone := tombstone && tombstonesExpired && !(overwrites && first < offset)
+		if err != nil || (latest[key] == offset && !dropTombstone) {
+			keep[offset] = true
+		} else {
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	// sl.mu is held while the precondition runs, so RetainFrom either returns
+	// before the segment is swapped in or after it
+	retained := func() error {
+		if segment.nextOffset > sl.retainFrom {
+			return errRetained
+		}
+		return nil
+	}
+	if err := sl.rewriteSegment(segment, info.ModTime(), func(offset int64, entry []byte, err error) ([]byte, error) {
+		if err != nil || keep[offset] {
+			return entry, err
+		}
+		return nil, nil
+	}, retained); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// transformFunc is called by rewriteSegment with every entry that has not
+// been compacted yet, or with the error encountered while reading it.
+// Returning a nil entry turns it into an empty line.
+type transformFunc func(offset int64, entry []byte, err error) ([]byte, error)
+
+// rewriteSegment writes a copy of a closed segment in which every entry is
+// replaced by the result of transform, then atomically swaps it in. The
+// original modification time is kept so retention windows are not reset. If
+// precondition is set, it is called with sl.mu held before the swap, and its
+// error leaves the segment untouched.
+func (sl *SegmentedLog) rewriteSegment(segment *LogSegment, modTime time.Time, transform transformFunc, precondition func() error) error {
+	segmentPath := segment.file.Name()
+	cleanedPath := segmentPath + cleanedFileExt
+	cleanedIndexPath := indexPath(segmentPath) + cleanedFileExt
+
+	size, err := writeCleanedSegment(segment, cleanedPath, cleanedIndexPath, transform)
+	if err != nil {
+		os.Remove(cleanedPath)
+		os.Remove(cleanedIndexPath)
+		return err
+	}
+	if err := os.Chtimes(cleanedPath, modTime, modTime); err != nil {
+		return fmt.Errorf("failed to preserve segment modification time: %w", err)
+	}
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if precondition != nil {
+		if err := precondition(); err != nil {
+			os.Remove(cleanedPath)
+			os.Remove(cleanedIndexPath)
+			return err
+		}
+	}
+
+	// A crash between the renames leaves a segment whose index does not match,
+	// which is detected and rebuilt the next time the log is opened
+	if err := os.Rename(cleanedPath, segmentPath); err != nil {
+		return fmt.Errorf("failed to swap in compacted segment: %w", err)
+	}
+	if err := os.Rename(cleanedIndexPath, indexPath(segmentPath)); err != nil {
+		return fmt.Errorf("failed to swap in compacted index: %w", err)
+	}
+
+	file, err := os.OpenFile(segmentPath, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open compacted segment: %w", err)
+	}
+	index, err := os.OpenFile(indexPath(segmentPath), os.O_RDWR, 0644)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open compacted index: %w", err)
+	}
+
+	segment.file.Close()
+	segment.index.Close()
+	segment.file = file
+	segment.index = index
+	segment.size = size
+	return nil
+}
+
+func writeCleanedSegment(segment *LogSegment, segmentPath, indexPath string, transform transformFunc) (int64, error) {
+	file, err := os.OpenFile(segmentPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create compacted segment: %w", err)
+	}
+	defer file.Close()
+
+	index, err := os.OpenFile(indexPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create compacted index: %w", err)
+	}
+	defer index.Close()
+
+	fileWriter := bufio.NewWriter(file)
+	indexWriter := bufio.NewWriter(index)
+	if _, err := fileWriter.Write(segment.header); err != nil {
+		return 0, fmt.Errorf("failed to write compacted segment: %w", err)
+	}
+	position := segment.dataStart()
+	for offset := segment.baseOffset; offset < segment.nextOffset; offset++ {
+		line := []byte("\n")
+		entry, err := segment.read(offset - segment.baseOffset)
+		if !errors.Is(err, ErrCompacted) {
+			if entry, err = transform(offset, entry, err); err != nil {
+				return 0, err
+			}
+			if entry != nil {
+				line = segment.encode(entry)
+			}
+		}
+
+		if err := writeIndexEntry(indexWriter, offset-segment.baseOffset, position); err != nil {
+			return 0, err
+		}
+		if _, err := fileWriter.Write(line); err != nil {
+			return 0, fmt.Errorf("failed to write compacted segment: %w", err)
+		}
+		position += int64(len(line))
+	}
+
+	if err := fileWriter.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to write compacted segment: %w", err)
+	}
+	if err := indexWriter.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to write compacted index: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync compacted segment: %w", err)
+	}
+	if err := index.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync compacted index: %w", err)
+	}
+	return position, nil
+}
@@ -0,0 +1,193 @@
+package seglog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKey treats entries as "key=value" and "key=" as a delete marker.
+func testKey(entry []byte) (string, bool, error) {
+	key, value, ok := strings.Cut(string(entry), "=")
+	if !ok {
+		return "", false, fmt.Errorf("malformed entry %q", entry)
+	}
+	return key, value == "", nil
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 3)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	entries := []string{
+		"a=1", "b=1", "a=2", // segment 0
+		"c=1", "b=", "a=3", // segment 3
+		"c=2", // active segment 6
+	}
+	for _, entry := range entries {
+		_, err := sl.Append([]byte(entry))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	stats, err := sl.Compact(CompactionPolicy{Key: testKey, DeleteRetention: time.Hour})
+	require.NoError(t, err, "Compaction failed")
+	assert.Equal(t, 1, stats.SegmentsRewritten, "Unexpected number of rewritten segments")
+	assert.Equal(t, 3, stats.EntriesRemoved, "Unexpected number of removed entries")
+
+	// The newest entry per key in closed segments keeps its original offset
+	for offset, want := range map[int64]string{3: "c=1", 4: "b=", 5: "a=3", 6: "c=2"} {
+		entry, err := sl.Read(offset)
+		require.NoError(t, err, "Failed to read entry at offset %d", offset)
+		assert.Equal(t, want, string(entry), "Unexpected entry at offset %d", offset)
+	}
+	for offset := int64(0); offset < 3; offset++ {
+		_, err := sl.Read(offset)
+		assert.True(t, errors.Is(err, ErrCompacted), "Expected ErrCompacted at offset %d, got %v", offset, err)
+	}
+
+	// Readers skip compacted offsets
+	r, err := sl.NewReader(0)
+	require.NoError(t, err, "Failed to create reader")
+	_, offset, err := r.Next()
+	require.NoError(t, err, "Failed to read next entry")
+	assert.Equal(t, int64(3), offset, "Expected reader to skip compacted offsets")
+
+	// Appends continue at the same offset
+	offset, err = sl.Append([]byte("d=1"))
+	require.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, int64(7), offset, "Unexpected offset after compaction")
+}
+
+func TestCompactDropsExpiredTombstones(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 2)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for _, entry := range []string{"a=1", "a=", "b=1"} {
+		_, err := sl.Append([]byte(entry))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(sl.GetAllSegmentPaths()[0], old, old))
+
+	stats, err := sl.Compact(CompactionPolicy{Key: testKey, DeleteRetention: time.Hour})
+	require.NoError(t, err, "Compaction failed")
+	assert.Equal(t, 2, stats.EntriesRemoved, "Expected entry and expired delete marker to be removed")
+
+	r, err := sl.NewReader(0)
+	require.NoError(t, err, "Failed to create reader")
+	entry, offset, err := r.Next()
+	require.NoError(t, err, "Failed to read next entry")
+	assert.Equal(t, int64(2), offset, "Unexpected offset")
+	assert.Equal(t, "b=1", string(entry), "Unexpected entry content")
+	_, _, err = r.Next()
+	assert.Equal(t, io.EOF, err, "Expected EOF at end of log")
+}
+
+func TestCompactedSegmentSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 2)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+
+	for _, entry := range []string{"a=1", "a=2", "b=1"} {
+		_, err := sl.Append([]byte(entry))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	_, err = sl.Compact(CompactionPolicy{Key: testKey})
+	require.NoError(t, err, "Compaction failed")
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	// Force the index to be rebuilt from the compacted segment
+	require.NoError(t, os.Remove(filepath.Join(dir, "log-0.index")))
+
+	sl, err = NewSegmentedLog(dir, 2)
+	require.NoError(t, err, "Failed to reopen SegmentedLog")
+	defer sl.Close()
+
+	_, err = sl.Read(0)
+	assert.True(t, errors.Is(err, ErrCompacted), "Expected ErrCompacted, got %v", err)
+	entry, err := sl.Read(1)
+	require.NoError(t, err, "Failed to read entry")
+	assert.Equal(t, "a=2", string(entry), "Unexpected entry content")
+	assert.Equal(t, int64(3), sl.NextOffset(), "Unexpected next offset")
+}
+
+func TestAppendRejectsEmptyEntry(t *testing.T) {
+	sl, err := NewSegmentedLog(t.TempDir(), 100)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	_, err = sl.Append(nil)
+	assert.Equal(t, ErrEmptyEntry, err, "Expected ErrEmptyEntry")
+}
+
+func TestRetainFrom(t *testing.T) {
+	sl, err := NewSegmentedLog(t.TempDir(), 2)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for _, entry := range []string{"a=1", "a=2", "a=3", "a=4", "a=5"} {
+		_, err := sl.Append([]byte(entry))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	// Segment 0 is behind the reader, segment 2 holds offset 3 it still needs
+	sl.RetainFrom(3)
+	stats, err := sl.Compact(CompactionPolicy{Key: testKey})
+	require.NoError(t, err, "Compaction failed")
+	assert.Equal(t, 2, stats.EntriesRemoved, "Expected only the segment before the retained offset to be compacted")
+	entry, err := sl.Read(2)
+	require.NoError(t, err, "Retained entries should not be compacted")
+	assert.Equal(t, "a=3", string(entry), "Unexpected entry content")
+
+	require.NoError(t, sl.RemoveSegmentsBefore(4), "Failed to remove segments")
+	assert.Equal(t, int64(2), sl.OldestOffset(), "Retained segments should not be removed")
+
+	sl.RetainFrom(math.MaxInt64)
+	require.NoError(t, sl.RemoveSegmentsBefore(4), "Failed to remove segments")
+	assert.Equal(t, int64(4), sl.OldestOffset(), "Released segments should be removed")
+}
+
+func TestRetainFromDuringCompaction(t *testing.T) {
+	sl, err := NewSegmentedLog(t.TempDir(), 2)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for _, entry := range []string{"a=1", "a=2", "a=3", "b=1", "c=1"} {
+		_, err := sl.Append([]byte(entry))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	// A reader is retained at offset 0 once the newest entries were collected
+	// and the first segment is being compacted
+	calls := 0
+	key := func(entry []byte) (string, bool, error) {
+		if calls++; calls == 5 {
+			sl.RetainFrom(0)
+		}
+		return testKey(entry)
+	}
+	stats, err := sl.Compact(CompactionPolicy{Key: key})
+	require.NoError(t, err, "Compaction failed")
+	assert.Zero(t, stats.EntriesRemoved, "Segments retained during compaction must not be swapped in")
+
+	r, err := sl.NewHistoryReader(0)
+	require.NoError(t, err, "Failed to create reader")
+	entry, offset, err := r.Next()
+	require.NoError(t, err, "Retained entries should still be readable")
+	assert.Equal(t, int64(0), offset)
+	assert.Equal(t, "a=1", string(entry), "Unexpected entry content")
+}
@@ -0,0 +1,8 @@
+package seglog
+
+import "github.com/joobisb/vitadb/internal/metrics"
+
+var (
+	segmentsArchivedMetric = metrics.NewCounter("vitadb_wal_segments_archived_total", "Closed WAL segments copied to the archive directory.")
+	archiveFailuresMetric  = metrics.NewCounter("vitadb_wal_archive_failures_total", "Failed attempts to copy a closed WAL segment to the archive directory.")
+)
@@ -0,0 +1,153 @@
+package seglog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Reader is a cursor that reads entries in offset order across segment
+// boundaries. It only keeps track of the next offset to read, so it stays
+// valid while new segments are rolled and fails with ErrOffsetRemoved once
+// retention deletes the segment it points into.
+type Reader struct {
+	log    *SegmentedLog
+	offset int64
+
+	// history is set for readers created by NewHistoryReader. archived holds
+	// the entries of the archived segment read last, by offset.
+	history  bool
+	archived map[int64][]byte
+}
+
+// NewReader returns a Reader positioned at fromOffset. fromOffset may be equal
+// to NextOffset, in which case the reader starts tailing new entries. Offsets
+// removed by compaction are skipped.
+func (sl *SegmentedLog) NewReader(fromOffset int64) (*Reader, error) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	if sl.closed {
+		return nil, ErrClosed
+	}
+	if fromOffset < sl.segments[0].baseOffset {
+		return nil, fmt.Errorf("%w: offset %d", ErrOffsetRemoved, fromOffset)
+	}
+	if fromOffset > sl.activeSegment.nextOffset {
+		return nil, fmt.Errorf("offset %d is beyond the end of the log", fromOffset)
+	}
+
+	return &Reader{log: sl, offset: fromOffset}, nil
+}
+
+// NewHistoryReader is like NewReader, but the reader returns every entry that
+// was appended: entries removed by compaction are read from the archived copy
+// of their segment. Next fails with ErrCompacted when that copy does not exist,
+// rather than silently skipping the offset.
+func (sl *SegmentedLog) NewHistoryReader(fromOffset int64) (*Reader, error) {
+	r, err := sl.NewReader(fromOffset)
+	if err != nil {
+		return nil, err
+	}
+	r.history = true
+	return r, nil
+}
+
+// Offset returns the offset of the entry the next call to Next will return.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Next returns the next entry and its offset. It returns io.EOF when the
+// reader has caught up with the end of the log.
+func (r *Reader) Next() ([]byte, int64, error) {
+	for {
+		entry, offset, compacted, err := r.next()
+		if !compacted {
+			return entry, offset, err
+		}
+		// The archived copy is read without blocking appends
+		if err := r.loadArchived(offset); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// next returns the next entry, or reports that the entry at offset was
+// removed by compaction and must be read from the archive.
+func (r *Reader) next() (entry []byte, offset int64, compacted bool, err error) {
+	r.log.mu.RLock()
+	defer r.log.mu.RUnlock()
+
+	if r.log.closed {
+		return nil, 0, false, ErrClosed
+	}
+	if r.offset < r.log.segments[0].baseOffset {
+		return nil, 0, false, fmt.Errorf("%w: offset %d", ErrOffsetRemoved, r.offset)
+	}
+	for r.offset < r.log.activeSegment.nextOffset {
+		segment := r.log.findSegment(r.offset)
+		if segment == nil {
+			return nil, 0, false, fmt.Errorf("offset %d not found", r.offset)
+		}
+
+		offset := r.offset
+		entry, err := segment.read(offset - segment.baseOffset)
+		if errors.Is(err, ErrCompacted) {
+			if !r.history {
+				r.offset++
+				continue
+			}
+			if entry, ok := r.archived[offset]; ok {
+				r.offset++
+				return entry, offset, false, nil
+			}
+			return nil, offset, true, nil
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		r.offset++
+		return entry, offset, false, nil
+	}
+	return nil, 0, false, io.EOF
+}
+
+// loadArchived reads the archived copy of the segment holding offset. It
+// fails with ErrCompacted when the copy does not hold the entry at offset.
+func (r *Reader) loadArchived(offset int64) error {
+	r.log.mu.RLock()
+	segment := r.log.findSegment(offset)
+	masterKey := r.log.masterKey
+	r.log.mu.RUnlock()
+	if segment == nil || r.log.archiveDir == "" {
+		return fmt.Errorf("%w: offset %d is not archived", ErrCompacted, offset)
+	}
+
+	path := filepath.Join(r.log.archiveDir, fmt.Sprintf("%s%d%s", logFilePrefix, segment.baseOffset, logFileExt))
+	archived := make(map[int64][]byte)
+	err := ReadSegmentFile(path, masterKey, func(offset int64, entry []byte) error {
+		archived[offset] = entry
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: offset %d is not archived", ErrCompacted, offset)
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := archived[offset]; !ok {
+		return fmt.Errorf("%w: offset %d is not archived", ErrCompacted, offset)
+	}
+	r.archived = archived
+	return nil
+}
+
+// Wait blocks until the entry the reader points at has been appended.
+func (r *Reader) Wait(ctx context.Context) error {
+	return r.log.Wait(ctx, r.offset)
+}
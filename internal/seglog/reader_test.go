@@ -0,0 +1,179 @@
+package seglog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 2) // Small segment size to force rotation
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	r, err := sl.NewReader(1)
+	require.NoError(t, err, "Failed to create reader")
+
+	for i := 1; i < 5; i++ {
+		entry, offset, err := r.Next()
+		require.NoError(t, err, "Failed to read next entry")
+		assert.Equal(t, int64(i), offset, "Unexpected offset")
+		assert.Equal(t, fmt.Sprintf("entry %d", i), string(entry), "Unexpected entry content")
+	}
+
+	_, _, err = r.Next()
+	assert.Equal(t, io.EOF, err, "Expected EOF at end of log")
+
+	// New entries, including ones in a freshly rolled segment, become visible
+	_, err = sl.Append([]byte("entry 5"))
+	require.NoError(t, err, "Failed to append entry")
+
+	entry, offset, err := r.Next()
+	require.NoError(t, err, "Failed to read appended entry")
+	assert.Equal(t, int64(5), offset, "Unexpected offset")
+	assert.Equal(t, "entry 5", string(entry), "Unexpected entry content")
+}
+
+func TestReaderWait(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 100)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	r, err := sl.NewReader(sl.NextOffset())
+	require.NoError(t, err, "Failed to create reader")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, r.Wait(ctx), context.DeadlineExceeded, "Expected Wait to time out on an idle log")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Wait(context.Background())
+	}()
+
+	_, err = sl.Append([]byte("tailed"))
+	require.NoError(t, err, "Failed to append entry")
+
+	select {
+	case err := <-done:
+		require.NoError(t, err, "Wait returned an error")
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not wake up after append")
+	}
+
+	entry, _, err := r.Next()
+	require.NoError(t, err, "Failed to read tailed entry")
+	assert.Equal(t, "tailed", string(entry), "Unexpected entry content")
+}
+
+func TestReaderSegmentRemoved(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 2)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	r, err := sl.NewReader(0)
+	require.NoError(t, err, "Failed to create reader")
+
+	require.NoError(t, sl.RemoveSegmentsBefore(4), "Failed to remove segments")
+	assert.Equal(t, int64(4), sl.OldestOffset(), "Unexpected oldest offset")
+	assert.Len(t, sl.GetAllSegmentPaths(), 1, "Expected only the active segment to remain")
+
+	_, _, err = r.Next()
+	assert.True(t, errors.Is(err, ErrOffsetRemoved), "Expected ErrOffsetRemoved, got %v", err)
+
+	_, err = sl.NewReader(0)
+	assert.True(t, errors.Is(err, ErrOffsetRemoved), "Expected ErrOffsetRemoved, got %v", err)
+}
+
+func TestWaitReturnsOnClose(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 100)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sl.Wait(context.Background(), 0)
+	}()
+
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrClosed, err, "Expected ErrClosed")
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after close")
+	}
+}
+
+func TestHistoryReader(t *testing.T) {
+	policy := CompactionPolicy{Key: testKey}
+	appendEntries := func(sl *SegmentedLog) {
+		for _, entry := range []string{"a=1", "a=2", "a=3", "b=1", "c=1"} {
+			_, err := sl.Append([]byte(entry))
+			require.NoError(t, err, "Failed to append entry")
+		}
+	}
+
+	t.Run("archived", func(t *testing.T) {
+		sl, err := NewSegmentedLog(t.TempDir(), 2, WithArchiveDir(filepath.Join(t.TempDir(), "archive")))
+		require.NoError(t, err, "Failed to create SegmentedLog")
+		defer sl.Close()
+		appendEntries(sl)
+		require.NoError(t, sl.Archive(), "Failed to archive segments")
+		stats, err := sl.Compact(policy)
+		require.NoError(t, err, "Compaction failed")
+		require.Equal(t, 2, stats.EntriesRemoved)
+
+		r, err := sl.NewHistoryReader(0)
+		require.NoError(t, err, "Failed to create reader")
+		for i, want := range []string{"a=1", "a=2", "a=3", "b=1", "c=1"} {
+			entry, offset, err := r.Next()
+			require.NoError(t, err, "Failed to read entry %d", i)
+			assert.Equal(t, int64(i), offset, "Unexpected offset")
+			assert.Equal(t, want, string(entry), "Compacted entries should be read from the archive")
+		}
+		_, _, err = r.Next()
+		assert.Equal(t, io.EOF, err, "Expected EOF at end of log")
+	})
+
+	t.Run("not archived", func(t *testing.T) {
+		sl, err := NewSegmentedLog(t.TempDir(), 2)
+		require.NoError(t, err, "Failed to create SegmentedLog")
+		defer sl.Close()
+		appendEntries(sl)
+		_, err = sl.Compact(policy)
+		require.NoError(t, err, "Compaction failed")
+
+		r, err := sl.NewHistoryReader(0)
+		require.NoError(t, err, "Failed to create reader")
+		_, _, err = r.Next()
+		assert.ErrorIs(t, err, ErrCompacted, "Compacted offsets must not be skipped")
+		assert.Equal(t, int64(0), r.Offset(), "The reader should stay at the compacted offset")
+
+		r, err = sl.NewReader(0)
+		require.NoError(t, err, "Failed to create reader")
+		_, offset, err := r.Next()
+		require.NoError(t, err, "Readers from NewReader skip compacted offsets")
+		assert.Equal(t, int64(2), offset)
+	})
+}
@@ -0,0 +1,218 @@
+package seglog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ScrubResult describes a segment in which Scrub found a problem and what was
+// done about it.
+type ScrubResult struct {
+	Path string
+
+	// IndexRebuilt is set when the index did not match the segment file
+	IndexRebuilt bool
+
+	// CorruptEntries is the number of unreadable entries, which are replaced
+	// by empty lines so that no offset is ever reused. A new segment is rolled
+	// first when they are in the active segment.
+	CorruptEntries int
+	Repaired       bool
+
+	// LostPath is where a copy of the segment was kept before it was modified
+	LostPath string
+}
+
+// Scrub verifies the index and every entry of all segments, using validate to
+// check that an entry is well formed. Corrupted segments are copied to lostDir
+// before being repaired. Closed segments are checked without blocking appends;
+// the active segment is only locked while it is checked and rolled.
+func (sl *SegmentedLog) Scrub(validate func(entry []byte) error, lostDir string) ([]ScrubResult, error) {
+	sl.compactMu.Lock()
+	defer sl.compactMu.Unlock()
+
+	sl.mu.RLock()
+	if sl.closed {
+		sl.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	closed := make([]*LogSegment, len(sl.segments)-1)
+	copy(closed, sl.segments[:len(sl.segments)-1])
+	sl.mu.RUnlock()
+
+	var results []ScrubResult
+	for _, segment := range closed {
+		result, err := sl.scrubClosedSegment(segment, validate, lostDir)
+		if err != nil {
+			return results, err
+		}
+		if result != nil {
+			results = append(results, *result)
+		}
+	}
+
+	result, err := sl.scrubActiveSegment(validate, lostDir)
+	if err != nil {
+		return results, err
+	}
+	if result != nil {
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+func (sl *SegmentedLog) scrubClosedSegment(segment *LogSegment, validate func([]byte) error, lostDir string) (*ScrubResult, error) {
+	result := ScrubResult{Path: segment.file.Name()}
+
+	indexOK, err := segment.checkIndex()
+	if err != nil {
+		return nil, err
+	}
+	if !indexOK {
+		sl.mu.Lock()
+		err := sl.rebuildIndex(segment, segment.nextOffset)
+		sl.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		result.IndexRebuilt = true
+	}
+
+	for offset := segment.baseOffset; offset < segment.nextOffset; offset++ {
+		if segment.corrupt(offset, validate) {
+			result.CorruptEntries++
+		}
+	}
+
+	if result.CorruptEntries > 0 {
+		info, err := segment.file.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat segment file: %w", err)
+		}
+		if result.LostPath, err = copyToLost(segment.file.Name(), lostDir); err != nil {
+			return nil, err
+		}
+		err = sl.rewriteSegment(segment, info.ModTime(), func(offset int64, entry []byte, err error) ([]byte, error) {
+			if err != nil || validate(entry) != nil {
+				return nil, nil
+			}
+			return entry, nil
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		result.Repaired = true
+	}
+
+	if !result.IndexRebuilt && result.CorruptEntries == 0 {
+		return nil, nil
+	}
+	return &result, nil
+}
+
+// scrubActiveSegment checks the active segment. When it holds corrupt
+// entries, a new segment is rolled so that it can be repaired like a closed
+// segment.
+func (sl *SegmentedLog) scrubActiveSegment(validate func([]byte) error, lostDir string) (*ScrubResult, error) {
+	sl.mu.Lock()
+	segment := sl.activeSegment
+	result := ScrubResult{Path: segment.file.Name()}
+
+	indexOK, err := segment.checkIndex()
+	if err == nil && !indexOK {
+		err = sl.rebuildIndex(segment, segment.nextOffset)
+		result.IndexRebuilt = true
+	}
+	if err != nil {
+		sl.mu.Unlock()
+		return nil, err
+	}
+
+	for offset := segment.baseOffset; offset < segment.nextOffset; offset++ {
+		if segment.corrupt(offset, validate) {
+			result.CorruptEntries++
+		}
+	}
+	if result.CorruptEntries > 0 {
+		err = sl.createNewSegment(segment.nextOffset)
+	}
+	sl.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if result.CorruptEntries > 0 {
+		closed, err := sl.scrubClosedSegment(segment, validate, lostDir)
+		if err != nil || closed == nil {
+			return closed, err
+		}
+		closed.IndexRebuilt = closed.IndexRebuilt || result.IndexRebuilt
+		return closed, nil
+	}
+	if !result.IndexRebuilt {
+		return nil, nil
+	}
+	return &result, nil
+}
+
+// corrupt reports whether the entry at offset cannot be read or is rejected
+// by validate. Compacted entries are never corrupt.
+func (s *LogSegment) corrupt(offset int64, validate func([]byte) error) bool {
+	entry, err := s.read(offset - s.baseOffset)
+	if errors.Is(err, ErrCompacted) {
+		return false
+	}
+	return err != nil || validate(entry) != nil
+}
+
+// checkIndex compares every index entry with the line positions in the
+// segment file.
+func (s *LogSegment) checkIndex() (bool, error) {
+	info, err := s.index.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat index file: %w", err)
+	}
+	if info.Size() != (s.nextOffset-s.baseOffset)*indexEntrySize {
+		return false, nil
+	}
+
+	position := s.dataStart()
+	reader := bufio.NewReader(io.NewSectionReader(s.file, position, s.size-position))
+	for relativeOffset := int64(0); relativeOffset < s.nextOffset-s.baseOffset; relativeOffset++ {
+		indexed, indexedPosition, err := s.readIndexEntry(relativeOffset)
+		if err != nil {
+			return false, err
+		}
+		if indexed != relativeOffset || indexedPosition != position {
+			return false, nil
+		}
+
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return false, fmt.Errorf("failed to scan segment file: %w", err)
+		}
+		if len(line) == 0 {
+			return false, nil
+		}
+		position += int64(len(line))
+	}
+	return position == s.size, nil
+}
+
+// copyToLost keeps a copy of a damaged file in lostDir and returns its path.
+func copyToLost(path, lostDir string) (string, error) {
+	if err := os.MkdirAll(lostDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create lost directory: %w", err)
+	}
+
+	lostPath := filepath.Join(lostDir, fmt.Sprintf("%s.%s", filepath.Base(path), time.Now().UTC().Format("20060102T150405.000000000")))
+	if err := copyFile(path, lostPath); err != nil {
+		return "", fmt.Errorf("failed to copy %s to %s: %w", path, lostPath, err)
+	}
+	return lostPath, nil
+}
@@ -0,0 +1,152 @@
+package seglog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validateTestEntry(entry []byte) error {
+	if !strings.HasPrefix(string(entry), "entry") {
+		return fmt.Errorf("malformed entry %q", entry)
+	}
+	return nil
+}
+
+func TestScrubHealthyLog(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 2)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	results, err := sl.Scrub(validateTestEntry, filepath.Join(dir, "lost"))
+	require.NoError(t, err, "Scrub failed")
+	assert.Empty(t, results, "Expected no findings on a healthy log")
+	_, err = os.Stat(filepath.Join(dir, "lost"))
+	assert.True(t, os.IsNotExist(err), "Lost directory should only be created when needed")
+}
+
+func TestScrubRepairsClosedSegment(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 3)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for i := 0; i < 4; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	// Corrupt the second entry of the closed segment in place
+	segmentPath := filepath.Join(dir, "log-0.seg")
+	content, err := os.ReadFile(segmentPath)
+	require.NoError(t, err)
+	corrupted := strings.Replace(string(content), "entry 1", "garbage", 1)
+	require.NoError(t, os.WriteFile(segmentPath, []byte(corrupted), 0644))
+
+	lostDir := filepath.Join(dir, "lost")
+	results, err := sl.Scrub(validateTestEntry, lostDir)
+	require.NoError(t, err, "Scrub failed")
+	require.Len(t, results, 1, "Expected one finding")
+	assert.Equal(t, segmentPath, results[0].Path)
+	assert.Equal(t, 1, results[0].CorruptEntries)
+	assert.True(t, results[0].Repaired)
+
+	lost, err := os.ReadFile(results[0].LostPath)
+	require.NoError(t, err, "Expected a copy of the damaged segment in the lost directory")
+	assert.Equal(t, corrupted, string(lost))
+
+	_, err = sl.Read(1)
+	assert.True(t, errors.Is(err, ErrCompacted), "Expected the corrupt entry to be dropped, got %v", err)
+	for _, offset := range []int64{0, 2, 3} {
+		entry, err := sl.Read(offset)
+		require.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, fmt.Sprintf("entry %d", offset), string(entry))
+	}
+}
+
+func TestScrubRepairsActiveSegmentAndRebuildsIndex(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 100)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	_, err = sl.Append([]byte("torn wri"))
+	require.NoError(t, err, "Failed to append entry")
+
+	// Scramble the index so it has to be rebuilt first
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "log-0.index"), make([]byte, 4*indexEntrySize), 0644))
+
+	results, err := sl.Scrub(validateTestEntry, filepath.Join(dir, "lost"))
+	require.NoError(t, err, "Scrub failed")
+	require.Len(t, results, 1, "Expected one finding")
+	assert.Equal(t, filepath.Join(dir, "log-0.seg"), results[0].Path)
+	assert.True(t, results[0].IndexRebuilt)
+	assert.Equal(t, 1, results[0].CorruptEntries)
+	assert.True(t, results[0].Repaired)
+	assert.NotEmpty(t, results[0].LostPath)
+
+	// Offsets that were handed out are never reused
+	assert.Equal(t, int64(4), sl.NextOffset(), "Expected the corrupt entry to keep its offset")
+	offset, err := sl.Append([]byte("entry 4"))
+	require.NoError(t, err, "Failed to append after the repair")
+	assert.Equal(t, int64(4), offset)
+	assert.FileExists(t, filepath.Join(dir, "log-4.seg"), "Expected a new active segment")
+
+	_, err = sl.Read(3)
+	assert.ErrorIs(t, err, ErrCompacted, "Expected the corrupt entry to be blanked")
+	for _, i := range []int64{0, 1, 2, 4} {
+		entry, err := sl.Read(i)
+		require.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, fmt.Sprintf("entry %d", i), string(entry))
+	}
+}
+
+func TestRebuildIndexKeepsOffsets(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 3)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	for i := 0; i < 4; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	require.NoError(t, sl.Close())
+
+	// Lose the last line of the closed segment and its index
+	segmentPath := filepath.Join(dir, "log-0.seg")
+	content, err := os.ReadFile(segmentPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(segmentPath, []byte(strings.TrimSuffix(string(content), "entry 2\n")), 0644))
+	require.NoError(t, os.Remove(filepath.Join(dir, "log-0.index")))
+
+	sl, err = NewSegmentedLog(dir, 3)
+	require.NoError(t, err, "Failed to reopen SegmentedLog")
+	defer sl.Close()
+	_, err = sl.Read(2)
+	assert.ErrorIs(t, err, ErrCompacted, "Expected the lost entry to read as compacted")
+
+	reader, err := sl.NewReader(0)
+	require.NoError(t, err, "Failed to create reader")
+	var offsets []int64
+	for i := 0; i < 3; i++ {
+		_, offset, err := reader.Next()
+		require.NoError(t, err, "Expected the reader to cross the lost entry")
+		offsets = append(offsets, offset)
+	}
+	assert.Equal(t, []int64{0, 1, 3}, offsets)
+}
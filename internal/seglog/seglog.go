@@ -2,20 +2,40 @@ package seglog
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/encryption"
 )
 
 const (
 	defaultSegmentSize = 1000 // Number of entries per segment
 	logFilePrefix      = "log-"
 	logFileExt         = ".seg"
+	indexFileExt       = ".index"
+
+	// Each index entry maps a relative offset (4 bytes) to the byte position
+	// of the entry in the segment file (8 bytes), similar to Kafka's .index files.
+	indexEntrySize = 12
+)
+
+var (
+	ErrClosed        = errors.New("segmented log is closed")
+	ErrOffsetRemoved = errors.New("offset has been removed by retention")
+	ErrCompacted     = errors.New("entry has been removed by compaction")
+	ErrEmptyEntry    = errors.New("cannot append an empty entry")
 )
 
 type SegmentedLog struct {
@@ -24,15 +44,59 @@ type SegmentedLog struct {
 	segmentSize   int
 	activeSegment *LogSegment
 	segments      []*LogSegment
+	closed        bool
+
+	// compactMu serializes compaction with retention so closed segments are
+	// not removed while they are being rewritten
+	compactMu sync.Mutex
+
+	// appended is closed and replaced on every Append to wake up waiting tailers
+	appended chan struct{}
+
+	// masterKey is set when new segments must be encrypted
+	masterKey *encryption.MasterKey
+
+	// archiveDir receives a copy of every closed segment when set. The
+	// archiver is woken through archiveWake whenever a segment is closed.
+	archiveDir  string
+	archiveWake chan struct{}
+	archiveStop chan struct{}
+	archiveDone chan struct{}
+
+	// retainFrom is the lowest offset a reader still needs, see RetainFrom.
+	// It is math.MaxInt64 when nothing is retained.
+	retainFrom int64
 }
 
 type LogSegment struct {
 	file       *os.File
+	index      *os.File
 	baseOffset int64
 	nextOffset int64
+	size       int64 // bytes written to file, entries are appended at this position
+
+	// header and key are only set for encrypted segments, whose entries are
+	// stored as encrypted lines after the header
+	header []byte
+	key    *encryption.DataKey
+
+	// archived is set by Archive once the segment has been copied to the
+	// archive directory. It is only accessed with compactMu held.
+	archived bool
+}
+
+// Option configures optional behaviour of a SegmentedLog.
+type Option func(*SegmentedLog)
+
+// WithEncryption encrypts new segments with a data key wrapped by mk. It is
+// also required to read segments that were encrypted earlier.
+func WithEncryption(mk *encryption.MasterKey) Option {
+	return func(sl *SegmentedLog) {
+		sl.masterKey = mk
+	}
 }
 
-func NewSegmentedLog(dir string, segmentSize int) (*SegmentedLog, error) {
+func NewSegmentedLog(dir string, segmentSize int, opts ...Option) (*SegmentedLog, error) {
 	if segmentSize <= 0 {
 		segmentSize = defaultSegmentSize
 	}
@@ -40,11 +104,19 @@ func NewSegmentedLog(dir string, segmentSize int) (*SegmentedLog, error) {
 	sl := &SegmentedLog{
 		dir:         dir,
 		segmentSize: segmentSize,
+		appended:    make(chan struct{}),
+		retainFrom:  math.MaxInt64,
+	}
+	for _, opt := range opts {
+		opt(sl)
 	}
 
 	if err := sl.initialize(); err != nil {
 		return nil, err
 	}
+	if sl.archiveDir != "" {
+		sl.startArchiver()
+	}
 
 	return sl, nil
 }
@@ -54,36 +126,30 @@ func (sl *SegmentedLog) initialize() error {
 		return fmt.Errorf("failed to create log directory: %v", err)
 	}
 
-	files, err := filepath.Glob(filepath.Join(sl.dir, logFilePrefix+"*"+logFileExt))
+	files, err := SegmentFiles(sl.dir)
 	if err != nil {
-		return fmt.Errorf("failed to read log directory: %v", err)
+		return err
 	}
 
-	// Sort files and load existing segments
-	sort.Slice(files, func(i, j int) bool {
-		return files[i] < files[j]
-	})
-
-	for _, file := range files {
-		segment := &LogSegment{}
-		segment.file, err = os.OpenFile(file, os.O_RDWR, 0644)
+	for i, file := range files {
+		segment := &LogSegment{baseOffset: file.BaseOffset}
+		// Finish a key rotation that was interrupted while rewriting the header
+		if err := encryption.RecoverRewrap(file.Path); err != nil {
+			return err
+		}
+		segment.file, err = os.OpenFile(file.Path, os.O_RDWR, 0644)
 		if err != nil {
 			return fmt.Errorf("failed to open segment file: %v", err)
 		}
 
-		// Extract base offset from filename
-		baseOffset, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), logFilePrefix), logFileExt), 10, 64)
-		if err != nil {
-			return fmt.Errorf("failed to parse base offset from filename: %v", err)
+		// Closed segments end where the next one starts
+		end := int64(-1)
+		if i+1 < len(files) {
+			end = files[i+1].BaseOffset
 		}
-		segment.baseOffset = baseOffset
-
-		// Calculate nextOffset by scanning the file
-		nextOffset, err := sl.calculateNextOffset(segment)
-		if err != nil {
-			return fmt.Errorf("failed to calculate next offset: %v", err)
+		if err := sl.loadIndex(segment, end); err != nil {
+			return fmt.Errorf("failed to load segment index: %w", err)
 		}
-		segment.nextOffset = nextOffset
 
 		sl.segments = append(sl.segments, segment)
 	}
@@ -96,28 +162,224 @@ func (sl *SegmentedLog) initialize() error {
 		sl.activeSegment = sl.segments[len(sl.segments)-1]
 	}
 
+	// Never append plaintext entries to a segment once encryption is enabled
+	if sl.masterKey != nil && sl.activeSegment.key == nil {
+		if err := sl.replacePlaintextActiveSegment(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (sl *SegmentedLog) calculateNextOffset(segment *LogSegment) (int64, error) {
-	scanner := bufio.NewScanner(segment.file)
-	offset := segment.baseOffset
+// SegmentFile is a segment file found on disk.
+type SegmentFile struct {
+	Path       string
+	BaseOffset int64
+}
 
-	for scanner.Scan() {
-		// Assuming each entry is on a new line
-		offset++
+// SegmentFiles lists the segment files in dir ordered by base offset.
+func SegmentFiles(dir string) ([]SegmentFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, logFilePrefix+"*"+logFileExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log directory: %v", err)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return 0, err
+	// Extract base offsets from filenames
+	files := make([]SegmentFile, 0, len(paths))
+	for _, path := range paths {
+		baseOffset, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), logFilePrefix), logFileExt), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse base offset from filename: %v", err)
+		}
+		files = append(files, SegmentFile{Path: path, BaseOffset: baseOffset})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].BaseOffset < files[j].BaseOffset
+	})
+	return files, nil
+}
+
+// replacePlaintextActiveSegment rolls a new encrypted segment, or recreates the
+// active segment encrypted when it has no entries yet.
+func (sl *SegmentedLog) replacePlaintextActiveSegment() error {
+	active := sl.activeSegment
+	if active.nextOffset > active.baseOffset {
+		return sl.createNewSegment(active.nextOffset)
 	}
 
-	// Reset file pointer to the end
-	if _, err := segment.file.Seek(0, io.SeekEnd); err != nil {
-		return 0, fmt.Errorf("failed to reset file pointer: %w", err)
+	if err := active.remove(); err != nil {
+		return err
 	}
+	sl.segments = sl.segments[:len(sl.segments)-1]
+	return sl.createNewSegment(active.baseOffset)
+}
 
-	return offset, nil
+func indexPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, logFileExt) + indexFileExt
+}
+
+// loadIndex opens the sidecar index of a segment and derives nextOffset and
+// size from it. The index is rebuilt from the segment file when it is missing
+// or does not match the segment contents, or when the segment does not end at
+// end, see rebuildIndex.
+func (sl *SegmentedLog) loadIndex(segment *LogSegment, end int64) error {
+	info, err := segment.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat segment file: %w", err)
+	}
+	segment.size = info.Size()
+
+	if segment.header, err = encryption.ReadHeader(segment.file); err != nil {
+		return err
+	}
+	if segment.header != nil {
+		if segment.key, err = encryption.OpenHeader(segment.header, sl.masterKey); err != nil {
+			return fmt.Errorf("failed to open encrypted segment %s: %w", segment.file.Name(), err)
+		}
+	}
+
+	segment.index, err = os.OpenFile(indexPath(segment.file.Name()), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open index file: %w", err)
+	}
+
+	valid, err := sl.validIndex(segment)
+	if err != nil {
+		return err
+	}
+	if valid && (end < 0 || segment.nextOffset == end) {
+		return nil
+	}
+	return sl.rebuildIndex(segment, end)
+}
+
+// validIndex checks that the index is well formed and that its last entry
+// ends exactly where the segment file ends.
+func (sl *SegmentedLog) validIndex(segment *LogSegment) (bool, error) {
+	info, err := segment.index.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat index file: %w", err)
+	}
+	if info.Size()%indexEntrySize != 0 {
+		return false, nil
+	}
+
+	count := info.Size() / indexEntrySize
+	segment.nextOffset = segment.baseOffset + count
+	if count == 0 {
+		return segment.size == segment.dataStart(), nil
+	}
+
+	relativeOffset, position, err := segment.readIndexEntry(count - 1)
+	if err != nil {
+		return false, err
+	}
+	if relativeOffset != count-1 || position >= segment.size {
+		return false, nil
+	}
+
+	// The last entry must be the only line between its position and the end of the file
+	tail := make([]byte, segment.size-position)
+	if _, err := segment.file.ReadAt(tail, position); err != nil {
+		return false, fmt.Errorf("failed to read segment tail: %w", err)
+	}
+	return bytes.IndexByte(tail, '\n') == len(tail)-1, nil
+}
+
+// rebuildIndex scans the segment file and rewrites its index from scratch,
+// dropping a torn entry at the end of the file. Unless end is negative, the
+// segment keeps the offsets up to end, which were handed out already: entries
+// missing from the file are added as empty lines, like compacted entries.
+func (sl *SegmentedLog) rebuildIndex(segment *LogSegment, end int64) error {
+	if err := segment.index.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate index file: %w", err)
+	}
+	if _, err := segment.index.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to reset index file pointer: %w", err)
+	}
+
+	position := segment.dataStart()
+	reader := bufio.NewReader(io.NewSectionReader(segment.file, position, segment.size-position))
+	writer := bufio.NewWriter(segment.index)
+	var count int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to scan segment file: %w", err)
+		}
+		if err := writeIndexEntry(writer, count, position); err != nil {
+			return err
+		}
+		position += int64(len(line))
+		count++
+	}
+
+	// An unterminated last line is an entry torn by a crash. It was never
+	// acknowledged, and new entries must not be appended to it.
+	if position < segment.size {
+		if err := segment.file.Truncate(position); err != nil {
+			return fmt.Errorf("failed to truncate torn entry: %w", err)
+		}
+		segment.size = position
+	}
+
+	if missing := end - segment.baseOffset - count; missing > 0 {
+		for ; missing > 0; missing-- {
+			if err := writeIndexEntry(writer, count, position); err != nil {
+				return err
+			}
+			position++
+			count++
+		}
+		if _, err := segment.file.WriteAt(bytes.Repeat([]byte("\n"), int(position-segment.size)), segment.size); err != nil {
+			return fmt.Errorf("failed to write missing entries: %w", err)
+		}
+		segment.size = position
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+	segment.nextOffset = segment.baseOffset + count
+	return nil
+}
+
+// dataStart returns the position of the first entry, right after the header of
+// encrypted segments.
+func (s *LogSegment) dataStart() int64 {
+	return int64(len(s.header))
+}
+
+// encode returns the line stored in the segment file for entry.
+func (s *LogSegment) encode(entry []byte) []byte {
+	if s.key != nil {
+		entry = s.key.SealLine(entry)
+	}
+	line := make([]byte, 0, len(entry)+1)
+	line = append(line, entry...)
+	return append(line, '\n')
+}
+
+func writeIndexEntry(w io.Writer, relativeOffset, position int64) error {
+	var buf [indexEntrySize]byte
+	binary.BigEndian.PutUint32(buf[0:4], uint32(relativeOffset))
+	binary.BigEndian.PutUint64(buf[4:12], uint64(position))
+	if _, err := w.Write(buf[:]); err != nil {
+		return fmt.Errorf("failed to write index entry: %w", err)
+	}
+	return nil
+}
+
+func (s *LogSegment) readIndexEntry(relativeOffset int64) (int64, int64, error) {
+	var buf [indexEntrySize]byte
+	if _, err := s.index.ReadAt(buf[:], relativeOffset*indexEntrySize); err != nil {
+		return 0, 0, fmt.Errorf("failed to read index entry: %w", err)
+	}
+	return int64(binary.BigEndian.Uint32(buf[0:4])), int64(binary.BigEndian.Uint64(buf[4:12])), nil
 }
 
 func (sl *SegmentedLog) createNewSegment(baseOffset int64) error {
@@ -126,12 +388,33 @@ func (sl *SegmentedLog) createNewSegment(baseOffset int64) error {
 		nextOffset: baseOffset,
 	}
 
-	segmentFile, err := os.OpenFile(filepath.Join(sl.dir, fmt.Sprintf("%s%d%s", logFilePrefix, baseOffset, logFileExt)), os.O_CREATE|os.O_RDWR, 0644)
+	segmentPath := filepath.Join(sl.dir, fmt.Sprintf("%s%d%s", logFilePrefix, baseOffset, logFileExt))
+	segmentFile, err := os.OpenFile(segmentPath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to create new segment file: %v", err)
 	}
 
+	indexFile, err := os.OpenFile(indexPath(segmentPath), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		segmentFile.Close()
+		return fmt.Errorf("failed to create new index file: %v", err)
+	}
+
 	segment.file = segmentFile
+	segment.index = indexFile
+
+	if sl.masterKey != nil {
+		if segment.header, segment.key, err = encryption.NewHeader(sl.masterKey); err != nil {
+			segment.close()
+			return err
+		}
+		if _, err := segmentFile.WriteAt(segment.header, 0); err != nil {
+			segment.close()
+			return fmt.Errorf("failed to write segment header: %v", err)
+		}
+		segment.size = segment.dataStart()
+	}
+
 	sl.segments = append(sl.segments, segment)
 	sl.activeSegment = segment
 
@@ -142,21 +425,45 @@ func (sl *SegmentedLog) Append(entry []byte) (int64, error) {
 	sl.mu.Lock()
 	defer sl.mu.Unlock()
 
+	if sl.closed {
+		return 0, ErrClosed
+	}
+	// Empty lines mark offsets that were removed by compaction
+	if len(entry) == 0 {
+		return 0, ErrEmptyEntry
+	}
+
 	if sl.activeSegment.nextOffset-sl.activeSegment.baseOffset >= int64(sl.segmentSize) {
 		if err := sl.createNewSegment(sl.activeSegment.nextOffset); err != nil {
 			return 0, err
 		}
+		// Copying is left to the archiver, the segment is neither compacted
+		// nor removed before it is archived
+		sl.wakeArchiver()
 	}
 
-	offset := sl.activeSegment.nextOffset
-	if _, err := sl.activeSegment.file.Write(entry); err != nil {
+	segment := sl.activeSegment
+	offset := segment.nextOffset
+
+	// Use positional writes so concurrent reads never move the append position
+	line := segment.encode(entry)
+	if _, err := segment.file.WriteAt(line, segment.size); err != nil {
 		return 0, err
 	}
-	if _, err := sl.activeSegment.file.Write([]byte("\n")); err != nil {
+
+	var indexEntry bytes.Buffer
+	if err := writeIndexEntry(&indexEntry, offset-segment.baseOffset, segment.size); err != nil {
 		return 0, err
 	}
+	if _, err := segment.index.WriteAt(indexEntry.Bytes(), (offset-segment.baseOffset)*indexEntrySize); err != nil {
+		return 0, fmt.Errorf("failed to write index entry: %w", err)
+	}
+
+	segment.size += int64(len(line))
+	segment.nextOffset++
 
-	sl.activeSegment.nextOffset++
+	close(sl.appended)
+	sl.appended = make(chan struct{})
 	return offset, nil
 }
 
@@ -164,50 +471,275 @@ func (sl *SegmentedLog) Read(offset int64) ([]byte, error) {
 	sl.mu.RLock()
 	defer sl.mu.RUnlock()
 
-	// Find the correct segment
-	var segment *LogSegment
-	for _, seg := range sl.segments {
-		if offset >= seg.baseOffset && offset < seg.nextOffset {
-			segment = seg
+	segment := sl.findSegment(offset)
+	if segment == nil {
+		return nil, fmt.Errorf("offset %d not found", offset)
+	}
+
+	return segment.read(offset - segment.baseOffset)
+}
+
+// findSegment returns the segment containing offset, or nil if no segment does.
+// Callers must hold sl.mu.
+func (sl *SegmentedLog) findSegment(offset int64) *LogSegment {
+	i := sort.Search(len(sl.segments), func(i int) bool {
+		return sl.segments[i].nextOffset > offset
+	})
+	if i == len(sl.segments) || offset < sl.segments[i].baseOffset {
+		return nil
+	}
+	return sl.segments[i]
+}
+
+// read returns the entry at relativeOffset using the index to locate it, so the
+// cost does not depend on the position of the entry in the segment.
+func (s *LogSegment) read(relativeOffset int64) ([]byte, error) {
+	_, start, err := s.readIndexEntry(relativeOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	end := s.size
+	if relativeOffset+1 < s.nextOffset-s.baseOffset {
+		if _, end, err = s.readIndexEntry(relativeOffset + 1); err != nil {
+			return nil, err
+		}
+	}
+	if end <= start {
+		return nil, fmt.Errorf("corrupt index entry at offset %d", s.baseOffset+relativeOffset)
+	}
+
+	entry := make([]byte, end-start)
+	if _, err := s.file.ReadAt(entry, start); err != nil {
+		return nil, fmt.Errorf("failed to read entry at offset %d: %w", s.baseOffset+relativeOffset, err)
+	}
+
+	entry = bytes.TrimSuffix(entry, []byte("\n"))
+	if len(entry) == 0 {
+		return nil, fmt.Errorf("%w: offset %d", ErrCompacted, s.baseOffset+relativeOffset)
+	}
+	if s.key != nil {
+		if entry, err = s.key.OpenLine(entry); err != nil {
+			return nil, fmt.Errorf("failed to decrypt entry at offset %d: %w", s.baseOffset+relativeOffset, err)
+		}
+	}
+	return entry, nil
+}
+
+// OldestOffset returns the first offset still retained by the log.
+func (sl *SegmentedLog) OldestOffset() int64 {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.segments[0].baseOffset
+}
+
+// NextOffset returns the offset that will be assigned to the next appended entry.
+func (sl *SegmentedLog) NextOffset() int64 {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.activeSegment.nextOffset
+}
+
+// Notify returns a channel that is closed the next time an entry is appended
+// or the log is closed.
+func (sl *SegmentedLog) Notify() <-chan struct{} {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.appended
+}
+
+// Wait blocks until an entry exists at offset, the log is closed or ctx is done.
+func (sl *SegmentedLog) Wait(ctx context.Context, offset int64) error {
+	for {
+		sl.mu.RLock()
+		closed, next, appended := sl.closed, sl.activeSegment.nextOffset, sl.appended
+		sl.mu.RUnlock()
+
+		if closed {
+			return ErrClosed
+		}
+		if offset < next {
+			return nil
+		}
+
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// RetainFrom keeps the segments holding offset and any later entry from being
+// removed or compacted, so that a reader starting at offset sees every entry
+// appended since. math.MaxInt64 releases the segments again.
+func (sl *SegmentedLog) RetainFrom(offset int64) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.retainFrom = offset
+}
+
+// errLiveEntry stops the scan of a segment at its first remaining entry.
+var errLiveEntry = errors.New("segment holds entries")
+
+// ExpiredOffset returns the offset before which every closed segment was last
+// written more than maxAge ago and no longer holds any entry, because all of
+// them were removed by compaction. Passing it to RemoveSegmentsBefore applies
+// a retention window without dropping entries needed to replay the log.
+func (sl *SegmentedLog) ExpiredOffset(maxAge time.Duration) (int64, error) {
+	sl.compactMu.Lock()
+	defer sl.compactMu.Unlock()
+
+	sl.mu.RLock()
+	if sl.closed {
+		sl.mu.RUnlock()
+		return 0, ErrClosed
+	}
+	closed := make([]*LogSegment, len(sl.segments)-1)
+	copy(closed, sl.segments[:len(sl.segments)-1])
+	offset := sl.segments[0].baseOffset
+	sl.mu.RUnlock()
+
+	for _, segment := range closed {
+		info, err := segment.file.Stat()
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat segment file: %w", err)
+		}
+		if time.Since(info.ModTime()) <= maxAge {
+			break
+		}
+		err = segment.scan(func(int64, []byte) error { return errLiveEntry })
+		if errors.Is(err, errLiveEntry) {
 			break
 		}
+		if err != nil {
+			return 0, err
+		}
+		offset = segment.nextOffset
 	}
+	return offset, nil
+}
 
-	if segment == nil {
-		return nil, fmt.Errorf("offset %d not found", offset)
+// RemoveSegmentsBefore deletes every closed segment whose entries are all
+// below offset, or below the offset passed to RetainFrom if it is lower. The
+// active segment is never removed, and neither are segments that were not
+// archived yet.
+func (sl *SegmentedLog) RemoveSegmentsBefore(offset int64) error {
+	sl.compactMu.Lock()
+	defer sl.compactMu.Unlock()
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	offset = min(offset, sl.retainFrom)
+	for len(sl.segments) > 1 && sl.segments[0].nextOffset <= offset {
+		segment := sl.segments[0]
+		if sl.archiveDir != "" && !segment.archived {
+			break
+		}
+		if err := segment.remove(); err != nil {
+			return err
+		}
+		sl.segments = sl.segments[1:]
 	}
+	return nil
+}
+
+// sync flushes the segment and its index to stable storage.
+func (s *LogSegment) sync() error {
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment file: %w", err)
+	}
+	if err := s.index.Sync(); err != nil {
+		return fmt.Errorf("failed to sync index file: %w", err)
+	}
+	return nil
+}
 
-	// Calculate the relative offset within the segment
-	relativeOffset := offset - segment.baseOffset
+func (s *LogSegment) close() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("failed to close segment file: %w", err)
+	}
+	if err := s.index.Close(); err != nil {
+		return fmt.Errorf("failed to close index file: %w", err)
+	}
+	return nil
+}
 
-	// Seek to the correct position in the file
-	_, err := segment.file.Seek(0, io.SeekStart)
-	if err != nil {
-		return nil, fmt.Errorf("failed to seek to start of file: %w", err)
+func (s *LogSegment) remove() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.file.Name()); err != nil {
+		return fmt.Errorf("failed to remove segment file: %w", err)
 	}
+	if err := os.Remove(s.index.Name()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove index file: %w", err)
+	}
+	return nil
+}
 
-	// Read line by line until we reach the desired offset
-	scanner := bufio.NewScanner(segment.file)
-	for i := int64(0); i < relativeOffset; i++ {
-		if !scanner.Scan() {
-			return nil, fmt.Errorf("unexpected end of file")
+// RotateMasterKey re-wraps the data key of every encrypted segment with
+// newKey, including the copies in the archive directory, which history readers
+// and restores open with the new key. Only segment headers are rewritten;
+// entries are left untouched. Segments already wrapped by newKey are skipped,
+// so a rotation that failed part way can be run again.
+func (sl *SegmentedLog) RotateMasterKey(newKey *encryption.MasterKey) error {
+	sl.compactMu.Lock()
+	defer sl.compactMu.Unlock()
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	for _, segment := range sl.segments {
+		if segment.header == nil {
+			continue
+		}
+		path := segment.file.Name()
+		rewrapped, err := encryption.RewrapFile(path, sl.masterKey, newKey)
+		if err != nil {
+			return fmt.Errorf("failed to rewrap segment %s: %w", path, err)
+		}
+		if !rewrapped {
+			continue
+		}
+		if segment.header, err = encryption.ReadHeader(segment.file); err != nil {
+			return err
 		}
 	}
 
-	// Read the entry at the desired offset
-	if !scanner.Scan() {
-		return nil, fmt.Errorf("failed to read entry at offset %d", offset)
+	if sl.archiveDir != "" {
+		paths, err := filepath.Glob(filepath.Join(sl.archiveDir, logFilePrefix+"*"+logFileExt))
+		if err != nil {
+			return fmt.Errorf("failed to list archived segments: %w", err)
+		}
+		for _, path := range paths {
+			if _, err := encryption.RewrapFile(path, sl.masterKey, newKey); err != nil {
+				return fmt.Errorf("failed to rewrap archived segment %s: %w", path, err)
+			}
+		}
 	}
 
-	return scanner.Bytes(), nil
+	sl.masterKey = newKey
+	return nil
 }
 
 func (sl *SegmentedLog) Close() error {
+	// Segments closed since the last copy are archived after the next open
+	sl.stopArchiver()
+
 	sl.mu.Lock()
 	defer sl.mu.Unlock()
 
+	if !sl.closed {
+		sl.closed = true
+		close(sl.appended)
+	}
+
 	for _, segment := range sl.segments {
-		if err := segment.file.Close(); err != nil {
+		if err := segment.sync(); err != nil {
+			return err
+		}
+		if err := segment.close(); err != nil {
 			return err
 		}
 	}
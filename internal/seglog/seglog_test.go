@@ -1,10 +1,16 @@
 package seglog
 
 import (
+	"crypto/rand"
 	"fmt"
+	"math"
+	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/joobisb/vitadb/internal/encryption"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -103,3 +109,286 @@ func TestClose(t *testing.T) {
 	_, err = sl.Append([]byte("test"))
 	assert.Error(t, err, "Expected error when appending to closed log")
 }
+
+func TestIndexFileCreated(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 100)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "log-0.index"))
+	require.NoError(t, err, "Expected index file to exist")
+	assert.Equal(t, int64(3*indexEntrySize), info.Size(), "Unexpected index file size")
+}
+
+func TestReadAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 2)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+
+	for i := 0; i < 5; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	// Remove one index and corrupt another to force a rebuild on open
+	require.NoError(t, os.Remove(filepath.Join(dir, "log-0.index")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "log-2.index"), []byte("garbage"), 0644))
+
+	sl, err = NewSegmentedLog(dir, 2)
+	require.NoError(t, err, "Failed to reopen SegmentedLog")
+	defer sl.Close()
+
+	for i := 0; i < 5; i++ {
+		entry, err := sl.Read(int64(i))
+		require.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, fmt.Sprintf("entry %d", i), string(entry), "Unexpected entry content")
+	}
+
+	offset, err := sl.Append([]byte("entry 5"))
+	require.NoError(t, err, "Failed to append entry after reopen")
+	assert.Equal(t, int64(5), offset, "Unexpected offset after reopen")
+}
+
+func TestReadDoesNotMoveAppendPosition(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 1000)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+			assert.NoError(t, err, "Failed to append entry")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			_, _ = sl.Read(0)
+		}
+	}()
+	wg.Wait()
+
+	for i := 0; i < 200; i++ {
+		entry, err := sl.Read(int64(i))
+		require.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, fmt.Sprintf("entry %d", i), string(entry), "Unexpected entry content")
+	}
+}
+
+func newTestMasterKey(t *testing.T) *encryption.MasterKey {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err, "Failed to generate key")
+	mk, err := encryption.NewMasterKey(key)
+	require.NoError(t, err, "Failed to create master key")
+	return mk
+}
+
+func TestEncryptedSegments(t *testing.T) {
+	dir := t.TempDir()
+	mk := newTestMasterKey(t)
+
+	sl, err := NewSegmentedLog(dir, 2, WithEncryption(mk))
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	for i := 0; i < 3; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("secret %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	for _, path := range []string{"log-0.seg", "log-2.seg"} {
+		content, err := os.ReadFile(filepath.Join(dir, path))
+		require.NoError(t, err)
+		assert.True(t, encryption.IsHeader(content), "Expected encryption header in %s", path)
+		assert.NotContains(t, string(content), "secret", "Entries must not be stored in plaintext")
+	}
+
+	_, err = NewSegmentedLog(dir, 2)
+	assert.ErrorIs(t, err, encryption.ErrNoMasterKey, "Expected error opening encrypted segments without a key")
+
+	// Rebuild the index to make sure the header is skipped
+	require.NoError(t, os.Remove(filepath.Join(dir, "log-0.index")))
+
+	sl, err = NewSegmentedLog(dir, 2, WithEncryption(mk))
+	require.NoError(t, err, "Failed to reopen SegmentedLog")
+	defer sl.Close()
+	for i := 0; i < 3; i++ {
+		entry, err := sl.Read(int64(i))
+		require.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, fmt.Sprintf("secret %d", i), string(entry), "Unexpected entry content")
+	}
+}
+
+func TestEnableEncryptionOnPlaintextLog(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 100)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	_, err = sl.Append([]byte("plaintext"))
+	require.NoError(t, err, "Failed to append entry")
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	sl, err = NewSegmentedLog(dir, 100, WithEncryption(newTestMasterKey(t)))
+	require.NoError(t, err, "Failed to reopen SegmentedLog with encryption")
+	defer sl.Close()
+
+	_, err = sl.Append([]byte("encrypted"))
+	require.NoError(t, err, "Failed to append entry")
+
+	paths := sl.GetAllSegmentPaths()
+	require.Len(t, paths, 2, "Expected a new segment to be rolled for encrypted entries")
+	content, err := os.ReadFile(paths[1])
+	require.NoError(t, err)
+	assert.True(t, encryption.IsHeader(content), "Expected the new segment to be encrypted")
+
+	for offset, want := range []string{"plaintext", "encrypted"} {
+		entry, err := sl.Read(int64(offset))
+		require.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, want, string(entry), "Unexpected entry content")
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := newTestMasterKey(t), newTestMasterKey(t)
+
+	sl, err := NewSegmentedLog(dir, 2, WithEncryption(oldKey))
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	for i := 0; i < 3; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+
+	before, err := os.ReadFile(filepath.Join(dir, "log-0.seg"))
+	require.NoError(t, err)
+	require.NoError(t, sl.RotateMasterKey(newKey), "Failed to rotate master key")
+	_, err = sl.Append([]byte("entry 3"))
+	require.NoError(t, err, "Failed to append entry after rotation")
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	after, err := os.ReadFile(filepath.Join(dir, "log-0.seg"))
+	require.NoError(t, err)
+	assert.Equal(t, before[encryption.HeaderSize:], after[encryption.HeaderSize:], "Rotation must not rewrite entries")
+
+	_, err = NewSegmentedLog(dir, 2, WithEncryption(oldKey))
+	assert.ErrorIs(t, err, encryption.ErrKeyMismatch, "Old key must no longer open the segments")
+
+	sl, err = NewSegmentedLog(dir, 2, WithEncryption(newKey))
+	require.NoError(t, err, "Failed to reopen SegmentedLog with the new key")
+	defer sl.Close()
+	for i := 0; i < 4; i++ {
+		entry, err := sl.Read(int64(i))
+		require.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, fmt.Sprintf("entry %d", i), string(entry), "Unexpected entry content")
+	}
+}
+
+func TestResumeRotateMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := newTestMasterKey(t), newTestMasterKey(t)
+
+	sl, err := NewSegmentedLog(dir, 2, WithEncryption(oldKey))
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	for i := 0; i < 3; i++ {
+		_, err := sl.Append([]byte(fmt.Sprintf("entry %d", i)))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	// A rotation interrupted after the first segment
+	rewrapped, err := encryption.RewrapFile(filepath.Join(dir, "log-0.seg"), oldKey, newKey)
+	require.NoError(t, err, "Failed to rewrap segment")
+	require.True(t, rewrapped)
+	_, err = NewSegmentedLog(dir, 2, WithEncryption(newKey))
+	assert.ErrorIs(t, err, encryption.ErrKeyMismatch, "Segments still wrapped by the old key need the previous key")
+
+	sl, err = NewSegmentedLog(dir, 2, WithEncryption(newKey.WithPrevious(oldKey)))
+	require.NoError(t, err, "Failed to open a partly rotated log with the previous key")
+	require.NoError(t, sl.RotateMasterKey(newKey), "Failed to resume rotation")
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+	matches, err := filepath.Glob(filepath.Join(dir, "*.rewrap"))
+	require.NoError(t, err)
+	assert.Empty(t, matches, "Expected no leftover journals")
+
+	sl, err = NewSegmentedLog(dir, 2, WithEncryption(newKey))
+	require.NoError(t, err, "Failed to reopen SegmentedLog with the new key")
+	defer sl.Close()
+	for i := 0; i < 3; i++ {
+		entry, err := sl.Read(int64(i))
+		require.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, fmt.Sprintf("entry %d", i), string(entry), "Unexpected entry content")
+	}
+}
+
+func TestExpiredOffset(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 2)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	defer sl.Close()
+
+	for _, entry := range []string{"a=1", "a=2", "a=3", "b=1", "c=1"} {
+		_, err := sl.Append([]byte(entry))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	_, err = sl.Compact(CompactionPolicy{Key: testKey})
+	require.NoError(t, err, "Compaction failed")
+
+	offset, err := sl.ExpiredOffset(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), offset, "Segments within the retention window must be kept")
+
+	offset, err = sl.ExpiredOffset(0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), offset, "Only the segment emptied by compaction has expired")
+
+	sl.RetainFrom(1)
+	require.NoError(t, sl.RemoveSegmentsBefore(offset), "Failed to remove segments")
+	assert.Equal(t, int64(0), sl.OldestOffset(), "Retained segments must be kept")
+
+	sl.RetainFrom(math.MaxInt64)
+	require.NoError(t, sl.RemoveSegmentsBefore(offset), "Failed to remove segments")
+	assert.Equal(t, int64(2), sl.OldestOffset(), "Expected the expired segment to be removed")
+	entry, err := sl.Read(2)
+	require.NoError(t, err, "Failed to read entry")
+	assert.Equal(t, "a=3", string(entry), "Live entries must be kept")
+}
+
+func TestTornEntryIsTruncated(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := NewSegmentedLog(dir, 100)
+	require.NoError(t, err, "Failed to create SegmentedLog")
+	for _, entry := range []string{"entry 0", "entry 1"} {
+		_, err := sl.Append([]byte(entry))
+		require.NoError(t, err, "Failed to append entry")
+	}
+	path := sl.GetActiveSegmentPath()
+	require.NoError(t, sl.Close(), "Failed to close SegmentedLog")
+
+	// A crash in the middle of an append leaves an unterminated line
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString("entr")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	sl, err = NewSegmentedLog(dir, 100)
+	require.NoError(t, err, "Failed to reopen SegmentedLog")
+	defer sl.Close()
+	assert.Equal(t, int64(2), sl.NextOffset(), "The torn entry should not be counted")
+
+	offset, err := sl.Append([]byte("entry 2"))
+	require.NoError(t, err, "Failed to append entry")
+	entry, err := sl.Read(offset)
+	require.NoError(t, err, "Failed to read entry")
+	assert.Equal(t, "entry 2", string(entry), "New entries should not be appended to the torn one")
+}
@@ -0,0 +1,289 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/encryption"
+	"github.com/joobisb/vitadb/internal/seglog"
+	"github.com/joobisb/vitadb/internal/wal"
+)
+
+const backupFileName = "backup.json"
+
+// errTargetReached stops the WAL replay once the restore target is passed.
+var errTargetReached = errors.New("restore target reached")
+
+// BackupInfo describes a base backup. WALOffset is the first WAL offset that is
+// not included in the backup, so a restore replays the WAL from there.
+type BackupInfo struct {
+	Time      time.Time `json:"time"`
+	WALOffset int64     `json:"wal_offset"`
+	Keys      int       `json:"keys"`
+}
+
+type backup struct {
+	BackupInfo
+	Data map[string]string `json:"data"`
+}
+
+// BackupDir returns backup_dir, the directory below which the BACKUP command
+// writes backups, empty when it is disabled.
+func (s *KVStore) BackupDir() string {
+	return s.backupDir
+}
+
+// Backup writes a consistent snapshot of the store to dir. Together with the
+// archived WAL it is the starting point of a point-in-time recovery. The
+// backup is encrypted when encryption at rest is enabled.
+func (s *KVStore) Backup(dir string) (BackupInfo, error) {
+	if !s.wal.IsSegmented() {
+		return BackupInfo{}, errors.New("backups require use_segmented_logs")
+	}
+
+	s.mu.RLock()
+	b := backup{
+		BackupInfo: BackupInfo{
+			Time:      time.Now().UTC(),
+			WALOffset: s.wal.NextOffset(),
+			Keys:      len(s.data),
+		},
+		Data: make(map[string]string, len(s.data)),
+	}
+	for key, value := range s.data {
+		b.Data[key] = value
+	}
+	s.mu.RUnlock()
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to marshal backup: %v", err)
+	}
+	if mk := s.wal.MasterKey(); mk != nil {
+		header, key, err := encryption.NewHeader(mk)
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		data = append(header, key.Seal(data)...)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+	path := filepath.Join(dir, backupFileName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to write backup: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to write backup: %v", err)
+	}
+	return b.BackupInfo, nil
+}
+
+// RewrapBackup re-wraps the data key of the base backup in dir with newKey,
+// so that it can be restored once oldKey is retired. It reports false when the
+// backup is not encrypted or already wrapped by newKey.
+func RewrapBackup(dir string, oldKey, newKey *encryption.MasterKey) (bool, error) {
+	return encryption.RewrapFile(filepath.Join(dir, backupFileName), oldKey, newKey)
+}
+
+func readBackup(dir string, mk *encryption.MasterKey) (*backup, error) {
+	path := filepath.Join(dir, backupFileName)
+	if err := encryption.RecoverRewrap(path); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup: %v", err)
+	}
+	if encryption.IsHeader(data) {
+		key, err := encryption.OpenHeader(data[:encryption.HeaderSize], mk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open encrypted backup %s: %w", path, err)
+		}
+		if data, err = key.Open(data[encryption.HeaderSize:]); err != nil {
+			return nil, fmt.Errorf("failed to decrypt backup %s: %w", path, err)
+		}
+	}
+
+	var b backup
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal backup: %v", err)
+	}
+	return &b, nil
+}
+
+// RestoreOptions configures a point-in-time recovery. Replay stops before the
+// first WAL entry past TargetOffset or written after TargetTime; a negative
+// TargetOffset and a zero TargetTime replay everything that is available.
+type RestoreOptions struct {
+	BackupDir  string
+	ArchiveDir string
+
+	// WALDir optionally holds the live WAL, used for entries that were not
+	// archived yet such as the active segment
+	WALDir string
+
+	TargetOffset int64
+	TargetTime   time.Time
+
+	// OutputDir receives the WAL of the restored store. It must not contain
+	// WAL segments yet.
+	OutputDir string
+}
+
+// RestoreResult describes the state a restore recovered.
+type RestoreResult struct {
+	Keys int
+
+	// LastOffset is the offset of the last replayed WAL entry, or -1 when the
+	// backup was restored as is
+	LastOffset int64
+	LastTime   time.Time
+}
+
+// Restore combines a base backup with the archived WAL and writes the state
+// as of the restore target to a new segmented WAL in opts.OutputDir, which a
+// server can then be started from. cfg provides the segment size and the
+// master key of encrypted segments and backups.
+func Restore(cfg *config.Config, opts RestoreOptions) (RestoreResult, error) {
+	result := RestoreResult{LastOffset: -1}
+
+	var mk *encryption.MasterKey
+	if cfg.EncryptionKeyFile != "" {
+		var err error
+		if mk, err = encryption.LoadMasterKeys(cfg.EncryptionKeyFile, cfg.PreviousEncryptionKeyFile); err != nil {
+			return result, err
+		}
+	}
+
+	b, err := readBackup(opts.BackupDir, mk)
+	if err != nil {
+		return result, err
+	}
+	if opts.TargetOffset >= 0 && opts.TargetOffset < b.WALOffset {
+		return result, fmt.Errorf("target offset %d is before the backup, which starts at offset %d", opts.TargetOffset, b.WALOffset)
+	}
+	if !opts.TargetTime.IsZero() && opts.TargetTime.Before(b.Time) {
+		return result, fmt.Errorf("target time %s is before the backup taken at %s", opts.TargetTime.Format(time.RFC3339), b.Time.Format(time.RFC3339))
+	}
+
+	files, err := restoreSegments(opts.ArchiveDir, opts.WALDir, b.WALOffset)
+	if err != nil {
+		return result, err
+	}
+
+	next := b.WALOffset
+	data := b.Data
+	for _, file := range files {
+		if file.BaseOffset > next {
+			return result, fmt.Errorf("WAL entries from offset %d to %d are missing from the archive", next, file.BaseOffset-1)
+		}
+		err := wal.ReplaySegmentFile(file.Path, mk, func(offset int64, entry wal.LogEntry) error {
+			if offset < next {
+				return nil
+			}
+			if opts.TargetOffset >= 0 && offset > opts.TargetOffset {
+				return errTargetReached
+			}
+			if !opts.TargetTime.IsZero() && entry.Timestamp > opts.TargetTime.UnixNano() {
+				return errTargetReached
+			}
+
+			applyLogEntry(data, entry)
+			next = offset + 1
+			result.LastOffset = offset
+			if entry.Timestamp != 0 {
+				result.LastTime = time.Unix(0, entry.Timestamp).UTC()
+			}
+			return nil
+		})
+		if errors.Is(err, errTargetReached) {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+	if opts.TargetOffset >= next {
+		return result, fmt.Errorf("target offset %d is past the end of the WAL at offset %d", opts.TargetOffset, next)
+	}
+
+	if err := writeRestoredWAL(cfg, opts.OutputDir, data); err != nil {
+		return result, err
+	}
+	result.Keys = len(data)
+	return result, nil
+}
+
+// restoreSegments lists the segments that may hold entries from offset
+// onwards, preferring archived copies over live segments, which may have been
+// compacted.
+func restoreSegments(archiveDir, walDir string, offset int64) ([]seglog.SegmentFile, error) {
+	byOffset := make(map[int64]seglog.SegmentFile)
+	for _, dir := range []string{walDir, archiveDir} {
+		if dir == "" {
+			continue
+		}
+		files, err := seglog.SegmentFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			byOffset[file.BaseOffset] = file
+		}
+	}
+
+	files := make([]seglog.SegmentFile, 0, len(byOffset))
+	for _, file := range byOffset {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].BaseOffset < files[j].BaseOffset
+	})
+
+	// Skip segments that end before offset
+	for len(files) > 1 && files[1].BaseOffset <= offset {
+		files = files[1:]
+	}
+	return files, nil
+}
+
+func writeRestoredWAL(cfg *config.Config, dir string, data map[string]string) error {
+	existing, err := seglog.SegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("restore output directory %s already contains a WAL", dir)
+	}
+
+	restoreCfg := *cfg
+	restoreCfg.WALDir = dir
+	restoreCfg.UseSegmentedLogs = true
+	restoreCfg.WALCompaction = false
+	restoreCfg.WALArchiveDir = ""
+	w, err := wal.NewWAL(&restoreCfg)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := w.AppendSet(key, data[key]); err != nil {
+			w.Close()
+			return fmt.Errorf("failed to write restored WAL: %v", err)
+		}
+	}
+	return w.Close()
+}
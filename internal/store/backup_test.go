@@ -0,0 +1,188 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// restoredData opens the WAL written by Restore and returns its contents.
+func restoredData(t *testing.T, dir string) map[string]string {
+	s, err := NewKVStore(&config.Config{WALDir: dir, SSTDir: t.TempDir(), UseSegmentedLogs: true, SegmentSize: 100})
+	require.NoError(t, err, "Failed to open restored store")
+	defer s.Close()
+	require.NoError(t, s.RecoverFromWAL(), "Failed to recover restored store")
+	return s.data
+}
+
+func TestPointInTimeRestore(t *testing.T) {
+	root := t.TempDir()
+	cfg := &config.Config{
+		WALDir:           filepath.Join(root, "wal"),
+		SSTDir:           filepath.Join(root, "sst"),
+		UseSegmentedLogs: true,
+		SegmentSize:      2,
+		WALArchiveDir:    filepath.Join(root, "archive"),
+	}
+	s, err := NewKVStore(cfg)
+	require.NoError(t, err, "Failed to create KVStore")
+	defer s.Close()
+
+	require.NoError(t, s.Set("a", "1"), "Set failed")
+	require.NoError(t, s.Set("b", "1"), "Set failed")
+
+	backupDir := filepath.Join(root, "backup")
+	info, err := s.Backup(backupDir)
+	require.NoError(t, err, "Backup failed")
+	assert.Equal(t, int64(2), info.WALOffset, "Unexpected backup WAL offset")
+	assert.Equal(t, 2, info.Keys, "Unexpected number of keys in backup")
+
+	require.NoError(t, s.Set("a", "2"), "Set failed") // offset 2
+	require.NoError(t, s.Set("c", "1"), "Set failed") // offset 3
+	time.Sleep(10 * time.Millisecond)
+	beforeWipe := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, s.Delete("a"), "Delete failed") // offset 4
+	require.NoError(t, s.Delete("b"), "Delete failed") // offset 5, active segment
+	require.NoError(t, s.wal.Archive(), "Failed to archive closed segments")
+
+	opts := RestoreOptions{
+		BackupDir:    backupDir,
+		ArchiveDir:   cfg.WALArchiveDir,
+		WALDir:       cfg.WALDir,
+		TargetOffset: -1,
+	}
+
+	t.Run("to offset", func(t *testing.T) {
+		opts := opts
+		opts.TargetOffset = 2
+		opts.OutputDir = t.TempDir()
+		result, err := Restore(cfg, opts)
+		require.NoError(t, err, "Restore failed")
+		assert.Equal(t, int64(2), result.LastOffset, "Unexpected last replayed offset")
+		assert.Equal(t, map[string]string{"a": "2", "b": "1"}, restoredData(t, opts.OutputDir), "Unexpected restored data")
+	})
+
+	t.Run("to time", func(t *testing.T) {
+		opts := opts
+		opts.TargetTime = beforeWipe
+		opts.OutputDir = t.TempDir()
+		result, err := Restore(cfg, opts)
+		require.NoError(t, err, "Restore failed")
+		assert.Equal(t, int64(3), result.LastOffset, "Unexpected last replayed offset")
+		assert.Equal(t, map[string]string{"a": "2", "b": "1", "c": "1"}, restoredData(t, opts.OutputDir), "Unexpected restored data")
+	})
+
+	t.Run("everything including the active segment", func(t *testing.T) {
+		opts := opts
+		opts.OutputDir = t.TempDir()
+		result, err := Restore(cfg, opts)
+		require.NoError(t, err, "Restore failed")
+		assert.Equal(t, int64(5), result.LastOffset, "Unexpected last replayed offset")
+		assert.Equal(t, map[string]string{"c": "1"}, restoredData(t, opts.OutputDir), "Unexpected restored data")
+	})
+
+	t.Run("archive only", func(t *testing.T) {
+		opts := opts
+		opts.WALDir = ""
+		opts.OutputDir = t.TempDir()
+		result, err := Restore(cfg, opts)
+		require.NoError(t, err, "Restore failed")
+		assert.Equal(t, int64(3), result.LastOffset, "Only archived segments should be replayed")
+	})
+
+	t.Run("target past the end of the WAL", func(t *testing.T) {
+		opts := opts
+		opts.TargetOffset = 100
+		opts.OutputDir = t.TempDir()
+		_, err := Restore(cfg, opts)
+		assert.Error(t, err, "Restore past the end of the WAL should fail")
+	})
+
+	t.Run("target before the backup", func(t *testing.T) {
+		opts := opts
+		opts.TargetOffset = 1
+		opts.OutputDir = t.TempDir()
+		_, err := Restore(cfg, opts)
+		assert.Error(t, err, "Restore to a target before the backup should fail")
+	})
+}
+
+// writeTestKeyFile writes a random master key to a file and returns its path
+// and the key.
+func writeTestKeyFile(t *testing.T) (string, *encryption.MasterKey) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "master.key")
+	require.NoError(t, os.WriteFile(path, []byte(hex.EncodeToString(key)), 0600))
+	mk, err := encryption.LoadMasterKey(path)
+	require.NoError(t, err, "Failed to load master key")
+	return path, mk
+}
+
+func TestRestoreAfterKeyRotation(t *testing.T) {
+	root := t.TempDir()
+	oldPath, oldKey := writeTestKeyFile(t)
+	newPath, newKey := writeTestKeyFile(t)
+	cfg := &config.Config{
+		WALDir:            filepath.Join(root, "wal"),
+		SSTDir:            filepath.Join(root, "sst"),
+		UseSegmentedLogs:  true,
+		SegmentSize:       2,
+		WALArchiveDir:     filepath.Join(root, "archive"),
+		EncryptionKeyFile: oldPath,
+	}
+	s, err := NewKVStore(cfg)
+	require.NoError(t, err, "Failed to create KVStore")
+	defer s.Close()
+
+	backupDir := filepath.Join(root, "backup")
+	_, err = s.Backup(backupDir)
+	require.NoError(t, err, "Backup failed")
+	for _, value := range []string{"1", "2", "3", "4"} {
+		require.NoError(t, s.Set("a", value), "Set failed")
+	}
+	require.NoError(t, s.wal.Archive(), "Failed to archive closed segments")
+	_, err = s.wal.Compact()
+	require.NoError(t, err, "Compaction failed")
+
+	require.NoError(t, s.RotateMasterKey(newKey), "Failed to rotate master key")
+	rewrapped, err := RewrapBackup(backupDir, oldKey, newKey)
+	require.NoError(t, err, "Failed to rewrap backup")
+	assert.True(t, rewrapped, "Expected the backup to be rewrapped")
+
+	// Compacted changes are read from the archive with the new key
+	changes, err := s.Changes(0)
+	require.NoError(t, err, "Failed to read changes")
+	for offset := int64(0); offset < 4; offset++ {
+		entry, got, err := changes.Next()
+		require.NoError(t, err, "Failed to read archived change")
+		assert.Equal(t, offset, got)
+		assert.Equal(t, strconv.FormatInt(offset+1, 10), entry.Value, "Unexpected archived change")
+	}
+
+	restoreCfg := *cfg
+	restoreCfg.EncryptionKeyFile = newPath
+	result, err := Restore(&restoreCfg, RestoreOptions{BackupDir: backupDir, ArchiveDir: cfg.WALArchiveDir, OutputDir: t.TempDir(), TargetOffset: -1})
+	require.NoError(t, err, "Failed to restore from the archive with the new key")
+	assert.Equal(t, int64(1), result.LastOffset, "Expected the archived segment to be replayed")
+}
+
+func TestBackupRequiresSegmentedWAL(t *testing.T) {
+	s, err := NewKVStore(&config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir()})
+	require.NoError(t, err, "Failed to create KVStore")
+	defer s.Close()
+
+	_, err = s.Backup(t.TempDir())
+	assert.Error(t, err, "Backup of a single file WAL should fail")
+}
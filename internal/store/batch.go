@@ -0,0 +1,141 @@
+package store
+
+import (
+	"github.com/joobisb/vitadb/internal/wal"
+)
+
+// WriteBatch collects updates that are applied atomically by KVStore.Write.
+// The zero value is an empty batch ready to use.
+type WriteBatch struct {
+	ops []wal.LogEntry
+}
+
+// Put sets key to value.
+func (b *WriteBatch) Put(key, value string) {
+	b.ops = append(b.ops, wal.LogEntry{Operation: wal.OperationSet, Key: key, Value: value})
+}
+
+// Delete removes key.
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, wal.LogEntry{Operation: wal.OperationDel, Key: key})
+}
+
+// Merge appends value to the current value of key, or sets it when the key
+// does not exist. Merges see the effect of earlier operations in the batch.
+func (b *WriteBatch) Merge(key, value string) {
+	b.ops = append(b.ops, wal.LogEntry{Operation: wal.OperationMerge, Key: key, Value: value})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset removes all operations so the batch can be reused.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write applies every operation of the batch or none of them. The batch is
+// logged as a single WAL record, so recovery never sees part of it, and
+// readers never observe the store in between two of its operations.
+func (s *KVStore) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(b)
+}
+
+// writeLocked applies a batch with s.mu held for writing.
+func (s *KVStore) writeLocked(b *WriteBatch) error {
+	version := s.seq + 1
+	if err := s.wal.Append(wal.LogEntry{Operation: wal.OperationBatch, Batch: b.ops, Version: version}); err != nil {
+		return err
+	}
+
+	// Resolve merges before touching the store so the memtable only sees
+	// final values
+	updates := make(map[string]*string)
+	lastOps := make(map[string]wal.OperationType)
+	var order []string
+	for _, op := range b.ops {
+		current, seen := updates[op.Key]
+		if !seen {
+			order = append(order, op.Key)
+			if value, ok := s.data[op.Key]; ok {
+				current = &value
+			}
+		}
+		updates[op.Key] = applyOperation(current, op)
+		lastOps[op.Key] = op.Operation
+	}
+
+	for _, key := range order {
+		value := updates[key]
+		if value == nil {
+			existed := s.remove(key)
+			s.recordVersion(key, version)
+			if existed {
+				s.events.emit(EventDel, key, version)
+			}
+			continue
+		}
+		s.put(key, *value)
+		s.recordVersion(key, version)
+		if lastOps[key] == wal.OperationMerge {
+			s.events.emit(EventMerge, key, version)
+		} else {
+			s.events.emit(EventSet, key, version)
+		}
+	}
+	for _, key := range order {
+		if value := updates[key]; value != nil {
+			if err := s.lsm.Set(key, *value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyOperation returns the value of a key after op, given its current value.
+// nil means the key does not exist.
+func applyOperation(current *string, op wal.LogEntry) *string {
+	switch op.Operation {
+	case wal.OperationSet:
+		value := op.Value
+		return &value
+	case wal.OperationDel:
+		return nil
+	case wal.OperationMerge:
+		value := op.Value
+		if current != nil {
+			value = *current + op.Value
+		}
+		return &value
+	}
+	return current
+}
+
+// applyLogEntry replays a WAL record, including every operation of a batch,
+// on data.
+func applyLogEntry(data map[string]string, entry wal.LogEntry) {
+	ops := []wal.LogEntry{entry}
+	if entry.Operation == wal.OperationBatch {
+		ops = entry.Batch
+	}
+	for _, op := range ops {
+		var current *string
+		if value, ok := data[op.Key]; ok {
+			current = &value
+		}
+		if value := applyOperation(current, op); value != nil {
+			data[op.Key] = *value
+		} else {
+			delete(data, op.Key)
+		}
+	}
+}
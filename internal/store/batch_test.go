@@ -0,0 +1,113 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatch(t *testing.T) {
+	cfg := &config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir(), UseSegmentedLogs: true}
+	s, err := NewKVStore(cfg)
+	require.NoError(t, err, "Failed to create KVStore")
+
+	require.NoError(t, s.Set("counter", "a"), "Set failed")
+	require.NoError(t, s.Set("stale", "1"), "Set failed")
+
+	var b WriteBatch
+	b.Put("x", "1")
+	b.Put("y", "2")
+	b.Delete("stale")
+	b.Merge("counter", "b")
+	b.Merge("new", "c")
+	b.Merge("new", "d")
+	assert.Equal(t, 6, b.Len(), "Unexpected batch length")
+	require.NoError(t, s.Write(&b), "Write failed")
+
+	want := map[string]string{"counter": "ab", "new": "cd", "x": "1", "y": "2"}
+	assert.Equal(t, want, s.data, "Unexpected data after batch")
+
+	b.Reset()
+	assert.Equal(t, 0, b.Len(), "Reset should empty the batch")
+	require.NoError(t, s.Write(&b), "Writing an empty batch should be a no-op")
+
+	require.NoError(t, s.Close(), "Failed to close store")
+	s, err = NewKVStore(cfg)
+	require.NoError(t, err, "Failed to reopen KVStore")
+	defer s.Close()
+	require.NoError(t, s.RecoverFromWAL(), "Failed to recover from WAL")
+	assert.Equal(t, want, s.data, "Unexpected data after recovery")
+}
+
+func TestWritesAfterTornBatch(t *testing.T) {
+	for _, segmented := range []bool{false, true} {
+		t.Run(fmt.Sprintf("segmented=%v", segmented), func(t *testing.T) {
+			cfg := &config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir(), UseSegmentedLogs: segmented}
+			s, err := NewKVStore(cfg)
+			require.NoError(t, err, "Failed to create KVStore")
+
+			require.NoError(t, s.Set("a", "0"), "Set failed")
+			var b WriteBatch
+			b.Put("a", "1")
+			b.Put("b", "1")
+			require.NoError(t, s.Write(&b), "Write failed")
+			path := s.wal.GetWALFilePath()
+			require.NoError(t, s.Close(), "Failed to close store")
+
+			// Cut the batch record in half, as a crash during the write would
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			require.NoError(t, os.Truncate(path, info.Size()-20), "Failed to truncate WAL")
+
+			s, err = NewKVStore(cfg)
+			require.NoError(t, err, "Failed to reopen KVStore")
+			require.NoError(t, s.RecoverFromWAL(), "The torn record should be dropped")
+			assert.Equal(t, map[string]string{"a": "0"}, s.data, "No operation of a torn batch should be applied")
+
+			// Writes after the torn record must survive the next restart
+			require.NoError(t, s.Set("c", "2"), "Set failed")
+			require.NoError(t, s.Close(), "Failed to close store")
+			s, err = NewKVStore(cfg)
+			require.NoError(t, err, "Failed to reopen KVStore")
+			defer s.Close()
+			require.NoError(t, s.RecoverFromWAL(), "Failed to recover from WAL")
+			assert.Equal(t, map[string]string{"a": "0", "c": "2"}, s.data, "Unexpected data after the second restart")
+		})
+	}
+}
+
+func TestCompactionKeepsTombstonesOfBatches(t *testing.T) {
+	// Every delete marker has expired by the time compaction runs
+	cfg := &config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir(), UseSegmentedLogs: true, SegmentSize: 2, WALDeleteRetention: time.Nanosecond}
+	s, err := NewKVStore(cfg)
+	require.NoError(t, err, "Failed to create KVStore")
+
+	var b WriteBatch
+	b.Merge("merged", "a")
+	require.NoError(t, s.Write(&b), "Write failed")
+	b.Reset()
+	b.Put("batched", "1")
+	require.NoError(t, s.Write(&b), "Write failed")
+	require.NoError(t, s.Delete("merged"), "Delete failed")
+	require.NoError(t, s.Delete("batched"), "Delete failed")
+	require.NoError(t, s.Set("other", "1"), "Set failed")
+	require.NoError(t, s.Delete("other"), "Delete failed")
+	require.NoError(t, s.Set("active", "1"), "Set failed")
+
+	time.Sleep(time.Millisecond)
+	stats, err := s.wal.Compact()
+	require.NoError(t, err, "Compaction failed")
+	assert.Equal(t, 2, stats.EntriesRemoved, "Expected only the set and delete of other to be removed")
+	require.NoError(t, s.Close(), "Failed to close store")
+
+	s, err = NewKVStore(cfg)
+	require.NoError(t, err, "Failed to reopen KVStore")
+	defer s.Close()
+	require.NoError(t, s.RecoverFromWAL(), "Failed to recover from WAL")
+	assert.Equal(t, map[string]string{"active": "1"}, s.data, "Deleted keys should not come back after compaction")
+}
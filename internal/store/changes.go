@@ -0,0 +1,139 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/joobisb/vitadb/internal/seglog"
+	"github.com/joobisb/vitadb/internal/wal"
+)
+
+// consumersFileName holds the offsets of the registered change consumers in
+// the WAL directory, so that their segments are still retained after a
+// restart.
+const consumersFileName = "cdc_consumers.json"
+
+// Changes returns a reader of every write logged from fromOffset on, with its
+// WAL offset, for change data capture. Writes are read in the order they were
+// committed; write batches are a single entry holding all their operations.
+//
+// Offsets are stable across restarts, so a consumer can resume after the last
+// offset it processed and see every change exactly once, provided the entries
+// are still in the WAL. Register the consumer with SetConsumerOffset to keep
+// compaction from removing them. Entries compaction removed before are read
+// from wal_archive_dir, and the reader fails with seglog.ErrCompacted when
+// they were not archived. It requires the segmented WAL.
+func (s *KVStore) Changes(fromOffset int64) (*wal.Reader, error) {
+	return s.wal.NewReader(fromOffset)
+}
+
+// SetConsumerOffset registers the consumer name at offset, or moves it there,
+// meaning that it has processed every change before offset. WAL segments
+// holding offset or later entries are neither compacted nor removed until
+// every consumer has moved past them. Consumers are kept across restarts
+// until RemoveConsumer is called.
+func (s *KVStore) SetConsumerOffset(name string, offset int64) error {
+	if !s.wal.IsSegmented() {
+		return wal.ErrNotSegmented
+	}
+	if name == "" {
+		return errors.New("consumer name cannot be empty")
+	}
+	if offset < s.wal.OldestOffset() {
+		return fmt.Errorf("%w: offset %d", seglog.ErrOffsetRemoved, offset)
+	}
+	if offset > s.wal.NextOffset() {
+		return fmt.Errorf("offset %d is beyond the end of the log", offset)
+	}
+
+	s.consumersMu.Lock()
+	defer s.consumersMu.Unlock()
+	if current, ok := s.consumers[name]; ok && current == offset {
+		return nil
+	}
+	consumers := make(map[string]int64, len(s.consumers)+1)
+	for consumer, current := range s.consumers {
+		consumers[consumer] = current
+	}
+	consumers[name] = offset
+	return s.saveConsumers(consumers)
+}
+
+// RemoveConsumer unregisters the consumer name and reports whether it was
+// registered.
+func (s *KVStore) RemoveConsumer(name string) (bool, error) {
+	s.consumersMu.Lock()
+	defer s.consumersMu.Unlock()
+	if _, ok := s.consumers[name]; !ok {
+		return false, nil
+	}
+	consumers := make(map[string]int64, len(s.consumers))
+	for consumer, offset := range s.consumers {
+		if consumer != name {
+			consumers[consumer] = offset
+		}
+	}
+	return true, s.saveConsumers(consumers)
+}
+
+// Consumers returns the offset of every registered consumer by name.
+func (s *KVStore) Consumers() map[string]int64 {
+	s.consumersMu.Lock()
+	defer s.consumersMu.Unlock()
+	consumers := make(map[string]int64, len(s.consumers))
+	for name, offset := range s.consumers {
+		consumers[name] = offset
+	}
+	return consumers
+}
+
+// saveConsumers writes consumers to disk before making them the registered
+// consumers. s.consumersMu must be held.
+func (s *KVStore) saveConsumers(consumers map[string]int64) error {
+	data, err := json.Marshal(consumers)
+	if err != nil {
+		return fmt.Errorf("failed to encode consumers: %v", err)
+	}
+	path := filepath.Join(s.walDir, consumersFileName)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write consumers: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace consumers file: %v", err)
+	}
+
+	s.consumers = consumers
+	s.retainConsumerSegments()
+	return nil
+}
+
+// loadConsumers reads the consumers registered in dir, if any.
+func loadConsumers(dir string) (map[string]int64, error) {
+	consumers := make(map[string]int64)
+	data, err := os.ReadFile(filepath.Join(dir, consumersFileName))
+	if os.IsNotExist(err) {
+		return consumers, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consumers: %v", err)
+	}
+	if err := json.Unmarshal(data, &consumers); err != nil {
+		return nil, fmt.Errorf("failed to decode consumers: %v", err)
+	}
+	return consumers, nil
+}
+
+// retainConsumerSegments keeps the WAL from the offset of the slowest
+// consumer. s.consumersMu must be held.
+func (s *KVStore) retainConsumerSegments() {
+	oldest := int64(math.MaxInt64)
+	for _, offset := range s.consumers {
+		oldest = min(oldest, offset)
+	}
+	s.wal.RetainFrom(oldest)
+}
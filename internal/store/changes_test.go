@@ -0,0 +1,98 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/seglog"
+	"github.com/joobisb/vitadb/internal/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChanges(t *testing.T) {
+	// Small segments, so that changes are read across segments
+	store := newTestStore(t, func(cfg *config.Config) { cfg.SegmentSize = 100 })
+	require.NoError(t, store.Set("a", "1"))
+	require.NoError(t, store.Delete("a"))
+	var b WriteBatch
+	b.Put("b", "2")
+	b.Merge("b", "3")
+	require.NoError(t, store.Write(&b))
+
+	changes, err := store.Changes(1)
+	require.NoError(t, err, "Failed to read changes")
+	entry, offset, err := changes.Next()
+	require.NoError(t, err, "Failed to read change")
+	assert.Equal(t, int64(1), offset, "Unexpected offset")
+	assert.Equal(t, wal.OperationDel, entry.Operation, "Unexpected operation")
+	assert.Equal(t, "a", entry.Key, "Unexpected key")
+	entry, offset, err = changes.Next()
+	require.NoError(t, err, "Failed to read change")
+	assert.Equal(t, int64(2), offset, "Unexpected offset")
+	assert.Equal(t, wal.OperationBatch, entry.Operation, "Batches should be a single change")
+	assert.Len(t, entry.Batch, 2, "Unexpected batch operations")
+	_, _, err = changes.Next()
+	assert.Equal(t, io.EOF, err, "Expected EOF once caught up")
+
+	require.NoError(t, store.Set("c", "4"))
+	entry, offset, err = changes.Next()
+	require.NoError(t, err, "Failed to read new change")
+	assert.Equal(t, int64(3), offset, "Unexpected offset")
+	assert.Equal(t, "c", entry.Key, "Unexpected key")
+}
+
+func TestConsumersRetainSegments(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{WALDir: dir, SSTDir: dir, MemtableSize: 1024, UseSegmentedLogs: true, SegmentSize: 2, WALDeleteRetention: time.Hour}
+	store, err := NewKVStore(cfg)
+	require.NoError(t, err, "Failed to create KVStore")
+
+	require.NoError(t, store.Set("a", "0"))
+	require.NoError(t, store.SetConsumerOffset("indexer", 1), "Failed to register consumer")
+	assert.Error(t, store.SetConsumerOffset("indexer", 2), "Offsets beyond the end of the WAL should be rejected")
+	assert.Error(t, store.SetConsumerOffset("", 0), "Consumers need a name")
+	require.NoError(t, store.Close(), "Failed to close KVStore")
+
+	// The consumer is still registered after a restart
+	store, err = NewKVStore(cfg)
+	require.NoError(t, err, "Failed to reopen KVStore")
+	defer store.Close()
+	assert.Equal(t, map[string]int64{"indexer": 1}, store.Consumers(), "Unexpected consumers")
+
+	for _, value := range []string{"1", "2", "3", "4", "5"} {
+		require.NoError(t, store.Set("a", value))
+	}
+	_, err = store.wal.Compact()
+	require.NoError(t, err, "Compaction failed")
+
+	// Every change after the consumer offset is still there
+	changes, err := store.Changes(1)
+	require.NoError(t, err, "Failed to read changes")
+	for offset := int64(1); offset < 6; offset++ {
+		_, got, err := changes.Next()
+		require.NoError(t, err, "Failed to read change")
+		assert.Equal(t, offset, got, "Retained changes should not be compacted")
+	}
+
+	removed, err := store.RemoveConsumer("indexer")
+	require.NoError(t, err, "Failed to remove consumer")
+	assert.True(t, removed, "Expected the consumer to be removed")
+	stats, err := store.wal.Compact()
+	require.NoError(t, err, "Compaction failed")
+	assert.Equal(t, 3, stats.EntriesRemoved, "Released changes should be compacted")
+
+	// Compacted changes are reported rather than skipped
+	changes, err = store.Changes(1)
+	require.NoError(t, err, "Failed to read changes")
+	_, _, err = changes.Next()
+	assert.ErrorIs(t, err, seglog.ErrCompacted, "Expected compacted changes to fail without an archive")
+
+	removed, err = store.RemoveConsumer("indexer")
+	require.NoError(t, err)
+	assert.False(t, removed, "Expected unknown consumers not to be removed")
+	assert.True(t, errors.Is(store.SetConsumerOffset("indexer", -1), seglog.ErrOffsetRemoved), "Expected removed offsets to be rejected")
+}
@@ -0,0 +1,93 @@
+package store
+
+// Conditional writes check their condition and log the write while holding
+// the store lock, so no other write can slip in between.
+
+// GetVersioned returns the value of key and its version. The version changes
+// with every write of the key and is 0 when the key does not exist.
+func (s *KVStore) GetVersioned(key string) (string, uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.data[key]
+	return value, s.currentVersion(key), ok
+}
+
+// CompareAndSet sets key to value if its current value is expected, and
+// reports whether it did.
+func (s *KVStore) CompareAndSet(key, expected, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.data[key]; !ok || current != expected {
+		return false, nil
+	}
+	return true, s.setLocked(key, value)
+}
+
+// SetIfAbsent sets key to value if it does not exist, and reports whether it
+// did.
+func (s *KVStore) SetIfAbsent(key, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data[key]; ok {
+		return false, nil
+	}
+	return true, s.setLocked(key, value)
+}
+
+// SetIfPresent sets key to value if it exists, and reports whether it did.
+func (s *KVStore) SetIfPresent(key, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data[key]; !ok {
+		return false, nil
+	}
+	return true, s.setLocked(key, value)
+}
+
+// SetIfVersion sets key to value if its version, as returned by
+// GetVersioned, is still version, and reports whether it did. Version 0 only
+// matches a key that does not exist.
+func (s *KVStore) SetIfVersion(key, value string, version uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.currentVersion(key) != version {
+		return false, nil
+	}
+	return true, s.setLocked(key, value)
+}
+
+// DeleteIfVersion deletes key if its version is still version, and reports
+// whether it did.
+func (s *KVStore) DeleteIfVersion(key string, version uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version == 0 || s.currentVersion(key) != version {
+		return false, nil
+	}
+	return true, s.deleteLocked(key)
+}
+
+// GetSet sets key to value and returns the previous value, if any.
+func (s *KVStore) GetSet(key, value string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.data[key]
+	if err := s.setLocked(key, value); err != nil {
+		return "", false, err
+	}
+	return old, ok, nil
+}
+
+func (s *KVStore) currentVersion(key string) uint64 {
+	if _, ok := s.data[key]; !ok {
+		return 0
+	}
+	return s.versions[key]
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	s := newTestStore(t)
+
+	ok, err := s.SetIfPresent("a", "1")
+	require.NoError(t, err)
+	assert.False(t, ok, "SetIfPresent should not create a key")
+
+	ok, err = s.SetIfAbsent("a", "1")
+	require.NoError(t, err)
+	assert.True(t, ok, "SetIfAbsent should create a missing key")
+	ok, err = s.SetIfAbsent("a", "2")
+	require.NoError(t, err)
+	assert.False(t, ok, "SetIfAbsent should not overwrite a key")
+
+	ok, err = s.CompareAndSet("a", "wrong", "2")
+	require.NoError(t, err)
+	assert.False(t, ok, "CompareAndSet should fail on a different value")
+	ok, err = s.CompareAndSet("a", "1", "2")
+	require.NoError(t, err)
+	assert.True(t, ok, "CompareAndSet should succeed on the expected value")
+	ok, err = s.CompareAndSet("missing", "", "x")
+	require.NoError(t, err)
+	assert.False(t, ok, "CompareAndSet should fail on a missing key")
+
+	old, existed, err := s.GetSet("a", "3")
+	require.NoError(t, err)
+	assert.True(t, existed, "GetSet should report the previous value")
+	assert.Equal(t, "2", old, "Unexpected previous value")
+	_, existed, err = s.GetSet("b", "1")
+	require.NoError(t, err)
+	assert.False(t, existed, "GetSet on a new key should report no previous value")
+
+	value, _ := s.Get("a")
+	assert.Equal(t, "3", value, "Unexpected final value")
+}
+
+func TestVersionedUpdates(t *testing.T) {
+	cfg := &config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir(), UseSegmentedLogs: true}
+	s, err := NewKVStore(cfg)
+	require.NoError(t, err, "Failed to create KVStore")
+
+	_, version, ok := s.GetVersioned("leader")
+	assert.False(t, ok, "Key should not exist")
+	assert.Equal(t, uint64(0), version, "Missing keys have version 0")
+
+	ok, err = s.SetIfVersion("leader", "node-1", 0)
+	require.NoError(t, err)
+	assert.True(t, ok, "Version 0 should match a missing key")
+
+	value, version, ok := s.GetVersioned("leader")
+	require.True(t, ok, "Key should exist")
+	assert.Equal(t, "node-1", value, "Unexpected value")
+	assert.NotZero(t, version, "Existing keys have a version")
+
+	ok, err = s.SetIfVersion("leader", "node-2", version+1)
+	require.NoError(t, err)
+	assert.False(t, ok, "A stale version should not match")
+
+	// Versions survive a restart
+	require.NoError(t, s.Close(), "Failed to close store")
+	s, err = NewKVStore(cfg)
+	require.NoError(t, err, "Failed to reopen KVStore")
+	defer s.Close()
+	require.NoError(t, s.RecoverFromWAL(), "Failed to recover from WAL")
+
+	_, recovered, _ := s.GetVersioned("leader")
+	assert.Equal(t, version, recovered, "Version should be restored from the WAL")
+	require.NoError(t, s.Set("other", "1"), "Set failed")
+	_, otherVersion, _ := s.GetVersioned("other")
+	assert.Greater(t, otherVersion, version, "Versions should keep increasing after a restart")
+
+	ok, err = s.SetIfVersion("leader", "node-2", version)
+	require.NoError(t, err)
+	assert.True(t, ok, "The current version should match")
+	ok, err = s.DeleteIfVersion("leader", version)
+	require.NoError(t, err)
+	assert.False(t, ok, "The old version should no longer match")
+}
+
+func TestConcurrentSetIfAbsent(t *testing.T) {
+	s := newTestStore(t)
+
+	var wins atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := s.SetIfAbsent("lock", "owner")
+			assert.NoError(t, err)
+			if ok {
+				wins.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), wins.Load(), "Exactly one caller should acquire the key")
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"strings"
+	"sync"
+)
+
+// EventType is the kind of change an Event reports.
+type EventType string
+
+const (
+	EventSet   EventType = "set"
+	EventDel   EventType = "del"
+	EventMerge EventType = "merge"
+)
+
+// Event reports a change to a key. Events are emitted once the change is
+// logged and applied, in the order of the writes, so the events of a key are
+// always delivered in order.
+type Event struct {
+	Type    EventType
+	Key     string
+	Version uint64 // version of the write, as returned by GetVersioned
+
+	// Missed is the number of events dropped for this subscription since the
+	// previous event was delivered, because its channel was full. Consumers
+	// that see it non-zero should treat every key of the prefix as changed.
+	Missed uint64
+}
+
+// Subscription receives the events of keys with a prefix until Close is
+// called.
+type Subscription struct {
+	bus    *eventBus
+	prefix string
+
+	// Exactly one of ch and fn is set. missed and dropped are guarded by
+	// bus.mu.
+	ch      chan<- Event
+	fn      func(Event)
+	missed  uint64
+	dropped uint64
+}
+
+// eventBus holds the subscriptions of a store.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscribe sends events for keys starting with prefix, or every key when it
+// is empty, to ch.
+//
+// Sending never blocks writers: when ch is full the event is dropped and
+// counted in the Missed field of the next event delivered, and in
+// Subscription.Dropped. Events are only delivered while the subscription is
+// open; changes made before Subscribe or after Close, for example while a
+// consumer restarts, are never replayed, so consumers should read the keys
+// they care about again after subscribing.
+func (s *KVStore) Subscribe(prefix string, ch chan<- Event) *Subscription {
+	return s.events.add(&Subscription{prefix: prefix, ch: ch})
+}
+
+// SubscribeFunc is like Subscribe but calls fn for every event instead of
+// sending it to a channel, so no event is ever dropped. fn is called while
+// the store is locked for writing: it must return quickly and must not call
+// the store.
+func (s *KVStore) SubscribeFunc(prefix string, fn func(Event)) *Subscription {
+	return s.events.add(&Subscription{prefix: prefix, fn: fn})
+}
+
+// Close stops the subscription. No event is sent once Close returns, and the
+// channel is not closed.
+func (sub *Subscription) Close() {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	delete(sub.bus.subs, sub)
+}
+
+// Dropped returns the number of events dropped because the channel of the
+// subscription was full.
+func (sub *Subscription) Dropped() uint64 {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	return sub.dropped
+}
+
+func (b *eventBus) add(sub *Subscription) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	sub.bus = b
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// emit delivers an event to the matching subscriptions. It is called with the
+// store locked for writing, which orders events like the writes.
+func (b *eventBus) emit(typ EventType, key string, version uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		if !strings.HasPrefix(key, sub.prefix) {
+			continue
+		}
+		event := Event{Type: typ, Key: key, Version: version, Missed: sub.missed}
+		if sub.fn != nil {
+			sub.fn(event)
+			continue
+		}
+		select {
+		case sub.ch <- event:
+			sub.missed = 0
+		default:
+			sub.missed++
+			sub.dropped++
+		}
+	}
+}
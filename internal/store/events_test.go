@@ -0,0 +1,69 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	store := newTestStore(t)
+	events := make(chan Event, 10)
+	sub := store.Subscribe("user:", events)
+
+	require.NoError(t, store.Set("user:1", "a"))
+	require.NoError(t, store.Set("order:1", "x"))
+	require.NoError(t, store.Delete("user:1"))
+	require.NoError(t, store.Delete("user:2"))
+	var b WriteBatch
+	b.Put("user:3", "a")
+	b.Merge("user:3", "b")
+	b.Put("user:4", "c")
+	b.Delete("user:4")
+	require.NoError(t, store.Write(&b))
+
+	_, version, _ := store.GetVersioned("user:3")
+	expected := []Event{
+		{Type: EventSet, Key: "user:1", Version: 1},
+		{Type: EventDel, Key: "user:1", Version: 3},
+		{Type: EventMerge, Key: "user:3", Version: version},
+	}
+	for _, want := range expected {
+		assert.Equal(t, want, <-events)
+	}
+	assert.Empty(t, events, "Expected no events for other prefixes, missing keys or keys created and deleted in a batch")
+
+	sub.Close()
+	require.NoError(t, store.Set("user:1", "b"))
+	assert.Empty(t, events, "Expected no events after Close")
+}
+
+func TestSubscribeMissedEvents(t *testing.T) {
+	store := newTestStore(t)
+	events := make(chan Event, 1)
+	sub := store.Subscribe("", events)
+	defer sub.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, store.Set(key, "1"))
+	}
+	assert.Equal(t, "a", (<-events).Key)
+	assert.Equal(t, uint64(2), sub.Dropped(), "Expected the events sent to a full channel to be dropped")
+
+	require.NoError(t, store.Set("d", "1"))
+	event := <-events
+	assert.Equal(t, "d", event.Key)
+	assert.Equal(t, uint64(2), event.Missed, "Expected the next event to report the dropped ones")
+
+	require.NoError(t, store.Set("e", "1"))
+	assert.Zero(t, (<-events).Missed)
+
+	var keys []string
+	fnSub := store.SubscribeFunc("", func(e Event) { keys = append(keys, e.Key) })
+	defer fnSub.Close()
+	for _, key := range []string{"f", "g"} {
+		require.NoError(t, store.Set(key, "1"))
+	}
+	assert.Equal(t, []string{"f", "g"}, keys, "Expected SubscribeFunc to see every event")
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLockTimeout is returned when a lock could not be acquired in time.
+	ErrLockTimeout = errors.New("lock wait timeout")
+
+	// ErrDeadlock is returned to the transaction chosen as the victim of a
+	// deadlock, which must be rolled back.
+	ErrDeadlock = errors.New("deadlock detected")
+)
+
+type LockMode int
+
+const (
+	LockShared LockMode = iota
+	LockExclusive
+)
+
+func (m LockMode) compatible(other LockMode) bool {
+	return m == LockShared && other == LockShared
+}
+
+// lockRequest is a transaction waiting for a lock. granted receives nil once
+// the lock is held, or the error that aborted the wait.
+type lockRequest struct {
+	owner   uint64
+	mode    LockMode
+	granted chan error
+}
+
+type keyLock struct {
+	holders map[uint64]LockMode
+	waiters []*lockRequest // FIFO
+}
+
+// LockManager hands out shared and exclusive key locks to transactions,
+// identified by an owner ID. Waiters are served in FIFO order. Every time a
+// transaction has to wait, a wait-for graph is built and, if the new edge
+// closes a cycle, the youngest transaction in the cycle (the highest owner
+// ID) is aborted with ErrDeadlock.
+type LockManager struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+
+	// waiting maps each waiting owner to the key it waits for
+	waiting map[uint64]string
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{
+		locks:   make(map[string]*keyLock),
+		waiting: make(map[uint64]string),
+	}
+}
+
+// Lock acquires key in mode for owner, waiting at most timeout. Locks are
+// reentrant and a shared lock is upgraded when owner asks for an exclusive
+// one.
+func (lm *LockManager) Lock(owner uint64, key string, mode LockMode, timeout time.Duration) error {
+	lm.mu.Lock()
+	l := lm.locks[key]
+	if l == nil {
+		l = &keyLock{holders: make(map[uint64]LockMode)}
+		lm.locks[key] = l
+	}
+	if held, ok := l.holders[owner]; ok && (held == LockExclusive || mode == LockShared) {
+		lm.mu.Unlock()
+		return nil
+	}
+	if len(l.waiters) == 0 && l.grantable(owner, mode) {
+		l.holders[owner] = mode
+		lm.mu.Unlock()
+		return nil
+	}
+
+	req := &lockRequest{owner: owner, mode: mode, granted: make(chan error, 1)}
+	l.waiters = append(l.waiters, req)
+	lm.waiting[owner] = key
+	if victim, ok := lm.findDeadlock(owner); ok {
+		lm.abort(victim)
+	}
+	lm.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-req.granted:
+		return err
+	case <-timer.C:
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	// The lock may have been granted or the wait aborted after the timer fired
+	select {
+	case err := <-req.granted:
+		return err
+	default:
+	}
+	lm.removeWaiter(key, req)
+	return ErrLockTimeout
+}
+
+// grantable reports whether owner can take key in mode given the current
+// holders, ignoring its own shared lock when upgrading.
+func (l *keyLock) grantable(owner uint64, mode LockMode) bool {
+	for holder, held := range l.holders {
+		if holder != owner && !mode.compatible(held) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReleaseAll releases every lock held by owner and wakes up waiters that can
+// now proceed.
+func (lm *LockManager) ReleaseAll(owner uint64) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for key, l := range lm.locks {
+		if _, ok := l.holders[owner]; !ok {
+			continue
+		}
+		delete(l.holders, owner)
+		lm.grantWaiters(key)
+	}
+}
+
+// grantWaiters grants the lock on key to waiters in FIFO order until one of
+// them has to keep waiting.
+func (lm *LockManager) grantWaiters(key string) {
+	l := lm.locks[key]
+	for len(l.waiters) > 0 && l.grantable(l.waiters[0].owner, l.waiters[0].mode) {
+		req := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		l.holders[req.owner] = req.mode
+		delete(lm.waiting, req.owner)
+		req.granted <- nil
+	}
+	if len(l.holders) == 0 && len(l.waiters) == 0 {
+		delete(lm.locks, key)
+	}
+}
+
+func (lm *LockManager) removeWaiter(key string, req *lockRequest) {
+	l := lm.locks[key]
+	for i, waiter := range l.waiters {
+		if waiter == req {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			break
+		}
+	}
+	delete(lm.waiting, req.owner)
+	// Waiters queued behind req may be grantable now
+	lm.grantWaiters(key)
+}
+
+// abort fails the pending lock request of victim with ErrDeadlock.
+func (lm *LockManager) abort(victim uint64) {
+	key := lm.waiting[victim]
+	for _, req := range lm.locks[key].waiters {
+		if req.owner == victim {
+			req.granted <- ErrDeadlock
+			lm.removeWaiter(key, req)
+			return
+		}
+	}
+}
+
+// waitsFor returns the owners that owner waits for: the holders of the key it
+// waits for and the waiters queued ahead of it with an incompatible mode.
+func (lm *LockManager) waitsFor(owner uint64) []uint64 {
+	key, ok := lm.waiting[owner]
+	if !ok {
+		return nil
+	}
+	l := lm.locks[key]
+
+	var mode LockMode
+	var ahead []*lockRequest
+	for i, req := range l.waiters {
+		if req.owner == owner {
+			mode, ahead = req.mode, l.waiters[:i]
+			break
+		}
+	}
+
+	var owners []uint64
+	for holder, held := range l.holders {
+		if holder != owner && !mode.compatible(held) {
+			owners = append(owners, holder)
+		}
+	}
+	for _, req := range ahead {
+		if !mode.compatible(req.mode) {
+			owners = append(owners, req.owner)
+		}
+	}
+	return owners
+}
+
+// findDeadlock looks for a cycle in the wait-for graph through start and
+// returns the youngest owner in it.
+func (lm *LockManager) findDeadlock(start uint64) (uint64, bool) {
+	// Depth-first search keeping the current path, a cycle is found when the
+	// search gets back to start
+	visited := make(map[uint64]bool)
+	var path []uint64
+	var visit func(owner uint64) bool
+	visit = func(owner uint64) bool {
+		path = append(path, owner)
+		for _, next := range lm.waitsFor(owner) {
+			if next == start {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if visit(next) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+
+	if !visit(start) {
+		return 0, false
+	}
+	victim := path[0]
+	for _, owner := range path {
+		if owner > victim {
+			victim = owner
+		}
+	}
+	return victim, true
+}
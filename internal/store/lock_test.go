@@ -0,0 +1,162 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockAsync acquires a lock in a goroutine and returns the channel its result
+// is sent on.
+func lockAsync(lm *LockManager, owner uint64, key string, mode LockMode, timeout time.Duration) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- lm.Lock(owner, key, mode, timeout)
+	}()
+	return result
+}
+
+func assertBlocked(t *testing.T, result <-chan error) {
+	select {
+	case err := <-result:
+		t.Fatalf("Expected the lock request to wait, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSharedAndExclusiveLocks(t *testing.T) {
+	lm := NewLockManager()
+
+	require.NoError(t, lm.Lock(1, "a", LockShared, time.Second), "Shared lock failed")
+	require.NoError(t, lm.Lock(2, "a", LockShared, time.Second), "Shared locks should be compatible")
+	require.NoError(t, lm.Lock(1, "a", LockShared, time.Second), "Locks should be reentrant")
+
+	exclusive := lockAsync(lm, 3, "a", LockExclusive, time.Second)
+	assertBlocked(t, exclusive)
+
+	// Later shared requests queue behind the exclusive one
+	shared := lockAsync(lm, 4, "a", LockShared, time.Second)
+	assertBlocked(t, shared)
+
+	lm.ReleaseAll(1)
+	assertBlocked(t, exclusive)
+	lm.ReleaseAll(2)
+	require.NoError(t, <-exclusive, "Exclusive lock should be granted once shared locks are released")
+	assertBlocked(t, shared)
+
+	lm.ReleaseAll(3)
+	require.NoError(t, <-shared, "Shared lock should be granted after the exclusive lock")
+}
+
+func TestLockTimeout(t *testing.T) {
+	lm := NewLockManager()
+	require.NoError(t, lm.Lock(1, "a", LockExclusive, time.Second), "Exclusive lock failed")
+
+	err := lm.Lock(2, "a", LockShared, 20*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrLockTimeout), "Expected a lock timeout, got %v", err)
+
+	// The timed out request no longer blocks others
+	lm.ReleaseAll(1)
+	assert.NoError(t, lm.Lock(3, "a", LockExclusive, time.Second), "Lock should be free after release")
+}
+
+func TestLockUpgrade(t *testing.T) {
+	lm := NewLockManager()
+	require.NoError(t, lm.Lock(1, "a", LockShared, time.Second), "Shared lock failed")
+	require.NoError(t, lm.Lock(1, "a", LockExclusive, time.Second), "Sole holder should upgrade immediately")
+
+	err := lm.Lock(2, "a", LockShared, 20*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrLockTimeout), "Upgraded lock should be exclusive")
+}
+
+func TestDeadlockDetection(t *testing.T) {
+	lm := NewLockManager()
+	require.NoError(t, lm.Lock(1, "a", LockExclusive, time.Second), "Lock failed")
+	require.NoError(t, lm.Lock(2, "b", LockExclusive, time.Second), "Lock failed")
+
+	older := lockAsync(lm, 1, "b", LockExclusive, 5*time.Second)
+	assertBlocked(t, older)
+
+	// Owner 2 closes the cycle and, being the youngest, is the victim
+	err := lm.Lock(2, "a", LockExclusive, 5*time.Second)
+	assert.True(t, errors.Is(err, ErrDeadlock), "Expected a deadlock, got %v", err)
+
+	lm.ReleaseAll(2)
+	require.NoError(t, <-older, "The surviving transaction should get its lock")
+}
+
+func TestDeadlockOnUpgrade(t *testing.T) {
+	lm := NewLockManager()
+	require.NoError(t, lm.Lock(1, "a", LockShared, time.Second), "Lock failed")
+	require.NoError(t, lm.Lock(2, "a", LockShared, time.Second), "Lock failed")
+
+	// The younger transaction waits first, the older one closes the cycle
+	younger := lockAsync(lm, 2, "a", LockExclusive, 5*time.Second)
+	assertBlocked(t, younger)
+	older := lockAsync(lm, 1, "a", LockExclusive, 5*time.Second)
+
+	require.True(t, errors.Is(<-younger, ErrDeadlock), "The youngest transaction should be the victim")
+	lm.ReleaseAll(2)
+	require.NoError(t, <-older, "The older transaction should get its upgrade")
+}
+
+func TestPessimisticTxnIncrements(t *testing.T) {
+	s := newTestStore(t)
+	require.NoError(t, s.Set("counter", ""), "Set failed")
+
+	// Locking the key for update serializes the transactions, so none of them
+	// has to retry
+	const workers, increments = 4, 25
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; n++ {
+				txn := s.BeginTxnWithOptions(TxnOptions{Pessimistic: true})
+				value, _, err := txn.GetForUpdate("counter")
+				if err != nil {
+					t.Errorf("GetForUpdate failed: %v", err)
+					return
+				}
+				txn.Set("counter", value+"x")
+				if err := txn.Commit(); err != nil {
+					t.Errorf("Commit failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, _ := s.Get("counter")
+	assert.Len(t, value, workers*increments, "Lost update detected")
+}
+
+func TestPessimisticTxnDeadlockVictimIsRolledBack(t *testing.T) {
+	s := newTestStore(t)
+
+	first := s.BeginTxnWithOptions(TxnOptions{Pessimistic: true})
+	second := s.BeginTxnWithOptions(TxnOptions{Pessimistic: true})
+	require.NoError(t, first.Set("a", "first"), "Set failed")
+	require.NoError(t, second.Set("b", "second"), "Set failed")
+
+	result := make(chan error, 1)
+	go func() {
+		result <- first.Set("b", "first")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	err := second.Set("a", "second")
+	assert.True(t, errors.Is(err, ErrDeadlock), "Expected the younger transaction to be the victim, got %v", err)
+	assert.True(t, errors.Is(second.Commit(), ErrTxnDone), "The victim should have been rolled back")
+
+	require.NoError(t, <-result, "The surviving transaction should proceed")
+	require.NoError(t, first.Commit(), "Commit failed")
+	value, _ := s.Get("b")
+	assert.Equal(t, "first", value, "Unexpected value after commit")
+}
@@ -0,0 +1,63 @@
+package store
+
+// Scan returns up to count keys in lexicographic order, starting with the
+// first key that is not less than start, and the start of the next call, or
+// "" once every key has been returned. An empty start begins a new scan, and
+// a count below 1 is taken as 1.
+//
+// The store is only locked while the keys of a call are collected, so a scan
+// of a large store does not hold up writers. Since the position of a scan is
+// a key, it is not affected by memtable flushes or restarts: a key that exists
+// for the whole scan is returned exactly once, while keys written or deleted
+// during the scan may or may not be. Returned keys may have been deleted by
+// the time they are read.
+func (s *KVStore) Scan(start string, count int) ([]string, string) {
+	count = max(count, 1)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, count)
+	elem := s.keys.Find(start)
+	for ; elem != nil && len(keys) < count; elem = elem.Next() {
+		keys = append(keys, elem.Key().(string))
+	}
+	if elem == nil {
+		return keys, ""
+	}
+	// The smallest key greater than the last key returned
+	return keys, keys[len(keys)-1] + "\x00"
+}
+
+// Len returns the number of keys in the store.
+func (s *KVStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.data)
+}
+
+// put sets key to value with s.mu held for writing.
+func (s *KVStore) put(key, value string) {
+	if _, ok := s.data[key]; !ok {
+		s.keys.Set(key, nil)
+	}
+	s.data[key] = value
+}
+
+// remove deletes key with s.mu held for writing, and reports whether it
+// existed.
+func (s *KVStore) remove(key string) bool {
+	if _, ok := s.data[key]; !ok {
+		return false
+	}
+	delete(s.data, key)
+	s.keys.Remove(key)
+	return true
+}
+
+// indexKeys rebuilds the key index from data.
+func (s *KVStore) indexKeys() {
+	s.keys.Init()
+	for key := range s.data {
+		s.keys.Set(key, nil)
+	}
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{WALDir: dir, SSTDir: dir, MemtableSize: 64, UseSegmentedLogs: true, SegmentSize: 100}
+	store, err := NewKVStore(cfg)
+	require.NoError(t, err, "Failed to create KVStore")
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), "value"))
+	}
+	var b WriteBatch
+	b.Put("key10", "value")
+	b.Delete("key9")
+	require.NoError(t, store.Write(&b))
+	assert.Equal(t, 10, store.Len(), "Unexpected number of keys")
+
+	keys, next := store.Scan("", 4)
+	assert.Equal(t, []string{"key0", "key1", "key10", "key2"}, keys, "Expected keys in lexicographic order")
+
+	// Keys written or deleted before the cursor do not affect the scan
+	require.NoError(t, store.Delete("key0"))
+	require.NoError(t, store.Set("key", "value"))
+	require.NoError(t, store.Close(), "Failed to close KVStore")
+
+	// The cursor stays valid across restarts
+	store, err = NewKVStore(cfg)
+	require.NoError(t, err, "Failed to reopen KVStore")
+	defer store.Close()
+	require.NoError(t, store.RecoverFromWAL(), "Failed to recover")
+
+	var rest []string
+	for next != "" {
+		keys, next = store.Scan(next, 4)
+		rest = append(rest, keys...)
+	}
+	assert.Equal(t, []string{"key3", "key4", "key5", "key6", "key7", "key8"}, rest, "Unexpected keys after the cursor")
+
+	keys, next = store.Scan("", 0)
+	assert.Equal(t, []string{"key"}, keys, "Expected a count below 1 to return a key")
+	assert.Equal(t, "key\x00", next, "Unexpected next start")
+}
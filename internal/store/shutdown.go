@@ -0,0 +1,66 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// shutdownMarkerName is written to the WAL directory once the store has been
+// closed cleanly, and removed again when the store is opened. Its absence on
+// startup means the previous process crashed or was killed.
+const shutdownMarkerName = "clean_shutdown"
+
+type shutdownMarker struct {
+	Time time.Time `json:"time"`
+
+	// NextOffset is the next WAL offset at shutdown. A mismatch on startup
+	// means the WAL was written to after the marker, so it is not trusted.
+	NextOffset int64 `json:"next_offset"`
+}
+
+// writeShutdownMarker records a clean shutdown in dir.
+func writeShutdownMarker(dir string, nextOffset int64) error {
+	data, err := json.Marshal(shutdownMarker{Time: time.Now(), NextOffset: nextOffset})
+	if err != nil {
+		return fmt.Errorf("failed to encode shutdown marker: %v", err)
+	}
+	path := filepath.Join(dir, shutdownMarkerName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create shutdown marker: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write shutdown marker: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync shutdown marker: %v", err)
+	}
+	return nil
+}
+
+// consumeShutdownMarker reports whether dir holds a valid clean-shutdown
+// marker for a WAL ending at nextOffset, and removes it so that a crash of
+// this process is not mistaken for a clean shutdown.
+func consumeShutdownMarker(dir string, nextOffset int64) (bool, error) {
+	path := filepath.Join(dir, shutdownMarkerName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read shutdown marker: %v", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return false, fmt.Errorf("failed to remove shutdown marker: %v", err)
+	}
+
+	var marker shutdownMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return false, nil
+	}
+	return marker.NextOffset == nextOffset, nil
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"time"
+)
+
+// Stats describes the state of a store, as reported by the INFO command.
+type Stats struct {
+	// Started is when the store was opened
+	Started time.Time
+
+	// Keys is the number of keys in the data map
+	Keys int
+
+	// MemtableBytes is the size of the keys and values in the memtable
+	MemtableBytes int
+
+	// WALSegments is the number of WAL files and WALBytes their total size.
+	// LastWALSync is zero when the WAL has not been synced since the store
+	// was opened.
+	WALSegments int
+	WALBytes    int64
+	LastWALSync time.Time
+
+	// LastFlush is zero when the memtable has not been flushed since the
+	// store was opened
+	LastFlush time.Time
+
+	// SSTablesPerLevel holds the number of SSTables on each level and
+	// SSTableBytes their total size. SSTables are not compacted yet, so they
+	// are all on level 0 and PendingCompactionBytes is always 0.
+	SSTablesPerLevel       []int
+	SSTableBytes           int64
+	PendingCompactionBytes int64
+}
+
+// Stats returns the current state of the store.
+func (s *KVStore) Stats() (Stats, error) {
+	s.mu.RLock()
+	keys := len(s.data)
+	lsmStats, err := s.lsm.Stats()
+	s.mu.RUnlock()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	walStats := s.wal.Stats()
+	return Stats{
+		Started:                s.started,
+		Keys:                   keys,
+		MemtableBytes:          lsmStats.MemtableBytes,
+		WALSegments:            walStats.Segments,
+		WALBytes:               walStats.Bytes,
+		LastWALSync:            walStats.LastSync,
+		LastFlush:              lsmStats.LastFlush,
+		SSTablesPerLevel:       lsmStats.TablesPerLevel,
+		SSTableBytes:           lsmStats.TableBytes,
+		PendingCompactionBytes: lsmStats.PendingCompactionBytes,
+	}, nil
+}
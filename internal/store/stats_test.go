@@ -0,0 +1,30 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewKVStore(&config.Config{WALDir: dir, SSTDir: dir, MemtableSize: 1024, UseSegmentedLogs: true, SegmentSize: 100})
+	require.NoError(t, err, "Failed to create KVStore")
+	defer store.Close()
+
+	require.NoError(t, store.Set("a", "1"))
+	require.NoError(t, store.Set("b", "2"))
+	require.NoError(t, store.Delete("b"))
+
+	stats, err := store.Stats()
+	require.NoError(t, err, "Failed to get stats")
+	assert.Equal(t, 1, stats.Keys, "Deleted keys should not be counted")
+	assert.Equal(t, 4, stats.MemtableBytes, "Unexpected memtable size")
+	assert.Equal(t, 1, stats.WALSegments)
+	assert.Positive(t, stats.WALBytes)
+	assert.Equal(t, []int{0}, stats.SSTablesPerLevel, "Expected no SSTables before a flush")
+	assert.True(t, stats.LastFlush.IsZero(), "Expected no flush yet")
+	assert.False(t, stats.Started.IsZero())
+}
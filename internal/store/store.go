@@ -1,14 +1,16 @@
 package store
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
-	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/huandu/skiplist"
 	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/encryption"
 	"github.com/joobisb/vitadb/internal/lsm"
+	"github.com/joobisb/vitadb/internal/repair"
 	"github.com/joobisb/vitadb/internal/wal"
 )
 
@@ -17,6 +19,49 @@ type KVStore struct {
 	data map[string]string
 	wal  *wal.WAL
 	lsm  *lsm.LSM
+
+	// keys orders the keys of data, for Scan. Writes update both with put
+	// and remove.
+	keys *skiplist.SkipList
+
+	// seq is the version of the newest write and versions holds the version
+	// of the last write to each key, deletes included. Versions are logged
+	// with every write; transactions and conditional writes use them to
+	// detect concurrent changes. tombstones lists the deleted keys in
+	// versions, oldest delete first, see recordVersion.
+	seq        uint64
+	versions   map[string]uint64
+	tombstones []tombstone
+
+	// txns maps the ID of each open transaction to its start seq
+	txnsMu sync.Mutex
+	txns   map[uint64]uint64
+
+	// locks is used by pessimistic transactions
+	locks     *LockManager
+	nextTxnID atomic.Uint64
+
+	// scrubber is only set when do_async_repair is enabled
+	scrubber *repair.Scrubber
+
+	// walDir holds the clean-shutdown marker. backupDir is where the BACKUP
+	// command may write backups. cleanStart reports whether the previous
+	// process shut down cleanly, closed whether Close was called.
+	walDir     string
+	backupDir  string
+	cleanStart bool
+	closed     bool
+
+	// started is when the store was opened, for Stats
+	started time.Time
+
+	// events delivers changes to subscribers, see Subscribe
+	events eventBus
+
+	// consumers holds the WAL offset of each change consumer by name, see
+	// SetConsumerOffset. The map is replaced rather than modified.
+	consumersMu sync.Mutex
+	consumers   map[string]int64
 }
 
 func NewKVStore(cfg *config.Config) (*KVStore, error) {
@@ -30,28 +75,49 @@ func NewKVStore(cfg *config.Config) (*KVStore, error) {
 		return nil, err
 	}
 
-	return &KVStore{
-		data: make(map[string]string),
-		wal:  w,
-		lsm:  l,
-	}, nil
+	clean, err := consumeShutdownMarker(cfg.WALDir, w.NextOffset())
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	consumers, err := loadConsumers(cfg.WALDir)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	s := &KVStore{
+		data:       make(map[string]string),
+		keys:       skiplist.New(skiplist.String),
+		versions:   make(map[string]uint64),
+		txns:       make(map[uint64]uint64),
+		locks:      NewLockManager(),
+		wal:        w,
+		lsm:        l,
+		walDir:     cfg.WALDir,
+		backupDir:  cfg.BackupDir,
+		cleanStart: clean,
+		started:    time.Now(),
+		consumers:  consumers,
+	}
+	s.retainConsumerSegments()
+	if cfg.DoAsyncRepair {
+		// The scrubber is started by RecoverFromWAL, so it does not move
+		// segments away while they are being replayed
+		s.scrubber = repair.NewScrubber(cfg, w, l)
+	}
+	return s, nil
+}
+
+// CleanStart reports whether the previous process closed the store cleanly.
+func (s *KVStore) CleanStart() bool {
+	return s.cleanStart
 }
 
 func (s *KVStore) Set(key, value string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
-	if err := s.wal.AppendSet(key, value); err != nil {
-		return err
-	}
-
-	if err := s.lsm.Set(key, value); err != nil {
-		return err
-	}
-
-	//TODO remove this once we have a proper LSM implementation
-	s.data[key] = value
-	return nil
+	return s.setLocked(key, value)
 }
 
 func (s *KVStore) Get(key string) (string, bool) {
@@ -68,59 +134,183 @@ func (s *KVStore) Get(key string) (string, bool) {
 func (s *KVStore) Delete(key string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.deleteLocked(key)
+}
 
-	if err := s.wal.AppendDelete(key); err != nil {
+// setLocked logs and applies a write of key with s.mu held for writing.
+func (s *KVStore) setLocked(key, value string) error {
+	version := s.seq + 1
+	if err := s.wal.Append(wal.LogEntry{Operation: wal.OperationSet, Key: key, Value: value, Version: version}); err != nil {
+		return err
+	}
+
+	if err := s.lsm.Set(key, value); err != nil {
+		return err
+	}
+
+	//TODO remove this once we have a proper LSM implementation
+	s.put(key, value)
+	s.recordVersion(key, version)
+	s.events.emit(EventSet, key, version)
+	return nil
+}
+
+// deleteLocked logs and applies a delete of key with s.mu held for writing.
+func (s *KVStore) deleteLocked(key string) error {
+	version := s.seq + 1
+	if err := s.wal.Append(wal.LogEntry{Operation: wal.OperationDel, Key: key, Version: version}); err != nil {
 		return err
 	}
 
 	//TODO: Implement once we have LSM and SST
 	//TODO: s.lsm.Get(key)
 
-	delete(s.data, key)
+	existed := s.remove(key)
+	s.recordVersion(key, version)
+	if existed {
+		s.events.emit(EventDel, key, version)
+	}
 	return nil
 }
 
-func (s *KVStore) Close() error {
-	return s.wal.Close()
+// tombstone is the version of a delete still recorded in versions.
+type tombstone struct {
+	key     string
+	version uint64
 }
 
-func (s *KVStore) RecoverFromWAL() error {
-	paths := s.wal.GetAllSegmentPaths()
+// recordVersion records a write of key at version, once it was applied to
+// s.data. s.mu must be held for writing.
+//
+// The version of a deleted key only matters to transactions that started
+// before the delete: they must see it as a change. It is dropped once there
+// are none left, after which the key reads as version 0 like a key that was
+// never written, so deleted keys do not pile up in versions.
+func (s *KVStore) recordVersion(key string, version uint64) {
+	if version > s.seq {
+		s.seq = version
+	}
+	s.versions[key] = version
+	if _, ok := s.data[key]; !ok {
+		s.tombstones = append(s.tombstones, tombstone{key: key, version: version})
+	}
+	s.pruneTombstones()
+}
+
+// pruneTombstones drops the versions of deletes that every open transaction
+// started after. s.mu must be held for writing.
+func (s *KVStore) pruneTombstones() {
+	if len(s.tombstones) == 0 {
+		return
+	}
+	oldest := s.seq
+	s.txnsMu.Lock()
+	for _, startSeq := range s.txns {
+		oldest = min(oldest, startSeq)
+	}
+	s.txnsMu.Unlock()
 
-	for _, path := range paths {
-		if err := s.recoverFromFile(path); err != nil {
-			return err
+	n := 0
+	for n < len(s.tombstones) && s.tombstones[n].version <= oldest {
+		// The key may have been written again since
+		if t := s.tombstones[n]; s.versions[t.key] == t.version {
+			delete(s.versions, t.key)
 		}
+		n++
 	}
+	if n > 0 {
+		s.tombstones = append(s.tombstones[:0], s.tombstones[n:]...)
+	}
+}
+
+// RotateMasterKey re-wraps the data keys of all WAL segments and SSTables with
+// newKey. Only file headers are rewritten, in place, so rotation is cheap
+// regardless of the amount of data stored.
+func (s *KVStore) RotateMasterKey(newKey *encryption.MasterKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	if err := s.wal.RotateMasterKey(newKey); err != nil {
+		return fmt.Errorf("failed to rotate WAL master key: %v", err)
+	}
+	if err := s.lsm.RotateMasterKey(newKey); err != nil {
+		return fmt.Errorf("failed to rotate SST master key: %v", err)
+	}
 	return nil
 }
 
-func (s *KVStore) recoverFromFile(filePath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to open WAL file %s: %v", filePath, err)
+// RepairStatus reports the activity of the async repair scrubber.
+func (s *KVStore) RepairStatus() repair.Status {
+	if s.scrubber == nil {
+		return repair.Status{}
 	}
-	defer file.Close()
+	return s.scrubber.Status()
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		var entry wal.LogEntry
-		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
-			return fmt.Errorf("failed to unmarshal log entry: %v", err)
-		}
+// Close flushes the memtable, syncs and closes the WAL and records a clean
+// shutdown, so the next start can skip the initial scrub. Calling Close more
+// than once is a no-op.
+func (s *KVStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
 
-		switch entry.Operation {
-		case wal.OperationSet:
-			s.data[entry.Key] = entry.Value
-		case wal.OperationDel:
-			delete(s.data, entry.Key)
-		}
+	if s.scrubber != nil {
+		s.scrubber.Stop()
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading WAL file %s: %v", filePath, err)
+	flushErr := s.lsm.Flush()
+	if flushErr != nil {
+		flushErr = fmt.Errorf("failed to flush memtable: %v", flushErr)
 	}
+	nextOffset := s.wal.NextOffset()
+	if err := s.wal.Close(); err != nil {
+		return err
+	}
+	if flushErr != nil {
+		return flushErr
+	}
+	return writeShutdownMarker(s.walDir, nextOffset)
+}
 
+// RecoverFromWAL replays the WAL into the store, then starts the scrubber if
+// async repair is enabled.
+func (s *KVStore) RecoverFromWAL() error {
+	// Replay only updates data, the keys are indexed once it is done
+	defer s.indexKeys()
+	if err := s.replay(); err != nil {
+		return err
+	}
+	if s.scrubber != nil {
+		// After a clean shutdown the files were synced and closed, so the
+		// first scrub can wait for the regular interval
+		if s.cleanStart {
+			s.scrubber.StartDeferred()
+		} else {
+			s.scrubber.Start()
+		}
+	}
 	return nil
 }
+
+func (s *KVStore) replay() error {
+	return s.wal.Replay(func(entry wal.LogEntry) error {
+		applyLogEntry(s.data, entry)
+
+		// Records written before versions were logged get a fresh one
+		version := entry.Version
+		if version == 0 {
+			version = s.seq + 1
+		}
+		if entry.Operation != wal.OperationBatch {
+			s.recordVersion(entry.Key, version)
+		}
+		for _, op := range entry.Batch {
+			s.recordVersion(op.Key, version)
+		}
+		return nil
+	})
+}
@@ -2,7 +2,9 @@ package store
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/joobisb/vitadb/internal/config"
 	"github.com/stretchr/testify/assert"
@@ -61,3 +63,64 @@ func TestKVStore(t *testing.T) {
 		assert.False(t, ok, "Recovery failed: key2 should have been deleted")
 	})
 }
+
+func TestCleanShutdown(t *testing.T) {
+	cfg := &config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir(), UseSegmentedLogs: true, MemtableSize: 1024}
+
+	s, err := NewKVStore(cfg)
+	require.NoError(t, err, "Failed to create KVStore")
+	assert.False(t, s.CleanStart(), "A new store has no clean shutdown marker")
+	require.NoError(t, s.Set("key1", "value1"), "Set failed")
+	require.NoError(t, s.Close(), "Failed to close store")
+	assert.NoError(t, s.Close(), "Closing twice should be a no-op")
+
+	sstables, err := filepath.Glob(filepath.Join(cfg.SSTDir, "sst_*.db"))
+	require.NoError(t, err)
+	assert.Len(t, sstables, 1, "Expected the memtable to be flushed on close")
+	assert.FileExists(t, filepath.Join(cfg.WALDir, shutdownMarkerName), "Expected a clean shutdown marker")
+
+	s, err = NewKVStore(cfg)
+	require.NoError(t, err, "Failed to reopen KVStore")
+	assert.True(t, s.CleanStart(), "Expected the previous shutdown to be clean")
+	assert.NoFileExists(t, filepath.Join(cfg.WALDir, shutdownMarkerName), "The marker should be removed on open")
+	require.NoError(t, s.RecoverFromWAL(), "Failed to recover from WAL")
+	value, ok := s.Get("key1")
+	assert.True(t, ok, "Recovery failed: key1 not found")
+	assert.Equal(t, "value1", value, "Recovery failed: unexpected value")
+	require.NoError(t, s.Set("key2", "value2"), "Set failed")
+
+	// Simulate a crash: the WAL is closed but the store never is
+	require.NoError(t, s.wal.Close())
+	s, err = NewKVStore(cfg)
+	require.NoError(t, err, "Failed to reopen KVStore")
+	defer s.Close()
+	assert.False(t, s.CleanStart(), "A crash must not look like a clean shutdown")
+}
+
+func TestScrubberStartsAfterRecovery(t *testing.T) {
+	cfg := &config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir(), UseSegmentedLogs: true, DoAsyncRepair: true}
+
+	s, err := NewKVStore(cfg)
+	require.NoError(t, err, "Failed to create KVStore")
+	defer s.Close()
+	require.False(t, s.CleanStart(), "A new store should scrub right after recovery")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Zero(t, s.RepairStatus().Runs, "The scrubber must not run before recovery")
+
+	require.NoError(t, s.RecoverFromWAL(), "Failed to recover from WAL")
+	assert.Eventually(t, func() bool { return s.RepairStatus().Runs == 1 }, time.Second, 5*time.Millisecond, "Expected a scrub once recovery is done")
+}
+
+func TestShutdownMarkerMustMatchWAL(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, writeShutdownMarker(dir, 5), "Failed to write marker")
+	clean, err := consumeShutdownMarker(dir, 6)
+	require.NoError(t, err)
+	assert.False(t, clean, "A WAL written after the marker must not be trusted")
+
+	require.NoError(t, writeShutdownMarker(dir, 5), "Failed to write marker")
+	clean, err = consumeShutdownMarker(dir, 5)
+	require.NoError(t, err)
+	assert.True(t, clean, "Expected a matching marker to be trusted")
+}
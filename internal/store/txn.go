@@ -0,0 +1,244 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+const defaultLockTimeout = 5 * time.Second
+
+var (
+	// ErrConflict is returned by Txn.Commit when a key read by the transaction
+	// was written by someone else after the transaction started, or a watched
+	// key after it was watched.
+	ErrConflict = errors.New("transaction conflict")
+
+	// ErrTxnDone is returned when a committed or rolled back transaction is used.
+	ErrTxnDone = errors.New("transaction has already been committed or rolled back")
+)
+
+// TxnOptions configures a transaction.
+type TxnOptions struct {
+	// Pessimistic transactions lock keys instead of detecting conflicts at
+	// commit: Get takes a shared lock, GetForUpdate, Set and Delete take an
+	// exclusive lock, and all locks are held until Commit or Rollback.
+	Pessimistic bool
+
+	// LockTimeout bounds how long a pessimistic transaction waits for a lock,
+	// 5 seconds when zero
+	LockTimeout time.Duration
+}
+
+// Txn is a read-modify-write transaction. Writes are buffered until Commit,
+// which applies them atomically as a WriteBatch after checking that no key
+// the transaction read or watched has changed since, see ErrConflict. A Txn
+// must not be used from several goroutines at once.
+type Txn struct {
+	store    *KVStore
+	id       uint64
+	opts     TxnOptions
+	startSeq uint64
+
+	// writes buffers the values written by the transaction, nil for deletes,
+	// so that reads see the transaction's own writes
+	writes map[string]*string
+	batch  WriteBatch
+
+	// reads maps the keys checked at commit to the seq they must not have
+	// been written after
+	reads map[string]uint64
+	done  bool
+}
+
+// BeginTxn starts an optimistic transaction.
+func (s *KVStore) BeginTxn() *Txn {
+	return s.BeginTxnWithOptions(TxnOptions{})
+}
+
+// BeginTxnWithOptions starts a transaction configured by opts.
+func (s *KVStore) BeginTxnWithOptions(opts TxnOptions) *Txn {
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = defaultLockTimeout
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t := &Txn{
+		store:    s,
+		id:       s.nextTxnID.Add(1),
+		opts:     opts,
+		startSeq: s.seq,
+		writes:   make(map[string]*string),
+		reads:    make(map[string]uint64),
+	}
+	// Deletes made from here on stay in versions until the transaction ends
+	s.txnsMu.Lock()
+	s.txns[t.id] = t.startSeq
+	s.txnsMu.Unlock()
+	return t
+}
+
+// lock takes key in mode for a pessimistic transaction. A transaction that
+// times out or is chosen as a deadlock victim is rolled back.
+func (t *Txn) lock(key string, mode LockMode) error {
+	if !t.opts.Pessimistic {
+		return nil
+	}
+	if err := t.store.locks.Lock(t.id, key, mode, t.opts.LockTimeout); err != nil {
+		t.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Get returns the value of key as written by the transaction, or else as
+// currently stored. The key is checked for conflicts at commit.
+func (t *Txn) Get(key string) (string, bool, error) {
+	return t.get(key, LockShared)
+}
+
+// GetForUpdate is Get for a key the transaction intends to write. Pessimistic
+// transactions lock it exclusively, so that two transactions reading the same
+// key before updating it do not deadlock on the lock upgrade.
+func (t *Txn) GetForUpdate(key string) (string, bool, error) {
+	return t.get(key, LockExclusive)
+}
+
+func (t *Txn) get(key string, mode LockMode) (string, bool, error) {
+	if t.done {
+		return "", false, ErrTxnDone
+	}
+	if value, ok := t.writes[key]; ok {
+		if value == nil {
+			return "", false, nil
+		}
+		return *value, true, nil
+	}
+	if err := t.lock(key, mode); err != nil {
+		return "", false, err
+	}
+
+	s := t.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := t.reads[key]; !ok {
+		// Under a lock only writes made after the key was locked conflict
+		t.reads[key] = t.startSeq
+		if t.opts.Pessimistic {
+			t.reads[key] = s.versions[key]
+		}
+	}
+	value, ok := s.data[key]
+	return value, ok, nil
+}
+
+// Peek is Get without checking key for conflicts at commit or locking it,
+// like the reads queued by MULTI in Redis.
+func (t *Txn) Peek(key string) (string, bool, error) {
+	if t.done {
+		return "", false, ErrTxnDone
+	}
+	if value, ok := t.writes[key]; ok {
+		if value == nil {
+			return "", false, nil
+		}
+		return *value, true, nil
+	}
+
+	s := t.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.data[key]
+	return value, ok, nil
+}
+
+// Watch marks keys to be checked for conflicts at commit without reading them.
+// Commit fails if a key is written after it was watched, so keys watched late
+// in a transaction are not affected by writes made before.
+func (t *Txn) Watch(keys ...string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	s := t.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range keys {
+		if _, ok := t.reads[key]; !ok {
+			t.reads[key] = s.versions[key]
+		}
+	}
+	return nil
+}
+
+// Set buffers a write of key.
+func (t *Txn) Set(key, value string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if err := t.lock(key, LockExclusive); err != nil {
+		return err
+	}
+	t.writes[key] = &value
+	t.batch.Put(key, value)
+	return nil
+}
+
+// Delete buffers a delete of key.
+func (t *Txn) Delete(key string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if err := t.lock(key, LockExclusive); err != nil {
+		return err
+	}
+	t.writes[key] = nil
+	t.batch.Delete(key)
+	return nil
+}
+
+// Commit applies the buffered writes, or returns ErrConflict without applying
+// any of them. The transaction cannot be used afterwards either way.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	defer t.end()
+
+	s := t.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, seq := range t.reads {
+		if s.versions[key] > seq {
+			return ErrConflict
+		}
+	}
+	if t.batch.Len() == 0 {
+		return nil
+	}
+	return s.writeLocked(&t.batch)
+}
+
+// Rollback discards the buffered writes and releases the locks.
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.end()
+}
+
+// end releases the locks of the transaction and unregisters it.
+func (t *Txn) end() {
+	if t.opts.Pessimistic {
+		t.store.locks.ReleaseAll(t.id)
+	}
+	t.store.txnsMu.Lock()
+	delete(t.store.txns, t.id)
+	t.store.txnsMu.Unlock()
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStore opens a store in temporary directories, after applying
+// options to its configuration.
+func newTestStore(t *testing.T, options ...func(cfg *config.Config)) *KVStore {
+	cfg := &config.Config{WALDir: t.TempDir(), SSTDir: t.TempDir(), UseSegmentedLogs: true}
+	for _, option := range options {
+		option(cfg)
+	}
+	s, err := NewKVStore(cfg)
+	require.NoError(t, err, "Failed to create KVStore")
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestTxnCommit(t *testing.T) {
+	s := newTestStore(t)
+	require.NoError(t, s.Set("a", "1"), "Set failed")
+
+	txn := s.BeginTxn()
+	value, ok, err := txn.Get("a")
+	require.NoError(t, err, "Get failed")
+	assert.True(t, ok, "Expected key a to exist")
+	assert.Equal(t, "1", value, "Unexpected value")
+
+	require.NoError(t, txn.Set("a", "2"), "Set failed")
+	require.NoError(t, txn.Set("b", "1"), "Set failed")
+	require.NoError(t, txn.Delete("b"), "Delete failed")
+
+	// Buffered writes are visible to the transaction only
+	value, _, _ = txn.Get("a")
+	assert.Equal(t, "2", value, "Transaction should read its own writes")
+	_, ok, _ = txn.Get("b")
+	assert.False(t, ok, "Transaction should see its own delete")
+	value, _ = s.Get("a")
+	assert.Equal(t, "1", value, "Writes should not be visible before commit")
+
+	require.NoError(t, txn.Commit(), "Commit failed")
+	value, _ = s.Get("a")
+	assert.Equal(t, "2", value, "Writes should be visible after commit")
+	_, ok = s.Get("b")
+	assert.False(t, ok, "Deleted key should not exist")
+
+	assert.True(t, errors.Is(txn.Commit(), ErrTxnDone), "Committing twice should fail")
+	assert.True(t, errors.Is(txn.Set("a", "3"), ErrTxnDone), "Writing after commit should fail")
+}
+
+func TestTxnConflict(t *testing.T) {
+	s := newTestStore(t)
+	require.NoError(t, s.Set("a", "1"), "Set failed")
+
+	txn := s.BeginTxn()
+	_, _, err := txn.Get("a")
+	require.NoError(t, err, "Get failed")
+	require.NoError(t, txn.Set("b", "1"), "Set failed")
+
+	require.NoError(t, s.Set("a", "changed"), "Concurrent set failed")
+
+	assert.True(t, errors.Is(txn.Commit(), ErrConflict), "Expected a conflict")
+	_, ok := s.Get("b")
+	assert.False(t, ok, "No write of a conflicting transaction should be applied")
+}
+
+func TestTxnWatchDetectsDeletes(t *testing.T) {
+	s := newTestStore(t)
+	require.NoError(t, s.Set("a", "1"), "Set failed")
+
+	txn := s.BeginTxn()
+	require.NoError(t, txn.Watch("a"), "Watch failed")
+	require.NoError(t, s.Delete("a"), "Concurrent delete failed")
+	require.NoError(t, txn.Set("a", "2"), "Set failed")
+	assert.True(t, errors.Is(txn.Commit(), ErrConflict), "Expected a conflict on a deleted key")
+
+	// Writes to keys that were not read do not conflict
+	txn = s.BeginTxn()
+	require.NoError(t, txn.Set("a", "3"), "Set failed")
+	require.NoError(t, s.Set("other", "1"), "Concurrent set failed")
+	assert.NoError(t, txn.Commit(), "Blind writes should not conflict")
+}
+
+func TestDeletedKeyVersionsArePruned(t *testing.T) {
+	s := newTestStore(t)
+	require.NoError(t, s.Set("a", "1"), "Set failed")
+	require.NoError(t, s.Set("b", "1"), "Set failed")
+
+	require.NoError(t, s.Delete("a"), "Delete failed")
+	assert.NotContains(t, s.versions, "a", "Expected deletes without open transactions to be dropped")
+
+	// The delete of b is kept for a transaction that started before it
+	txn := s.BeginTxn()
+	require.NoError(t, txn.Watch("b"), "Watch failed")
+	require.NoError(t, s.Delete("b"), "Delete failed")
+	assert.Contains(t, s.versions, "b", "Expected the delete to be kept for the open transaction")
+	require.NoError(t, txn.Set("b", "2"), "Set failed")
+	assert.True(t, errors.Is(txn.Commit(), ErrConflict), "Expected a conflict on the deleted key")
+
+	require.NoError(t, s.Delete("missing"), "Delete failed")
+	assert.Empty(t, s.versions, "Expected deleted keys to be dropped once the transaction ended")
+	assert.Empty(t, s.tombstones)
+
+	// Keys written again after their delete keep their version
+	txn = s.BeginTxn()
+	require.NoError(t, s.Set("a", "2"), "Set failed")
+	require.NoError(t, s.Delete("a"), "Delete failed")
+	require.NoError(t, s.Set("a", "3"), "Set failed")
+	txn.Rollback()
+	require.NoError(t, s.Delete("missing"), "Delete failed")
+	assert.Equal(t, map[string]uint64{"a": s.seq - 1}, s.versions, "Expected only the live key to keep its version")
+}
+
+func TestTxnWatchFromWatchedVersion(t *testing.T) {
+	s := newTestStore(t)
+
+	txn := s.BeginTxn()
+	require.NoError(t, s.Set("a", "1"), "Set failed")
+	require.NoError(t, txn.Watch("a"), "Watch failed")
+	value, ok, err := txn.Peek("b")
+	require.NoError(t, err, "Peek failed")
+	assert.False(t, ok, "Unexpected value %q", value)
+	require.NoError(t, s.Set("b", "1"), "Concurrent set failed")
+	require.NoError(t, txn.Set("a", "2"), "Set failed")
+	assert.NoError(t, txn.Commit(), "Writes before Watch and to peeked keys should not conflict")
+}
+
+func TestTxnRollback(t *testing.T) {
+	s := newTestStore(t)
+
+	txn := s.BeginTxn()
+	require.NoError(t, txn.Set("a", "1"), "Set failed")
+	txn.Rollback()
+
+	_, ok := s.Get("a")
+	assert.False(t, ok, "Rolled back writes should not be applied")
+	assert.True(t, errors.Is(txn.Commit(), ErrTxnDone), "Committing after rollback should fail")
+}
+
+func TestConcurrentTxnIncrements(t *testing.T) {
+	s := newTestStore(t)
+	require.NoError(t, s.Set("counter", ""), "Set failed")
+
+	// Every committed transaction appends exactly one character, so the final
+	// length equals the number of increments even under contention
+	const workers, increments = 4, 25
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; {
+				txn := s.BeginTxn()
+				value, _, _ := txn.Get("counter")
+				txn.Set("counter", value+"x")
+				if err := txn.Commit(); err == nil {
+					n++
+				} else if !errors.Is(err, ErrConflict) {
+					t.Errorf("Unexpected commit error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, _ := s.Get("counter")
+	assert.Len(t, value, workers*increments, "Lost update detected")
+}
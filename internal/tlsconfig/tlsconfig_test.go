@@ -0,0 +1,204 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA is a self-signed CA that issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	path string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "Failed to generate CA key")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err, "Failed to create CA certificate")
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), name+".pem")
+	writePEM(t, path, "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, path: path}
+}
+
+// issue writes a certificate for name signed by the CA, and its key, to dir.
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "Failed to generate key")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err, "Failed to create certificate")
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0600), "Failed to write %s", path)
+}
+
+// serveEcho accepts TLS connections and echoes what they send.
+func serveEcho(t *testing.T, config *tls.Config) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err, "Failed to listen")
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// roundTrip dials addr and checks that data is echoed back.
+func roundTrip(addr string, config *tls.Config) (*tls.Conn, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("PING\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue(t, dir, "localhost", 2)
+
+	reloader, err := NewReloader(certFile, keyFile, "")
+	require.NoError(t, err, "Failed to load server certificate")
+	addr := serveEcho(t, reloader.ServerConfig())
+
+	config, err := ClientConfig("localhost", ca.path, "", "")
+	require.NoError(t, err, "Failed to create client config")
+	conn, err := roundTrip(addr, config)
+	require.NoError(t, err, "Expected a client trusting the CA to connect")
+	conn.Close()
+
+	other := newTestCA(t, "other")
+	config, err = ClientConfig("localhost", other.path, "", "")
+	require.NoError(t, err)
+	_, err = roundTrip(addr, config)
+	assert.Error(t, err, "Expected a certificate from an unknown CA to be rejected")
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue(t, dir, "localhost", 2)
+	clientCert, clientKey := ca.issue(t, dir, "client", 3)
+
+	reloader, err := NewReloader(certFile, keyFile, ca.path)
+	require.NoError(t, err, "Failed to load server certificate")
+	addr := serveEcho(t, reloader.ServerConfig())
+
+	config, err := ClientConfig("localhost", ca.path, clientCert, clientKey)
+	require.NoError(t, err, "Failed to create client config")
+	conn, err := roundTrip(addr, config)
+	require.NoError(t, err, "Expected a client with a certificate to connect")
+	conn.Close()
+
+	config, err = ClientConfig("localhost", ca.path, "", "")
+	require.NoError(t, err)
+	_, err = roundTrip(addr, config)
+	assert.Error(t, err, "Expected a client without a certificate to be rejected")
+
+	untrusted := newTestCA(t, "untrusted")
+	clientCert, clientKey = untrusted.issue(t, dir, "intruder", 4)
+	config, err = ClientConfig("localhost", ca.path, clientCert, clientKey)
+	require.NoError(t, err)
+	_, err = roundTrip(addr, config)
+	assert.Error(t, err, "Expected a client certificate from an unknown CA to be rejected")
+
+	_, err = ClientConfig("localhost", ca.path, clientCert, "")
+	assert.Error(t, err, "A client certificate without a key should be rejected")
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue(t, dir, "localhost", 2)
+
+	reloader, err := NewReloader(certFile, keyFile, "")
+	require.NoError(t, err, "Failed to load server certificate")
+	addr := serveEcho(t, reloader.ServerConfig())
+	config, err := ClientConfig("localhost", ca.path, "", "")
+	require.NoError(t, err)
+
+	serial := func() int64 {
+		conn, err := roundTrip(addr, config)
+		require.NoError(t, err, "Failed to connect")
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(2), serial(), "Unexpected server certificate")
+
+	// Replace the files, as a certificate renewal would
+	ca.issue(t, dir, "localhost", 5)
+	require.NoError(t, reloader.Reload(), "Failed to reload certificate")
+	assert.Equal(t, int64(5), serial(), "Expected new connections to use the reloaded certificate")
+
+	// A broken file keeps the current certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	assert.Error(t, reloader.Reload(), "Expected reload of a broken key to fail")
+	assert.Equal(t, int64(5), serial(), "Expected the previous certificate to be kept")
+
+	_, err = NewReloader(certFile, keyFile, "")
+	assert.Error(t, err, "Expected a broken key to be rejected")
+}
@@ -0,0 +1,10 @@
+package wal
+
+import "github.com/joobisb/vitadb/internal/metrics"
+
+var (
+	bytesWrittenMetric       = metrics.NewCounter("vitadb_wal_bytes_written_total", "Bytes of records appended to the WAL, before encryption.")
+	syncDurationMetric       = metrics.NewHistogram("vitadb_wal_sync_duration_seconds", "Time taken to sync the WAL to stable storage.", metrics.DurationBuckets)
+	compactionsMetric        = metrics.NewCounter("vitadb_wal_compactions_total", "WAL compaction runs.")
+	compactionDurationMetric = metrics.NewHistogram("vitadb_wal_compaction_duration_seconds", "Time taken by a WAL compaction run.", metrics.DurationBuckets)
+)
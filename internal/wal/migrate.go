@@ -0,0 +1,250 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/encryption"
+	"github.com/joobisb/vitadb/internal/seglog"
+)
+
+const (
+	// The migrated WAL is written to migrateTmpDir and renamed to
+	// migrateDoneDir once complete. That rename is the commit point: from then
+	// on the old files are replaced, even if a crash interrupts the swap.
+	migrateTmpDir  = "migrate.tmp"
+	migrateDoneDir = "migrate.done"
+
+	segmentFilePattern = "log-*"
+
+	// oldFilesRemovedMarker is created in migrateDoneDir once the old WAL files
+	// are gone, so a resumed swap does not remove files it already moved
+	oldFilesRemovedMarker = ".old-removed"
+)
+
+// MigrationResult describes what Migrate found and did.
+type MigrationResult struct {
+	// Migrated is false when the WAL was already in the configured layout
+	Migrated bool
+	Entries  int
+	From     string
+	To       string
+}
+
+func layoutName(segmented bool) string {
+	if segmented {
+		return "segmented"
+	}
+	return "single-file"
+}
+
+// Migrate converts the WAL in cfg.WALDir to the layout selected by
+// cfg.UseSegmentedLogs. When files of both layouts exist, for example because
+// the flag was flipped after the node had already written data, the records
+// of the layout that was modified last are appended after the others.
+// Records are copied verbatim, keeping their timestamps, and encrypted with
+// the configured master key. It must not run while the WAL is open.
+func Migrate(cfg *config.Config) (MigrationResult, error) {
+	result := MigrationResult{To: layoutName(cfg.UseSegmentedLogs)}
+	if err := finishMigration(cfg.WALDir); err != nil {
+		return result, err
+	}
+
+	singlePath := filepath.Join(cfg.WALDir, singleLogFileName)
+	singleModTime, hasSingle, err := modTime(singlePath)
+	if err != nil {
+		return result, err
+	}
+	segments, err := seglog.SegmentFiles(cfg.WALDir)
+	if err != nil {
+		return result, err
+	}
+	var segmentsModTime time.Time
+	for _, segment := range segments {
+		t, _, err := modTime(segment.Path)
+		if err != nil {
+			return result, err
+		}
+		if t.After(segmentsModTime) {
+			segmentsModTime = t
+		}
+	}
+
+	if cfg.UseSegmentedLogs && !hasSingle || !cfg.UseSegmentedLogs && len(segments) == 0 {
+		return result, nil
+	}
+	result.From = layoutName(!cfg.UseSegmentedLogs)
+
+	var masterKey *encryption.MasterKey
+	if cfg.EncryptionKeyFile != "" {
+		if masterKey, err = encryption.LoadMasterKeys(cfg.EncryptionKeyFile, cfg.PreviousEncryptionKeyFile); err != nil {
+			return result, err
+		}
+	}
+
+	readSingle := func(fn func([]byte) error) error {
+		if !hasSingle {
+			return nil
+		}
+		return readSingleLogFile(singlePath, masterKey, fn)
+	}
+	readSegments := func(fn func([]byte) error) error {
+		for _, segment := range segments {
+			err := seglog.ReadSegmentFile(segment.Path, masterKey, func(_ int64, data []byte) error {
+				return fn(data)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sources := []func(func([]byte) error) error{readSingle, readSegments}
+	if hasSingle && len(segments) > 0 && singleModTime.After(segmentsModTime) {
+		sources[0], sources[1] = sources[1], sources[0]
+	}
+
+	var records [][]byte
+	for _, read := range sources {
+		err := read(func(data []byte) error {
+			if err := validateEntry(data); err != nil {
+				return fmt.Errorf("invalid WAL record: %v", err)
+			}
+			records = append(records, append([]byte(nil), data...))
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to read WAL for migration: %w", err)
+		}
+	}
+
+	tmpDir := filepath.Join(cfg.WALDir, migrateTmpDir)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return result, fmt.Errorf("failed to remove incomplete migration: %v", err)
+	}
+	if err := writeMigratedWAL(cfg, tmpDir, masterKey, records); err != nil {
+		os.RemoveAll(tmpDir)
+		return result, err
+	}
+	if err := os.Rename(tmpDir, filepath.Join(cfg.WALDir, migrateDoneDir)); err != nil {
+		return result, fmt.Errorf("failed to commit migration: %v", err)
+	}
+	if err := finishMigration(cfg.WALDir); err != nil {
+		return result, err
+	}
+
+	result.Migrated = true
+	result.Entries = len(records)
+	return result, nil
+}
+
+func modTime(path string) (time.Time, bool, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	return info.ModTime(), true, nil
+}
+
+func writeMigratedWAL(cfg *config.Config, dir string, mk *encryption.MasterKey, records [][]byte) error {
+	if cfg.UseSegmentedLogs {
+		var opts []seglog.Option
+		if mk != nil {
+			opts = append(opts, seglog.WithEncryption(mk))
+		}
+		log, err := seglog.NewSegmentedLog(dir, cfg.SegmentSize, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to create migrated WAL: %v", err)
+		}
+		for _, record := range records {
+			if _, err := log.Append(record); err != nil {
+				log.Close()
+				return fmt.Errorf("failed to write migrated WAL: %v", err)
+			}
+		}
+		return log.Close()
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create migrated WAL: %v", err)
+	}
+	file, err := os.Create(filepath.Join(dir, singleLogFileName))
+	if err != nil {
+		return fmt.Errorf("failed to create migrated WAL: %v", err)
+	}
+	defer file.Close()
+
+	var key *encryption.DataKey
+	if mk != nil {
+		var header []byte
+		if header, key, err = encryption.NewHeader(mk); err != nil {
+			return err
+		}
+		if _, err := file.Write(header); err != nil {
+			return fmt.Errorf("failed to write migrated WAL: %v", err)
+		}
+	}
+	for _, record := range records {
+		if key != nil {
+			record = key.SealLine(record)
+		}
+		if _, err := fmt.Fprintf(file, "%s\n", record); err != nil {
+			return fmt.Errorf("failed to write migrated WAL: %v", err)
+		}
+	}
+	return file.Sync()
+}
+
+// finishMigration replaces the WAL files in dir with a committed migration,
+// if there is one. It is idempotent so an interrupted swap is completed the
+// next time the WAL is opened.
+func finishMigration(dir string) error {
+	doneDir := filepath.Join(dir, migrateDoneDir)
+	migrated, err := os.ReadDir(doneDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read migrated WAL: %v", err)
+	}
+
+	markerPath := filepath.Join(doneDir, oldFilesRemovedMarker)
+	if _, err := os.Stat(markerPath); os.IsNotExist(err) {
+		old, err := filepath.Glob(filepath.Join(dir, segmentFilePattern))
+		if err != nil {
+			return fmt.Errorf("failed to list WAL files: %v", err)
+		}
+		old = append(old, filepath.Join(dir, singleLogFileName))
+		for _, path := range old {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove migrated WAL file: %v", err)
+			}
+		}
+		if err := os.WriteFile(markerPath, nil, 0644); err != nil {
+			return fmt.Errorf("failed to record migration progress: %v", err)
+		}
+	}
+
+	for _, entry := range migrated {
+		if entry.Name() == oldFilesRemovedMarker {
+			continue
+		}
+		if err := os.Rename(filepath.Join(doneDir, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to move migrated WAL file: %v", err)
+		}
+	}
+	if err := os.Remove(markerPath); err != nil {
+		return fmt.Errorf("failed to remove migration directory: %v", err)
+	}
+	if err := os.Remove(doneDir); err != nil {
+		return fmt.Errorf("failed to remove migration directory: %v", err)
+	}
+	return nil
+}
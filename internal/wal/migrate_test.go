@@ -0,0 +1,116 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joobisb/vitadb/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestWAL(t *testing.T, cfg *config.Config, keys ...string) {
+	w, err := NewWAL(cfg)
+	require.NoError(t, err, "Failed to create WAL")
+	for _, key := range keys {
+		require.NoError(t, w.AppendSet(key, "v"), "Failed to append set")
+	}
+	require.NoError(t, w.Close(), "Failed to close WAL")
+}
+
+func replayTestWAL(t *testing.T, cfg *config.Config) []string {
+	w, err := NewWAL(cfg)
+	require.NoError(t, err, "Failed to open WAL")
+	defer w.Close()
+
+	var keys []string
+	require.NoError(t, w.Replay(func(entry LogEntry) error {
+		keys = append(keys, entry.Key)
+		return nil
+	}), "Failed to replay WAL")
+	return keys
+}
+
+func TestMigrateOnStartup(t *testing.T) {
+	for _, segmented := range []bool{false, true} {
+		t.Run(fmt.Sprintf("to segmented=%v", segmented), func(t *testing.T) {
+			cfg := &config.Config{WALDir: t.TempDir(), UseSegmentedLogs: !segmented, SegmentSize: 2}
+			writeTestWAL(t, cfg, "a", "b", "c")
+
+			cfg.UseSegmentedLogs = segmented
+			assert.Equal(t, []string{"a", "b", "c"}, replayTestWAL(t, cfg), "Records of the other layout should be migrated")
+
+			_, err := os.Stat(filepath.Join(cfg.WALDir, singleLogFileName))
+			assert.Equal(t, !segmented, err == nil, "Unexpected single file WAL after migration")
+			segments, err := filepath.Glob(filepath.Join(cfg.WALDir, "log-*.seg"))
+			require.NoError(t, err)
+			assert.Equal(t, segmented, len(segments) > 0, "Unexpected segments after migration")
+		})
+	}
+}
+
+func TestMigrateMergesBothLayouts(t *testing.T) {
+	cfg := &config.Config{WALDir: t.TempDir(), UseSegmentedLogs: true, SegmentSize: 2}
+	writeTestWAL(t, cfg, "a", "b", "c")
+
+	// Make the segments older than the single file written after the flip
+	old := time.Now().Add(-time.Hour)
+	segments, err := filepath.Glob(filepath.Join(cfg.WALDir, "log-*.seg"))
+	require.NoError(t, err)
+	for _, segment := range segments {
+		require.NoError(t, os.Chtimes(segment, old, old))
+	}
+	singlePath := filepath.Join(cfg.WALDir, singleLogFileName)
+	require.NoError(t, os.WriteFile(singlePath, []byte(`{"op":"SET","key":"d","value":"v"}`+"\n"), 0644))
+
+	result, err := Migrate(cfg)
+	require.NoError(t, err, "Migration failed")
+	assert.True(t, result.Migrated, "Expected a migration")
+	assert.Equal(t, 4, result.Entries, "Unexpected number of migrated records")
+	assert.Equal(t, []string{"a", "b", "c", "d"}, replayTestWAL(t, cfg), "Records should be ordered by layout modification time")
+
+	result, err = Migrate(cfg)
+	require.NoError(t, err, "Second migration failed")
+	assert.False(t, result.Migrated, "Migrating twice should be a no-op")
+}
+
+func TestMigrateEncryptedWAL(t *testing.T) {
+	cfg := &config.Config{
+		WALDir:            t.TempDir(),
+		SegmentSize:       2,
+		EncryptionKeyFile: writeTestKey(t, t.TempDir(), "master.key"),
+	}
+	writeTestWAL(t, cfg, "a", "b", "c")
+
+	cfg.UseSegmentedLogs = true
+	assert.Equal(t, []string{"a", "b", "c"}, replayTestWAL(t, cfg), "Encrypted records should be migrated")
+
+	content, err := os.ReadFile(filepath.Join(cfg.WALDir, "log-0.seg"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), `"key":"a"`, "Migrated segments should be encrypted")
+}
+
+func TestMigrateResumesCommittedSwap(t *testing.T) {
+	cfg := &config.Config{WALDir: t.TempDir(), SegmentSize: 2}
+	writeTestWAL(t, cfg, "old")
+
+	// Simulate a crash after the migrated WAL was committed and one file was
+	// already moved into place
+	cfg.UseSegmentedLogs = true
+	doneDir := filepath.Join(cfg.WALDir, migrateDoneDir)
+	require.NoError(t, writeMigratedWAL(cfg, doneDir, nil, [][]byte{
+		[]byte(`{"op":"SET","key":"a","value":"v"}`),
+		[]byte(`{"op":"SET","key":"b","value":"v"}`),
+		[]byte(`{"op":"SET","key":"c","value":"v"}`),
+	}))
+	require.NoError(t, os.Remove(filepath.Join(cfg.WALDir, singleLogFileName)))
+	require.NoError(t, os.WriteFile(filepath.Join(doneDir, oldFilesRemovedMarker), nil, 0644))
+	require.NoError(t, os.Rename(filepath.Join(doneDir, "log-0.seg"), filepath.Join(cfg.WALDir, "log-0.seg")))
+
+	assert.Equal(t, []string{"a", "b", "c"}, replayTestWAL(t, cfg), "Interrupted migration should be completed")
+	_, err := os.Stat(doneDir)
+	assert.True(t, os.IsNotExist(err), "Migration directory should be removed")
+}
@@ -1,27 +1,59 @@
 package wal
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/encryption"
 	"github.com/joobisb/vitadb/internal/seglog"
 )
 
 type OperationType string
 
 const (
-	OperationSet OperationType = "SET"
-	OperationDel OperationType = "DEL"
+	OperationSet   OperationType = "SET"
+	OperationDel   OperationType = "DEL"
+	OperationMerge OperationType = "MERGE"
+
+	// OperationBatch records carry the operations of a write batch in Batch,
+	// so that they are replayed together or not at all
+	OperationBatch OperationType = "BATCH"
+)
+
+// ErrNotSegmented is returned by operations that need offsets, which only the
+// segmented WAL has.
+var ErrNotSegmented = errors.New("the WAL is not segmented, enable use_segmented_logs")
+
+const (
+	defaultCompactionInterval = 10 * time.Minute
+	singleLogFileName         = "wal.log"
 )
 
 type LogEntry struct {
 	Operation OperationType `json:"op"`
 	Key       string        `json:"key"`
 	Value     string        `json:"value,omitempty"`
+
+	// Timestamp is the write time in Unix nanoseconds, used as a point-in-time
+	// recovery target. Entries written before it was introduced have none.
+	Timestamp int64 `json:"ts,omitempty"`
+
+	// Version is the version the write gave its keys, restored on recovery so
+	// that versions returned to clients stay valid across restarts
+	Version uint64 `json:"ver,omitempty"`
+
+	Batch []LogEntry `json:"batch,omitempty"`
 }
 
 type WAL struct {
@@ -29,6 +61,32 @@ type WAL struct {
 	useSegmentedLog bool
 	singleLog       *os.File
 	segmentedLog    *seglog.SegmentedLog
+
+	// masterKey is set when encryption at rest is enabled, singleLogKey is the
+	// data key of an encrypted single file WAL
+	masterKey    *encryption.MasterKey
+	singleLogKey *encryption.DataKey
+
+	compactionPolicy seglog.CompactionPolicy
+	segmentRetention time.Duration
+	stopCompaction   chan struct{}
+	compactionDone   chan struct{}
+
+	// lastSync is when the WAL was last synced to disk, guarded by mu
+	lastSync time.Time
+}
+
+// Stats describes the files of the WAL.
+type Stats struct {
+	// Segments is the number of segment files, 1 for the single file WAL,
+	// and Bytes their total size
+	Segments int
+	Bytes    int64
+
+	// LastSync is when the WAL was last synced to disk, zero if it has not
+	// been since it was opened. Appends are left to the operating system to
+	// write back; the WAL is only synced when it is closed.
+	LastSync time.Time
 }
 
 func NewWAL(cfg *config.Config) (*WAL, error) {
@@ -36,25 +94,197 @@ func NewWAL(cfg *config.Config) (*WAL, error) {
 	if err := os.MkdirAll(cfg.WALDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create WAL directory: %v", err)
 	}
+
+	// Pick up records written in the other layout before the flag was flipped
+	result, err := Migrate(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate WAL to the %s layout: %w", result.To, err)
+	}
+	if result.Migrated {
+		slog.Info("Migrated WAL records", "entries", result.Entries, "from", result.From, "to", result.To)
+	}
+
+	var masterKey *encryption.MasterKey
+	if cfg.EncryptionKeyFile != "" {
+		if masterKey, err = encryption.LoadMasterKeys(cfg.EncryptionKeyFile, cfg.PreviousEncryptionKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
 	if cfg.UseSegmentedLogs {
-		log, err := seglog.NewSegmentedLog(cfg.WALDir, cfg.SegmentSize)
+		var opts []seglog.Option
+		if masterKey != nil {
+			opts = append(opts, seglog.WithEncryption(masterKey))
+		}
+		if cfg.WALArchiveDir != "" {
+			opts = append(opts, seglog.WithArchiveDir(cfg.WALArchiveDir))
+		}
+		log, err := seglog.NewSegmentedLog(cfg.WALDir, cfg.SegmentSize, opts...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create segmented log: %v", err)
 		}
-		return &WAL{
+		w := &WAL{
 			useSegmentedLog: true,
 			segmentedLog:    log,
-		}, nil
+			masterKey:       masterKey,
+			compactionPolicy: seglog.CompactionPolicy{
+				Key:             entryKey,
+				UnkeyedKeys:     entryKeys,
+				DeleteRetention: cfg.WALDeleteRetention,
+			},
+			segmentRetention: cfg.WALSegmentRetention,
+		}
+		if cfg.WALCompaction {
+			w.startCompaction(cfg.WALCompactionInterval)
+		}
+		return w, nil
 	}
 	// Existing single file implementation
-	file, err := os.OpenFile(filepath.Join(cfg.WALDir, "wal.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	path := filepath.Join(cfg.WALDir, singleLogFileName)
+	if masterKey != nil {
+		if err := encryptSingleLog(path, masterKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := encryption.RecoverRewrap(path); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL file: %v", err)
 	}
-	return &WAL{
+	w := &WAL{
 		useSegmentedLog: false,
 		singleLog:       file,
-	}, nil
+		masterKey:       masterKey,
+	}
+
+	header, err := encryption.ReadHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if header != nil {
+		if w.singleLogKey, err = encryption.OpenHeader(header, masterKey); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open encrypted WAL file: %w", err)
+		}
+	}
+	if err := truncateTornRecord(file, int64(len(header))); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// truncateTornRecord removes an unterminated last record from a single file
+// WAL whose records start at dataStart. It was torn by a crash while being
+// written, so it was never acknowledged, and the next record would otherwise
+// be appended to it.
+func truncateTornRecord(file *os.File, dataStart int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat WAL file: %v", err)
+	}
+
+	// Look for the end of the last complete record, a chunk at a time
+	end := info.Size()
+	buf := make([]byte, 4096)
+	for end > dataStart {
+		start := max(end-int64(len(buf)), dataStart)
+		chunk := buf[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return fmt.Errorf("failed to read WAL file: %v", err)
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end == info.Size() {
+		return nil
+	}
+
+	slog.Warn("Truncating torn record at the end of the WAL", "path", file.Name(), "bytes", info.Size()-end)
+	if err := file.Truncate(end); err != nil {
+		return fmt.Errorf("failed to truncate torn WAL record: %v", err)
+	}
+	return nil
+}
+
+// encryptSingleLog makes sure the single file WAL at path is encrypted. An
+// existing plaintext file is encrypted line by line into a temporary file,
+// which is synced before it replaces the original.
+func encryptSingleLog(path string, mk *encryption.MasterKey) error {
+	// src stays nil for a new WAL, which only gets the header
+	var src io.Reader
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read WAL file: %v", err)
+	}
+	if err == nil {
+		defer file.Close()
+		header, err := encryption.ReadHeader(file)
+		if err != nil {
+			return err
+		}
+		if header != nil {
+			return nil
+		}
+		src = file
+	}
+
+	header, key, err := encryption.NewHeader(mk)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write encrypted WAL file: %v", err)
+	}
+	defer tmp.Close()
+	if err := writeEncryptedLog(tmp, src, header, key); err != nil {
+		return fmt.Errorf("failed to write encrypted WAL file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write encrypted WAL file: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace WAL file: %v", err)
+	}
+	return encryption.SyncDir(filepath.Dir(path))
+}
+
+// writeEncryptedLog writes header and the lines of the plaintext WAL src,
+// which may be nil, sealed with key to dst and syncs it.
+func writeEncryptedLog(dst *os.File, src io.Reader, header []byte, key *encryption.DataKey) error {
+	w := bufio.NewWriter(dst)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if src != nil {
+		r := bufio.NewReader(src)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if line = bytes.TrimSuffix(line, []byte("\n")); len(line) > 0 {
+				w.Write(key.SealLine(line))
+				w.WriteByte('\n')
+			}
+			if err == io.EOF {
+				break
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return dst.Sync()
 }
 
 func (w *WAL) GetWALFilePath() string {
@@ -71,48 +301,441 @@ func (w *WAL) GetAllSegmentPaths() []string {
 	return []string{w.singleLog.Name()}
 }
 
+// NextOffset returns the offset the next entry will be written at. It is only
+// meaningful for the segmented WAL.
+func (w *WAL) NextOffset() int64 {
+	if !w.useSegmentedLog {
+		return 0
+	}
+	return w.segmentedLog.NextOffset()
+}
+
+// MasterKey returns the key used to encrypt the WAL, or nil when encryption at
+// rest is disabled.
+func (w *WAL) MasterKey() *encryption.MasterKey {
+	return w.masterKey
+}
+
+// IsSegmented reports whether the WAL is a segmented log.
+func (w *WAL) IsSegmented() bool {
+	return w.useSegmentedLog
+}
+
 func (w *WAL) AppendSet(key, value string) error {
+	return w.Append(LogEntry{Operation: OperationSet, Key: key, Value: value})
+}
+
+func (w *WAL) AppendDelete(key string) error {
+	return w.Append(LogEntry{Operation: OperationDel, Key: key})
+}
+
+// AppendBatch writes entries as a single record. The entries must be SET,
+// DEL or MERGE operations.
+func (w *WAL) AppendBatch(entries []LogEntry) error {
+	return w.Append(LogEntry{Operation: OperationBatch, Batch: entries})
+}
+
+// Stats returns the number and size of the WAL files.
+func (w *WAL) Stats() Stats {
+	paths := w.GetAllSegmentPaths()
+	stats := Stats{Segments: len(paths)}
+	for _, path := range paths {
+		// Segments can be removed by a concurrent compaction, skip them
+		if info, err := os.Stat(path); err == nil {
+			stats.Bytes += info.Size()
+		}
+	}
+	w.mu.Lock()
+	stats.LastSync = w.lastSync
+	w.mu.Unlock()
+	return stats
+}
+
+// Append writes entry as a single record, stamped with the current time.
+func (w *WAL) Append(entry LogEntry) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	entry := LogEntry{Operation: OperationSet, Key: key, Value: value}
+	entry.Timestamp = time.Now().UnixNano()
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return fmt.Errorf("failed to marshal log entry: %v", err)
 	}
 
+	size := len(data) + 1
 	if w.useSegmentedLog {
 		_, err = w.segmentedLog.Append(data)
 	} else {
+		if w.singleLogKey != nil {
+			data = w.singleLogKey.SealLine(data)
+		}
 		_, err = fmt.Fprintf(w.singleLog, "%s\n", data)
 	}
+	if err == nil {
+		bytesWrittenMetric.Add(float64(size))
+	}
 
 	return err
 }
 
-func (w *WAL) AppendDelete(key string) error {
-	// Similar to AppendSet, but for delete operation
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// Replay calls fn for every entry in the WAL, oldest first.
+func (w *WAL) Replay(fn func(entry LogEntry) error) error {
+	if w.useSegmentedLog {
+		reader, err := w.segmentedLog.NewReader(w.segmentedLog.OldestOffset())
+		if err != nil {
+			return err
+		}
+		for {
+			data, _, err := reader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := replayEntry(data, fn); err != nil {
+				return err
+			}
+		}
+	}
 
-	entry := LogEntry{Operation: OperationDel, Key: key}
-	data, err := json.Marshal(entry)
+	return readSingleLogFile(w.singleLog.Name(), w.masterKey, func(data []byte) error {
+		return replayEntry(data, fn)
+	})
+}
+
+// Reader reads the entries of the segmented WAL in offset order, see
+// seglog.Reader.
+type Reader struct {
+	reader *seglog.Reader
+}
+
+// NewReader returns a Reader positioned at fromOffset, which may be equal to
+// NextOffset to only read new entries. Records removed by compaction are read
+// from the archive; Next fails with seglog.ErrCompacted when they were not
+// archived, see seglog.SegmentedLog.NewHistoryReader.
+func (w *WAL) NewReader(fromOffset int64) (*Reader, error) {
+	if !w.useSegmentedLog {
+		return nil, ErrNotSegmented
+	}
+	reader, err := w.segmentedLog.NewHistoryReader(fromOffset)
 	if err != nil {
-		return fmt.Errorf("failed to marshal log entry: %v", err)
+		return nil, err
 	}
+	return &Reader{reader: reader}, nil
+}
 
+// Next returns the next entry and its offset, or io.EOF when the reader has
+// caught up with the end of the WAL.
+func (r *Reader) Next() (LogEntry, int64, error) {
+	data, offset, err := r.reader.Next()
+	if err != nil {
+		return LogEntry{}, 0, err
+	}
+	var entry LogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return LogEntry{}, 0, fmt.Errorf("failed to unmarshal log entry at offset %d: %v", offset, err)
+	}
+	return entry, offset, nil
+}
+
+// Offset returns the offset of the entry the next call to Next will return.
+func (r *Reader) Offset() int64 {
+	return r.reader.Offset()
+}
+
+// Wait blocks until the entry the reader points at has been written, the WAL
+// is closed or ctx is done.
+func (r *Reader) Wait(ctx context.Context) error {
+	return r.reader.Wait(ctx)
+}
+
+// OldestOffset returns the offset of the oldest entry still in the WAL. It is
+// only meaningful for the segmented WAL.
+func (w *WAL) OldestOffset() int64 {
+	if !w.useSegmentedLog {
+		return 0
+	}
+	return w.segmentedLog.OldestOffset()
+}
+
+// RetainFrom keeps the entries from offset on from being compacted or
+// removed, see seglog.SegmentedLog.RetainFrom. It is a no-op for the single
+// file WAL.
+func (w *WAL) RetainFrom(offset int64) {
 	if w.useSegmentedLog {
-		_, err = w.segmentedLog.Append(data)
+		w.segmentedLog.RetainFrom(offset)
+	}
+}
+
+// readSingleLogFile calls fn with every record of a single file WAL. mk may be
+// nil when the file is not encrypted.
+func readSingleLogFile(path string, mk *encryption.MasterKey, fn func(data []byte) error) error {
+	if err := encryption.RecoverRewrap(path); err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	header, err := encryption.ReadHeader(file)
+	if err != nil {
+		return err
+	}
+	var key *encryption.DataKey
+	if header != nil {
+		if key, err = encryption.OpenHeader(header, mk); err != nil {
+			return fmt.Errorf("failed to open encrypted WAL file: %w", err)
+		}
+	}
+
+	reader := bufio.NewReader(file)
+	if _, err := reader.Discard(len(header)); err != nil {
+		return fmt.Errorf("failed to skip WAL file header: %v", err)
+	}
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if line = bytes.TrimSuffix(line, []byte("\n")); len(line) > 0 {
+			if key != nil {
+				if line, err = key.OpenLine(line); err != nil {
+					return err
+				}
+			}
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return fmt.Errorf("error reading WAL file %s: %v", path, readErr)
+		}
+	}
+}
+
+// ReplaySegmentFile calls fn for every entry of a WAL segment file that is not
+// part of an open WAL, such as an archived segment. mk may be nil when the
+// segment is not encrypted.
+func ReplaySegmentFile(path string, mk *encryption.MasterKey, fn func(offset int64, entry LogEntry) error) error {
+	return seglog.ReadSegmentFile(path, mk, func(offset int64, data []byte) error {
+		return replayEntry(data, func(entry LogEntry) error {
+			return fn(offset, entry)
+		})
+	})
+}
+
+func replayEntry(data []byte, fn func(entry LogEntry) error) error {
+	var entry LogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return fmt.Errorf("failed to unmarshal log entry: %v", err)
+	}
+	return fn(entry)
+}
+
+// RotateMasterKey re-wraps the data keys of all WAL files with newKey without
+// rewriting any records.
+func (w *WAL) RotateMasterKey(newKey *encryption.MasterKey) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.useSegmentedLog {
+		if err := w.segmentedLog.RotateMasterKey(newKey); err != nil {
+			return err
+		}
 	} else {
-		_, err = fmt.Fprintf(w.singleLog, "%s\n", data)
+		path := w.singleLog.Name()
+		rewrapped, err := encryption.RewrapFile(path, w.masterKey, newKey)
+		if err != nil {
+			return err
+		}
+		if rewrapped {
+			header, err := encryption.ReadHeader(w.singleLog)
+			if err != nil {
+				return err
+			}
+			if w.singleLogKey, err = encryption.OpenHeader(header, newKey); err != nil {
+				return err
+			}
+		}
 	}
 
-	return err
+	w.masterKey = newKey
+	return nil
+}
+
+// errBatchRecord is returned by entryKey for batch records, which compaction
+// always keeps because they update several keys.
+var errBatchRecord = errors.New("batch records have no single key")
+
+// entryKey is the seglog.KeyFunc used to compact WAL segments.
+func entryKey(data []byte) (string, bool, error) {
+	var entry LogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return "", false, err
+	}
+	if entry.Operation == OperationBatch || entry.Operation == OperationMerge {
+		return "", false, errBatchRecord
+	}
+	return entry.Key, entry.Operation == OperationDel, nil
+}
+
+// entryKeys returns the keys written by the batch and merge records that
+// entryKey does not return a key for.
+func entryKeys(data []byte) []string {
+	var entry LogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil
+	}
+	if entry.Operation != OperationBatch {
+		return []string{entry.Key}
+	}
+	keys := make([]string, len(entry.Batch))
+	for i, op := range entry.Batch {
+		keys[i] = op.Key
+	}
+	return keys
+}
+
+// validateEntry is used by Scrub to detect corrupt WAL records.
+func validateEntry(data []byte) error {
+	var entry LogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	if entry.Operation != OperationBatch {
+		return validateOperation(entry.Operation)
+	}
+	for _, op := range entry.Batch {
+		if err := validateOperation(op.Operation); err != nil {
+			return fmt.Errorf("batch: %v", err)
+		}
+	}
+	return nil
+}
+
+func validateOperation(op OperationType) error {
+	switch op {
+	case OperationSet, OperationDel, OperationMerge:
+		return nil
+	default:
+		return fmt.Errorf("unknown operation %q", op)
+	}
+}
+
+// Scrub verifies every WAL segment and repairs corrupt ones, keeping a copy of
+// the damaged segments in lostDir. The single file WAL is not scrubbed.
+func (w *WAL) Scrub(lostDir string) ([]seglog.ScrubResult, error) {
+	if !w.useSegmentedLog {
+		return nil, nil
+	}
+	return w.segmentedLog.Scrub(validateEntry, lostDir)
+}
+
+// Compact removes records from closed segments that are superseded by a newer
+// record for the same key. It is a no-op for the single file WAL.
+func (w *WAL) Compact() (seglog.CompactionStats, error) {
+	if !w.useSegmentedLog {
+		return seglog.CompactionStats{}, nil
+	}
+	start := time.Now()
+	stats, err := w.segmentedLog.Compact(w.compactionPolicy)
+	compactionsMetric.Inc()
+	compactionDurationMetric.ObserveDuration(start)
+	return stats, err
+}
+
+// Archive waits until every closed segment is copied to wal_archive_dir,
+// which otherwise happens in the background. It is a no-op when archiving is
+// disabled and for the single file WAL.
+func (w *WAL) Archive() error {
+	if !w.useSegmentedLog {
+		return nil
+	}
+	return w.segmentedLog.Archive()
+}
+
+// RemoveExpiredSegments removes the closed segments that compaction left
+// without records once they are older than wal_segment_retention, and returns
+// how many entries were dropped from the start of the log. Segments are kept
+// until they are archived and every change consumer has moved past them. It
+// is a no-op when retention is disabled and for the single file WAL.
+func (w *WAL) RemoveExpiredSegments() (int64, error) {
+	if !w.useSegmentedLog || w.segmentRetention <= 0 {
+		return 0, nil
+	}
+	offset, err := w.segmentedLog.ExpiredOffset(w.segmentRetention)
+	if err != nil {
+		return 0, err
+	}
+	oldest := w.segmentedLog.OldestOffset()
+	if err := w.segmentedLog.RemoveSegmentsBefore(offset); err != nil {
+		return 0, err
+	}
+	return w.segmentedLog.OldestOffset() - oldest, nil
+}
+
+func (w *WAL) startCompaction(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultCompactionInterval
+	}
+	w.stopCompaction = make(chan struct{})
+	w.compactionDone = make(chan struct{})
+
+	go func() {
+		defer close(w.compactionDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				stats, err := w.Compact()
+				if err != nil {
+					slog.Error("WAL compaction failed", "err", err)
+					continue
+				}
+				if stats.EntriesRemoved > 0 {
+					slog.Info("WAL compaction removed entries", "entries", stats.EntriesRemoved, "segments", stats.SegmentsRewritten)
+				}
+				// Compaction is what leaves segments without records
+				removed, err := w.RemoveExpiredSegments()
+				if err != nil {
+					slog.Error("WAL segment retention failed", "err", err)
+				} else if removed > 0 {
+					slog.Info("Removed expired WAL segments", "offsets", removed)
+				}
+			case <-w.stopCompaction:
+				return
+			}
+		}
+	}()
 }
 
 func (w *WAL) Close() error {
+	if w.stopCompaction != nil {
+		close(w.stopCompaction)
+		<-w.compactionDone
+	}
+	// Closing the segmented log syncs its segments
+	start := time.Now()
 	if w.useSegmentedLog {
-		return w.segmentedLog.Close()
+		err := w.segmentedLog.Close()
+		w.synced(start)
+		return err
+	}
+	if err := w.singleLog.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL file: %v", err)
 	}
+	w.synced(start)
 	return w.singleLog.Close()
 }
+
+// synced records a sync of the WAL that started at start.
+func (w *WAL) synced(start time.Time) {
+	syncDurationMetric.ObserveDuration(start)
+	w.mu.Lock()
+	w.lastSync = time.Now()
+	w.mu.Unlock()
+}
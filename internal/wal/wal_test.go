@@ -1,11 +1,18 @@
 package wal
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/joobisb/vitadb/internal/config"
+	"github.com/joobisb/vitadb/internal/encryption"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -90,3 +97,239 @@ func splitLines(data []byte) [][]byte {
 	}
 	return lines
 }
+
+func TestWALCompact(t *testing.T) {
+	cfg := &config.Config{
+		WALDir:             t.TempDir(),
+		UseSegmentedLogs:   true,
+		SegmentSize:        2,
+		WALDeleteRetention: time.Hour,
+	}
+
+	wal, err := NewWAL(cfg)
+	require.NoError(t, err, "Failed to create WAL")
+	defer wal.Close()
+
+	require.NoError(t, wal.AppendSet("key1", "value1"))
+	require.NoError(t, wal.AppendSet("key1", "value2"))
+	require.NoError(t, wal.AppendSet("key2", "value1"))
+	require.NoError(t, wal.AppendDelete("key2"))
+	require.NoError(t, wal.AppendSet("key3", "value1"))
+
+	stats, err := wal.Compact()
+	require.NoError(t, err, "Compaction failed")
+	assert.Equal(t, 2, stats.EntriesRemoved, "Expected superseded records to be removed")
+
+	content, err := os.ReadFile(wal.GetAllSegmentPaths()[0])
+	require.NoError(t, err, "Failed to read WAL segment")
+	lines := splitLines(content)
+	require.Len(t, lines, 2, "Compaction must keep one line per offset")
+	assert.Empty(t, lines[0], "Expected superseded record to be removed")
+
+	var entry LogEntry
+	require.NoError(t, json.Unmarshal(lines[1], &entry))
+	assert.Equal(t, "value2", entry.Value, "Expected newest record to be kept")
+}
+
+func writeTestKey(t *testing.T, dir, name string) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err, "Failed to generate key")
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, key, 0600), "Failed to write key file")
+	return path
+}
+
+func TestEncryptedWAL(t *testing.T) {
+	for _, segmented := range []bool{false, true} {
+		t.Run(fmt.Sprintf("segmented=%v", segmented), func(t *testing.T) {
+			cfg := &config.Config{
+				WALDir:            t.TempDir(),
+				UseSegmentedLogs:  segmented,
+				SegmentSize:       2,
+				EncryptionKeyFile: writeTestKey(t, t.TempDir(), "master.key"),
+			}
+
+			wal, err := NewWAL(cfg)
+			require.NoError(t, err, "Failed to create WAL")
+			require.NoError(t, wal.AppendSet("key1", "secret1"))
+			require.NoError(t, wal.AppendSet("key2", "secret2"))
+			require.NoError(t, wal.AppendDelete("key1"))
+
+			for _, path := range wal.GetAllSegmentPaths() {
+				content, err := os.ReadFile(path)
+				require.NoError(t, err)
+				assert.True(t, encryption.IsHeader(content), "Expected encryption header in %s", path)
+				assert.NotContains(t, string(content), "secret", "Records must not be stored in plaintext")
+			}
+
+			// Rotate to a new master key and make sure the WAL can still be replayed
+			newKeyFile := writeTestKey(t, t.TempDir(), "new.key")
+			newKey, err := encryption.LoadMasterKey(newKeyFile)
+			require.NoError(t, err)
+			require.NoError(t, wal.RotateMasterKey(newKey), "Failed to rotate master key")
+			require.NoError(t, wal.AppendSet("key3", "secret3"), "Failed to append after rotation")
+			require.NoError(t, wal.Close())
+
+			cfg.EncryptionKeyFile = newKeyFile
+			wal, err = NewWAL(cfg)
+			require.NoError(t, err, "Failed to reopen WAL with the rotated key")
+			defer wal.Close()
+
+			var entries []LogEntry
+			require.NoError(t, wal.Replay(func(entry LogEntry) error {
+				entries = append(entries, entry)
+				return nil
+			}))
+			require.Len(t, entries, 4, "Expected all records to be replayed")
+			assert.Equal(t, "secret2", entries[1].Value)
+			assert.Equal(t, OperationDel, entries[2].Operation)
+			assert.Equal(t, "secret3", entries[3].Value, "Expected the record appended after rotation")
+		})
+	}
+}
+
+func TestEncryptExistingSingleFileWAL(t *testing.T) {
+	cfg := &config.Config{WALDir: t.TempDir()}
+
+	wal, err := NewWAL(cfg)
+	require.NoError(t, err, "Failed to create WAL")
+	require.NoError(t, wal.AppendSet("key1", "plaintext"))
+	require.NoError(t, wal.Close())
+
+	cfg.EncryptionKeyFile = writeTestKey(t, t.TempDir(), "master.key")
+	wal, err = NewWAL(cfg)
+	require.NoError(t, err, "Failed to reopen WAL with encryption enabled")
+	defer wal.Close()
+	require.NoError(t, wal.AppendSet("key2", "encrypted"))
+
+	content, err := os.ReadFile(wal.GetWALFilePath())
+	require.NoError(t, err)
+	assert.True(t, encryption.IsHeader(content), "Expected existing WAL to be encrypted")
+	assert.NotContains(t, string(content), "plaintext", "Existing records must be encrypted")
+	assert.NoFileExists(t, wal.GetWALFilePath()+".tmp", "Expected the temporary file to replace the WAL")
+
+	var values []string
+	require.NoError(t, wal.Replay(func(entry LogEntry) error {
+		values = append(values, entry.Value)
+		return nil
+	}))
+	assert.Equal(t, []string{"plaintext", "encrypted"}, values)
+}
+
+func TestEntriesHaveTimestamps(t *testing.T) {
+	cfg := &config.Config{
+		WALDir:           t.TempDir(),
+		UseSegmentedLogs: true,
+		SegmentSize:      1,
+		WALArchiveDir:    t.TempDir(),
+	}
+	w, err := NewWAL(cfg)
+	require.NoError(t, err, "Failed to create WAL")
+	defer w.Close()
+
+	before := time.Now().UnixNano()
+	require.NoError(t, w.AppendSet("key", "value"), "Failed to append set")
+	require.NoError(t, w.AppendDelete("key"), "Failed to append delete")
+	after := time.Now().UnixNano()
+
+	err = w.Replay(func(entry LogEntry) error {
+		assert.True(t, entry.Timestamp >= before && entry.Timestamp <= after, "Unexpected timestamp %d for %s", entry.Timestamp, entry.Operation)
+		return nil
+	})
+	require.NoError(t, err, "Failed to replay WAL")
+
+	// The first segment was closed by the second append and archived
+	archivePath := filepath.Join(cfg.WALArchiveDir, "log-0.seg")
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(archivePath)
+		return err == nil
+	}, time.Second, 5*time.Millisecond, "Expected the closed segment to be archived")
+	var archived []LogEntry
+	err = ReplaySegmentFile(archivePath, nil, func(offset int64, entry LogEntry) error {
+		archived = append(archived, entry)
+		return nil
+	})
+	require.NoError(t, err, "Failed to replay archived segment")
+	require.Len(t, archived, 1, "Unexpected number of archived entries")
+	assert.Equal(t, OperationSet, archived[0].Operation, "Unexpected archived entry")
+}
+
+func TestAppendBatch(t *testing.T) {
+	w, err := NewWAL(&config.Config{WALDir: t.TempDir(), UseSegmentedLogs: true})
+	require.NoError(t, err, "Failed to create WAL")
+	defer w.Close()
+
+	ops := []LogEntry{
+		{Operation: OperationSet, Key: "a", Value: "1"},
+		{Operation: OperationMerge, Key: "a", Value: "2"},
+		{Operation: OperationDel, Key: "b"},
+	}
+	require.NoError(t, w.AppendBatch(ops), "Failed to append batch")
+
+	var records []LogEntry
+	require.NoError(t, w.Replay(func(entry LogEntry) error {
+		records = append(records, entry)
+		return nil
+	}), "Failed to replay WAL")
+	require.Len(t, records, 1, "A batch should be a single record")
+	assert.Equal(t, OperationBatch, records[0].Operation, "Unexpected record operation")
+	assert.Equal(t, ops, records[0].Batch, "Unexpected batch operations")
+
+	data, err := json.Marshal(records[0])
+	require.NoError(t, err)
+	assert.NoError(t, validateEntry(data), "Batch records should be valid")
+	_, _, err = entryKey(data)
+	assert.Error(t, err, "Batch records should never be compacted")
+	assert.Error(t, validateEntry([]byte(`{"op":"BATCH","batch":[{"op":"NOPE","key":"a"}]}`)), "Unknown batch operations should be invalid")
+}
+
+func TestWALStats(t *testing.T) {
+	w, err := NewWAL(&config.Config{WALDir: t.TempDir(), UseSegmentedLogs: true, SegmentSize: 5})
+	require.NoError(t, err, "Failed to create WAL")
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, w.AppendSet(fmt.Sprintf("key%d", i), "value"))
+	}
+	stats := w.Stats()
+	assert.Greater(t, stats.Segments, 1, "Expected the WAL to roll over to new segments")
+	assert.Positive(t, stats.Bytes)
+	assert.True(t, stats.LastSync.IsZero(), "Appends should not sync the WAL")
+
+	require.NoError(t, w.Close())
+	assert.False(t, w.Stats().LastSync.IsZero(), "Expected Close to record the sync")
+}
+
+func TestReader(t *testing.T) {
+	w, err := NewWAL(&config.Config{WALDir: t.TempDir(), UseSegmentedLogs: true, SegmentSize: 2})
+	require.NoError(t, err, "Failed to create WAL")
+	defer w.Close()
+
+	require.NoError(t, w.AppendSet("a", "1"))
+	require.NoError(t, w.AppendDelete("a"))
+	require.NoError(t, w.AppendBatch([]LogEntry{{Operation: OperationSet, Key: "b", Value: "2"}}))
+
+	reader, err := w.NewReader(1)
+	require.NoError(t, err, "Failed to create reader")
+	entry, offset, err := reader.Next()
+	require.NoError(t, err, "Failed to read entry")
+	assert.Equal(t, int64(1), offset, "Unexpected offset")
+	assert.Equal(t, OperationDel, entry.Operation, "Unexpected operation")
+	entry, offset, err = reader.Next()
+	require.NoError(t, err, "Failed to read entry")
+	assert.Equal(t, int64(2), offset, "Unexpected offset")
+	assert.Equal(t, []LogEntry{{Operation: OperationSet, Key: "b", Value: "2"}}, entry.Batch, "Unexpected batch")
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err, "Expected EOF at the end of the WAL")
+	assert.Equal(t, int64(3), reader.Offset(), "Unexpected reader offset")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, reader.Wait(ctx), "Expected Wait to time out")
+
+	single, err := NewWAL(&config.Config{WALDir: t.TempDir()})
+	require.NoError(t, err, "Failed to create WAL")
+	defer single.Close()
+	_, err = single.NewReader(0)
+	assert.Equal(t, ErrNotSegmented, err, "Expected the single file WAL to have no reader")
+}